@@ -0,0 +1,59 @@
+package ops
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// accessLogWriter records the status and size of a response for the access log.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// Flush is implemented so that subscriptions
+// can flush events through the writer.
+func (w *accessLogWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// logAccess logs an operation request served over HTTP at Registry.AccessLogLevel.
+func (h *Handler) logAccess(r *http.Request, service string, operation string, start time.Time, w *accessLogWriter) {
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	h.logger.LogAttrs(r.Context(), h.accessLogLevel, "served operation",
+		slog.String("service", service),
+		slog.String("operation", operation),
+		slog.Duration("duration", time.Since(start)),
+		slog.Int("status", status),
+		slog.Int("bytes", w.bytes),
+	)
+}
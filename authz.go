@@ -0,0 +1,62 @@
+package ops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/common-fate/ops/protocol"
+)
+
+// Authorizer decides whether the caller of an operation has the scopes
+// it requires, which are declared with OperationMetadata.Scopes. The caller's
+// claims can be read from the context, for example with MetadataFromContext.
+//
+// Authorize returns nil if the call is allowed. An error which is an *Error
+// sets the response code; other errors are reported as protocol.CodeUnauthorized.
+type Authorizer interface {
+	Authorize(ctx context.Context, service, operation string, required []string) error
+}
+
+// AuthorizerFunc is a function which implements the Authorizer interface.
+type AuthorizerFunc func(ctx context.Context, service, operation string, required []string) error
+
+// Authorize delegates to the underlying AuthorizerFunc.
+func (f AuthorizerFunc) Authorize(ctx context.Context, service, operation string, required []string) error {
+	return f(ctx, service, operation, required)
+}
+
+// authorize calls the registry's Authorizer for operations which require scopes.
+func (h *Handler) authorize(ctx context.Context, service, operation string, fn function) error {
+	if len(fn.scopes) == 0 {
+		return nil
+	}
+
+	err := h.authorizer.Authorize(ctx, service, operation, fn.scopes)
+	if err == nil {
+		return nil
+	}
+
+	var opErr *Error
+	if errors.As(err, &opErr) {
+		return err
+	}
+
+	return &Error{Code: protocol.CodeUnauthorized, Err: fmt.Errorf("operation %s for service %s: %w", operation, service, err)}
+}
+
+// checkAuthorizer returns an error if an operation requires
+// scopes which can't be checked, because there's no Authorizer.
+func (h *Handler) checkAuthorizer() error {
+	if h.authorizer != nil {
+		return nil
+	}
+	for _, svc := range h.defs.Services {
+		for _, op := range svc.Operations {
+			if len(op.Scopes) > 0 {
+				return fmt.Errorf("the operation %s for service %s requires scopes, but Registry.Authorizer isn't set", op.ID, svc.Path())
+			}
+		}
+	}
+	return nil
+}
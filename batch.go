@@ -0,0 +1,211 @@
+package ops
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/common-fate/ops/protocol"
+)
+
+// Multiple operations can be called in a single request with
+// POST {prefix}/batch, where the body is an array of calls:
+//
+//	[{"service": "example", "operation": "Foo", "input": {"bar": "baz"}}]
+//
+// The response is a 207 Multi-Status BatchResponse, with the results in the
+// same order as the calls, each with the HTTP status of the call and either
+// its result or its error, followed by a count of the calls which succeeded
+// with a 2xx status and the calls which failed:
+//
+//	{
+//	  "results": [
+//	    {"status": 200, "result": "hello baz"},
+//	    {"status": 404, "error": "operation Missing not found for service example"}
+//	  ],
+//	  "summary": {"succeeded": 1, "failed": 1}
+//	}
+//
+// Each call is made with Call, so runs through the middleware, and fails
+// independently of the others: a failing call doesn't stop the batch.
+// If Registry.BatchOKOnSuccess is set, a batch where every call succeeds
+// responds with 200 OK instead, with the same body. The batch only fails
+// as a whole, with an ErrorResponse, if the body can't be decoded.
+//
+// Calls run sequentially unless Registry.BatchConcurrency is set.
+// Subscriptions, operations requiring a checksum and operations
+// returning a RawResponse can't be batched.
+
+// BatchCall is a single call in a batch request.
+type BatchCall struct {
+	Service   string          `json:"service"`
+	Operation string          `json:"operation"`
+	Input     json.RawMessage `json:"input,omitempty"`
+	// Parameters are the named parameters of the operation. See WithParameters.
+	Parameters map[string]string `json:"parameters,omitempty"`
+}
+
+// BatchResult is the result of a single call in a batch request.
+type BatchResult struct {
+	// Status is the HTTP status the call would have responded with if it was made alone.
+	Status int             `json:"status"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// succeeded is true if the call responded with a 2xx status.
+func (r BatchResult) succeeded() bool {
+	return r.Status >= 200 && r.Status < 300
+}
+
+// BatchResponse is the response to a batch request.
+type BatchResponse struct {
+	// Results are the results of the calls, in the same order as the calls.
+	Results []BatchResult `json:"results"`
+	Summary BatchSummary  `json:"summary"`
+}
+
+// BatchSummary counts the calls in a batch which succeeded
+// with a 2xx status, and the calls which failed.
+type BatchSummary struct {
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+}
+
+// serveBatch serves POST {prefix}/batch.
+func (h *Handler) serveBatch(w http.ResponseWriter, r *http.Request) {
+	body, ok := h.readEnvelope(w, r)
+	if !ok {
+		return
+	}
+
+	var calls []BatchCall
+	if err := json.Unmarshal(body, &calls); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("error unmarshalling batch: %s", err))
+		return
+	}
+
+	ctx, cancel, err := withRequestTimeout(h.envelopeContext(r), r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	defer cancel()
+
+	res := BatchResponse{Results: h.callBatch(ctx, calls)}
+	for _, result := range res.Results {
+		if result.succeeded() {
+			res.Summary.Succeeded++
+		} else {
+			res.Summary.Failed++
+		}
+	}
+
+	status := http.StatusMultiStatus
+	if h.batchOKOnSuccess && res.Summary.Failed == 0 {
+		status = http.StatusOK
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		h.logger.Error("error marshalling batch results", "error", err)
+	}
+}
+
+// readEnvelope reads the body of a request which wraps one or more calls, such
+// as a batch, writing an error response and returning false if it can't be read.
+func (h *Handler) readEnvelope(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if err := h.contentTypeCheck.checkContentType(r, ""); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+
+	if err := h.decompressRequest(r); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+	defer r.Body.Close()
+
+	body, err := h.readBody(w, r)
+	if err != nil {
+		writeError(w, readBodyStatus(err), err)
+		return nil, false
+	}
+
+	return body, true
+}
+
+// envelopeContext returns the context for the calls wrapped by a request.
+func (h *Handler) envelopeContext(r *http.Request) context.Context {
+	ctx := extractTraceContext(r.Context(), r)
+	ctx = contextWithRequest(ctx, r)
+	return headerMetadata(ctx, r, h.metadataHeaders)
+}
+
+// callBatch makes each call, running up to h.batchConcurrency calls at once.
+func (h *Handler) callBatch(ctx context.Context, calls []BatchCall) []BatchResult {
+	results := make([]BatchResult, len(calls))
+
+	h.forEachBatched(len(calls), func(i int) {
+		results[i] = h.callBatchItem(ctx, calls[i])
+	})
+
+	return results
+}
+
+// forEachBatched calls fn for each index up to n,
+// running up to h.batchConcurrency calls at once.
+func (h *Handler) forEachBatched(n int, fn func(i int)) {
+	concurrency := h.batchConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			fn(i)
+		}()
+	}
+
+	wg.Wait()
+}
+
+func (h *Handler) callBatchItem(ctx context.Context, call BatchCall) BatchResult {
+	fn, ok := h.routes[call.Service][call.Operation]
+	if ok && !fn.batchable() {
+		return BatchResult{
+			Status: http.StatusBadRequest,
+			Error:  fmt.Sprintf("operation %s for service %s can't be called in a batch", call.Operation, call.Service),
+		}
+	}
+
+	if call.Parameters != nil {
+		ctx = WithParameters(ctx, call.Parameters)
+	}
+
+	res, err := h.Call(ctx, call.Service, call.Operation, call.Input)
+	if err != nil {
+		return BatchResult{Status: httpStatus(errorCode(err)), Error: err.Error()}
+	}
+
+	return BatchResult{Status: httpStatus(protocol.CodeOK), Result: res}
+}
+
+// batchable is true if the operation can be called in a batch,
+// which requires that it returns a single JSON result.
+func (fn function) batchable() bool {
+	return !fn.streamsResponse() && !fn.checksum && !fn.rawResponse
+}
@@ -0,0 +1,262 @@
+package ops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/common-fate/ops/protocol"
+)
+
+// Operations may be bidirectional, exchanging messages with the client in both
+// directions during a single call, by taking a receive-only channel of inputs
+// followed by a send-only channel of outputs, and returning only an error:
+//
+//	func (s *Service) Chat(ctx context.Context, in <-chan Message, out chan<- Reply) error
+//
+// The request and response bodies are streams of protocol.StreamFrames, encoded
+// with protocol.Encoder, each carrying a JSON-encoded message. Frames from the
+// client are decoded and sent on the input channel as they are read, and the
+// channel is closed once the request body ends. Messages sent on the output
+// channel are written to the client as they are sent, so a slow client applies
+// backpressure to the operation. The handler closes the output channel once the
+// operation has returned, so operations mustn't close it themselves. If the
+// operation fails, the error is sent as the final frame of the response.
+//
+// As the request and response are streamed at the same time, bidirectional
+// operations can only be called over HTTP/2 or HTTP/3, which includes both
+// tunnel transports, where each call is served on its own stream. Calls over
+// HTTP/1.x, and calls made with Handler.Call, JSON-RPC or a batch, fail with
+// protocol.CodeBadRequest. Bidirectional operations are marked as Bidirectional
+// in their definition.
+//
+// If OperationMetadata.FrameTimeout is set, each frame must be read from and
+// written to the client within the timeout, otherwise the call fails with
+// protocol.CodeTimeout and an error wrapping ErrFrameTimeout.
+
+// isOutputStream returns whether a parameter type is a send-only channel.
+func isOutputStream(t reflect.Type) bool {
+	return t.Kind() == reflect.Chan && t.ChanDir() == reflect.SendDir
+}
+
+// streamsResponse is true if the operation writes its response
+// to the client as it runs, rather than returning a result.
+func (fn function) streamsResponse() bool {
+	return fn.subscription || fn.bidirectional
+}
+
+// streamContentType returns the Content-Type accepted for the request body of
+// the operation in addition to JSON, or "" if the body must be JSON.
+func (fn function) streamContentType() string {
+	switch {
+	case fn.bidirectional:
+		return protocol.StreamFrameContentType
+	case fn.inputStream:
+		return "application/x-ndjson"
+	}
+	return ""
+}
+
+// bidiStream is a call to a bidirectional operation.
+type bidiStream struct {
+	w            http.ResponseWriter
+	codec        Codec
+	frameTimeout time.Duration
+
+	// in and out are the channels passed to the operation.
+	in  reflect.Value
+	out reflect.Value
+
+	// cancel cancels the operation's context, and must be
+	// called once the operation has returned.
+	cancel context.CancelCauseFunc
+	// done is closed once every output has been written.
+	done chan struct{}
+	// writeErr is set if writing an output failed, and must only be read once done is closed.
+	writeErr error
+}
+
+// openBidirectional starts decoding frames from the request body onto the input channel
+// of a bidirectional operation. The returned context is cancelled if a frame is malformed,
+// or if a frame isn't read or written within the frame timeout, in which case streamError
+// returns the error. Outputs aren't written until start is called.
+func openBidirectional(ctx context.Context, service string, operation string, function function, codec Codec) (*bidiStream, context.Context, error) {
+	w, hasWriter := ctx.Value(responseWriterContextKey{}).(http.ResponseWriter)
+	req, hasRequest := requestFromContext(ctx)
+	if !hasWriter || !hasRequest || req.ProtoMajor < 2 {
+		return nil, nil, &Error{Code: protocol.CodeBadRequest, Err: fmt.Errorf("operation %s for service %s is bidirectional and can only be called over HTTP/2 or HTTP/3", operation, service)}
+	}
+
+	body, ok := ctx.Value(bodyContextKey{}).(io.Reader)
+	if !ok {
+		body = req.Body
+	}
+
+	// read deadlines are only available if the server supports them.
+	setDeadline := func(time.Time) error { return nil }
+	if function.frameTimeout > 0 {
+		setDeadline = http.NewResponseController(w).SetReadDeadline
+	}
+
+	serr := &inputStreamError{}
+	ctx = context.WithValue(ctx, streamErrorContextKey{}, serr)
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	fail := func(err error) {
+		serr.set(err)
+		cancel(err)
+	}
+
+	inType := *function.inputType
+	in := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, inType.Elem()), 0)
+	out := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, function.outputType.Elem()), 0)
+
+	go func() {
+		defer in.Close()
+
+		dec := protocol.NewDecoder[protocol.StreamFrame](io.NopCloser(body))
+		defer dec.Close()
+
+		for n := 1; ; n++ {
+			if function.frameTimeout > 0 {
+				_ = setDeadline(time.Now().Add(function.frameTimeout))
+			}
+
+			frame, err := dec.Decode()
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				fail(&Error{Code: protocol.CodeTimeout, Err: fmt.Errorf("%w: frame %d was not received within %s", ErrFrameTimeout, n, function.frameTimeout)})
+				return
+			}
+			if err != nil {
+				fail(&StreamDecodeError{Line: n, Err: err})
+				return
+			}
+			if len(frame.Data) == 0 {
+				continue
+			}
+
+			record := reflect.New(inType.Elem())
+			if err := codec.Unmarshal(frame.Data, record.Interface()); err != nil {
+				fail(&StreamDecodeError{Line: n, Err: err})
+				return
+			}
+
+			chosen, _, _ := reflect.Select([]reflect.SelectCase{
+				{Dir: reflect.SelectSend, Chan: in, Send: record.Elem()},
+				{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+			})
+			if chosen == 1 {
+				return
+			}
+		}
+	}()
+
+	stream := &bidiStream{
+		w:            w,
+		codec:        codec,
+		frameTimeout: function.frameTimeout,
+		in:           in.Convert(inType),
+		out:          out,
+		cancel:       cancel,
+		done:         make(chan struct{}),
+	}
+
+	return stream, ctx, nil
+}
+
+// outputArg returns the output channel as it's passed to the operation.
+func (s *bidiStream) outputArg(t reflect.Type) reflect.Value {
+	return s.out.Convert(t)
+}
+
+// start writes the response headers, and starts writing
+// the outputs sent by the operation to the response.
+func (s *bidiStream) start() {
+	flush := func() {}
+	if f, ok := s.w.(http.Flusher); ok {
+		flush = f.Flush
+	}
+
+	s.w.Header().Set("Content-Type", protocol.StreamFrameContentType)
+	s.w.WriteHeader(http.StatusOK)
+	flush()
+
+	go func() {
+		defer close(s.done)
+
+		for {
+			v, ok := s.out.Recv()
+			if !ok {
+				return
+			}
+			if s.writeErr != nil {
+				// the client has gone away, so the remaining
+				// outputs are discarded until the operation returns.
+				continue
+			}
+
+			data, err := s.codec.Marshal(v.Interface())
+			if err == nil {
+				err = s.writeFrame(protocol.StreamFrame{Data: data}, flush)
+			}
+			if err != nil {
+				s.writeErr = err
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					// the client has stalled.
+					err = &Error{Code: protocol.CodeTimeout, Err: fmt.Errorf("%w: an output was not written within %s", ErrFrameTimeout, s.frameTimeout)}
+				}
+				s.cancel(err)
+			}
+		}
+	}()
+}
+
+func (s *bidiStream) writeFrame(frame protocol.StreamFrame, flush func()) error {
+	if s.frameTimeout > 0 {
+		// servers which don't support deadlines
+		// write frames without a timeout.
+		_ = http.NewResponseController(s.w).SetWriteDeadline(time.Now().Add(s.frameTimeout))
+	}
+
+	enc := protocol.NewEncoder[protocol.StreamFrame](responseWriteCloser{s.w})
+	defer enc.Close()
+
+	if err := enc.Encode(&frame); err != nil {
+		return err
+	}
+	flush()
+	return nil
+}
+
+// finish closes the output channel once the operation has returned, waits for the
+// outputs to be written, and writes err as the final frame if the operation failed.
+func (s *bidiStream) finish(err error) {
+	s.out.Close()
+	<-s.done
+
+	if err == nil || s.writeErr != nil {
+		return
+	}
+
+	flush := func() {}
+	if f, ok := s.w.(http.Flusher); ok {
+		flush = f.Flush
+	}
+	_ = s.writeFrame(protocol.StreamFrame{Code: errorCode(err), Error: err.Error()}, flush)
+}
+
+// responseWriteCloser adapts a response writer to
+// the io.WriteCloser taken by protocol.NewEncoder.
+type responseWriteCloser struct {
+	http.ResponseWriter
+}
+
+func (responseWriteCloser) Close() error { return nil }
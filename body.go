@@ -0,0 +1,36 @@
+package ops
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// DefaultMaxRequestBytes is the default Registry.MaxRequestBytes.
+const DefaultMaxRequestBytes = 4 << 20
+
+// readBody reads the request body, up to the handler's MaxRequestBytes.
+func (h *Handler) readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	if h.maxRequestBytes < 0 {
+		return io.ReadAll(r.Body)
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.maxRequestBytes))
+
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return nil, fmt.Errorf("request body exceeds the limit of %d bytes: %w", maxErr.Limit, err)
+	}
+
+	return body, err
+}
+
+// readBodyStatus returns the HTTP status for an error returned by readBody.
+func readBodyStatus(err error) int {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,31 @@
+package ops
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+)
+
+// StatusClientClosedRequest is the status recorded for requests which the
+// client cancelled before the response was written, following the convention
+// of nginx. The status is only seen in access logs, as the client is gone.
+const StatusClientClosedRequest = 499
+
+// clientGone returns whether the client cancelled the request, for example by
+// disconnecting. The operation's context is the request's context, so it's
+// cancelled as soon as the client goes away. If it has, the cancellation is
+// logged and no body is written, rather than reporting the resulting error.
+func (h *Handler) clientGone(w http.ResponseWriter, r *http.Request, service string, operation string) bool {
+	ctx := r.Context()
+	if ctx.Err() == nil {
+		return false
+	}
+
+	h.logger.LogAttrs(ctx, slog.LevelInfo, "client cancelled request",
+		slog.String("service", service),
+		slog.String("operation", operation),
+		slog.Any("error", context.Cause(ctx)),
+	)
+	w.WriteHeader(StatusClientClosedRequest)
+	return true
+}
@@ -0,0 +1,248 @@
+package ops
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/invopop/jsonschema"
+)
+
+// FieldNaming converts the Go name of a struct field without a
+// `json` tag into the name used for the field on the wire.
+//
+// Setting Registry.FieldNaming applies the policy consistently to the
+// emitted schemas, the decoding of inputs, and the encoding of results.
+// Fields with an explicit `json` tag always use the tag's name.
+type FieldNaming func(goName string) string
+
+// CamelCase names untagged fields in camelCase, e.g. UserID becomes userId.
+func CamelCase(goName string) string {
+	words := splitWords(goName)
+	for i, w := range words {
+		if i == 0 {
+			words[i] = strings.ToLower(w)
+			continue
+		}
+		words[i] = strings.ToUpper(w[:1]) + strings.ToLower(w[1:])
+	}
+	return strings.Join(words, "")
+}
+
+// SnakeCase names untagged fields in snake_case, e.g. UserID becomes user_id.
+func SnakeCase(goName string) string {
+	words := splitWords(goName)
+	for i, w := range words {
+		words[i] = strings.ToLower(w)
+	}
+	return strings.Join(words, "_")
+}
+
+// KebabCase names untagged fields in kebab-case, e.g. UserID becomes user-id.
+func KebabCase(goName string) string {
+	return strings.ReplaceAll(SnakeCase(goName), "_", "-")
+}
+
+// splitWords splits a Go identifier into words, keeping
+// initialisms together, e.g. HTTPServerID is split into HTTP, Server, ID.
+func splitWords(s string) []string {
+	runes := []rune(s)
+	var words []string
+	start := 0
+
+	for i := 1; i < len(runes); i++ {
+		prev, cur := runes[i-1], runes[i]
+		lowerToUpper := !unicode.IsUpper(prev) && unicode.IsUpper(cur)
+		endOfInitialism := unicode.IsUpper(prev) && unicode.IsUpper(cur) && i+1 < len(runes) && unicode.IsLower(runes[i+1])
+
+		if lowerToUpper || endOfInitialism {
+			words = append(words, string(runes[start:i]))
+			start = i
+		}
+	}
+
+	return append(words, string(runes[start:]))
+}
+
+// jsonField is a struct field as seen by encoding/json.
+type jsonField struct {
+	goName string
+	// wireName is the name of the field when encoded.
+	wireName string
+	tagged   bool
+	typ      reflect.Type
+}
+
+// jsonFields returns the fields of a struct type, promoting the
+// fields of untagged embedded structs in the same way as encoding/json.
+func jsonFields(t reflect.Type, naming FieldNaming) []jsonField {
+	var fields []jsonField
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			fields = append(fields, jsonFields(ft, naming)...)
+			continue
+		}
+
+		if !f.IsExported() {
+			continue
+		}
+
+		field := jsonField{goName: f.Name, wireName: name, tagged: name != "", typ: f.Type}
+		if !field.tagged {
+			field.wireName = naming(f.Name)
+		}
+
+		fields = append(fields, field)
+	}
+
+	return fields
+}
+
+var (
+	jsonMarshalerType   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+// rename walks a decoded JSON value alongside the Go type it represents,
+// renaming the keys of untagged struct fields. If toWire is true keys are renamed
+// from their Go names to their wire names, otherwise from wire names to Go names.
+func (n FieldNaming) rename(t reflect.Type, v any, toWire bool) any {
+	if t.Implements(jsonMarshalerType) || reflect.PointerTo(t).Implements(jsonUnmarshalerType) {
+		return v
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return n.rename(t.Elem(), v, toWire)
+
+	case reflect.Slice, reflect.Array:
+		if items, ok := v.([]any); ok {
+			for i := range items {
+				items[i] = n.rename(t.Elem(), items[i], toWire)
+			}
+		}
+
+	case reflect.Map:
+		if m, ok := v.(map[string]any); ok {
+			for k := range m {
+				m[k] = n.rename(t.Elem(), m[k], toWire)
+			}
+		}
+
+	case reflect.Struct:
+		m, ok := v.(map[string]any)
+		if !ok {
+			return v
+		}
+
+		res := make(map[string]any, len(m))
+		for k, val := range m {
+			res[k] = val
+		}
+
+		for _, f := range jsonFields(t, n) {
+			from, to := f.wireName, f.goName
+			if toWire {
+				from, to = f.goName, f.wireName
+			}
+			if f.tagged {
+				from, to = f.wireName, f.wireName
+			}
+
+			val, ok := m[from]
+			if !ok {
+				continue
+			}
+			delete(res, from)
+			res[to] = n.rename(f.typ, val, toWire)
+		}
+
+		return res
+	}
+
+	return v
+}
+
+// transform decodes the JSON document, renames its keys, and re-encodes it.
+func (n FieldNaming) transform(t reflect.Type, data []byte, toWire bool) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(n.rename(t, v, toWire))
+}
+
+// keyNamer returns a jsonschema KeyNamer which applies the naming policy
+// to the untagged fields in the type. jsonschema passes the tag name to the
+// KeyNamer for tagged fields, so names used by tags are left untouched.
+func (n FieldNaming) keyNamer(t reflect.Type) func(string) string {
+	untagged := map[string]bool{}
+	tagged := map[string]bool{}
+	seen := map[reflect.Type]bool{}
+
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		if seen[t] {
+			return
+		}
+		seen[t] = true
+
+		switch t.Kind() {
+		case reflect.Pointer, reflect.Slice, reflect.Array, reflect.Map:
+			walk(t.Elem())
+		case reflect.Struct:
+			for _, f := range jsonFields(t, n) {
+				if f.tagged {
+					tagged[f.wireName] = true
+				} else {
+					untagged[f.goName] = true
+				}
+				walk(f.typ)
+			}
+		}
+	}
+	walk(t)
+
+	return func(name string) string {
+		if untagged[name] && !tagged[name] {
+			return n(name)
+		}
+		return name
+	}
+}
+
+// reflectSchema reflects the JSON schema for a value, applying the naming policy if set.
+// The base reflector, if set, is copied so that the KeyNamer set for one type
+// isn't shared with others. Definitions of generic types are named by genericTypeName
+// unless the base reflector sets a Namer.
+func reflectSchema(v any, naming FieldNaming, base *jsonschema.Reflector) *jsonschema.Schema {
+	r := &jsonschema.Reflector{}
+	if base != nil {
+		*r = *base
+	}
+	if naming != nil && r.KeyNamer == nil {
+		r.KeyNamer = naming.keyNamer(reflect.TypeOf(v))
+	}
+	if r.Namer == nil {
+		r.Namer = genericTypeName
+	}
+	return r.Reflect(v)
+}
@@ -0,0 +1,41 @@
+package ops
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ChecksumHeader is the header carrying the SHA-256 checksum of a request
+// or response body, as a lowercase hex string.
+//
+// For operations with OperationMetadata.Checksum set, callers must send the
+// checksum of the request body in this header. Requests with a missing or
+// mismatched checksum are rejected with protocol.CodeBadRequest before the
+// input is decoded. Successful responses include the checksum of the response body.
+//
+// Checksums aren't supported for operations which stream their input or
+// return a subscription, as the body isn't buffered.
+const ChecksumHeader = "X-Content-SHA256"
+
+// checksum returns the hex encoded SHA-256 checksum of b.
+func checksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyChecksum checks the request body against the checksum sent by the caller.
+func verifyChecksum(r *http.Request, body []byte) error {
+	want := r.Header.Get(ChecksumHeader)
+	if want == "" {
+		return fmt.Errorf("missing %s header", ChecksumHeader)
+	}
+
+	if got := checksum(body); !strings.EqualFold(got, want) {
+		return fmt.Errorf("request body checksum %s does not match %s header %s", got, ChecksumHeader, want)
+	}
+
+	return nil
+}
@@ -0,0 +1,216 @@
+package ops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/common-fate/ops/protocol"
+)
+
+// DefaultCircuitBreakerCooldown is how long an open circuit breaker
+// fails calls for, unless CircuitBreaker.Cooldown is set.
+const DefaultCircuitBreakerCooldown = 30 * time.Second
+
+// ErrCircuitOpen is wrapped by the errors of calls which fail
+// without calling the operation because its circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitBreaker configures the circuit breaker of an operation, which stops calling
+// an operation which keeps failing, for example because a dependency is down.
+//
+// The breaker opens after FailureThreshold consecutive calls fail with
+// protocol.CodeServerError or CodeTimeout. While it's open, calls fail with
+// protocol.CodeServerError and an error wrapping ErrCircuitOpen, without
+// calling the operation. After the Cooldown the breaker is half-open, and
+// lets HalfOpenProbes calls through: if they all succeed the breaker closes,
+// and if any fails it opens again for another Cooldown.
+//
+// Each operation has its own breaker, shared by all callers.
+// See Handler.CircuitState for the state of a breaker.
+type CircuitBreaker struct {
+	// FailureThreshold is the number of consecutive failures which open
+	// the breaker. The breaker is disabled if it isn't positive.
+	FailureThreshold int
+	// Cooldown defaults to DefaultCircuitBreakerCooldown.
+	Cooldown time.Duration
+	// HalfOpenProbes defaults to one.
+	HalfOpenProbes int
+}
+
+// CircuitState is the state of a circuit breaker.
+type CircuitState int
+
+const (
+	// CircuitClosed breakers call the operation.
+	CircuitClosed CircuitState = iota
+	// CircuitHalfOpen breakers call the operation for a limited number of probes.
+	CircuitHalfOpen
+	// CircuitOpen breakers fail calls without calling the operation.
+	CircuitOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitHalfOpen:
+		return "half-open"
+	case CircuitOpen:
+		return "open"
+	}
+	return fmt.Sprintf("CircuitState(%d)", int(s))
+}
+
+// breaker is the circuit breaker of an operation.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	probes    int
+
+	mu    sync.Mutex
+	state CircuitState
+	// generation is incremented on every change of state,
+	// so that results of calls started in an earlier state are ignored.
+	generation int
+	failures   int
+	openedAt   time.Time
+	// probesStarted and probesSucceeded count the calls let through while half-open.
+	probesStarted   int
+	probesSucceeded int
+}
+
+// newBreaker returns the breaker for an operation, or nil if it doesn't have one.
+func newBreaker(conf *CircuitBreaker) *breaker {
+	if conf == nil || conf.FailureThreshold <= 0 {
+		return nil
+	}
+
+	b := &breaker{
+		threshold: conf.FailureThreshold,
+		cooldown:  conf.Cooldown,
+		probes:    conf.HalfOpenProbes,
+	}
+	if b.cooldown <= 0 {
+		b.cooldown = DefaultCircuitBreakerCooldown
+	}
+	if b.probes <= 0 {
+		b.probes = 1
+	}
+	return b
+}
+
+// call calls fn if the breaker allows it, recording the result.
+func (b *breaker) call(service string, operation string, fn func() ([]byte, error)) ([]byte, error) {
+	generation, ok := b.allow(time.Now())
+	if !ok {
+		return nil, &Error{Code: protocol.CodeServerError, Err: fmt.Errorf("operation %s for service %s is unavailable: %w", operation, service, ErrCircuitOpen)}
+	}
+
+	res, err := fn()
+	b.record(generation, isBreakerFailure(err))
+	return res, err
+}
+
+// isBreakerFailure is true if the error suggests the operation is failing,
+// rather than that the call was invalid or was cancelled by the caller.
+func isBreakerFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	code := errorCode(err)
+	return code == protocol.CodeServerError || code == protocol.CodeTimeout
+}
+
+// currentState returns the state of the breaker, moving
+// from open to half-open once the cooldown has passed.
+// b.mu must be held.
+func (b *breaker) currentState(now time.Time) CircuitState {
+	if b.state == CircuitOpen && now.Sub(b.openedAt) >= b.cooldown {
+		b.setState(CircuitHalfOpen, now)
+	}
+	return b.state
+}
+
+// setState changes the state of the breaker. b.mu must be held.
+func (b *breaker) setState(state CircuitState, now time.Time) {
+	b.state = state
+	b.generation++
+	b.failures = 0
+	b.probesStarted = 0
+	b.probesSucceeded = 0
+	if state == CircuitOpen {
+		b.openedAt = now
+	}
+}
+
+// allow returns whether a call may be made, and the generation of the breaker to record its result against.
+func (b *breaker) allow(now time.Time) (int, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.currentState(now) {
+	case CircuitOpen:
+		return 0, false
+	case CircuitHalfOpen:
+		if b.probesStarted >= b.probes {
+			return 0, false
+		}
+		b.probesStarted++
+	}
+
+	return b.generation, true
+}
+
+// record records the result of a call allowed in the generation.
+func (b *breaker) record(generation int, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation != b.generation {
+		return
+	}
+
+	now := time.Now()
+
+	switch b.state {
+	case CircuitClosed:
+		if !failed {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.threshold {
+			b.setState(CircuitOpen, now)
+		}
+
+	case CircuitHalfOpen:
+		if failed {
+			b.setState(CircuitOpen, now)
+			return
+		}
+		b.probesSucceeded++
+		if b.probesSucceeded >= b.probes {
+			b.setState(CircuitClosed, now)
+		}
+	}
+}
+
+// current returns the current state of the breaker.
+func (b *breaker) current() CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.currentState(time.Now())
+}
+
+// CircuitState returns the state of the circuit breaker of an operation.
+// It returns false if the operation doesn't exist or doesn't have a breaker.
+func (h *Handler) CircuitState(service string, operation string) (CircuitState, bool) {
+	fn, ok := h.routes[service][operation]
+	if !ok || fn.breaker == nil {
+		return CircuitClosed, false
+	}
+	return fn.breaker.current(), true
+}
@@ -0,0 +1,81 @@
+// Command opsgen generates a typed Go client from service definitions.
+//
+// The definitions are read from a JSON file, or fetched from the discovery
+// endpoint of a running handler if an http(s) URL is provided:
+//
+//	opsgen -definitions http://localhost:8080/.lightwave/operations -package client -out client/client.go
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/common-fate/ops/servicedef"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "opsgen: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	defsPath := flag.String("definitions", "", "path or URL of the service definitions JSON ('-' for stdin)")
+	pkg := flag.String("package", "client", "package name of the generated client")
+	out := flag.String("out", "", "file to write the generated client to (defaults to stdout)")
+	flag.Parse()
+
+	if *defsPath == "" {
+		return fmt.Errorf("-definitions is required")
+	}
+
+	b, err := readDefinitions(*defsPath)
+	if err != nil {
+		return err
+	}
+
+	var defs servicedef.Definitions
+	if err := json.Unmarshal(b, &defs); err != nil {
+		return fmt.Errorf("decoding definitions: %w", err)
+	}
+
+	src, err := defs.GoClient(*pkg)
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		_, err = os.Stdout.Write(src)
+		return err
+	}
+
+	return os.WriteFile(*out, src, 0644)
+}
+
+func readDefinitions(path string) ([]byte, error) {
+	switch {
+	case path == "-":
+		return io.ReadAll(os.Stdin)
+
+	case strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://"):
+		res, err := http.Get(path)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching definitions: unexpected status %s", res.Status)
+		}
+
+		return io.ReadAll(res.Body)
+	}
+
+	return os.ReadFile(path)
+}
@@ -0,0 +1,50 @@
+package ops
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// Codec encodes operation inputs and results, including the records of
+// input streams and the frames of subscriptions. It can be set with
+// Registry.Codec, and defaults to JSONCodec.
+//
+// Codecs must produce and accept JSON, as operations are described with
+// JSON schemas. Discovery endpoints and errors always use encoding/json.
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// JSONCodec is a Codec using encoding/json.
+type JSONCodec struct {
+	// DisallowUnknownFields causes inputs containing fields which don't match
+	// a field of the input type to be rejected with protocol.CodeBadRequest,
+	// rather than the fields being silently dropped.
+	DisallowUnknownFields bool
+}
+
+func (c JSONCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c JSONCodec) Unmarshal(data []byte, v any) error {
+	if !c.DisallowUnknownFields {
+		return json.Unmarshal(data, v)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+
+	// match json.Unmarshal, which rejects data after the value.
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return errors.New("invalid data after top-level value")
+	}
+
+	return nil
+}
@@ -0,0 +1,212 @@
+package ops
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultCompressionMinSize is the default Compression.MinSize.
+const DefaultCompressionMinSize = 1024
+
+// Compression configures compression of request and response bodies served over HTTP.
+//
+// Responses are compressed with the first compressor which the caller
+// advertises support for in the Accept-Encoding header, and the encoding is
+// set in the Content-Encoding header. Request bodies sent with a
+// Content-Encoding header are decompressed before the input is decoded.
+// Requests with an unsupported Content-Encoding are rejected with
+// 415 Unsupported Media Type.
+//
+// Subscriptions and error responses aren't compressed.
+type Compression struct {
+	// Compressors in order of preference, defaulting to Zstd then Gzip.
+	Compressors []Compressor
+
+	// MinSize is the minimum size in bytes of a response body to compress,
+	// defaulting to DefaultCompressionMinSize. Compressing smaller bodies
+	// usually costs more than it saves.
+	MinSize int
+}
+
+// Compressor compresses and decompresses bodies with a HTTP content coding.
+type Compressor interface {
+	// Encoding is the name of the content coding, such as 'gzip'.
+	Encoding() string
+	Compress(w io.Writer) (io.WriteCloser, error)
+	Decompress(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	// Gzip compresses bodies with the 'gzip' content coding.
+	Gzip Compressor = gzipCompressor{}
+
+	// Zstd compresses bodies with the 'zstd' content coding.
+	Zstd Compressor = zstdCompressor{}
+)
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Encoding() string { return "gzip" }
+
+func (gzipCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCompressor) Decompress(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type zstdCompressor struct{}
+
+func (zstdCompressor) Encoding() string { return "zstd" }
+
+func (zstdCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w)
+}
+
+func (zstdCompressor) Decompress(r io.Reader) (io.ReadCloser, error) {
+	dec, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return dec.IOReadCloser(), nil
+}
+
+// withDefaults returns the compression options with defaults applied,
+// or nil if compression is disabled.
+func (c *Compression) withDefaults() *Compression {
+	if c == nil {
+		return nil
+	}
+
+	out := *c
+	if len(out.Compressors) == 0 {
+		out.Compressors = []Compressor{Zstd, Gzip}
+	}
+	if out.MinSize == 0 {
+		out.MinSize = DefaultCompressionMinSize
+	}
+	return &out
+}
+
+// decompressRequest replaces the request body with a decompressing reader,
+// if the request has a Content-Encoding header. Callers must close the request
+// body once it has been read, to release the decompressor.
+func (h *Handler) decompressRequest(r *http.Request) error {
+	encoding := strings.TrimSpace(r.Header.Get("Content-Encoding"))
+	if encoding == "" || strings.EqualFold(encoding, "identity") {
+		return nil
+	}
+
+	var compressors []Compressor
+	if h.compression != nil {
+		compressors = h.compression.Compressors
+	}
+
+	for _, c := range compressors {
+		if strings.EqualFold(c.Encoding(), encoding) {
+			body, err := c.Decompress(r.Body)
+			if err != nil {
+				return fmt.Errorf("error decompressing %s request body: %w", encoding, err)
+			}
+			r.Body = decompressedBody{ReadCloser: body, compressed: r.Body}
+			return nil
+		}
+	}
+
+	return unsupportedEncodingError{encoding: encoding}
+}
+
+// decompressedBody reads a decompressed request body.
+// Closing it closes both the decompressor and the compressed body.
+type decompressedBody struct {
+	io.ReadCloser
+	compressed io.ReadCloser
+}
+
+func (b decompressedBody) Close() error {
+	err := b.ReadCloser.Close()
+	if cerr := b.compressed.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+type unsupportedEncodingError struct {
+	encoding string
+}
+
+func (e unsupportedEncodingError) Error() string {
+	return fmt.Sprintf("unsupported Content-Encoding: %s", e.encoding)
+}
+
+// compressResponse compresses a response body with the preferred encoding which
+// the caller accepts. It returns the body unchanged, with an empty encoding, if
+// compression is disabled, the body is too small, or no encoding is accepted.
+func (h *Handler) compressResponse(r *http.Request, res []byte) ([]byte, string, error) {
+	if h.compression == nil || len(res) < h.compression.MinSize {
+		return res, "", nil
+	}
+
+	accepted := acceptedEncodings(r.Header.Values("Accept-Encoding"))
+
+	for _, c := range h.compression.Compressors {
+		q, ok := accepted[strings.ToLower(c.Encoding())]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if !ok || q == 0 {
+			continue
+		}
+
+		var buf bytes.Buffer
+		cw, err := c.Compress(&buf)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := cw.Write(res); err != nil {
+			return nil, "", err
+		}
+		if err := cw.Close(); err != nil {
+			return nil, "", err
+		}
+
+		return buf.Bytes(), c.Encoding(), nil
+	}
+
+	return res, "", nil
+}
+
+// acceptedEncodings parses Accept-Encoding header values
+// into a map of lowercase content codings to their quality.
+func acceptedEncodings(values []string) map[string]float64 {
+	accepted := map[string]float64{}
+
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			encoding, params, _ := strings.Cut(part, ";")
+			encoding = strings.ToLower(strings.TrimSpace(encoding))
+			if encoding == "" {
+				continue
+			}
+
+			q := 1.0
+			if qs, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if parsed, err := strconv.ParseFloat(qs, 64); err == nil {
+					q = parsed
+				}
+			}
+
+			accepted[encoding] = q
+		}
+	}
+
+	return accepted
+}
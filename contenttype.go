@@ -0,0 +1,58 @@
+package ops
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// jsonContentType is the Content-Type of operation results served over HTTP.
+const jsonContentType = "application/json"
+
+// ContentTypeCheck controls how the Content-Type of requests
+// served over HTTP is checked. See Registry.ContentTypeCheck.
+type ContentTypeCheck int
+
+const (
+	// ContentTypeUnchecked accepts requests with any Content-Type. It's the default.
+	ContentTypeUnchecked ContentTypeCheck = iota
+	// ContentTypeAllowMissing rejects requests which declare a Content-Type
+	// other than JSON, but accepts requests without one, as some clients
+	// don't set it.
+	ContentTypeAllowMissing
+	// ContentTypeRequired rejects requests which don't declare a JSON Content-Type.
+	ContentTypeRequired
+)
+
+// checkContentType returns an error if the request's Content-Type isn't accepted.
+// JSON types such as application/json and application/problem+json are accepted,
+// and requests to operations which stream their input may also use streamType,
+// such as application/x-ndjson, if it's set.
+func (c ContentTypeCheck) checkContentType(r *http.Request, streamType string) error {
+	if c == ContentTypeUnchecked {
+		return nil
+	}
+
+	header := r.Header.Get("Content-Type")
+	if header == "" {
+		if c == ContentTypeRequired {
+			return fmt.Errorf("the Content-Type header is required and must be %s", jsonContentType)
+		}
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return fmt.Errorf("invalid Content-Type %q: %w", header, err)
+	}
+
+	if mediaType == jsonContentType || strings.HasSuffix(mediaType, "+json") {
+		return nil
+	}
+	if streamType != "" && mediaType == streamType {
+		return nil
+	}
+
+	return fmt.Errorf("unsupported Content-Type %q, requests must be %s", mediaType, jsonContentType)
+}
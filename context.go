@@ -0,0 +1,97 @@
+package ops
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/common-fate/ops/protocol"
+)
+
+type requestContextKey struct{}
+
+// contextWithRequest stores the HTTP request being served
+// so that it can be passed to operations accepting an *http.Request.
+func contextWithRequest(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, requestContextKey{}, r)
+}
+
+func requestFromContext(ctx context.Context) (*http.Request, bool) {
+	r, ok := ctx.Value(requestContextKey{}).(*http.Request)
+	return r, ok
+}
+
+type tenantContextKey struct{}
+
+// WithTenant returns a copy of ctx scoped to the provided tenant.
+//
+// Operations marked as TenantScoped in their metadata can only be called
+// with a tenant present in the context. Callers of Handler.Call should set
+// the tenant after authenticating the request; when serving over HTTP,
+// wrap the Handler and set the tenant on the request context:
+//
+//	next.ServeHTTP(w, r.WithContext(ops.WithTenant(r.Context(), tenant)))
+//
+// To set the tenant of every call, including calls served over a
+// tunnel by Registry.Start, set Registry.TenantResolver instead.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant the context is scoped to.
+// It returns false if there is no tenant in the context.
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantContextKey{}).(string)
+	if tenant == "" {
+		return "", false
+	}
+	return tenant, ok
+}
+
+// TenantResolver returns the tenant a call is made on behalf of, for example from
+// the request metadata set by an authenticating proxy, or "" if the call isn't made
+// on behalf of a tenant. Returning an *Error sets the response code of the call;
+// other errors fail the call with protocol.CodeUnauthorized.
+type TenantResolver func(ctx context.Context) (string, error)
+
+// TenantFromMetadata returns a TenantResolver which reads the tenant from a key of
+// the call's metadata. See MetadataFromContext. To read the tenant from a header,
+// the header must also be listed in Registry.MetadataHeaders:
+//
+//	registry.MetadataHeaders = []string{"X-Tenant-Id"}
+//	registry.TenantResolver = ops.TenantFromMetadata("X-Tenant-Id")
+//
+// As headers are set by the caller, only read the tenant from a header
+// which is set by a trusted proxy or by the server the tunnel connects to.
+func TenantFromMetadata(key string) TenantResolver {
+	return func(ctx context.Context) (string, error) {
+		tenant, _ := MetadataFromContext(ctx).Get(key)
+		return tenant, nil
+	}
+}
+
+// resolveTenant wraps the invoker to set the tenant of calls made
+// without one using the resolver, so that middleware can read it.
+func resolveTenant(resolve TenantResolver, next Invoker) Invoker {
+	return func(ctx context.Context, service, operation string, input json.RawMessage) ([]byte, error) {
+		if _, ok := TenantFromContext(ctx); ok {
+			return next(ctx, service, operation, input)
+		}
+
+		tenant, err := resolve(ctx)
+		if err != nil {
+			var opErr *Error
+			if errors.As(err, &opErr) {
+				return nil, err
+			}
+			return nil, &Error{Code: protocol.CodeUnauthorized, Err: fmt.Errorf("resolving the tenant: %w", err)}
+		}
+		if tenant != "" {
+			ctx = WithTenant(ctx, tenant)
+		}
+
+		return next(ctx, service, operation, input)
+	}
+}
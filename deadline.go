@@ -0,0 +1,70 @@
+package ops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/common-fate/ops/protocol"
+)
+
+// RequestTimeoutHeader is the header with which HTTP callers set how long they're
+// willing to wait for a call, either as a number of seconds, such as '2.5', or as
+// a Go duration, such as '2500ms'. It is applied as a deadline to the context of
+// the operation, or to the context of every call in a batch or JSON-RPC request.
+//
+// Callers of Handler.Call set a deadline on the context passed to Call instead.
+// If the operation has a Timeout, whichever deadline is sooner applies.
+// Calls which run past the deadline fail with protocol.CodeTimeout.
+const RequestTimeoutHeader = "Request-Timeout"
+
+// errOperationTimeout is the cause of the context of an
+// operation being cancelled when its Timeout passes.
+var errOperationTimeout = errors.New("operation timed out")
+
+// parseRequestTimeout parses the value of the RequestTimeoutHeader.
+func parseRequestTimeout(v string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(v)
+	if err != nil {
+		secs, serr := strconv.ParseFloat(v, 64)
+		if serr != nil {
+			return 0, fmt.Errorf("invalid %s header '%s': must be a number of seconds or a duration", RequestTimeoutHeader, v)
+		}
+		timeout = time.Duration(secs * float64(time.Second))
+	}
+
+	if timeout <= 0 {
+		return 0, fmt.Errorf("invalid %s header '%s': must be positive", RequestTimeoutHeader, v)
+	}
+
+	return timeout, nil
+}
+
+// withRequestTimeout applies the deadline set by the RequestTimeoutHeader, if any, to the context.
+// The returned cancel function must be called once the request has been served.
+func withRequestTimeout(ctx context.Context, r *http.Request) (context.Context, context.CancelFunc, error) {
+	v := r.Header.Get(RequestTimeoutHeader)
+	if v == "" {
+		return ctx, func() {}, nil
+	}
+
+	timeout, err := parseRequestTimeout(v)
+	if err != nil {
+		return ctx, func() {}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, cancel, nil
+}
+
+// deadlineError returns the error for an operation whose context passed its deadline,
+// distinguishing the operation's own Timeout from a deadline set by the caller.
+func deadlineError(ctx context.Context, service string, operation string, function function) error {
+	if errors.Is(context.Cause(ctx), errOperationTimeout) {
+		return &Error{Code: protocol.CodeTimeout, Err: fmt.Errorf("operation %s for service %s timed out after %s", operation, service, function.timeout)}
+	}
+	return &Error{Code: protocol.CodeTimeout, Err: fmt.Errorf("operation %s for service %s didn't complete before the caller's deadline", operation, service)}
+}
@@ -0,0 +1,175 @@
+package ops
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/invopop/jsonschema"
+)
+
+// Input fields may be tagged with a default, which is used if the
+// field is absent from the request:
+//
+//	type ListInput struct {
+//		Limit int `json:"limit" default:"50"`
+//	}
+//
+// Defaults are supported on string, bool, integer and float fields, and on
+// pointers to them. A value field which is present in the request keeps the
+// value it was sent with, even if that's the zero value, so an explicit 0
+// overrides a default of 50, while a value field set to null keeps its
+// default. A pointer field is set to point to the default
+// if it's absent, and is left nil if the request sets it to null.
+//
+// Defaults are applied to the fields of the input and of structs nested in it
+// by value, but not to structs behind pointers or in slices and maps. They're
+// included in the input's schema with the default keyword.
+
+// defaultTag is the struct tag which sets the default of an input field.
+const defaultTag = "default"
+
+// fieldDefault is the default value of a field of an input.
+type fieldDefault struct {
+	// index of the field in the input.
+	index []int
+	// path of the field in the input's schema.
+	path []string
+	// value is the default, of the field's type or the type it points to.
+	value reflect.Value
+}
+
+// parseDefaults returns the defaults of the fields of t.
+func parseDefaults(t reflect.Type, naming FieldNaming) ([]fieldDefault, error) {
+	if t.Kind() != reflect.Struct {
+		return nil, nil
+	}
+
+	var defaults []fieldDefault
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() || f.Tag.Get("json") == "-" {
+			continue
+		}
+
+		name := wireName(f, naming)
+		jsonName, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		embedded := f.Anonymous && jsonName == ""
+
+		if tag, ok := f.Tag.Lookup(defaultTag); ok {
+			v, err := parseDefault(f.Type, tag)
+			if err != nil {
+				return nil, fmt.Errorf("invalid default for field %s of %s: %w", f.Name, t, err)
+			}
+			defaults = append(defaults, fieldDefault{index: []int{i}, path: []string{name}, value: v})
+			continue
+		}
+
+		if f.Type.Kind() != reflect.Struct {
+			continue
+		}
+
+		nested, err := parseDefaults(f.Type, naming)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range nested {
+			d.index = append([]int{i}, d.index...)
+			if !embedded {
+				// the fields of embedded structs are promoted in the schema.
+				d.path = append([]string{name}, d.path...)
+			}
+			defaults = append(defaults, d)
+		}
+	}
+
+	return defaults, nil
+}
+
+// parseDefault parses a default tag for a field of type t.
+func parseDefault(t reflect.Type, s string) (reflect.Value, error) {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	v := reflect.New(t).Elem()
+
+	switch t.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return v, err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, t.Bits())
+		if err != nil {
+			return v, err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, t.Bits())
+		if err != nil {
+			return v, err
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, t.Bits())
+		if err != nil {
+			return v, err
+		}
+		v.SetFloat(f)
+	default:
+		return v, fmt.Errorf("defaults aren't supported for fields of type %s", t)
+	}
+
+	return v, nil
+}
+
+// applyDefaults sets the defaults on an input before it's decoded,
+// so that decoding only replaces the defaults of fields in the request.
+func applyDefaults(input reflect.Value, defaults []fieldDefault) {
+	for _, d := range defaults {
+		field := input.FieldByIndex(d.index)
+		if field.Kind() == reflect.Pointer {
+			p := reflect.New(field.Type().Elem())
+			p.Elem().Set(d.value)
+			field.Set(p)
+			continue
+		}
+		field.Set(d.value)
+	}
+}
+
+// setSchemaDefaults sets the default keyword of the properties with defaults in the input's schema.
+func setSchemaDefaults(root *jsonschema.Schema, defaults []fieldDefault) {
+	for _, d := range defaults {
+		schema := root
+		for _, name := range d.path {
+			schema = resolveSchemaRef(root, schema)
+			if schema == nil || schema.Properties == nil {
+				break
+			}
+			schema, _ = schema.Properties.Get(name)
+		}
+		if schema != nil {
+			schema.Default = d.value.Interface()
+		}
+	}
+}
+
+// resolveSchemaRef returns the definition referred to by the schema, if it's a reference.
+func resolveSchemaRef(root, schema *jsonschema.Schema) *jsonschema.Schema {
+	if schema == nil {
+		return nil
+	}
+	name, ok := strings.CutPrefix(schema.Ref, "#/$defs/")
+	if !ok {
+		return schema
+	}
+	return root.Definitions[name]
+}
@@ -0,0 +1,16 @@
+package ops
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// setDeprecationHeaders marks the response to a deprecated operation with
+// a Deprecation header, and a Warning header with the message if it's set.
+func setDeprecationHeaders(header http.Header, message string) {
+	header.Set("Deprecation", "true")
+	if message != "" {
+		// 299 is the "miscellaneous persistent warning" code.
+		header.Set("Warning", "299 - "+strconv.Quote(message))
+	}
+}
@@ -0,0 +1,175 @@
+package ops
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/common-fate/ops/servicedef"
+	"github.com/invopop/jsonschema"
+)
+
+// DefaultMetaPathPrefix is the default path prefix of the discovery and health
+// endpoints served by the handler. See Registry.MetaPathPrefix.
+const DefaultMetaPathPrefix = "/.lightwave"
+
+// metaPath returns the path of a discovery or health endpoint.
+func (h *Handler) metaPath(name string) string {
+	return h.metaPrefix + "/" + name
+}
+
+// metaPathPrefix normalises a configured prefix, applying the default.
+func metaPathPrefix(prefix string) string {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return DefaultMetaPathPrefix
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	return prefix
+}
+
+// operationDefinition returns the definition of a single operation.
+func (h *Handler) operationDefinition(service, operation string) (servicedef.Operation, bool) {
+	for _, svc := range h.defs.Services {
+		if svc.Path() != service {
+			continue
+		}
+		for _, op := range svc.Operations {
+			if op.ID == operation {
+				return op, true
+			}
+		}
+	}
+	return servicedef.Operation{}, false
+}
+
+// serviceDefinition returns the definition of a service, identified by its path.
+func (h *Handler) serviceDefinition(service string) (servicedef.Service, bool) {
+	for _, svc := range h.defs.Services {
+		if svc.Path() == service {
+			return svc, true
+		}
+	}
+	return servicedef.Service{}, false
+}
+
+// serveDefinitions serves GET {prefix}/operations with the definitions of every
+// service, GET {prefix}/operations/{service} with the definition of a service,
+// and GET {prefix}/operations/{service}/{operation}, where the service is
+// prefixed by its version if it's versioned. With ?summary=true, services
+// are described by the IDs of their operations, without any schemas.
+func (h *Handler) serveDefinitions(w http.ResponseWriter, r *http.Request) {
+	summary, _ := strconv.ParseBool(r.URL.Query().Get("summary"))
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, h.metaPath("operations")), "/")
+
+	if path == "" {
+		if summary {
+			h.writeDefinition(w, h.defs.Summary())
+			return
+		}
+		h.writeDefinition(w, h.defs)
+		return
+	}
+
+	if svc, ok := h.serviceDefinition(path); ok {
+		if summary {
+			h.writeDefinition(w, svc.Summary())
+			return
+		}
+		h.writeDefinition(w, svc)
+		return
+	}
+
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("service %s not found", path))
+		return
+	}
+	if i == 0 || i == len(path)-1 || strings.Count(path, "/") > 2 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("invalid path: %s", r.URL.Path))
+		return
+	}
+	service, operation := path[:i], path[i+1:]
+
+	op, ok := h.operationDefinition(service, operation)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("operation %s not found for service %s", operation, service))
+		return
+	}
+
+	h.writeDefinition(w, op)
+}
+
+// InputSchema returns the JSON schema of the input of an operation, where the
+// service is prefixed by its version if it's versioned. It returns false if
+// the operation isn't registered, and a nil schema if the operation doesn't
+// take an input. If schema definitions are shared across operations, the
+// schema includes them so that its references resolve on its own.
+func (h *Handler) InputSchema(service, operation string) (*jsonschema.Schema, bool) {
+	op, ok := h.operationDefinition(service, operation)
+	if !ok || op.RequestBody == nil {
+		return nil, ok
+	}
+	return h.standaloneSchema(op.RequestBody.Schema), true
+}
+
+// standaloneSchema returns a copy of an operation's schema
+// including any shared definitions it may reference.
+func (h *Handler) standaloneSchema(schema jsonschema.Schema) *jsonschema.Schema {
+	if len(h.defs.Defs) > 0 && schema.Definitions == nil {
+		schema.Definitions = h.defs.Defs
+	}
+	return &schema
+}
+
+// serveSchema serves GET {prefix}/schema/{service}/{operation} with the JSON
+// schema of the operation's input, or of its result with ?response=true,
+// so that clients don't need to fetch the definitions of every service.
+func (h *Handler) serveSchema(w http.ResponseWriter, r *http.Request) {
+	response, _ := strconv.ParseBool(r.URL.Query().Get("response"))
+	path := strings.TrimPrefix(r.URL.Path, h.metaPath("schema")+"/")
+
+	i := strings.LastIndex(path, "/")
+	if i <= 0 || i == len(path)-1 || strings.Count(path, "/") > 2 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("invalid path: %s", r.URL.Path))
+		return
+	}
+	service, operation := path[:i], path[i+1:]
+
+	op, ok := h.operationDefinition(service, operation)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("operation %s not found for service %s", operation, service))
+		return
+	}
+
+	if response {
+		res, ok := op.ResponseBody["200"]
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("operation %s for service %s has no response schema", operation, service))
+			return
+		}
+		h.writeDefinition(w, h.standaloneSchema(res))
+		return
+	}
+
+	if op.RequestBody == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("operation %s for service %s has no input", operation, service))
+		return
+	}
+
+	h.writeDefinition(w, h.standaloneSchema(op.RequestBody.Schema))
+}
+
+// writeDefinition writes a definition served by the discovery endpoints.
+func (h *Handler) writeDefinition(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", jsonContentType)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		h.logger.Error("error marshalling definitions", "error", err)
+		_, _ = w.Write([]byte(err.Error()))
+	}
+}
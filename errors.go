@@ -0,0 +1,132 @@
+package ops
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/common-fate/ops/protocol"
+)
+
+// Error is an error carrying the protocol.ResponseCode which
+// should be returned to the caller.
+//
+// Operations may return an *Error to control the response code,
+// for example:
+//
+//	return nil, &ops.Error{Code: protocol.CodeNotFound, Err: err}
+//
+// Other errors returned by operations are mapped to a code by
+// Registry.ErrorMapper if it's set, and are otherwise reported
+// as protocol.CodeServerError.
+type Error struct {
+	Code protocol.ResponseCode
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// operationError converts an error returned by an operation into an *Error,
+// preserving the code if one was set by the operation, or otherwise
+// using the code from the error mapper if it's set and returns one.
+func operationError(err error, mapper func(error) protocol.ResponseCode) error {
+	var opErr *Error
+	if errors.As(err, &opErr) {
+		return err
+	}
+	if mapper != nil {
+		if code := mapper(err); code != protocol.CodeOK {
+			return &Error{Code: code, Err: err}
+		}
+	}
+	return &Error{Code: protocol.CodeServerError, Err: err}
+}
+
+// errorCode returns the response code for an error returned from Call.
+func errorCode(err error) protocol.ResponseCode {
+	var opErr *Error
+	if errors.As(err, &opErr) {
+		return opErr.Code
+	}
+	return protocol.CodeBadRequest
+}
+
+// httpStatus maps a response code to the equivalent HTTP status code.
+func httpStatus(code protocol.ResponseCode) int {
+	switch code {
+	case protocol.CodeOK:
+		return http.StatusOK
+	case protocol.CodeBadRequest:
+		return http.StatusBadRequest
+	case protocol.CodeNotFound:
+		return http.StatusNotFound
+	case protocol.CodeUnauthorized:
+		return http.StatusUnauthorized
+	case protocol.CodeTimeout:
+		return http.StatusGatewayTimeout
+	case protocol.CodeTooManyRequests:
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// ErrorResponse is the body of error responses served over HTTP, so that
+// clients can handle errors without parsing their messages:
+//
+//	{"code": "CodeNotFound", "message": "operation Foo not found for service example"}
+//
+// Code is the name of the protocol.ResponseCode of the error, as returned by
+// its String method. Details are set for some errors, such as the fields of a
+// ValidationError, which can be unmarshalled into a ValidationError.
+// Successful responses are the operation's result, without an envelope.
+// Errors reported by the tunnel, such as when a connection is serving
+// too many requests, have the same body.
+type ErrorResponse = protocol.ErrorResponse
+
+// responseCode maps an HTTP status code to the equivalent response code,
+// for errors which are reported by the handler rather than by Call.
+func responseCode(status int) protocol.ResponseCode {
+	switch {
+	case status == http.StatusNotFound:
+		return protocol.CodeNotFound
+	case status == http.StatusUnauthorized:
+		return protocol.CodeUnauthorized
+	case status == http.StatusGatewayTimeout:
+		return protocol.CodeTimeout
+	case status == http.StatusTooManyRequests:
+		return protocol.CodeTooManyRequests
+	case status >= 500:
+		return protocol.CodeServerError
+	default:
+		return protocol.CodeBadRequest
+	}
+}
+
+// writeError writes an ErrorResponse with the HTTP status, and the equivalent response code.
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeErrorResponse(w, status, responseCode(status), err)
+}
+
+// writeCallError writes an ErrorResponse for an error returned by Call.
+func writeCallError(w http.ResponseWriter, err error) {
+	code := errorCode(err)
+	writeErrorResponse(w, httpStatus(code), code, err)
+}
+
+func writeErrorResponse(w http.ResponseWriter, status int, code protocol.ResponseCode, err error) {
+	res := &ErrorResponse{Code: code.String(), Message: err.Error()}
+
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		res.Details, _ = json.Marshal(verr)
+	}
+
+	protocol.WriteErrorResponse(w, status, res)
+}
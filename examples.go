@@ -0,0 +1,68 @@
+package ops
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// operationExamples encodes the RequestExample and ResponseExample of an operation
+// for its definition, checking that they match the operation's input and result types.
+// Examples are encoded with encoding/json, using the names of fields on the wire.
+func operationExamples(meta OperationMetadata, extract extractMethodsResult, naming FieldNaming) (request, response json.RawMessage, err error) {
+	if meta.RequestExample != nil {
+		if extract.InputType == nil {
+			return nil, nil, errors.New("the operation has a RequestExample, but doesn't take an input")
+		}
+		request, err = encodeExample("RequestExample", meta.RequestExample, *extract.InputType, naming)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if meta.ResponseExample != nil {
+		switch {
+		case extract.RawResponse:
+			return nil, nil, errors.New("the operation has a ResponseExample, but returns a RawResponse, which can't be described by an example")
+		case extract.ResultsType != nil:
+			return nil, nil, errors.New("the operation has a ResponseExample, but returns several values, which can't be described by an example")
+		case extract.ResponseType == nil:
+			return nil, nil, errors.New("the operation has a ResponseExample, but doesn't return a value")
+		}
+		response, err = encodeExample("ResponseExample", meta.ResponseExample, extract.ResponseType, naming)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return request, response, nil
+}
+
+// encodeExample encodes an example of type t, or of a pointer to t.
+func encodeExample(name string, example any, t reflect.Type, naming FieldNaming) (json.RawMessage, error) {
+	et := reflect.TypeOf(example)
+	if et.Kind() == reflect.Pointer && et.Elem() == t {
+		et = et.Elem()
+	}
+	if t.Kind() == reflect.Pointer && et == t.Elem() {
+		et = t
+	}
+	if et != t {
+		return nil, fmt.Errorf("the %s must be a %s, got %T", name, t, example)
+	}
+
+	b, err := json.Marshal(example)
+	if err != nil {
+		return nil, fmt.Errorf("encoding the %s: %w", name, err)
+	}
+
+	if naming != nil {
+		b, err = naming.transform(t, b, true)
+		if err != nil {
+			return nil, fmt.Errorf("encoding the %s: %w", name, err)
+		}
+	}
+
+	return b, nil
+}
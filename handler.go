@@ -4,18 +4,29 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"reflect"
+	"runtime/debug"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/common-fate/ops/protocol"
 	"github.com/common-fate/ops/servicedef"
 	"github.com/common-fate/ops/tunnel"
+	"github.com/go-playground/validator/v10"
 	"github.com/invopop/jsonschema"
 	"github.com/quic-go/quic-go"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
 type ResourceHandler[R any] struct {
@@ -23,39 +34,355 @@ type ResourceHandler[R any] struct {
 }
 
 type Registry struct {
-	services  []any
-	resources []any
+	// ValidateInputs enables validation of operation inputs
+	// using `validate:"..."` struct tags from github.com/go-playground/validator.
+	// Inputs are validated after being decoded and before the operation is called.
+	ValidateInputs bool
+
+	// FieldNaming, if set, is applied to the names of struct fields
+	// without a `json` tag in operation inputs and results. See CamelCase and SnakeCase.
+	FieldNaming FieldNaming
+
+	// ShareSchemaDefinitions moves the $defs of the schemas of operations
+	// and resources into a single $defs section of the definitions, so that
+	// types used by many operations are only defined once. See
+	// servicedef.Definitions.ShareDefinitions.
+	ShareSchemaDefinitions bool
+
+	// SchemaReflector, if set, is used to reflect the JSON schemas of
+	// operation inputs, results and resources, for example to set
+	// ExpandedStruct or DoNotReference. It's copied rather than modified,
+	// and FieldNaming is applied unless the reflector sets its own KeyNamer.
+	// If nil, schemas are reflected with the jsonschema package defaults.
+	SchemaReflector *jsonschema.Reflector
+
+	// InputValidator, if set, is called with each decoded operation input
+	// after any struct tag validation and before the operation is called.
+	InputValidator InputValidator
+
+	// Authorizer checks the Scopes of operations before they are called.
+	// It must be set if any operation requires scopes.
+	Authorizer Authorizer
+
+	// TenantResolver, if set, is called for each call made without a tenant in
+	// its context, to set the tenant the call is made on behalf of, before any
+	// middleware runs. It applies to every call, including calls served over
+	// a tunnel by Start. See TenantFromMetadata and WithTenant.
+	TenantResolver TenantResolver
+
+	// TracerProvider is used to start a span named service/operation for every
+	// call, defaulting to the global OpenTelemetry tracer provider. Tracing is a
+	// no-op unless a tracer provider is configured. W3C trace context headers
+	// of HTTP requests are used as the parent of the span.
+	TracerProvider trace.TracerProvider
+
+	// MetaPathPrefix is the path prefix of the discovery and health endpoints,
+	// such as GET {prefix}/operations, defaulting to DefaultMetaPathPrefix.
+	// Operations are never routed under the prefix, and Build returns an
+	// error if a service ID collides with it.
+	MetaPathPrefix string
+
+	// Logger is used to log requests and errors, defaulting to slog.Default().
+	// It is replaced by StartOpts.Logger, if set, when serving over a tunnel,
+	// and is otherwise used by the tunnel too.
+	Logger *slog.Logger
+
+	// AccessLog enables logging each operation request served over HTTP, with
+	// its service, operation, duration, HTTP status and response size, at
+	// AccessLogLevel. Requests to the discovery and health endpoints aren't
+	// logged. Requests aren't logged by default.
+	AccessLog bool
+	// AccessLogLevel is the level of the access log, defaulting
+	// to slog.LevelInfo. It's ignored unless AccessLog is set.
+	AccessLogLevel slog.Level
+
+	// Codec encodes operation inputs and results, defaulting to JSONCodec.
+	Codec Codec
+
+	// IdempotencyStore stores the results of calls to idempotent operations,
+	// defaulting to a MemoryIdempotencyStore with DefaultIdempotencyTTL.
+	IdempotencyStore IdempotencyStore
+
+	// MaxRequestBytes limits the size of request bodies served over HTTP,
+	// after they're decompressed, defaulting to DefaultMaxRequestBytes.
+	// Larger requests are rejected with 413 Request Entity Too Large.
+	// Set a negative value to allow bodies of any size. Operations
+	// which stream their input aren't limited.
+	MaxRequestBytes int64
+
+	// BatchConcurrency is the number of calls in a batch request which
+	// may run at once. Calls run sequentially if it is zero or one.
+	BatchConcurrency int
+
+	// BatchOKOnSuccess makes batch requests respond with 200 OK rather
+	// than 207 Multi-Status when every call in the batch succeeds.
+	BatchOKOnSuccess bool
+
+	// JSONRPC enables calling operations with JSON-RPC 2.0 requests to
+	// POST {prefix}/jsonrpc, alongside the path based routes. The method of a
+	// request is the service and operation separated by a dot, e.g. example.Foo,
+	// and its params are the operation's input. Arrays of requests are batched.
+	JSONRPC bool
+
+	// WarnResponseBytes and WarnDuration, if set, log a warning for calls
+	// which return an encoded result larger than WarnResponseBytes, or whose
+	// method takes longer than WarnDuration to return, to find operations
+	// which need pagination or optimisation. Calls aren't otherwise affected.
+	WarnResponseBytes int64
+	WarnDuration      time.Duration
+
+	// CLINameFunc, if set, derives the CLIName of each service and operation
+	// in the definitions from its ID, for example with KebabCase, so that
+	// clients generated from the definitions don't use Go naming conventions.
+	// CLINames are left empty if it isn't set.
+	CLINameFunc func(id string) string
+
+	// PartialBuild makes Build skip services and operations which fail to
+	// build, rather than failing, so that one bad service doesn't prevent the
+	// others from being served. The failures are returned by Handler.BuildErrors.
+	// Errors in the registry's own configuration still fail the build.
+	PartialBuild bool
+
+	// Compression, if set, enables compression of request and
+	// response bodies served over HTTP. See Compression.
+	Compression *Compression
+
+	// ErrorMapper, if set, maps the errors returned by operations to the
+	// response code returned to the caller, for example:
+	//
+	//	func(err error) protocol.ResponseCode {
+	//		if errors.Is(err, ErrNotFound) {
+	//			return protocol.CodeNotFound
+	//		}
+	//		return protocol.CodeServerError
+	//	}
+	//
+	// It isn't called for an *Error, whose Code is used as-is.
+	// If it returns protocol.CodeOK, protocol.CodeServerError is used.
+	ErrorMapper func(error) protocol.ResponseCode
+
+	// MetadataHeaders lists the HTTP request headers, such as "X-Request-Id",
+	// which are exposed to operations by MetadataFromContext. Other headers
+	// can be read by operations taking an *http.Request.
+	MetadataHeaders []string
+
+	// ContentTypeCheck controls whether requests served over HTTP must
+	// declare a JSON Content-Type. Requests which fail the check are
+	// rejected with 400 Bad Request. Defaults to ContentTypeUnchecked.
+	ContentTypeCheck ContentTypeCheck
+
+	// mu guards registrations against Handler building the registry.
+	mu         sync.Mutex
+	services   []registration
+	operations []operationRegistration
+	resources  []Resource
+	middleware []Middleware
+
+	handlerOnce sync.Once
+	handler     *Handler
+	handlerErr  error
+	// lateErrs are the registrations made after Handler built the registry.
+	lateErrs []error
 }
 
 type function struct {
 	method    reflect.Value
 	inputType *reflect.Type
+	// inputPointer is true if method takes a pointer to inputType.
+	inputPointer bool
+	// params describes how each argument to method
+	// is constructed when the function is called.
+	params []paramKind
+	// returnsValue is true if the first return value
+	// of method is the operation's result.
+	returnsValue bool
+	// returnsError is true if the last return value
+	// of method is an error.
+	returnsError bool
+	// tenantScoped is true if a tenant must be present
+	// in the context for the function to be called.
+	tenantScoped bool
+	// subscription is true if method returns a Subscription.
+	subscription bool
+	// timeout is applied to the context passed to method, if set.
+	timeout time.Duration
+	// inputStream is true if the input is a stream of NDJSON records.
+	inputStream bool
+	// frameTimeout bounds each record read from an input stream
+	// and each event written to a subscription, if set.
+	frameTimeout time.Duration
+	// checksum is true if request and response bodies are checksummed.
+	checksum bool
+	// resource is loaded and passed to method, if set, using
+	// the ID in the input field at resourceIDField.
+	resource        Resource
+	resourceIDField []int
+	// limiter is nil if the operation isn't rate limited.
+	limiter *rate.Limiter
+	// breaker is nil if the operation doesn't have a circuit breaker.
+	breaker *breaker
+	// idempotent is true if results are stored per idempotency key.
+	idempotent bool
+	// parameters are bound from the URL path, in order. See WithParameters.
+	parameters []parameter
+	// defaults are set on the input before it's decoded. See defaultTag.
+	defaults []fieldDefault
+	// deprecated is true if responses include a Deprecation header,
+	// with a Warning header if deprecationMessage is set.
+	deprecated         bool
+	deprecationMessage string
+	// scopes are checked by the handler's authorizer, if there are any.
+	scopes []string
+	// rawResponse is true if method returns a RawResponse.
+	rawResponse bool
+	// resultsType is set if method returns several values,
+	// which are packaged into a single result. See resultsType.
+	resultsType reflect.Type
+	// retryable is true if error responses include a
+	// Retry-After header of retryAfter, where the error allows it.
+	retryable  bool
+	retryAfter time.Duration
+	// strictInput is true if inputs with unknown fields are rejected.
+	strictInput bool
+	// bidirectional is true if the input is a stream of frames and the
+	// method sends its outputs on a channel of outputType. See openBidirectional.
+	bidirectional bool
+	outputType    reflect.Type
 }
 
+type paramKind int
+
+const (
+	paramContext paramKind = iota
+	paramInput
+	paramRequest
+	paramInputStream
+	paramResource
+	paramParameter
+	paramOutputStream
+)
+
+// Handler serves the operations of a built Registry.
+//
+// A Handler is safe for concurrent use by multiple goroutines: its routes and
+// the parsed signatures of its operations are only written by Build, and each
+// call decodes its input into a freshly allocated value. The state shared
+// between calls, such as the idempotency store, rate limiters and readiness,
+// is synchronized. Operations must themselves be safe for concurrent use, as
+// the same service value serves every call.
 type Handler struct {
 	// map service -> operation -> Go function
 	routes map[string]map[string]function
 
 	defs servicedef.Definitions
+
+	// validate is nil if input validation is disabled.
+	validate *validator.Validate
+
+	// inputValidator is nil if no custom validator is registered.
+	inputValidator InputValidator
+
+	// authorizer is nil if no operations require scopes.
+	authorizer Authorizer
+
+	// warnResponseBytes and warnDuration are disabled if zero.
+	warnResponseBytes int64
+	warnDuration      time.Duration
+
+	// buildErrs are the services and operations skipped by a partial build.
+	buildErrs []error
+
+	// lifecycles are the services implementing Lifecycle, in registration order.
+	lifecycles []lifecycleService
+
+	// fieldNaming is nil if Go field names are used as-is.
+	fieldNaming FieldNaming
+
+	// invoke dispatches a call through the
+	// middleware chain to the operation.
+	invoke Invoker
+
+	// notReady is true while the tunnel serving the handler is
+	// disconnected. See SetReady. It isn't shared with forTunnel.
+	notReady *atomic.Bool
+
+	tracer trace.Tracer
+
+	// metaPrefix is the path prefix of the discovery and health endpoints.
+	metaPrefix string
+
+	// compression is nil if compression is disabled.
+	compression *Compression
+
+	contentTypeCheck ContentTypeCheck
+
+	errorMapper func(error) protocol.ResponseCode
+
+	// metadataHeaders are added to the context of each call served over HTTP.
+	metadataHeaders []string
+
+	codec Codec
+
+	idempotencyStore IdempotencyStore
+	idempotent       *idempotentCalls
+
+	// maxRequestBytes is negative if request bodies aren't limited.
+	maxRequestBytes int64
+
+	// batchConcurrency is the number of batched calls which may run at once.
+	batchConcurrency int
+	// batchOKOnSuccess is true if fully successful batches respond with 200.
+	batchOKOnSuccess bool
+	// jsonrpc is true if JSON-RPC requests are served.
+	jsonrpc bool
+
+	logger *slog.Logger
+	// accessLog is true if each HTTP request is logged at accessLogLevel.
+	accessLog      bool
+	accessLogLevel slog.Level
 }
 
 func New() *Registry {
 	return &Registry{}
 }
 
-type ResourceSchema[R any] struct{}
+type ResourceSchema[R any] struct {
+	loader ResourceLoader[R]
+}
 
 func (r ResourceSchema[R]) resourceType() {
 
 }
 
+// goType returns the type of the argument which
+// operations declare to have the resource loaded.
+func (r ResourceSchema[R]) goType() reflect.Type {
+	return reflect.TypeOf((*R)(nil))
+}
+
+func (r ResourceSchema[R]) load(ctx context.Context, id string) (reflect.Value, bool, error) {
+	if r.loader == nil {
+		return reflect.Value{}, false, fmt.Errorf("no loader was provided for resource %s", r.goType().Elem())
+	}
+
+	res, err := r.loader.Load(ctx, id)
+	if err != nil || res == nil {
+		return reflect.Value{}, false, err
+	}
+
+	return reflect.ValueOf(res), true, nil
+}
+
 // Use ops.NewResource() to construct a resource.
 type Resource interface {
 	resourceType()
+	goType() reflect.Type
+	// load returns false if the resource wasn't found.
+	load(ctx context.Context, id string) (reflect.Value, bool, error)
 }
 
 func NewResource[R any](loader ResourceLoader[R]) *ResourceSchema[R] {
-	r := new(ResourceSchema[R])
+	r := &ResourceSchema[R]{loader: loader}
 	return r
 }
 
@@ -64,68 +391,598 @@ type ResourceLoader[R any] interface {
 }
 
 type ServiceMetadata struct {
-	ID                string
-	DisplayName       string
-	Description       string
+	ID          string
+	DisplayName string
+	Description string
+	// TenantScoped requires a tenant to be present in the context
+	// for every operation in the service, unless the operation
+	// is marked as TenantAgnostic.
+	TenantScoped      bool
 	OperationMetadata map[string]OperationMetadata
+	// Version, if set, is a path segment such as "v2" which prefixes the
+	// path of the service's operations, as in /v2/billing/CreateInvoice.
+	// Versioned services are called by their path, such as "v2/billing",
+	// so that several versions of a service can be registered with the
+	// same ID. See servicedef.Service.Path.
+	Version string
 }
 
 type OperationMetadata struct {
 	Description string
+	// TenantScoped requires a tenant to be present in the context
+	// when the operation is called. See WithTenant.
+	TenantScoped bool
+	// TenantAgnostic exempts the operation from
+	// the service's TenantScoped requirement.
+	TenantAgnostic bool
+	// Timeout is applied to the context passed to the operation, if set.
+	// Operations which return after the timeout result in protocol.CodeTimeout.
+	// If the caller sets a sooner deadline it applies instead, see RequestTimeoutHeader.
+	Timeout time.Duration
+	// FrameTimeout bounds how long the handler waits for the peer while
+	// reading each record of a streamed input, or while writing each event
+	// of a subscription, so that a stalled peer can't hang a stream forever.
+	// It doesn't bound the time spent waiting for the operation to send the
+	// next event. See ErrFrameTimeout.
+	//
+	// If FrameTimeout is zero, frames wait on the peer indefinitely, and
+	// the stream is only ended by Timeout or by the request's context.
+	FrameTimeout time.Duration
+	// Checksum requires HTTP callers to send a checksum of the request body,
+	// and adds a checksum of the response body to the response.
+	// See ChecksumHeader.
+	Checksum bool
+	// RoutingRule describes how a gateway consuming the service definitions
+	// should route external requests to the operation, for example:
+	//
+	//	RoutingRule: servicedef.RoutingRule{Type: "http", Method: "GET", Path: "/users/{id}"}
+	//
+	// If it isn't set, the operation is routed with a POST to /{service}/{operation},
+	// prefixed by the service's Version if set. The rule is only published in the
+	// definitions: the handler itself always serves operations at that path.
+	RoutingRule servicedef.RoutingRule
+	// RateLimit is the number of calls per second allowed to the operation,
+	// shared by all callers. Calls over the limit fail with
+	// protocol.CodeTooManyRequests. Calls which fail the tenant or scope
+	// checks aren't counted. If it is zero, calls aren't rate limited.
+	RateLimit rate.Limit
+	// RateLimitBurst is the number of calls allowed at once before the rate
+	// limit applies, defaulting to RateLimit rounded up to a whole number.
+	RateLimitBurst int
+	// Parameters names the scalar parameters of the operation which are
+	// bound from the URL path, in order. See WithParameters.
+	Parameters []string
+	// Idempotent operations are only executed once per idempotency key.
+	// See IdempotencyKeyHeader.
+	Idempotent bool
+	// Deprecated operations are marked as deprecated in the definitions, and
+	// responses to them served over HTTP include a Deprecation header, and a
+	// Warning header with the DeprecationMessage if it's set.
+	Deprecated         bool
+	DeprecationMessage string
+	// Retryable operations are safe to call again if they fail with
+	// protocol.CodeServerError, CodeTimeout or CodeTooManyRequests, in which
+	// case responses served over HTTP include a Retry-After header of
+	// RetryAfter, defaulting to DefaultRetryAfter. Operations aren't
+	// retryable unless this is set.
+	Retryable  bool
+	RetryAfter time.Duration
+	// Scopes are required of the caller to call the operation, and are
+	// checked by Registry.Authorizer before the operation is called.
+	Scopes []string
+	// Hidden excludes a method from registration, so that exported helper
+	// methods, including those promoted from embedded structs, aren't served
+	// as operations. Hidden methods may have any signature.
+	Hidden bool
+	// StrictInput rejects inputs containing fields which don't match a field
+	// of the input type with protocol.CodeBadRequest, rather than silently
+	// dropping them. Strict inputs are decoded with encoding/json regardless
+	// of Registry.Codec. The records of input streams aren't affected.
+	// To reject unknown fields for every operation, see JSONCodec.
+	StrictInput bool
+	// CircuitBreaker, if set, stops calling the operation for a cooldown
+	// period once it keeps failing. See CircuitBreaker.
+	CircuitBreaker *CircuitBreaker
+	// RequestExample and ResponseExample are example values of the operation's
+	// input and result types, or pointers to them, which are published in the
+	// definitions for documentation and generated clients. For subscriptions
+	// the ResponseExample is an event. Build fails if an example doesn't
+	// have the type of the input or result.
+	RequestExample  any
+	ResponseExample any
+}
+
+// tenantScoped returns whether a tenant is required to call an operation.
+func tenantScoped(meta ServiceMetadata, opMeta OperationMetadata) bool {
+	if opMeta.TenantAgnostic {
+		return false
+	}
+	return meta.TenantScoped || opMeta.TenantScoped
 }
 
 type ServiceWithMetadata interface {
 	Metadata() ServiceMetadata
 }
 
+// registration is a service passed to Register or RegisterAs.
+type registration struct {
+	service any
+	// id overrides the service ID, if set.
+	id string
+}
+
+// operationRegistration is a function registered with RegisterOperation.
+type operationRegistration struct {
+	service   string
+	operation string
+	fn        any
+}
+
+// Register registers the exported methods of a service as operations.
+//
+// Methods promoted from embedded structs are registered as operations of the
+// service, so services can be composed from shared building blocks:
+//
+//	type BaseService struct{}
+//
+//	func (BaseService) Health(ctx context.Context) error { return nil }
+//
+//	type Billing struct {
+//		BaseService
+//	}
+//
+// Methods can be excluded from registration by setting Hidden in their
+// OperationMetadata.
 func (h *Registry) Register(service any) {
-	h.services = append(h.services, service)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.registeredAfterBuild(fmt.Sprintf("Register(%T)", service)) {
+		return
+	}
+	h.services = append(h.services, registration{service: service})
+}
+
+// RegisterAs registers a service under an explicit ID, overriding the ID from
+// the service's Metadata or type name. This allows the same service type to be
+// registered multiple times with different state, for example one per tenant:
+//
+//	h.RegisterAs("billing-acme", &BillingService{Tenant: "acme"})
+//	h.RegisterAs("billing-globex", &BillingService{Tenant: "globex"})
+func (h *Registry) RegisterAs(id string, service any) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.registeredAfterBuild(fmt.Sprintf("RegisterAs(%q, %T)", id, service)) {
+		return
+	}
+	h.services = append(h.services, registration{service: service, id: id})
 }
 
-// Register a new resource.
+// RegisterOperation registers a function as an operation, without defining a service struct:
+//
+//	h.RegisterOperation("math", "Add", func(ctx context.Context, in AddInput) (AddResult, error) {
+//		return AddResult{Sum: in.A + in.B}, nil
+//	})
+//
+// The function may have any signature supported for service methods. If a service
+// with the ID has been registered with Register, the operation is added to it,
+// otherwise a service is defined with the operations registered for it.
+func (h *Registry) RegisterOperation(service string, operation string, fn any) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.registeredAfterBuild(fmt.Sprintf("RegisterOperation(%q, %q)", service, operation)) {
+		return
+	}
+	h.operations = append(h.operations, operationRegistration{service: service, operation: operation, fn: fn})
+}
+
+// Register a new resource. Operations which take a pointer to the
+// resource type have the resource loaded before they are called. See loadResource.
+// The resource's schema is included in the service definitions, identified by its type name.
 //
 // Example:
 //
 //	h.RegisterResource(ops.NewResource(customer))
 func (h *Registry) RegisterResource(r Resource) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.registeredAfterBuild(fmt.Sprintf("RegisterResource(%T)", r)) {
+		return
+	}
 	h.resources = append(h.resources, r)
 }
 
+// Handler builds the registry into a handler the first time it is called, and returns
+// the same handler on every later call. It is safe to call from multiple goroutines.
+// Use Handler rather than Build to serve the registry over HTTP:
+//
+//	h, err := registry.Handler()
+//	if err != nil {
+//		return err
+//	}
+//	http.ListenAndServe(":8080", h)
+//
+// Registrations made after the handler is built have no effect, so once a
+// service, resource or middleware has been registered late, Handler returns an error.
+func (h *Registry) Handler() (*Handler, error) {
+	h.handlerOnce.Do(func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.handler, h.handlerErr = h.Build()
+	})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.handlerErr != nil {
+		return nil, h.handlerErr
+	}
+	if len(h.lateErrs) > 0 {
+		return nil, errors.Join(h.lateErrs...)
+	}
+
+	return h.handler, nil
+}
+
+// registeredAfterBuild records an error and returns true if the handler has
+// already been built by Handler, in which case the registration has no effect.
+// h.mu must be held.
+func (h *Registry) registeredAfterBuild(call string) bool {
+	if h.handler == nil && h.handlerErr == nil {
+		return false
+	}
+	h.lateErrs = append(h.lateErrs, fmt.Errorf("%s was called after the handler was built by Registry.Handler and has no effect", call))
+	return true
+}
+
 func (h *Handler) ServiceDefinitions() servicedef.Definitions {
 	return h.defs
 }
 
+// Services returns the IDs of the registered services in order, with
+// versioned services identified by their path, such as "v2/billing".
+func (h *Handler) Services() []string {
+	services := make([]string, 0, len(h.defs.Services))
+	for _, svc := range h.defs.Services {
+		services = append(services, svc.Path())
+	}
+	return services
+}
+
+// Operations returns the IDs of the operations of a service in order.
+// It returns false if the service isn't registered.
+func (h *Handler) Operations(service string) ([]string, bool) {
+	for _, svc := range h.defs.Services {
+		if svc.Path() != service {
+			continue
+		}
+		ops := make([]string, 0, len(svc.Operations))
+		for _, op := range svc.Operations {
+			ops = append(ops, op.ID)
+		}
+		return ops, true
+	}
+	return nil, false
+}
+
+// BuildErrors returns the errors of the services and operations which
+// were skipped because they failed to build, if Registry.PartialBuild is set.
+func (h *Handler) BuildErrors() []error {
+	return h.buildErrs
+}
+
+// HasOperation returns whether an operation is registered on a service,
+// in which case it can be called with Call.
+func (h *Handler) HasOperation(service, operation string) bool {
+	_, ok := h.routes[service][operation]
+	return ok
+}
+
+// AssertCompatibleWith returns an error listing every breaking change
+// between the baseline definitions (for example, those of the previously
+// deployed version) and the definitions of the handler.
+func (h *Handler) AssertCompatibleWith(baseline servicedef.Definitions) error {
+	var errs []error
+
+	for _, c := range servicedef.Compare(baseline, h.defs) {
+		if c.Breaking {
+			errs = append(errs, errors.New(c.String()))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("service definitions are not compatible with the baseline: %w", errors.Join(errs...))
+	}
+
+	return nil
+}
+
+// Call invokes an operation on a service, running any
+// middleware registered with Registry.Use.
+// Each call is traced, see Registry.TracerProvider, and has a request ID,
+// which is generated unless the context has one. See WithRequestID.
+//
+// Operations which return a nil pointer, slice, map or interface with a nil
+// error succeed with the result null, regardless of the Codec.
 func (h *Handler) Call(ctx context.Context, service string, operation string, input json.RawMessage) ([]byte, error) {
+	ctx = ensureRequestID(ctx)
+	return h.traceCall(ctx, service, operation, input, h.invoke)
+}
+
+func (h *Handler) dispatch(ctx context.Context, service string, operation string, input json.RawMessage) ([]byte, error) {
 	svcroutes, ok := h.routes[service]
 	if !ok {
-		return nil, fmt.Errorf("service %s not found", service)
+		return nil, &Error{Code: protocol.CodeNotFound, Err: fmt.Errorf("service %s not found", service)}
 	}
 
 	function, ok := svcroutes[operation]
 	if !ok {
-		return nil, fmt.Errorf("operation %s not found for service %s", operation, service)
+		return nil, &Error{Code: protocol.CodeNotFound, Err: fmt.Errorf("operation %s not found for service %s", operation, service)}
+	}
+
+	if function.tenantScoped {
+		if _, ok := TenantFromContext(ctx); !ok {
+			return nil, &Error{Code: protocol.CodeUnauthorized, Err: fmt.Errorf("operation %s for service %s requires a tenant", operation, service)}
+		}
+	}
+
+	if err := h.authorize(ctx, service, operation, function); err != nil {
+		return nil, err
+	}
+
+	// the limit is checked once the call is authorized, so that
+	// unauthorized callers can't use up the limit of the operation.
+	if function.limiter != nil && !function.limiter.Allow() {
+		return nil, &Error{Code: protocol.CodeTooManyRequests, Err: fmt.Errorf("operation %s for service %s is rate limited", operation, service)}
+	}
+
+	call := func() ([]byte, error) {
+		return h.callFunction(ctx, service, operation, function, input)
+	}
+
+	if key, ok := IdempotencyKeyFromContext(ctx); ok && function.idempotent {
+		callFunction := call
+		call = func() ([]byte, error) {
+			return h.callIdempotent(ctx, service, operation, key, callFunction)
+		}
+	}
+
+	if function.breaker != nil {
+		return function.breaker.call(service, operation, call)
+	}
+
+	return call()
+}
+
+// callFunction decodes the input and calls the operation.
+func (h *Handler) callFunction(ctx context.Context, service string, operation string, function function, input json.RawMessage) ([]byte, error) {
+	if function.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, function.timeout, errOperationTimeout)
+		defer cancel()
+	}
+
+	var records reflect.Value
+	var stream *bidiStream
+
+	if function.bidirectional {
+		var err error
+		stream, ctx, err = openBidirectional(ctx, service, operation, function, h.codec)
+		if err != nil {
+			return nil, err
+		}
+		defer stream.cancel(nil)
+		records = stream.in
+	} else if function.inputStream {
+		var cancel context.CancelCauseFunc
+		records, ctx, cancel = streamInput(ctx, *function.inputType, input, function.frameTimeout, h.codec)
+		defer cancel(nil)
+	}
+
+	// inputValue is the decoded input, and inputArg is
+	// the input as it's passed to the method.
+	inputValue, inputArg, err := h.decodeInput(ctx, service, operation, function, input)
+	if err != nil {
+		return nil, err
 	}
 
 	var args []reflect.Value
+	var nextParameter int
 
-	args = append(args, reflect.ValueOf(ctx)) // TODO: ctx should not always be required
+	for _, p := range function.params {
+		switch p {
+		case paramParameter:
+			v, err := bindParameter(ctx, function.parameters[nextParameter])
+			if err != nil {
+				return nil, err
+			}
+			nextParameter++
+			args = append(args, v)
+
+		case paramContext:
+			args = append(args, reflect.ValueOf(ctx))
+
+		case paramInputStream:
+			args = append(args, records)
+
+		case paramOutputStream:
+			args = append(args, stream.outputArg(function.outputType))
+
+		case paramRequest:
+			req, ok := requestFromContext(ctx)
+			if !ok {
+				return nil, fmt.Errorf("operation %s for service %s requires an HTTP request and can't be called over this transport", operation, service)
+			}
+			args = append(args, reflect.ValueOf(req))
+
+		case paramResource:
+			res, err := loadResource(ctx, function, inputValue)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, res)
+
+		case paramInput:
+			args = append(args, inputArg)
+		}
+	}
+
+	if function.bidirectional {
+		stream.start()
+		output, err := h.callMethod(ctx, service, operation, function.method, args)
+		if err == nil {
+			_, err = h.operationResult(ctx, service, operation, function, output)
+		}
+		// the response has already been written, so the error is sent as its final frame.
+		stream.finish(err)
+		return nil, nil
+	}
 
-	if function.inputType != nil {
-		v := reflect.New(*function.inputType)
-		valInt := v.Interface()
+	start := time.Now()
+	output, err := h.callMethod(ctx, service, operation, function.method, args)
+	duration := time.Since(start)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := h.operationResult(ctx, service, operation, function, output)
+	h.checkThresholds(ctx, service, operation, len(res), duration)
+	return res, err
+}
+
+// decodeInput decodes and validates the input of an operation, returning the
+// decoded input and the input as it's passed to the method. Operations without
+// an input, or which stream their input, don't decode it, so they can be called
+// with an empty body.
+func (h *Handler) decodeInput(ctx context.Context, service string, operation string, function function, input json.RawMessage) (inputValue, inputArg reflect.Value, err error) {
+	if function.inputType == nil || function.inputStream {
+		return reflect.Value{}, reflect.Value{}, nil
+	}
+
+	v := reflect.New(*function.inputType)
+	applyDefaults(v.Elem(), function.defaults)
+	valInt := v.Interface()
+
+	raw := input
 
-		err := json.Unmarshal(input, &valInt)
+	if h.fieldNaming != nil {
+		input, err = h.fieldNaming.transform(*function.inputType, input, false)
 		if err != nil {
-			return nil, fmt.Errorf("error unmarshalling input: %w", err)
+			return reflect.Value{}, reflect.Value{}, h.unmarshalError(*function.inputType, err)
+		}
+	}
+
+	codec := h.codec
+	if function.strictInput {
+		codec = JSONCodec{DisallowUnknownFields: true}
+	}
+
+	if err := codec.Unmarshal(input, valInt); err != nil {
+		return reflect.Value{}, reflect.Value{}, h.unmarshalError(*function.inputType, err)
+	}
+
+	inputValue = v.Elem()
+	inputArg = inputValue
+	if function.inputPointer {
+		inputArg = v
+	}
+
+	if err := h.validateInput(inputValue); err != nil {
+		return reflect.Value{}, reflect.Value{}, err
+	}
+
+	if err := h.runInputValidator(ctx, ValidationRequest{
+		Service:   service,
+		Operation: operation,
+		Raw:       raw,
+		Input:     inputArg.Interface(),
+	}); err != nil {
+		return reflect.Value{}, reflect.Value{}, err
+	}
+
+	return inputValue, inputArg, nil
+}
+
+// operationResult returns the encoded result of
+// an operation from the return values of its method.
+func (h *Handler) operationResult(ctx context.Context, service string, operation string, function function, output []reflect.Value) ([]byte, error) {
+	if function.inputStream {
+		if err := streamError(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, deadlineError(ctx, service, operation, function)
+	}
+
+	if function.returnsError {
+		if errValue := output[len(output)-1]; !errValue.IsNil() {
+			return nil, operationError(errValue.Interface().(error), h.errorMapper)
+		}
+	}
+
+	if !function.returnsValue {
+		// the operation only reports success or failure,
+		// so there is no response body.
+		return nil, nil
+	}
+
+	if len(output) == 0 || !output[0].IsValid() {
+		return nil, &Error{Code: protocol.CodeServerError, Err: fmt.Errorf("operation %s for service %s didn't return a result", operation, service)}
+	}
+
+	result := output[0]
+	if function.resultsType != nil {
+		result = packResults(function.resultsType, output)
+	}
+
+	if function.subscription {
+		sub, ok := result.Interface().(subscription)
+		if !ok || result.IsNil() {
+			return nil, &Error{Code: protocol.CodeServerError, Err: fmt.Errorf("operation %s for service %s returned a nil subscription", operation, service)}
 		}
-		args = append(args, reflect.ValueOf(valInt).Elem())
+		return nil, serveSubscription(ctx, service, operation, sub, function.frameTimeout, h.codec)
+	}
+
+	if function.rawResponse {
+		return writeRawResponse(ctx, result), nil
+	}
+
+	if isNilValue(result) {
+		return []byte("null"), nil
 	}
 
-	output := function.method.Call(args)
-	result := output[0] // TODO: output should not always be required
 	msgValue := result.Interface()
 
-	return json.Marshal(msgValue)
+	res, err := h.codec.Marshal(msgValue)
+	if err != nil || h.fieldNaming == nil {
+		return res, err
+	}
+
+	return h.fieldNaming.transform(result.Type(), res, true)
+}
+
+// isNilValue returns whether v is a nil pointer, slice, map or interface.
+func isNilValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Slice, reflect.Map, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+// callMethod calls an operation's method, recovering from any panic so that a
+// failing operation doesn't take down the server. Panics are logged with their
+// stack trace and returned as a protocol.CodeServerError.
+func (h *Handler) callMethod(ctx context.Context, service string, operation string, method reflect.Value, args []reflect.Value) (output []reflect.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			h.logger.ErrorContext(ctx, "operation panicked", "service", service, "operation", operation, "panic", r, "stack", string(debug.Stack()))
+			err = &Error{Code: protocol.CodeServerError, Err: fmt.Errorf("operation %s for service %s panicked: %v", operation, service, r)}
+		}
+	}()
+
+	return method.Call(args), nil
 }
 
 func (r *Registry) Build() (*Handler, error) {
@@ -133,79 +990,343 @@ func (r *Registry) Build() (*Handler, error) {
 		routes: map[string]map[string]function{},
 	}
 
-	for _, svc := range r.services {
-		v := reflect.ValueOf(svc)
+	if r.ValidateInputs {
+		h.validate = newValidator(r.FieldNaming)
+	}
 
-		if v.Kind() != reflect.Pointer {
-			return nil, fmt.Errorf("received a struct that wasn't a pointer for %T: ensure that you call Register() with the address of the struct, e.g. Register(&MyService{})", svc)
-		}
+	h.fieldNaming = r.FieldNaming
+	h.inputValidator = r.InputValidator
+	h.authorizer = r.Authorizer
+	h.tracer = tracer(r.TracerProvider)
+	h.metaPrefix = metaPathPrefix(r.MetaPathPrefix)
+	h.compression = r.Compression.withDefaults()
+	h.contentTypeCheck = r.ContentTypeCheck
+	h.metadataHeaders = r.MetadataHeaders
+	h.errorMapper = r.ErrorMapper
+
+	h.codec = r.Codec
+	if h.codec == nil {
+		h.codec = JSONCodec{}
+	}
+
+	h.logger = r.Logger
+	if h.logger == nil {
+		h.logger = slog.Default()
+	}
+	h.logger = withRequestIDLogging(h.logger)
+	h.accessLog = r.AccessLog
+	h.accessLogLevel = r.AccessLogLevel
+	h.batchConcurrency = r.BatchConcurrency
+	h.batchOKOnSuccess = r.BatchOKOnSuccess
+	h.jsonrpc = r.JSONRPC
+	h.warnResponseBytes = r.WarnResponseBytes
+	h.warnDuration = r.WarnDuration
+
+	h.maxRequestBytes = r.MaxRequestBytes
+	if h.maxRequestBytes == 0 {
+		h.maxRequestBytes = DefaultMaxRequestBytes
+	}
+
+	h.idempotencyStore = r.IdempotencyStore
+	if h.idempotencyStore == nil {
+		h.idempotencyStore = NewMemoryIdempotencyStore(DefaultIdempotencyTTL)
+	}
+	h.idempotent = &idempotentCalls{inflight: map[string]chan struct{}{}}
+	h.notReady = &atomic.Bool{}
+
+	h.invoke = chain(h.dispatch, r.middleware)
+	if r.TenantResolver != nil {
+		h.invoke = resolveTenant(r.TenantResolver, h.invoke)
+	}
 
-		tt := reflect.TypeOf(svc)
+	if err := r.addRegistrations(&h, r.PartialBuild); err != nil {
+		return nil, err
+	}
+
+	return &h, nil
+}
 
-		sdef := servicedef.Service{
-			ID: v.Elem().Type().Name(),
+// Validate checks the registered services, operations and resources without building a
+// handler, returning an error describing every problem which would fail Build, such as
+// unsupported operation signatures, IDs which have already been registered, operations
+// requiring scopes without an Authorizer, and schema definitions which can't be shared.
+// PartialBuild is ignored, so that registrations which a partial build would skip are
+// reported. It's intended for tests and CI checks:
+//
+//	func TestServicesValid(t *testing.T) {
+//		if err := newRegistry().Validate(); err != nil {
+//			t.Fatal(err)
+//		}
+//	}
+func (r *Registry) Validate() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	h := Handler{
+		routes:     map[string]map[string]function{},
+		authorizer: r.Authorizer,
+		metaPrefix: metaPathPrefix(r.MetaPathPrefix),
+	}
+
+	return r.addRegistrations(&h, false)
+}
+
+// addRegistrations adds the registered resources, services and operations to the
+// handler along with their definitions, and runs the checks made by Build, returning
+// every problem found. If partial is set, services and operations which can't be added
+// are skipped and recorded in h.buildErrs rather than returned.
+func (r *Registry) addRegistrations(h *Handler, partial bool) error {
+	schemas := newSchemaCache(r.FieldNaming, r.SchemaReflector)
+
+	var errs []error
+
+	resources := map[reflect.Type]Resource{}
+	for _, res := range r.resources {
+		t := res.goType()
+		if _, exists := resources[t]; exists {
+			errs = append(errs, fmt.Errorf("the resource %s has already been registered", t.Elem()))
+			continue
 		}
+		resources[t] = res
 
-		var meta ServiceMetadata
+		h.defs.Resources = append(h.defs.Resources, servicedef.Resource{
+			ID:     t.Elem().Name(),
+			Schema: servicedef.RootSchema{Schema: *schemas.reflect(t.Elem())},
+		})
+	}
 
-		if metasrv, ok := svc.(ServiceWithMetadata); ok {
-			meta = metasrv.Metadata()
+	// signature errors are collected so that
+	// every problem is reported at once.
+	var sigErrs []error
+
+	for _, reg := range r.services {
+		serviceSigErrs, err := h.addService(reg, schemas, resources)
+		switch {
+		case err != nil && partial:
+			h.buildErrs = append(h.buildErrs, err)
+		case err != nil:
+			errs = append(errs, err)
+		case len(serviceSigErrs) > 0 && partial:
+			h.buildErrs = append(h.buildErrs, fmt.Errorf("unsupported operation signatures:\n%w", errors.Join(serviceSigErrs...)))
+		default:
+			sigErrs = append(sigErrs, serviceSigErrs...)
+		}
+	}
 
-			sdef = servicedef.Service{
-				ID:          meta.ID,
-				Name:        meta.DisplayName,
-				Description: meta.Description,
+	for _, reg := range r.operations {
+		if err := h.addOperation(reg, schemas, resources); err != nil {
+			err = fmt.Errorf("%s.%s: %w", reg.service, reg.operation, err)
+			if partial {
+				h.buildErrs = append(h.buildErrs, err)
+				continue
 			}
+			sigErrs = append(sigErrs, err)
 		}
+	}
+
+	if len(sigErrs) > 0 {
+		errs = append(errs, fmt.Errorf("unsupported operation signatures:\n%w", errors.Join(sigErrs...)))
+	}
+
+	if err := h.checkAuthorizer(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	if r.CLINameFunc != nil {
+		setCLINames(&h.defs, r.CLINameFunc)
+	}
+
+	sortDefinitions(&h.defs)
+
+	if r.ShareSchemaDefinitions {
+		if err := h.defs.ShareDefinitions(); err != nil {
+			return fmt.Errorf("sharing schema definitions: %w", err)
+		}
+	}
+
+	return nil
+}
 
-		_, exists := h.routes[sdef.ID]
-		if exists {
-			return nil, fmt.Errorf("a service with ID '%s' has already been registered, please rename the service or remove the second registration (you can update the ID by setting it in Metadata())", sdef.ID)
+// setCLINames sets the CLIName of every service and operation using name.
+func setCLINames(defs *servicedef.Definitions, name func(id string) string) {
+	for i := range defs.Services {
+		svc := &defs.Services[i]
+		svc.CLIName = name(svc.ID)
+		for j := range svc.Operations {
+			svc.Operations[j].CLIName = name(svc.Operations[j].ID)
 		}
+	}
+}
 
-		routeMap := map[string]function{}
+// sortDefinitions sorts services, operations and resources by ID, so that the
+// definitions are the same regardless of the order things were registered in.
+func sortDefinitions(defs *servicedef.Definitions) {
+	sort.SliceStable(defs.Services, func(i, j int) bool {
+		if defs.Services[i].ID != defs.Services[j].ID {
+			return defs.Services[i].ID < defs.Services[j].ID
+		}
+		return defs.Services[i].Version < defs.Services[j].Version
+	})
 
-		for i := 0; i < tt.NumMethod(); i++ {
-			method := tt.Method(i)
+	for _, svc := range defs.Services {
+		sort.SliceStable(svc.Operations, func(i, j int) bool {
+			return svc.Operations[i].ID < svc.Operations[j].ID
+		})
+	}
 
-			if method.Name == "Metadata" {
-				continue
-			}
+	sort.SliceStable(defs.Resources, func(i, j int) bool {
+		return defs.Resources[i].ID < defs.Resources[j].ID
+	})
+}
 
-			methodValue := v.Method(i)
+// addService adds the operations of a registered service to the handler. It
+// returns the errors of any unsupported operation signatures, in which case
+// the service isn't added, and an error if the service can't be added at all.
+func (h *Handler) addService(reg registration, schemas *schemaCache, resources map[reflect.Type]Resource) ([]error, error) {
+	var errs []error
 
-			opMeta := meta.OperationMetadata[method.Name]
+	svc := reg.service
+	v := reflect.ValueOf(svc)
 
-			op := servicedef.Operation{
-				ID:          method.Name,
-				Description: opMeta.Description,
-			}
+	if v.Kind() != reflect.Pointer {
+		return nil, fmt.Errorf("received a struct that wasn't a pointer for %T: ensure that you call Register() with the address of the struct, e.g. Register(&MyService{})", svc)
+	}
 
-			extract, err := extractMethods(method.Func)
-			if err != nil {
-				slog.Error("error extracting method", "error", err)
-			}
-			if extract.InputSchema != nil {
-				op.RequestBody = &servicedef.RootSchema{
-					Schema: *extract.InputSchema,
-				}
-			}
+	tt := reflect.TypeOf(svc)
+
+	sdef := servicedef.Service{
+		ID: v.Elem().Type().Name(),
+	}
+
+	var meta ServiceMetadata
 
-			parsed, ok := parseMethod(method, methodValue, meta)
-			if ok {
-				routeMap[parsed.operation.ID] = function{
-					method:    methodValue,
-					inputType: extract.InputType,
-				}
-				sdef.Operations = append(sdef.Operations, op)
+	if metasrv, ok := svc.(ServiceWithMetadata); ok {
+		meta = metasrv.Metadata()
+
+		sdef = servicedef.Service{
+			ID:          meta.ID,
+			Name:        meta.DisplayName,
+			Description: meta.Description,
+			Version:     meta.Version,
+		}
+	}
+
+	if reg.id != "" {
+		sdef.ID = reg.id
+	}
+
+	if strings.Contains(sdef.Version, "/") {
+		return nil, fmt.Errorf("the version '%s' of service '%s' must be a single path segment", sdef.Version, sdef.ID)
+	}
+
+	if strings.HasPrefix(h.metaPrefix+"/", "/"+sdef.ID+"/") || strings.HasPrefix(h.metaPrefix+"/", "/"+sdef.Version+"/") {
+		return nil, fmt.Errorf("the service ID '%s' collides with the discovery path prefix '%s', please rename the service or set Registry.MetaPathPrefix", sdef.Path(), h.metaPrefix)
+	}
+
+	_, exists := h.routes[sdef.Path()]
+	if exists {
+		return nil, fmt.Errorf("a service with ID '%s' has already been registered, please rename the service or remove the second registration (you can update the ID by setting it in Metadata(), or by registering the service with RegisterAs())", sdef.Path())
+	}
+
+	routeMap := map[string]function{}
+
+	for i := 0; i < tt.NumMethod(); i++ {
+		method := tt.Method(i)
+
+		parsed, ok, err := parseMethod(method, v.Method(i), meta, schemas, resources)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s.%s: %w", sdef.ID, method.Name, err))
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		if parsed.operation.RoutingRule == (servicedef.RoutingRule{}) {
+			parsed.operation.RoutingRule = servicedef.RoutingRule{
+				Type:   "http",
+				Method: http.MethodPost,
+				Path:   "/" + sdef.Path() + "/" + parsed.operation.ID + parameterPath(parsed.function.parameters),
 			}
 		}
 
-		h.routes[sdef.ID] = routeMap
-		h.defs.Services = append(h.defs.Services, sdef)
+		routeMap[parsed.operation.ID] = parsed.function
+		sdef.Operations = append(sdef.Operations, parsed.operation)
 	}
 
-	return &h, nil
+	if len(errs) > 0 {
+		return errs, nil
+	}
+
+	h.routes[sdef.Path()] = routeMap
+	h.defs.Services = append(h.defs.Services, sdef)
+
+	if l, ok := svc.(Lifecycle); ok {
+		h.lifecycles = append(h.lifecycles, lifecycleService{id: sdef.Path(), svc: l})
+	}
+
+	return nil, nil
+}
+
+// addOperation adds a function registered with RegisterOperation to its service,
+// defining the service if it doesn't exist.
+func (h *Handler) addOperation(reg operationRegistration, schemas *schemaCache, resources map[reflect.Type]Resource) error {
+	v := reflect.ValueOf(reg.fn)
+	if v.Kind() != reflect.Func {
+		return fmt.Errorf("expected a function, got %T", reg.fn)
+	}
+
+	if _, exists := h.routes[reg.service][reg.operation]; exists {
+		return fmt.Errorf("an operation with ID '%s' has already been registered for the service", reg.operation)
+	}
+
+	parsed, err := parseOperation(reg.operation, v, 0, v, ServiceMetadata{}, schemas, resources)
+	if err != nil {
+		return err
+	}
+
+	parsed.operation.RoutingRule = servicedef.RoutingRule{
+		Type:   "http",
+		Method: http.MethodPost,
+		Path:   "/" + reg.service + "/" + reg.operation + parameterPath(parsed.function.parameters),
+	}
+
+	if _, exists := h.routes[reg.service]; !exists {
+		if strings.HasPrefix(h.metaPrefix+"/", "/"+reg.service+"/") {
+			return fmt.Errorf("the service ID '%s' collides with the discovery path prefix '%s', please rename the service or set Registry.MetaPathPrefix", reg.service, h.metaPrefix)
+		}
+		h.routes[reg.service] = map[string]function{}
+		h.defs.Services = append(h.defs.Services, servicedef.Service{ID: reg.service})
+	}
+
+	h.routes[reg.service][reg.operation] = parsed.function
+
+	for i := range h.defs.Services {
+		if h.defs.Services[i].Path() == reg.service {
+			h.defs.Services[i].Operations = append(h.defs.Services[i].Operations, parsed.operation)
+		}
+	}
+
+	return nil
+}
+
+// rateLimiter returns the limiter for an operation, or nil if it isn't rate limited.
+// Each operation has its own limiter, created when the handler is built.
+func rateLimiter(meta OperationMetadata) *rate.Limiter {
+	if meta.RateLimit <= 0 {
+		return nil
+	}
+
+	burst := meta.RateLimitBurst
+	if burst <= 0 {
+		burst = int(math.Ceil(float64(meta.RateLimit)))
+	}
+
+	return rate.NewLimiter(meta.RateLimit, burst)
 }
 
 type parseMethodResult struct {
@@ -213,143 +1334,790 @@ type parseMethodResult struct {
 	operation servicedef.Operation
 }
 
-func parseMethod(method reflect.Method, methodValue reflect.Value, meta ServiceMetadata) (parseMethodResult, bool) {
-	if method.Name == "Metadata" {
-		return parseMethodResult{}, false
+// parseMethod returns the function and operation definition for a method.
+// It returns false if the method isn't an operation, and an error if the
+// method's signature isn't supported.
+func parseMethod(method reflect.Method, methodValue reflect.Value, meta ServiceMetadata, schemas *schemaCache, resources map[reflect.Type]Resource) (parseMethodResult, bool, error) {
+	if method.Name == "Metadata" || isLifecycleMethod(method) || meta.OperationMetadata[method.Name].Hidden {
+		return parseMethodResult{}, false, nil
 	}
 
-	opMeta := meta.OperationMetadata[method.Name]
+	// the first argument of the method expression is the receiver.
+	res, err := parseOperation(method.Name, method.Func, 1, methodValue, meta, schemas, resources)
+	return res, err == nil, err
+}
+
+// parseOperation returns the function and operation definition for an operation
+// named name, with the signature of f starting at argument first. The operation
+// is called with call, which is f with any receiver bound.
+func parseOperation(name string, f reflect.Value, first int, call reflect.Value, meta ServiceMetadata, schemas *schemaCache, resources map[reflect.Type]Resource) (parseMethodResult, error) {
+	opMeta := meta.OperationMetadata[name]
 
 	op := servicedef.Operation{
-		ID:          method.Name,
+		ID:          name,
 		Description: opMeta.Description,
+		RoutingRule: opMeta.RoutingRule,
+		Deprecated:  opMeta.Deprecated,
+	}
+	if opMeta.Deprecated {
+		op.DeprecationMessage = opMeta.DeprecationMessage
 	}
 
-	extract, err := extractMethods(method.Func)
+	extract, err := extractMethods(f, first, schemas, resources)
 	if err != nil {
-		slog.Error("error extracting method", "error", err)
+		return parseMethodResult{}, err
 	}
 	if extract.InputSchema != nil {
 		op.RequestBody = &servicedef.RootSchema{
 			Schema: *extract.InputSchema,
 		}
 	}
+	params, err := namedParameters(extract.ParameterTypes, opMeta.Parameters)
+	if err != nil {
+		return parseMethodResult{}, err
+	}
+	op.Parameters = parameterDefinitions(params)
+
+	op.HTTPOnly = extract.RequiresHTTP
+	op.TenantScoped = tenantScoped(meta, opMeta)
+	op.Scopes = opMeta.Scopes
+	op.Retryable = opMeta.Retryable
+	op.Subscription = extract.Subscription
+	op.RawResponse = extract.RawResponse
+	op.Paginated = extract.Paginated
+	op.InputStream = extract.InputStream && !extract.Bidirectional
+	op.Bidirectional = extract.Bidirectional
+	op.ResponseBody = map[string]jsonschema.Schema{
+		"200": *extract.ResponseSchema,
+	}
+
+	op.RequestExample, op.ResponseExample, err = operationExamples(opMeta, extract, schemas.naming)
+	if err != nil {
+		return parseMethodResult{}, err
+	}
 
 	res := parseMethodResult{
 		function: function{
-			method:    methodValue,
-			inputType: extract.InputType,
+			method:       call,
+			inputType:    extract.InputType,
+			inputPointer: extract.InputPointer,
+			params:       extract.Params,
+			returnsValue: extract.ReturnsValue,
+			returnsError: extract.ReturnsError,
+			tenantScoped: tenantScoped(meta, opMeta),
+			subscription: extract.Subscription,
+			timeout:      opMeta.Timeout,
+			inputStream:  extract.InputStream,
+			frameTimeout: opMeta.FrameTimeout,
+			checksum:     opMeta.Checksum,
+
+			resource:        extract.Resource,
+			resourceIDField: extract.ResourceIDField,
+			limiter:         rateLimiter(opMeta),
+			breaker:         newBreaker(opMeta.CircuitBreaker),
+			idempotent:      opMeta.Idempotent && !extract.Subscription && !extract.InputStream && !extract.RawResponse,
+			parameters:      params,
+			defaults:        extract.InputDefaults,
+
+			deprecated:         op.Deprecated,
+			deprecationMessage: op.DeprecationMessage,
+			scopes:             opMeta.Scopes,
+			rawResponse:        extract.RawResponse,
+			resultsType:        extract.ResultsType,
+			retryable:          opMeta.Retryable,
+			retryAfter:         opMeta.RetryAfter,
+			strictInput:        opMeta.StrictInput,
+			bidirectional:      extract.Bidirectional,
+			outputType:         extract.OutputType,
 		},
 		operation: op,
 	}
 
-	return res, true
+	return res, nil
 }
 
 type extractMethodsResult struct {
 	InputSchema *jsonschema.Schema
 	InputType   *reflect.Type
+	Params      []paramKind
+
+	// InputPointer is true if the method takes a pointer to InputType,
+	// which is passed a newly allocated input, so it's never nil.
+	InputPointer bool
+
+	// RequiresHTTP is true if the method takes an *http.Request
+	// argument, meaning that it can only be called over an HTTP transport.
+	RequiresHTTP bool
+
+	ReturnsValue bool
+	ReturnsError bool
+
+	// Subscription is true if the method returns a *Subscription[T].
+	Subscription bool
+
+	// RawResponse is true if the method returns a RawResponse.
+	RawResponse bool
+
+	// Paginated is true if the method returns a Paginated[T].
+	Paginated bool
+
+	// ResultsType is set if the method returns several values,
+	// which are packaged into a value of the type.
+	ResultsType reflect.Type
+
+	// InputStream is true if the input is a receive-only
+	// channel of records decoded from NDJSON.
+	InputStream bool
+
+	// Bidirectional is true if the input channel is followed by a send-only
+	// channel of OutputType, on which the method sends its outputs.
+	Bidirectional bool
+	OutputType    reflect.Type
+
+	// ResponseSchema is the schema of the result, or of each event for
+	// subscriptions and each output of bidirectional operations. It is empty if the method only returns an error.
+	ResponseSchema *jsonschema.Schema
+
+	// ResponseType is the Go type described by ResponseSchema.
+	// It is nil if the method only returns an error.
+	ResponseType reflect.Type
+
+	// ParameterTypes are the types of the scalar arguments
+	// preceding the input, which are bound from the URL path.
+	ParameterTypes []reflect.Type
+
+	// Resource is set if the method takes a registered resource,
+	// which is loaded using the ID in the input field at ResourceIDField.
+	Resource        Resource
+	ResourceIDField []int
+	InputDefaults   []fieldDefault
 }
 
-func extractMethods(f reflect.Value) (extractMethodsResult, error) {
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// httpRequestType is the type of the *http.Request argument which
+// may be accepted by an operation.
+//
+// Operations taking an *http.Request are an escape hatch for
+// reading HTTP specifics such as cookies or TLS client certificate details.
+// They aren't transport-portable: calling them outside of ServeHTTP returns an error.
+var httpRequestType = reflect.TypeOf((*http.Request)(nil))
+
+// extractMethods reads the signature of an operation. For methods, f is the method
+// expression and the first argument, the receiver, is skipped by setting first to 1.
+func extractMethods(f reflect.Value, first int, schemas *schemaCache, resources map[reflect.Type]Resource) (extractMethodsResult, error) {
 	funcType := f.Type()
 	var res extractMethodsResult
 
-	for i := 1; i < funcType.NumIn(); i++ {
+	for i := first; i < funcType.NumIn(); i++ {
 		t := funcType.In(i)
-		v := reflect.New(t)
 
-		interf := v.Interface()
-		// should be possible to relax this in future,
-		// for example if the function does not do anything
-		// async and doesn't take a context.
-		_, isCtx := interf.(*context.Context)
-		if !isCtx && i == 1 {
-			return res, fmt.Errorf("first arg was not context.Context, got %T", interf)
+		if i == first && t == contextType {
+			res.Params = append(res.Params, paramContext)
+			continue
+		}
+
+		// a context may be omitted by operations which only take an input,
+		// for example pure transformations which don't do anything async.
+		if i == first && funcType.NumIn()-first > 1 {
+			return res, fmt.Errorf("the first argument must be a context.Context, got %s", t)
+		}
+
+		if t == httpRequestType {
+			res.Params = append(res.Params, paramRequest)
+			res.RequiresHTTP = true
+			continue
+		}
+
+		if isParameterType(t) && i < funcType.NumIn()-1 {
+			if res.InputType != nil {
+				return res, fmt.Errorf("parameters must precede the input, got %s after %s", t, *res.InputType)
+			}
+			res.ParameterTypes = append(res.ParameterTypes, t)
+			res.Params = append(res.Params, paramParameter)
+			continue
 		}
 
-		if i == 2 {
-			res.InputSchema = jsonschema.Reflect(v.Interface())
+		if r, ok := resources[t]; ok {
+			if res.Resource != nil {
+				return res, fmt.Errorf("only one resource argument is supported, got %s and %s", res.Resource.goType(), t)
+			}
+			res.Resource = r
+			res.Params = append(res.Params, paramResource)
+			continue
+		}
+
+		if isOutputStream(t) {
+			if !res.InputStream || res.Bidirectional {
+				return res, fmt.Errorf("bidirectional operations must take an input channel followed by an output channel, got %s", t)
+			}
+			res.OutputType = t
+			res.Bidirectional = true
+			res.Params = append(res.Params, paramOutputStream)
+			continue
+		}
+
+		if res.InputType != nil {
+			return res, fmt.Errorf("only one input argument is supported, got %s and %s", *res.InputType, t)
+		}
+
+		if isInputStream(t) {
+			// the schema describes a single record in the stream.
+			res.InputSchema = schemas.reflect(t.Elem())
 			res.InputType = &t
+			res.InputStream = true
+			res.Params = append(res.Params, paramInputStream)
+			continue
+		}
 
-			return res, nil
+		if t.Kind() == reflect.Pointer && t.Elem().Kind() == reflect.Struct {
+			// the input is decoded into a newly allocated struct,
+			// and the method is passed a pointer to it.
+			t = t.Elem()
+			res.InputPointer = true
 		}
+
+		defaults, err := parseDefaults(t, schemas.naming)
+		if err != nil {
+			return res, err
+		}
+
+		res.InputSchema = schemas.reflect(t)
+		setSchemaDefaults(res.InputSchema, defaults)
+		res.InputType = &t
+		res.InputDefaults = defaults
+		res.Params = append(res.Params, paramInput)
+	}
+
+	if res.Resource != nil {
+		if res.InputType == nil || res.InputStream {
+			return res, fmt.Errorf("operations taking a resource must have an input to read the resource ID from")
+		}
+
+		idx, err := resourceIDField(*res.InputType, schemas.naming)
+		if err != nil {
+			return res, err
+		}
+		res.ResourceIDField = idx
+	}
+
+	// supported return values are (T), (T, error) and (error), and several
+	// struct values, optionally followed by an error, which are packaged
+	// into a single result. See resultsType.
+	n := funcType.NumOut()
+	if n == 0 {
+		return res, errors.New("operations must return a value, an error, or both")
+	}
+
+	res.ReturnsError = funcType.Out(n-1) == errorType
+	values := n
+	if res.ReturnsError {
+		values--
+	}
+
+	if values > 1 {
+		t, err := resultsType(funcType, values)
+		if err != nil && n == 2 {
+			return res, fmt.Errorf("the second return value must be an error, got %s", funcType.Out(1))
+		}
+		if err != nil {
+			return res, err
+		}
+		res.ResultsType = t
+	}
+
+	res.ReturnsValue = values > 0
+
+	if res.Bidirectional {
+		if res.ReturnsValue {
+			return res, fmt.Errorf("bidirectional operations must only return an error, got %s", funcType.Out(0))
+		}
+		res.ResponseType = res.OutputType.Elem()
+		res.ResponseSchema = schemas.reflect(res.ResponseType)
+		return res, nil
 	}
+	res.Subscription = values == 1 && funcType.Out(0).Implements(subscriptionType)
+	res.RawResponse = values == 1 && isRawResponse(funcType.Out(0))
+	res.Paginated = values == 1 && isPaginated(funcType.Out(0))
+
+	switch {
+	case res.ResultsType != nil:
+		res.ResponseType = res.ResultsType
+		res.ResponseSchema = schemas.reflect(res.ResultsType)
+	case res.Subscription:
+		res.ResponseType = subscriptionEventType(funcType.Out(0))
+		res.ResponseSchema = schemas.reflect(res.ResponseType)
+	case res.RawResponse:
+		res.ResponseType = funcType.Out(0)
+		res.ResponseSchema = rawResponseSchema()
+	case res.ReturnsValue:
+		res.ResponseType = funcType.Out(0)
+		res.ResponseSchema = schemas.reflect(res.ResponseType)
+	default:
+		// there is no response body.
+		res.ResponseSchema = &jsonschema.Schema{}
+	}
+
 	return res, nil
 }
 
+// schemaCache holds the schemas reflected for input types during a single call to Build,
+// as reflecting a schema is the most expensive part of building a handler and
+// the same input types are often shared by many operations.
+type schemaCache struct {
+	naming    FieldNaming
+	reflector *jsonschema.Reflector
+	schemas   map[reflect.Type]*jsonschema.Schema
+}
+
+func newSchemaCache(naming FieldNaming, reflector *jsonschema.Reflector) *schemaCache {
+	return &schemaCache{
+		naming:    naming,
+		reflector: reflector,
+		schemas:   map[reflect.Type]*jsonschema.Schema{},
+	}
+}
+
+// reflect returns the schema for values of type t.
+func (c *schemaCache) reflect(t reflect.Type) *jsonschema.Schema {
+	if schema, ok := c.schemas[t]; ok {
+		return schema
+	}
+
+	schema := reflectSchema(reflect.New(t).Interface(), c.naming, c.reflector)
+	c.schemas[t] = schema
+	return schema
+}
+
 type StartOpts struct {
 	Namespace string
+	// Namespaces are served over the same tunnel connection as Namespace,
+	// by their own handlers, for example other built registries.
+	// See tunnel.Tunnel.Namespaces for how requests are routed.
+	Namespaces map[string]http.Handler
 	// TLSConfig allows the tunnel TLS
 	// config to be optionally overridden.
-	TLSConfig         *tls.Config
-	QuicConfig        *quic.Config
+	TLSConfig *tls.Config
+	// ALPN overrides the application protocol advertised by the
+	// tunnel if TLSConfig isn't set. See tunnel.Tunnel.ALPN.
+	ALPN       string
+	QuicConfig *quic.Config
+	// IdleTimeout and KeepAlivePeriod override the timeouts of QuicConfig,
+	// or of tunnel.DefaultQuicConfig if it isn't set. See tunnel.Tunnel.
+	IdleTimeout       time.Duration
+	KeepAlivePeriod   time.Duration
 	OnConnectionReady func(protocol.RegisterListenerResponse)
-	Logger            *slog.Logger
-	Addr              string
+	// Logger is used by both the tunnel and the calls it serves, replacing
+	// Registry.Logger if set. If neither is set, slog.Default() is used.
+	Logger *slog.Logger
+	Addr   string
+
+	// Transport defaults to tunnel.TransportQUIC. Use tunnel.TransportTCP
+	// to connect over TCP in networks which block UDP.
+	Transport tunnel.Transport
+
+	// LocalAddr and PacketConn set the local address or socket the
+	// tunnel connects from, for networks which only allow outbound
+	// traffic from specific ports. See tunnel.Tunnel.
+	LocalAddr  string
+	PacketConn net.PacketConn
+
+	// MaxConcurrentRequests limits the number of requests served at once on each
+	// tunnel connection. See tunnel.Tunnel.MaxConcurrentRequests.
+	MaxConcurrentRequests int
+
+	// Authenticator adds credentials when registering with the tunnel.
+	// Use tunnel.BearerAuthenticator for a static token, or
+	// tunnel.ClientCertificateAuthenticator to present a client
+	// certificate during the TLS handshake, for mutual TLS.
+	Authenticator tunnel.Authenticator
+
+	// OnDisconnect is called when a registered tunnel connection stops being served.
+	OnDisconnect func(error)
+	// OnReconnecting is called before the tunnel retries after
+	// a failed dial or a disconnect, with the attempt count.
+	OnReconnecting func(attempt int, err error)
+	// OnRegister is called after every tunnel registration attempt,
+	// successful or not, with the response and the error, if any.
+	OnRegister func(resp protocol.RegisterListenerResponse, err error)
+
+	// Backoff controls how the tunnel reconnects, defaulting to tunnel.DefaultBackoff.
+	// A Backoff with zero Steps retries forever, with the interval capped at Cap.
+	Backoff *wait.Backoff
+
+	// LogMetadataKeys is an allowlist of tunnel registration metadata keys
+	// which are added as attributes to the logger for the connection.
+	LogMetadataKeys []string
+	// SensitiveMetadataKeys are never logged, even if
+	// they are included in LogMetadataKeys.
+	SensitiveMetadataKeys []string
+
+	// Metrics, if set, records Prometheus metrics for every operation call
+	// served by the tunnel. Calls aren't measured if Metrics is nil.
+	Metrics *Metrics
+
+	// MaxRequestBytes replaces Registry.MaxRequestBytes for
+	// requests served by the tunnel, if set.
+	MaxRequestBytes int64
+
+	// OnStats, if set, is called with the stats of the tunnel's QUIC
+	// connection every StatsInterval, defaulting to tunnel.DefaultStatsInterval.
+	OnStats       func(tunnel.ConnectionStats)
+	StatsInterval time.Duration
 }
 
+// Start serves the registry's Handler over a tunnel until ctx is cancelled.
+// The handler is built by Registry.Handler, so its operations and their state,
+// such as rate limiters and circuit breakers, are shared with Handler, Serve and
+// other tunnels. The logger, request size limit and metrics in opts only apply
+// to calls served by this tunnel, and its readiness follows this tunnel's connection.
+// Services implementing Lifecycle are started before serving, and stopped
+// once the tunnel has stopped serving.
+//
+// To shut down gracefully, use NewTunnel instead and call Shutdown on the returned tunnel.
 func (r *Registry) Start(ctx context.Context, opts StartOpts) error {
-	h, err := r.Build()
+	server, h, err := r.newTunnel(opts)
+	if err != nil {
+		return err
+	}
+
+	if err := h.Start(ctx); err != nil {
+		return err
+	}
+
+	err = server.DialAndServe(ctx, opts.Addr)
+
+	stopCtx, cancel := stopContext(ctx)
+	defer cancel()
+
+	return errors.Join(err, h.Stop(stopCtx))
+}
+
+// NewTunnel returns a tunnel configured to serve the registry's Handler, building it if
+// it hasn't been built. Call DialAndServe on the tunnel with opts.Addr to start serving.
+// Like Handler, NewTunnel fails if anything was registered after the handler was built.
+//
+// The tunnel's Handler is an *ops.Handler sharing the operations of Registry.Handler,
+// configured as described in Start.
+//
+// Services implementing Lifecycle aren't started. To start and stop them,
+// call Start and Stop on the tunnel's Handler.
+func (r *Registry) NewTunnel(opts StartOpts) (*tunnel.Tunnel, error) {
+	server, _, err := r.newTunnel(opts)
+	return server, err
+}
+
+func (r *Registry) newTunnel(opts StartOpts) (*tunnel.Tunnel, *Handler, error) {
+	shared, err := r.Handler()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h := shared.forTunnel(opts)
+
+	server := &tunnel.Tunnel{
+		Namespace:       opts.Namespace,
+		Namespaces:      opts.Namespaces,
+		ALPN:            opts.ALPN,
+		TLSConfig:       opts.TLSConfig,
+		Logger:          h.logger,
+		QuicConfig:      opts.QuicConfig,
+		IdleTimeout:     opts.IdleTimeout,
+		KeepAlivePeriod: opts.KeepAlivePeriod,
+		OnConnectionReady: func(res protocol.RegisterListenerResponse) {
+			h.SetReady(true)
+			if opts.OnConnectionReady != nil {
+				opts.OnConnectionReady(res)
+			}
+		},
+		Authenticator:         opts.Authenticator,
+		Transport:             opts.Transport,
+		MaxConcurrentRequests: opts.MaxConcurrentRequests,
+		LocalAddr:             opts.LocalAddr,
+		PacketConn:            opts.PacketConn,
+		OnDisconnect: func(err error) {
+			h.SetReady(false)
+			if opts.OnDisconnect != nil {
+				opts.OnDisconnect(err)
+			}
+		},
+		OnReconnecting: opts.OnReconnecting,
+		OnRegister:     opts.OnRegister,
+		Handler:        h,
+		Backoff:        opts.Backoff,
+
+		LogMetadataKeys:       opts.LogMetadataKeys,
+		SensitiveMetadataKeys: opts.SensitiveMetadataKeys,
+
+		OnStats:       opts.OnStats,
+		StatsInterval: opts.StatsInterval,
+	}
+
+	return server, h, nil
+}
+
+// forTunnel returns a copy of the handler to serve over a tunnel. The copy shares
+// the handler's operations and the state of its calls, but has the logger, request
+// size limit and metrics set in opts, and is only ready once the tunnel connects.
+func (h *Handler) forTunnel(opts StartOpts) *Handler {
+	t := *h
+	t.notReady = &atomic.Bool{}
+	t.notReady.Store(true)
+
+	if opts.Logger != nil {
+		t.logger = withRequestIDLogging(opts.Logger)
+	}
+	if opts.MaxRequestBytes != 0 {
+		t.maxRequestBytes = opts.MaxRequestBytes
+	}
+	if opts.Metrics != nil {
+		// metrics are outermost, so that they
+		// include the time spent in middleware.
+		t.invoke = opts.Metrics.Middleware()(t.invoke)
+		// the circuit breakers are shared, so they're observed on the shared handler.
+		opts.Metrics.ObserveCircuitBreakers(h)
+	}
+
+	return &t
+}
+
+// Serve serves the registry's Handler on the listener until ctx is cancelled,
+// for running the handler behind a load balancer or in a network where
+// the tunnel can't connect. Requests in flight are given 10 seconds
+// to finish once ctx is cancelled. Authentication isn't applied to requests
+// served this way; add Middleware or wrap the listener with TLS to authenticate.
+// Services implementing Lifecycle are started before serving, and stopped
+// once the requests in flight have finished.
+func (r *Registry) Serve(ctx context.Context, ln net.Listener) error {
+	h, err := r.Handler()
 	if err != nil {
 		return err
 	}
 
-	server := tunnel.Tunnel{
-		Namespace:         opts.Namespace,
-		TLSConfig:         opts.TLSConfig,
-		Logger:            opts.Logger,
-		QuicConfig:        opts.QuicConfig,
-		OnConnectionReady: opts.OnConnectionReady,
-		Handler:           h,
+	if err := h.Start(ctx); err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Handler:  h,
+		ErrorLog: slog.NewLogLogger(h.logger.Handler(), slog.LevelError),
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(ln)
+	}()
+
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), serveShutdownTimeout)
+		defer cancel()
+
+		err = server.Shutdown(shutdownCtx)
 	}
 
-	return server.DialAndServe(ctx, opts.Addr)
+	stopCtx, cancel := stopContext(ctx)
+	defer cancel()
+
+	return errors.Join(err, h.Stop(stopCtx))
 }
 
+// serveShutdownTimeout is how long Serve waits for requests in flight to finish.
+const serveShutdownTimeout = 10 * time.Second
+
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "GET" && r.URL.Path == "/.lightwave/operations" {
-		err := json.NewEncoder(w).Encode(h.defs)
-		if err != nil {
-			slog.Error("error marshalling operations", "error", err)
-			_, _ = w.Write([]byte(err.Error()))
-		}
+	if r.Method == "GET" && r.URL.Path == h.metaPath("healthz") {
+		h.serveHealthz(w)
+		return
+	}
+
+	if r.Method == "GET" && r.URL.Path == h.metaPath("readyz") {
+		h.serveReadyz(w)
+		return
+	}
+
+	if r.Method == "GET" && (r.URL.Path == h.metaPath("operations") || strings.HasPrefix(r.URL.Path, h.metaPath("operations")+"/")) {
+		h.serveDefinitions(w, r)
+		return
+	}
+
+	if r.Method == "GET" && strings.HasPrefix(r.URL.Path, h.metaPath("schema")+"/") {
+		h.serveSchema(w, r)
+		return
+	}
+
+	if r.Method == "POST" && r.URL.Path == h.metaPath("batch") {
+		h.serveBatch(w, withRequestID(w, r))
+		return
+	}
+
+	if r.Method == "POST" && h.jsonrpc && r.URL.Path == h.metaPath("jsonrpc") {
+		h.serveJSONRPC(w, withRequestID(w, r))
 		return
 	}
 
 	if r.Method != "POST" {
 		// POST-only protocol
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Write([]byte(http.StatusText(http.StatusMethodNotAllowed)))
+		writeError(w, http.StatusMethodNotAllowed, errors.New(http.StatusText(http.StatusMethodNotAllowed)))
 		return
 	}
 
-	urlPath := strings.TrimPrefix(r.URL.Path, "/")
-	parts := strings.Split(urlPath, "/")
-	// expect path to be /service/method
-	if len(parts) != 2 {
-		w.WriteHeader(http.StatusNotFound)
-		msg := fmt.Sprintf("invalid path: %s", r.URL.Path)
-		w.Write([]byte(msg))
+	parts, err := splitPath(r)
+	var service, op string
+	var paramValues []string
+	ok := err == nil && !strings.HasPrefix(r.URL.Path, h.metaPrefix+"/")
+	if ok {
+		service, op, paramValues, ok = h.matchRoute(parts)
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("invalid path: %s", r.URL.Path))
 		return
 	}
 
-	body, err := io.ReadAll(r.Body)
+	r = withRequestID(w, r)
+
+	if !h.accessLog {
+		h.serveOperation(w, r, service, op, paramValues)
+		return
+	}
+
+	start := time.Now()
+	aw := &accessLogWriter{ResponseWriter: w}
+	h.serveOperation(aw, r, service, op, paramValues)
+	h.logAccess(r, service, op, start, aw)
+}
+
+// matchRoute returns the service and operation for a path split into segments,
+// with the values of any parameters from the rest of the path. The path is expected
+// to be /service/operation, or /version/service/operation for versioned services,
+// which take precedence.
+func (h *Handler) matchRoute(parts []string) (service string, op string, paramValues []string, ok bool) {
+	if len(parts) >= 3 {
+		versioned := parts[0] + "/" + parts[1]
+		if fn, found := h.routes[versioned][parts[2]]; found && len(parts)-3 == len(fn.parameters) {
+			return versioned, parts[2], parts[3:], true
+		}
+	}
+
+	if len(parts) < 2 || len(parts)-2 != len(h.routes[parts[0]][parts[1]].parameters) {
+		return "", "", nil, false
+	}
+
+	return parts[0], parts[1], parts[2:], true
+}
+
+// serveOperation serves a POST /{service}/{operation} request,
+// with the values of any parameters from the rest of the path.
+func (h *Handler) serveOperation(w http.ResponseWriter, r *http.Request, service string, op string, paramValues []string) {
+	ctx := extractTraceContext(r.Context(), r)
+
+	if len(paramValues) > 0 {
+		params := map[string]string{}
+		for i, p := range h.routes[service][op].parameters {
+			params[p.name] = paramValues[i]
+		}
+		ctx = WithParameters(ctx, params)
+	}
+
+	ctx = contextWithRequest(ctx, r)
+	ctx = contextWithResponseWriter(ctx, w)
+	ctx = headerMetadata(ctx, r, h.metadataHeaders)
+
+	if key := r.Header.Get(IdempotencyKeyHeader); key != "" {
+		ctx = WithIdempotencyKey(ctx, key)
+	}
+
+	ctx, cancel, err := withRequestTimeout(ctx, r)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	defer cancel()
+
+	fn, ok := h.routes[service][op]
+
+	if fn.deprecated {
+		setDeprecationHeaders(w.Header(), fn.deprecationMessage)
+	}
+
+	if err := h.contentTypeCheck.checkContentType(r, fn.streamContentType()); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.decompressRequest(r); err != nil {
+		status := http.StatusBadRequest
+		if errors.As(err, &unsupportedEncodingError{}) {
+			status = http.StatusUnsupportedMediaType
+		}
+		writeError(w, status, err)
 		return
 	}
+	defer r.Body.Close()
 
-	service := parts[0]
-	op := parts[1]
+	var body []byte
+
+	if ok && fn.inputStream {
+		// the operation decodes the body as it is read.
+		ctx = contextWithBody(ctx, r.Body)
+	} else {
+		var err error
+		body, err = h.readBody(w, r)
+		if err != nil {
+			if h.clientGone(w, r, service, op) {
+				return
+			}
+			writeError(w, readBodyStatus(err), err)
+			return
+		}
+	}
+
+	if fn.checksum && !fn.inputStream {
+		if err := verifyChecksum(r, body); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
 
-	res, err := h.Call(r.Context(), service, op, body)
+	res, err := h.Call(ctx, service, op, body)
+	// errors explaining why the operation failed, such as a frame
+	// timeout cancelling the request, are still reported.
+	if !fn.streamsResponse() && (err == nil || errors.Is(err, context.Canceled)) && h.clientGone(w, r, service, op) {
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
+		if fn.retryable {
+			setRetryAfter(w.Header(), errorCode(err), fn.retryAfter)
+		}
+
+		writeCallError(w, err)
 		return
 	}
 
+	if !fn.streamsResponse() && w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", jsonContentType)
+	}
+
+	if fn.checksum && !fn.streamsResponse() {
+		w.Header().Set(ChecksumHeader, checksum(res))
+	}
+
+	if h.compression != nil && !fn.streamsResponse() {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		var encoding string
+		res, encoding, err = h.compressResponse(r, res)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if encoding != "" {
+			w.Header().Set("Content-Encoding", encoding)
+		}
+	}
+
 	w.Write(res)
 }
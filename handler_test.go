@@ -1,14 +1,54 @@
 package ops
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/common-fate/ops/protocol"
+	"github.com/common-fate/ops/servicedef"
+	"github.com/common-fate/ops/tunnel"
 	"github.com/gkampitakis/go-snaps/snaps"
+	"github.com/invopop/jsonschema"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/net/http2"
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
+// errorMessage returns the message of the ErrorResponse in the body of an error response.
+func errorMessage(t *testing.T, body io.Reader) string {
+	t.Helper()
+	var res ErrorResponse
+	if err := json.NewDecoder(body).Decode(&res); err != nil {
+		t.Fatalf("decoding error response: %s", err)
+	}
+	return res.Message
+}
+
 type fooInput struct {
 	Bar   string `json:"bar"`
 	Other string `json:"other,omitempty"`
@@ -144,3 +184,4343 @@ func TestCallWithNoPointerReturnsError(t *testing.T) {
 	_, err := o.Build()
 	assert.Error(t, err)
 }
+
+type withRequest struct {
+}
+
+func (withRequest) Metadata() ServiceMetadata {
+	return ServiceMetadata{
+		ID: "withRequest",
+	}
+}
+
+func (s *withRequest) Cookie(ctx context.Context, r *http.Request, input fooInput) string {
+	c, err := r.Cookie("session")
+	if err != nil {
+		return err.Error()
+	}
+	return input.Bar + " " + c.Value
+}
+
+func TestServeHTTPInjectsRequest(t *testing.T) {
+	o := New()
+	o.Register(&withRequest{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, h.ServiceDefinitions().Services[0].Operations[0].HTTPOnly)
+
+	req := httptest.NewRequest(http.MethodPost, "/withRequest/Cookie", strings.NewReader(`{"bar": "testing"}`))
+	req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `"testing abc"`, rec.Body.String())
+}
+
+func TestCallHTTPOnlyOperationReturnsError(t *testing.T) {
+	o := New()
+	o.Register(&withRequest{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = h.Call(context.Background(), "withRequest", "Cookie", json.RawMessage(`{"bar": "testing"}`))
+	assert.Error(t, err)
+}
+
+type errorOnly struct {
+}
+
+func (errorOnly) Metadata() ServiceMetadata {
+	return ServiceMetadata{
+		ID: "errorOnly",
+	}
+}
+
+func (s *errorOnly) Delete(ctx context.Context, input fooInput) error {
+	if input.Bar == "" {
+		return errors.New("bar is required")
+	}
+	return nil
+}
+
+func (s *errorOnly) Get(ctx context.Context, input fooInput) (secondOutput, error) {
+	return secondOutput{}, &Error{Code: protocol.CodeNotFound, Err: errors.New("not found")}
+}
+
+func TestCallErrorOnly(t *testing.T) {
+	ctx := context.Background()
+	o := New()
+	o.Register(&errorOnly{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := h.Call(ctx, "errorOnly", "Delete", json.RawMessage(`{"bar": "testing"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, got)
+
+	_, err = h.Call(ctx, "errorOnly", "Delete", json.RawMessage(`{}`))
+	assert.EqualError(t, err, "bar is required")
+	assert.Equal(t, protocol.CodeServerError, errorCode(err))
+
+	_, err = h.Call(ctx, "errorOnly", "Get", json.RawMessage(`{}`))
+	assert.Equal(t, protocol.CodeNotFound, errorCode(err))
+}
+
+type pingResult struct {
+	Pong bool `json:"pong"`
+}
+
+type noInput struct {
+}
+
+func (noInput) Metadata() ServiceMetadata {
+	return ServiceMetadata{
+		ID: "noInput",
+	}
+}
+
+func (s *noInput) Ping(ctx context.Context) (pingResult, error) {
+	return pingResult{Pong: true}, nil
+}
+
+func TestCallNoInput(t *testing.T) {
+	ctx := context.Background()
+	o := New()
+	o.Register(&noInput{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, h.ServiceDefinitions().Services[0].Operations[0].RequestBody)
+
+	got, err := h.Call(ctx, "noInput", "Ping", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"pong":true}`
+
+	assert.Equal(t, want, string(got))
+}
+
+func TestServeHTTPNoInputEmptyBody(t *testing.T) {
+	o := New()
+	o.Register(&noInput{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/noInput/Ping", nil)
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `{"pong":true}`, rec.Body.String())
+}
+
+type tenanted struct {
+}
+
+func (tenanted) Metadata() ServiceMetadata {
+	return ServiceMetadata{
+		ID:           "tenanted",
+		TenantScoped: true,
+		OperationMetadata: map[string]OperationMetadata{
+			"Status": {
+				TenantAgnostic: true,
+			},
+		},
+	}
+}
+
+func (s *tenanted) List(ctx context.Context) string {
+	tenant, _ := TenantFromContext(ctx)
+	return "items for " + tenant
+}
+
+func (s *tenanted) Status(ctx context.Context) string {
+	return "ok"
+}
+
+func TestCallTenantScoped(t *testing.T) {
+	ctx := context.Background()
+	o := New()
+	o.Register(&tenanted{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = h.Call(ctx, "tenanted", "List", nil)
+	assert.Equal(t, protocol.CodeUnauthorized, errorCode(err))
+
+	got, err := h.Call(WithTenant(ctx, "acme"), "tenanted", "List", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `"items for acme"`, string(got))
+
+	got, err = h.Call(ctx, "tenanted", "Status", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `"ok"`, string(got))
+}
+
+func TestStartTenantResolver(t *testing.T) {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", selfSignedTLSConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	o := New()
+	o.Register(&tenanted{})
+	o.MetadataHeaders = []string{"X-Tenant-Id"}
+	o.TenantResolver = TenantFromMetadata("X-Tenant-Id")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- o.Start(ctx, StartOpts{
+			Addr:      ln.Addr().String(),
+			Transport: tunnel.TransportTCP,
+			TLSConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				ServerName:         "localhost",
+				NextProtos:         []string{protocol.Name},
+			},
+			Backoff: &wait.Backoff{Steps: 1, Duration: time.Millisecond},
+		})
+	}()
+
+	// register the connection, then call the handler over it as the tunnel server would.
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := protocol.NewDecoder[protocol.RegisterListenerRequest](conn).Decode(); err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.NewEncoder[protocol.RegisterListenerResponse](conn).Encode(&protocol.RegisterListenerResponse{Code: protocol.CodeOK}); err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := (&http2.Transport{}).NewClientConn(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	call := func(tenant string) (int, string) {
+		req, _ := http.NewRequest(http.MethodPost, "https://tunnel/tenanted/List", nil)
+		if tenant != "" {
+			req.Header.Set("X-Tenant-Id", tenant)
+		}
+		res, err := cc.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, strings.TrimSpace(string(body))
+	}
+
+	code, body := call("acme")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `"items for acme"`, body)
+
+	code, body = call("")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Contains(t, body, "operation List for service tenanted requires a tenant")
+
+	cancel()
+	if err := <-done; err != nil {
+		assert.ErrorIs(t, err, context.Canceled)
+	}
+}
+
+func TestTenantResolver(t *testing.T) {
+	ctx := context.Background()
+
+	var seen []string
+	o := New()
+	o.Register(&tenanted{})
+	o.Use(func(next Invoker) Invoker {
+		return func(ctx context.Context, service, operation string, input json.RawMessage) ([]byte, error) {
+			tenant, _ := TenantFromContext(ctx)
+			seen = append(seen, tenant)
+			return next(ctx, service, operation, input)
+		}
+	})
+	o.TenantResolver = func(ctx context.Context) (string, error) {
+		switch MetadataFromContext(ctx)["X-Token"] {
+		case "acme-token":
+			return "acme", nil
+		case "":
+			return "", nil
+		case "expired":
+			return "", &Error{Code: protocol.CodeBadRequest, Err: errors.New("the token has expired")}
+		}
+		return "", errors.New("unknown token")
+	}
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := h.Call(WithMetadata(ctx, map[string]string{"X-Token": "acme-token"}), "tenanted", "List", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `"items for acme"`, string(got))
+	assert.Equal(t, []string{"acme"}, seen, "middleware sees the resolved tenant")
+
+	got, err = h.Call(WithTenant(ctx, "globex"), "tenanted", "List", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `"items for globex"`, string(got), "a tenant in the context takes precedence")
+
+	_, err = h.Call(ctx, "tenanted", "List", nil)
+	assert.Equal(t, protocol.CodeUnauthorized, errorCode(err))
+
+	_, err = h.Call(WithMetadata(ctx, map[string]string{"X-Token": "other"}), "tenanted", "List", nil)
+	assert.Equal(t, protocol.CodeUnauthorized, errorCode(err))
+	assert.EqualError(t, err, "resolving the tenant: unknown token")
+
+	_, err = h.Call(WithMetadata(ctx, map[string]string{"X-Token": "expired"}), "tenanted", "List", nil)
+	assert.Equal(t, protocol.CodeBadRequest, errorCode(err), "an *Error sets the response code")
+}
+
+// selfSignedTLSConfig returns a tunnel server TLS config with a certificate for localhost.
+func selfSignedTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{protocol.Name},
+	}
+}
+
+type createInput struct {
+	Name  string `json:"name" validate:"required"`
+	Limit int    `json:"limit" validate:"min=1,max=100"`
+}
+
+type validated struct {
+	calls int
+}
+
+func (validated) Metadata() ServiceMetadata {
+	return ServiceMetadata{
+		ID: "validated",
+	}
+}
+
+func (s *validated) Create(ctx context.Context, input createInput) string {
+	s.calls++
+	return "created " + input.Name
+}
+
+func TestCallValidatesInput(t *testing.T) {
+	ctx := context.Background()
+	o := New()
+	o.ValidateInputs = true
+	o.Register(&validated{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := h.Call(ctx, "validated", "Create", json.RawMessage(`{"name": "test", "limit": 10}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `"created test"`, string(got))
+
+	_, err = h.Call(ctx, "validated", "Create", json.RawMessage(`{"limit": 0}`))
+	assert.Equal(t, protocol.CodeBadRequest, errorCode(err))
+
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+
+	want := []FieldError{
+		{Field: "name", Rule: "required", Message: "name failed on the 'required' rule"},
+		{Field: "limit", Rule: "min", Message: "limit failed on the 'min=1' rule"},
+	}
+	assert.Equal(t, want, verr.Fields)
+}
+
+func TestCallValidationDisabledByDefault(t *testing.T) {
+	o := New()
+	o.Register(&validated{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = h.Call(context.Background(), "validated", "Create", json.RawMessage(`{}`))
+	assert.NoError(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	ctx := context.Background()
+	svc := &validated{}
+	o := New()
+	o.ValidateInputs = true
+	o.Register(svc)
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = h.Validate(ctx, "validated", "Create", json.RawMessage(`{"name": "test", "limit": 10}`))
+	assert.NoError(t, err)
+
+	input := json.RawMessage(`{"limit": 0}`)
+	err = h.Validate(ctx, "validated", "Create", input)
+	assert.Equal(t, protocol.CodeBadRequest, errorCode(err))
+
+	_, callErr := h.Call(ctx, "validated", "Create", input)
+	assert.Equal(t, callErr, err, "Validate should return the same error as Call")
+
+	err = h.Validate(ctx, "validated", "Create", json.RawMessage(`{"limit": "ten"}`))
+	var verr *ValidationError
+	if assert.ErrorAs(t, err, &verr) {
+		assert.Equal(t, "type", verr.Fields[0].Rule)
+	}
+
+	err = h.Validate(ctx, "validated", "Delete", nil)
+	assert.Equal(t, protocol.CodeNotFound, errorCode(err))
+
+	assert.Equal(t, 0, svc.calls, "Validate shouldn't call the operation")
+}
+
+func TestCallInputValidator(t *testing.T) {
+	ctx := context.Background()
+	o := New()
+	o.Register(&validated{})
+
+	var got ValidationRequest
+	o.InputValidator = InputValidatorFunc(func(ctx context.Context, req ValidationRequest) error {
+		got = req
+		if req.Input.(createInput).Name == "reserved" {
+			return &ValidationError{Fields: []FieldError{
+				{Field: "name", Rule: "reserved", Message: "name is reserved"},
+			}}
+		}
+		return nil
+	})
+
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = h.Call(ctx, "validated", "Create", json.RawMessage(`{"name": "test"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, ValidationRequest{
+		Service:   "validated",
+		Operation: "Create",
+		Raw:       json.RawMessage(`{"name": "test"}`),
+		Input:     createInput{Name: "test"},
+	}, got)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/validated/Create", strings.NewReader(`{"name": "reserved"}`)))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.JSONEq(t, `{
+		"code": "CodeBadRequest",
+		"message": "input validation failed: name is reserved",
+		"details": {"fields": [{"field": "name", "rule": "reserved", "message": "name is reserved"}]}
+	}`, rec.Body.String())
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	ctx := context.Background()
+	o := New()
+	o.Register(&example{})
+
+	var calls []string
+
+	record := func(name string) Middleware {
+		return func(next Invoker) Invoker {
+			return func(ctx context.Context, service, operation string, input json.RawMessage) ([]byte, error) {
+				calls = append(calls, name+" "+service+"/"+operation)
+				return next(ctx, service, operation, input)
+			}
+		}
+	}
+
+	o.Use(record("first"), record("second"))
+	o.Use(record("third"))
+
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := h.Call(ctx, "example", "Foo", json.RawMessage(`{"bar": "testing"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, `"hello testing"`, string(got))
+	assert.Equal(t, []string{"first example/Foo", "second example/Foo", "third example/Foo"}, calls)
+}
+
+func TestMiddlewareShortCircuit(t *testing.T) {
+	ctx := context.Background()
+	o := New()
+	o.Register(&example{})
+
+	var reachedInner bool
+
+	o.Use(func(next Invoker) Invoker {
+		return func(ctx context.Context, service, operation string, input json.RawMessage) ([]byte, error) {
+			return nil, &Error{Code: protocol.CodeUnauthorized, Err: errors.New("denied")}
+		}
+	}, func(next Invoker) Invoker {
+		return func(ctx context.Context, service, operation string, input json.RawMessage) ([]byte, error) {
+			reachedInner = true
+			return next(ctx, service, operation, input)
+		}
+	})
+
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = h.Call(ctx, "example", "Foo", json.RawMessage(`{"bar": "testing"}`))
+	assert.EqualError(t, err, "denied")
+	assert.Equal(t, protocol.CodeUnauthorized, errorCode(err))
+	assert.False(t, reachedInner)
+}
+
+type watchEvent struct {
+	Count int `json:"count"`
+}
+
+type watcher struct {
+	// stopped receives the error returned from Send
+	// once the client has gone away.
+	stopped chan error
+}
+
+func (watcher) Metadata() ServiceMetadata {
+	return ServiceMetadata{
+		ID: "watcher",
+	}
+}
+
+func (s *watcher) Count(ctx context.Context, input fooInput) (*Subscription[watchEvent], error) {
+	sub := NewSubscription[watchEvent]()
+	go func() {
+		for i := 1; i <= 3; i++ {
+			if err := sub.Send(ctx, watchEvent{Count: i}); err != nil {
+				return
+			}
+		}
+		if input.Bar == "fail" {
+			sub.Close(errors.New("something went wrong"))
+			return
+		}
+		sub.Close(nil)
+	}()
+	return sub, nil
+}
+
+func (s *watcher) Forever(ctx context.Context) (*Subscription[watchEvent], error) {
+	sub := NewSubscription[watchEvent]()
+	go func() {
+		for i := 1; ; i++ {
+			if err := sub.Send(context.Background(), watchEvent{Count: i}); err != nil {
+				s.stopped <- err
+				return
+			}
+		}
+	}()
+	return sub, nil
+}
+
+func TestServeHTTPSubscription(t *testing.T) {
+	o := New()
+	o.Register(&watcher{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/watcher/Count", strings.NewReader(`{"bar": "ok"}`)))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "{\"event\":{\"count\":1}}\n{\"event\":{\"count\":2}}\n{\"event\":{\"count\":3}}\n", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/watcher/Count", strings.NewReader(`{"bar": "fail"}`)))
+
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	assert.Equal(t, `{"error":"something went wrong"}`, lines[len(lines)-1])
+}
+
+func TestSubscriptionClientDisconnect(t *testing.T) {
+	svc := &watcher{stopped: make(chan error, 1)}
+	o := New()
+	o.Register(svc)
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodPost, "/watcher/Forever", nil).WithContext(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		close(done)
+	}()
+
+	cancel()
+	<-done
+
+	assert.ErrorIs(t, <-svc.stopped, ErrSubscriptionClosed)
+}
+
+func TestCallSubscriptionReturnsError(t *testing.T) {
+	o := New()
+	o.Register(&watcher{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = h.Call(context.Background(), "watcher", "Count", json.RawMessage(`{"bar": "ok"}`))
+	assert.Equal(t, protocol.CodeBadRequest, errorCode(err))
+}
+
+func TestOpenAPISnapshot(t *testing.T) {
+	o := New()
+	o.Register(&example{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := h.ServiceDefinitions().OpenAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snaps.MatchJSON(t, got)
+}
+
+func TestGoClientSnapshot(t *testing.T) {
+	o := New()
+	o.Register(&example{})
+	o.Register(&noInput{})
+	o.Register(&members{})
+	o.Register(&reports{})
+	o.Register(&chat{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := h.ServiceDefinitions().GoClient("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snaps.MatchSnapshot(t, string(got))
+}
+
+type slow struct {
+}
+
+func (slow) Metadata() ServiceMetadata {
+	return ServiceMetadata{
+		ID: "slow",
+		OperationMetadata: map[string]OperationMetadata{
+			"Sleep": {
+				Timeout: 10 * time.Millisecond,
+			},
+			"Wait": {
+				Timeout: 100 * time.Millisecond,
+			},
+		},
+	}
+}
+
+func (s *slow) Wait(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (s *slow) Sleep(ctx context.Context) (string, error) {
+	time.Sleep(50 * time.Millisecond)
+	return "done", nil
+}
+
+func (s *slow) Quick(ctx context.Context) (string, error) {
+	if _, ok := ctx.Deadline(); ok {
+		return "", errors.New("expected no deadline")
+	}
+	return "done", nil
+}
+
+func TestCallTimeout(t *testing.T) {
+	ctx := context.Background()
+	o := New()
+	o.Register(&slow{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = h.Call(ctx, "slow", "Sleep", nil)
+	assert.Equal(t, protocol.CodeTimeout, errorCode(err))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/slow/Sleep", nil))
+	assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+
+	got, err := h.Call(ctx, "slow", "Quick", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `"done"`, string(got))
+}
+
+func TestClientDeadline(t *testing.T) {
+	o := New()
+	o.Register(&slow{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(timeout string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/slow/Wait", nil)
+		req.Header.Set(RequestTimeoutHeader, timeout)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("client deadline wins", func(t *testing.T) {
+		start := time.Now()
+		rec := serve("10ms")
+		assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+		assert.Contains(t, rec.Body.String(), "didn't complete before the caller's deadline")
+		assert.Less(t, time.Since(start), 100*time.Millisecond)
+
+		rec = serve("0.01")
+		assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := h.Call(ctx, "slow", "Wait", nil)
+		assert.Equal(t, protocol.CodeTimeout, errorCode(err))
+		assert.ErrorContains(t, err, "didn't complete before the caller's deadline")
+	})
+
+	t.Run("server timeout wins", func(t *testing.T) {
+		rec := serve("5s")
+		assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+		assert.Contains(t, rec.Body.String(), "timed out after 100ms")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := h.Call(ctx, "slow", "Wait", nil)
+		assert.Equal(t, protocol.CodeTimeout, errorCode(err))
+		assert.ErrorContains(t, err, "timed out after 100ms")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, timeout := range []string{"soon", "-1s", "0"} {
+			rec := serve(timeout)
+			assert.Equal(t, http.StatusBadRequest, rec.Code, timeout)
+		}
+	})
+}
+
+type untaggedNested struct {
+	PageSize int
+}
+
+type untaggedInput struct {
+	UserID   string
+	Tagged   string `json:"Tagged"`
+	Paging   untaggedNested
+	Optional *untaggedNested
+}
+
+type untaggedOutput struct {
+	DisplayName string
+	Items       []untaggedNested
+}
+
+type untagged struct {
+}
+
+func (untagged) Metadata() ServiceMetadata {
+	return ServiceMetadata{
+		ID: "untagged",
+	}
+}
+
+func (s *untagged) Get(ctx context.Context, input untaggedInput) (untaggedOutput, error) {
+	return untaggedOutput{
+		DisplayName: input.UserID + " " + input.Tagged,
+		Items:       []untaggedNested{input.Paging, *input.Optional},
+	}, nil
+}
+
+func TestFieldNaming(t *testing.T) {
+	ctx := context.Background()
+	o := New()
+	o.FieldNaming = SnakeCase
+	o.Register(&untagged{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := h.Call(ctx, "untagged", "Get", json.RawMessage(`{"user_id": "abc", "Tagged": "tag", "paging": {"page_size": 10}, "optional": {"page_size": 20}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.JSONEq(t, `{"display_name": "abc tag", "items": [{"page_size": 10}, {"page_size": 20}]}`, string(got))
+
+	schema, err := json.Marshal(h.ServiceDefinitions().Services[0].Operations[0].RequestBody.Schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{`"user_id"`, `"Tagged"`, `"paging"`, `"page_size"`} {
+		assert.Contains(t, string(schema), key)
+	}
+	assert.NotContains(t, string(schema), `"UserID"`)
+}
+
+func TestSchemaReflector(t *testing.T) {
+	requestSchema := func(o *Registry) string {
+		o.Register(&untagged{})
+		h, err := o.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		schema, err := json.Marshal(h.ServiceDefinitions().Services[0].Operations[0].RequestBody.Schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(schema)
+	}
+
+	assert.Contains(t, requestSchema(New()), `"$ref"`)
+
+	o := New()
+	o.FieldNaming = SnakeCase
+	o.SchemaReflector = &jsonschema.Reflector{DoNotReference: true, ExpandedStruct: true}
+	schema := requestSchema(o)
+	assert.NotContains(t, schema, `"$ref"`)
+	assert.Contains(t, schema, `"page_size"`, "the field naming policy should still be applied")
+	assert.Nil(t, o.SchemaReflector.KeyNamer, "the reflector shouldn't be modified")
+}
+
+type lister struct{}
+
+type listPaging struct {
+	Size int `json:"size" default:"10"`
+}
+
+type listInput struct {
+	Limit  int        `json:"limit" default:"50"`
+	Cursor *string    `json:"cursor" default:"start"`
+	Paging listPaging `json:"paging"`
+	Query  string     `json:"query"`
+}
+
+func (lister) Metadata() ServiceMetadata {
+	return ServiceMetadata{ID: "lister"}
+}
+
+func (lister) List(ctx context.Context, input listInput) listInput {
+	return input
+}
+
+type badDefault struct{}
+
+func (badDefault) Metadata() ServiceMetadata {
+	return ServiceMetadata{ID: "badDefault"}
+}
+
+func (badDefault) List(ctx context.Context, input struct {
+	Limit int `default:"many"`
+}) string {
+	return ""
+}
+
+func TestInputDefaults(t *testing.T) {
+	ctx := context.Background()
+	o := New()
+	o.Register(&lister{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := h.Call(ctx, "lister", "List", json.RawMessage(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.JSONEq(t, `{"limit": 50, "cursor": "start", "paging": {"size": 10}, "query": ""}`, string(got))
+
+	// fields in the request keep their value, even if it's the zero value.
+	got, err = h.Call(ctx, "lister", "List", json.RawMessage(`{"limit": 0, "cursor": null, "paging": {"size": 20}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.JSONEq(t, `{"limit": 0, "cursor": null, "paging": {"size": 20}, "query": ""}`, string(got))
+
+	schema, err := json.Marshal(h.ServiceDefinitions().Services[0].Operations[0].RequestBody.Schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(schema), `"limit":{"type":"integer","default":50}`)
+	assert.Contains(t, string(schema), `"cursor":{"type":"string","default":"start"}`)
+	assert.Contains(t, string(schema), `"size":{"type":"integer","default":10}`)
+
+	o = New()
+	o.Register(&badDefault{})
+	_, err = o.Build()
+	assert.ErrorContains(t, err, `invalid default for field Limit`)
+}
+
+func TestCasing(t *testing.T) {
+	tests := map[string][2]string{
+		"UserID":       {"userId", "user_id"},
+		"HTTPServerID": {"httpServerId", "http_server_id"},
+		"Name":         {"name", "name"},
+		"PageSize":     {"pageSize", "page_size"},
+	}
+
+	for in, want := range tests {
+		assert.Equal(t, want[0], CamelCase(in))
+		assert.Equal(t, want[1], SnakeCase(in))
+	}
+}
+
+type requiredAdded struct {
+}
+
+type requiredAddedInput struct {
+	Bar   string `json:"bar"`
+	Other string `json:"other"`
+}
+
+func (requiredAdded) Metadata() ServiceMetadata {
+	return ServiceMetadata{
+		ID: "example",
+	}
+}
+
+func (requiredAdded) Foo(ctx context.Context, input requiredAddedInput) string {
+	return "hello " + input.Bar
+}
+
+func TestAssertCompatibleWith(t *testing.T) {
+	o := New()
+	o.Register(&example{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	baseline := h.ServiceDefinitions()
+
+	assert.NoError(t, h.AssertCompatibleWith(baseline))
+
+	o = New()
+	o.Register(&requiredAdded{})
+	o.Register(&second{})
+	changed, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = changed.AssertCompatibleWith(baseline)
+	assert.ErrorContains(t, err, "example.Bar: operation was removed")
+	assert.ErrorContains(t, err, "example.Foo: request field other is now required")
+	assert.NotContains(t, err.Error(), "second")
+}
+
+type importRecord struct {
+	Name string `json:"name"`
+}
+
+type importSummary struct {
+	Imported []string `json:"imported"`
+}
+
+type importer struct {
+	frameTimeout time.Duration
+}
+
+func (s importer) Metadata() ServiceMetadata {
+	return ServiceMetadata{
+		ID: "importer",
+		OperationMetadata: map[string]OperationMetadata{
+			"Import": {FrameTimeout: s.frameTimeout},
+		},
+	}
+}
+
+func (s *importer) Import(ctx context.Context, in <-chan importRecord) (importSummary, error) {
+	var res importSummary
+	for record := range in {
+		res.Imported = append(res.Imported, record.Name)
+	}
+	return res, nil
+}
+
+func TestServeHTTPInputStream(t *testing.T) {
+	o := New()
+	o.Register(&importer{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op := h.ServiceDefinitions().Services[0].Operations[0]
+	assert.True(t, op.InputStream)
+	assert.NotNil(t, op.RequestBody)
+
+	body := "{\"name\": \"a\"}\n\n{\"name\": \"b\"}\n{\"name\": \"c\"}"
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/importer/Import", strings.NewReader(body)))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `{"imported":["a","b","c"]}`, rec.Body.String())
+}
+
+func TestCallInputStreamMalformedLine(t *testing.T) {
+	o := New()
+	o.Register(&importer{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := "{\"name\": \"a\"}\n{\"name\": \"b\"}\n{\"name\": \n{\"name\": \"d\"}\n"
+
+	_, err = h.Call(context.Background(), "importer", "Import", json.RawMessage(body))
+	assert.Equal(t, protocol.CodeBadRequest, errorCode(err))
+
+	var serr *StreamDecodeError
+	if assert.ErrorAs(t, err, &serr) {
+		assert.Equal(t, 3, serr.Line)
+	}
+}
+
+func TestServeHTTPInputStreamFrameTimeout(t *testing.T) {
+	o := New()
+	o.Register(&importer{frameTimeout: 50 * time.Millisecond})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	// send a single record, then stall.
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go func() {
+		_, _ = pw.Write([]byte("{\"name\": \"a\"}\n"))
+	}()
+
+	res, err := http.Post(srv.URL+"/importer/Import", "application/x-ndjson", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, http.StatusGatewayTimeout, res.StatusCode)
+	assert.Contains(t, string(b), "frame timeout exceeded: record 2 was not received within 50ms")
+}
+
+func TestServeHTTPOperationDefinition(t *testing.T) {
+	o := New()
+	o.Register(&example{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/.lightwave/operations/example/Foo", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var op servicedef.Operation
+	if err := json.Unmarshal(rec.Body.Bytes(), &op); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Foo", op.ID)
+	assert.Equal(t, "does foo", op.Description)
+	assert.NotNil(t, op.RequestBody)
+
+	for _, path := range []string{"/.lightwave/operations/example/Missing", "/.lightwave/operations/missing/Foo", "/.lightwave/operations/missing"} {
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusNotFound, rec.Code, path)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/.lightwave/operations", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestServeHTTPServiceDefinition(t *testing.T) {
+	o := New()
+	o.Register(&example{})
+	o.Register(&invoices{version: "v2"})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	rec := get("/.lightwave/operations/example")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var svc servicedef.Service
+	if err := json.Unmarshal(rec.Body.Bytes(), &svc); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "example", svc.ID)
+	assert.Len(t, svc.Operations, 2)
+
+	rec = get("/.lightwave/operations/v2/billing?summary=true")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"id": "billing", "version": "v2", "name": "", "description": "", "operations": ["CreateInvoice"]}`, rec.Body.String())
+
+	rec = get("/.lightwave/operations?summary=true")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "schema")
+	var summary servicedef.DefinitionsSummary
+	if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []servicedef.ServiceSummary{
+		{ID: "billing", Version: "v2", Operations: []string{"CreateInvoice"}},
+		{ID: "example", Name: "Example", Description: "My Example service", Operations: []string{"Bar", "Foo"}},
+	}, summary.Services)
+
+	rec = get("/.lightwave/operations/missing")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, "service missing not found", errorMessage(t, rec.Body))
+}
+
+func TestInputSchema(t *testing.T) {
+	o := New()
+	o.Register(&example{})
+	o.Register(&legacy{})
+	o.ShareSchemaDefinitions = true
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schema, ok := h.InputSchema("example", "Foo")
+	assert.True(t, ok)
+	if assert.NotNil(t, schema) {
+		assert.Contains(t, schema.Definitions, "fooInput", "shared definitions should be included")
+	}
+
+	schema, ok = h.InputSchema("legacy", "Old")
+	assert.True(t, ok)
+	assert.Nil(t, schema)
+
+	_, ok = h.InputSchema("example", "Missing")
+	assert.False(t, ok)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	rec := get("/.lightwave/schema/example/Foo")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), `"bar"`)
+
+	rec = get("/.lightwave/schema/example/Foo?response=true")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var res jsonschema.Schema
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "string", res.Type)
+
+	for path, want := range map[string]string{
+		"/.lightwave/schema/example/Missing": "operation Missing not found for service example",
+		"/.lightwave/schema/missing/Foo":     "operation Foo not found for service missing",
+		"/.lightwave/schema/legacy/Old":      "operation Old for service legacy has no input",
+		"/.lightwave/schema/example":         "invalid path: /.lightwave/schema/example",
+	} {
+		rec := get(path)
+		assert.Equal(t, http.StatusNotFound, rec.Code, path)
+		assert.Equal(t, want, errorMessage(t, rec.Body), path)
+	}
+}
+
+type benchInput struct {
+	Name   string            `json:"name"`
+	Limit  int               `json:"limit"`
+	Labels map[string]string `json:"labels"`
+	Nested struct {
+		Enabled bool     `json:"enabled"`
+		Tags    []string `json:"tags"`
+	} `json:"nested"`
+}
+
+type benchService struct {
+	id string
+}
+
+func (s benchService) Metadata() ServiceMetadata {
+	return ServiceMetadata{ID: s.id}
+}
+
+func (benchService) Create(ctx context.Context, input benchInput) (benchInput, error) {
+	return input, nil
+}
+func (benchService) Update(ctx context.Context, input benchInput) (benchInput, error) {
+	return input, nil
+}
+func (benchService) Delete(ctx context.Context, input benchInput) error { return nil }
+func (benchService) Get(ctx context.Context, input fooInput) (benchInput, error) {
+	return benchInput{}, nil
+}
+func (benchService) List(ctx context.Context, input fooInput) ([]benchInput, error) { return nil, nil }
+func (benchService) Import(ctx context.Context, in <-chan benchInput) error         { return nil }
+func (benchService) Status(ctx context.Context) (string, error)                     { return "ok", nil }
+func (benchService) Validate(ctx context.Context, input createInput) error          { return nil }
+
+// BenchmarkBuild builds a registry of 200 operations
+// which share a small number of input types.
+func BenchmarkBuild(b *testing.B) {
+	o := New()
+	for i := 0; i < 25; i++ {
+		o.Register(&benchService{id: fmt.Sprintf("bench%d", i)})
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := o.Build(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+type checksummed struct {
+}
+
+func (checksummed) Metadata() ServiceMetadata {
+	return ServiceMetadata{
+		ID: "checksummed",
+		OperationMetadata: map[string]OperationMetadata{
+			"Put": {Checksum: true},
+		},
+	}
+}
+
+func (s *checksummed) Put(ctx context.Context, input fooInput) string {
+	return "stored " + input.Bar
+}
+
+func TestServeHTTPChecksum(t *testing.T) {
+	o := New()
+	o.Register(&checksummed{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"bar": "test"}`
+
+	tests := []struct {
+		name     string
+		checksum string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "ok",
+			checksum: checksum([]byte(body)),
+			wantCode: http.StatusOK,
+			wantBody: `"stored test"`,
+		},
+		{
+			name:     "missing",
+			wantCode: http.StatusBadRequest,
+			wantBody: "missing X-Content-SHA256 header",
+		},
+		{
+			name:     "mismatch",
+			checksum: checksum([]byte(`{"bar": "other"}`)),
+			wantCode: http.StatusBadRequest,
+			wantBody: "request body checksum " + checksum([]byte(body)) + " does not match X-Content-SHA256 header " + checksum([]byte(`{"bar": "other"}`)),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/checksummed/Put", strings.NewReader(body))
+			if tt.checksum != "" {
+				req.Header.Set(ChecksumHeader, tt.checksum)
+			}
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantCode, rec.Code)
+			if tt.wantCode == http.StatusOK {
+				assert.Equal(t, tt.wantBody, rec.Body.String())
+			} else {
+				assert.Equal(t, tt.wantBody, errorMessage(t, rec.Body))
+			}
+
+			if tt.wantCode == http.StatusOK {
+				assert.Equal(t, checksum(rec.Body.Bytes()), rec.Header().Get(ChecksumHeader))
+			}
+		})
+	}
+}
+
+type unsupported struct {
+}
+
+func (unsupported) Metadata() ServiceMetadata {
+	return ServiceMetadata{
+		ID: "unsupported",
+	}
+}
+
+func (s *unsupported) NoContext(input fooInput, other fooInput) error              { return nil }
+func (s *unsupported) TwoInputs(ctx context.Context, a fooInput, b fooInput) error { return nil }
+func (s *unsupported) NoReturn(ctx context.Context)                                {}
+func (s *unsupported) NotError(ctx context.Context) (string, string)               { return "", "" }
+func (s *unsupported) Supported(ctx context.Context) (string, error)               { return "", nil }
+
+func TestBuildRejectsUnsupportedSignatures(t *testing.T) {
+	o := New()
+	o.Register(&unsupported{})
+	_, err := o.Build()
+
+	want := `unsupported operation signatures:
+unsupported.NoContext: the first argument must be a context.Context, got ops.fooInput
+unsupported.NoReturn: operations must return a value, an error, or both
+unsupported.NotError: the second return value must be an error, got string
+unsupported.TwoInputs: only one input argument is supported, got ops.fooInput and ops.fooInput`
+
+	assert.EqualError(t, err, want)
+}
+
+type invoices struct {
+	version string
+}
+
+func (b invoices) Metadata() ServiceMetadata {
+	return ServiceMetadata{ID: "billing", Version: b.version}
+}
+
+func (b invoices) CreateInvoice(ctx context.Context, input fooInput) string {
+	return input.Bar + " " + b.version
+}
+
+func TestVersionedServices(t *testing.T) {
+	o := New()
+	o.Register(&invoices{})
+	o.Register(&invoices{version: "v2"})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(path string) (int, string) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"bar": "invoice"}`)))
+		return rec.Code, rec.Body.String()
+	}
+
+	code, body := post("/billing/CreateInvoice")
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `"invoice "`, body)
+
+	code, body = post("/v2/billing/CreateInvoice")
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `"invoice v2"`, body)
+
+	code, _ = post("/v3/billing/CreateInvoice")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	got, err := h.Call(context.Background(), "v2/billing", "CreateInvoice", json.RawMessage(`{"bar": "invoice"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.JSONEq(t, `"invoice v2"`, string(got))
+
+	defs := h.ServiceDefinitions()
+	if assert.Len(t, defs.Services, 2) {
+		assert.Equal(t, "billing", defs.Services[0].Path())
+		assert.Equal(t, "v2/billing", defs.Services[1].Path())
+		assert.Equal(t, "/v2/billing/CreateInvoice", defs.Services[1].Operations[0].RoutingRule.Path)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/.lightwave/operations/v2/billing/CreateInvoice", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	o = New()
+	o.Register(&invoices{version: "v2"})
+	o.Register(&invoices{version: "v2"})
+	_, err = o.Build()
+	assert.ErrorContains(t, err, "a service with ID 'v2/billing' has already been registered")
+}
+
+type greeter struct {
+	greeting string
+}
+
+func (s *greeter) Greet(ctx context.Context, input fooInput) string {
+	return s.greeting + " " + input.Bar
+}
+
+func TestRegisterAs(t *testing.T) {
+	ctx := context.Background()
+	o := New()
+	o.RegisterAs("english", &greeter{greeting: "hello"})
+	o.RegisterAs("french", &greeter{greeting: "bonjour"})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, svc := range h.ServiceDefinitions().Services {
+		ids = append(ids, svc.ID)
+	}
+	assert.Equal(t, []string{"english", "french"}, ids)
+
+	got, err := h.Call(ctx, "english", "Greet", json.RawMessage(`{"bar": "world"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `"hello world"`, string(got))
+
+	got, err = h.Call(ctx, "french", "Greet", json.RawMessage(`{"bar": "world"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `"bonjour world"`, string(got))
+
+	o.RegisterAs("french", &greeter{greeting: "salut"})
+	_, err = o.Build()
+	assert.ErrorContains(t, err, "a service with ID 'french' has already been registered")
+}
+
+func TestRegistryServe(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := New()
+	o.Register(&example{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- o.Serve(ctx, ln)
+	}()
+
+	res, err := http.Post("http://"+ln.Addr().String()+"/example/Foo", "application/json", strings.NewReader(`{"bar": "world"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.JSONEq(t, `"hello world"`, string(body))
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+// pool is a service which acquires a resource when the server starts.
+type pool struct {
+	id       string
+	events   *[]string
+	startErr error
+}
+
+func (p *pool) Metadata() ServiceMetadata {
+	return ServiceMetadata{ID: p.id}
+}
+
+func (p *pool) Start(ctx context.Context) error {
+	*p.events = append(*p.events, "start "+p.id)
+	return p.startErr
+}
+
+func (p *pool) Stop(ctx context.Context) error {
+	*p.events = append(*p.events, "stop "+p.id)
+	return nil
+}
+
+func (p *pool) Query(ctx context.Context) string {
+	return "queried " + p.id
+}
+
+func TestLifecycle(t *testing.T) {
+	t.Run("start and stop", func(t *testing.T) {
+		var events []string
+		o := New()
+		o.Register(&pool{id: "users", events: &events})
+		o.Register(&example{})
+		o.Register(&pool{id: "orders", events: &events})
+		h, err := o.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		op, ok := h.operationDefinition("users", "Query")
+		assert.True(t, ok)
+		assert.Equal(t, "Query", op.ID)
+		_, ok = h.operationDefinition("users", "Start")
+		assert.False(t, ok, "lifecycle methods shouldn't be operations")
+		_, ok = h.operationDefinition("users", "Stop")
+		assert.False(t, ok, "lifecycle methods shouldn't be operations")
+
+		ctx := context.Background()
+		assert.NoError(t, h.Start(ctx))
+		assert.NoError(t, h.Stop(ctx))
+		assert.Equal(t, []string{"start users", "start orders", "stop orders", "stop users"}, events)
+	})
+
+	t.Run("start error", func(t *testing.T) {
+		var events []string
+		o := New()
+		o.Register(&pool{id: "users", events: &events})
+		o.Register(&pool{id: "orders", events: &events, startErr: errors.New("connection refused")})
+		o.Register(&pool{id: "items", events: &events})
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+
+		err = o.Serve(context.Background(), ln)
+		assert.EqualError(t, err, "starting service orders: connection refused")
+		assert.Equal(t, []string{"start users", "start orders", "stop users"}, events)
+	})
+
+	t.Run("serve", func(t *testing.T) {
+		var events []string
+		o := New()
+		o.Register(&pool{id: "users", events: &events})
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- o.Serve(ctx, ln)
+		}()
+
+		res, err := http.Post("http://"+ln.Addr().String()+"/users/Query", "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+
+		cancel()
+		assert.NoError(t, <-done)
+		assert.Equal(t, []string{"start users", "stop users"}, events)
+	})
+}
+
+func TestServeHTTPHealthAndReadiness(t *testing.T) {
+	o := New()
+	o.Register(&example{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, get("/.lightwave/healthz"))
+	assert.Equal(t, http.StatusOK, get("/.lightwave/readyz"))
+
+	// e.g. the tunnel is reconnecting
+	h.SetReady(false)
+	assert.Equal(t, http.StatusOK, get("/.lightwave/healthz"))
+	assert.Equal(t, http.StatusServiceUnavailable, get("/.lightwave/readyz"))
+
+	h.SetReady(true)
+	assert.Equal(t, http.StatusOK, get("/.lightwave/readyz"))
+}
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	metrics := NewMetrics()
+
+	o := New()
+	o.Register(&example{})
+	o.Register(&errorOnly{})
+	o.Use(metrics.Middleware())
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = h.Call(ctx, "example", "Foo", json.RawMessage(`{"bar": "test"}`))
+	_, _ = h.Call(ctx, "example", "Foo", json.RawMessage(`{"bar": "test"}`))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/example/Missing", strings.NewReader(`{}`)))
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.calls.WithLabelValues("example", "Foo", "CodeOK")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.calls.WithLabelValues("example", "Missing", "CodeNotFound")))
+	assert.Equal(t, 2, testutil.CollectAndCount(metrics, "ops_calls_total"))
+	assert.Equal(t, 2, testutil.CollectAndCount(metrics, "ops_call_duration_seconds"))
+}
+
+func TestServeHTTPTracing(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+
+	o := New()
+	o.Register(&example{})
+	o.Register(&errorOnly{})
+	o.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/example/Foo", strings.NewReader(`{"bar": "test"}`))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	_, err = h.Call(context.Background(), "example", "Missing", nil)
+	assert.Error(t, err)
+
+	ended := spans.Ended()
+	if assert.Len(t, ended, 2) {
+		assert.Equal(t, "example/Foo", ended[0].Name())
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", ended[0].SpanContext().TraceID().String())
+		assert.Equal(t, "00f067aa0ba902b7", ended[0].Parent().SpanID().String())
+		assert.Contains(t, ended[0].Attributes(), attribute.String("ops.response_code", "CodeOK"))
+
+		assert.Equal(t, "example/Missing", ended[1].Name())
+		assert.Equal(t, codes.Error, ended[1].Status().Code)
+		assert.Contains(t, ended[1].Attributes(), attribute.String("ops.response_code", "CodeNotFound"))
+	}
+}
+
+func TestResponseBodySchemas(t *testing.T) {
+	o := New()
+	o.Register(&errorOnly{})
+	o.Register(&watcher{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responses := map[string]string{}
+	for _, svc := range h.ServiceDefinitions().Services {
+		for _, op := range svc.Operations {
+			b, err := json.Marshal(op.ResponseBody)
+			if err != nil {
+				t.Fatal(err)
+			}
+			responses[svc.ID+"."+op.ID] = string(b)
+		}
+	}
+
+	// error-only operations have no response body
+	assert.JSONEq(t, `{"200": {}}`, responses["errorOnly.Delete"])
+	assert.Contains(t, responses["errorOnly.Get"], `"$ref":"#/$defs/secondOutput"`)
+	// subscriptions describe each event
+	assert.Contains(t, responses["watcher.Count"], `"$ref":"#/$defs/watchEvent"`)
+}
+
+type routed struct {
+}
+
+func (routed) Metadata() ServiceMetadata {
+	return ServiceMetadata{
+		ID: "users",
+		OperationMetadata: map[string]OperationMetadata{
+			"Get": {
+				RoutingRule: servicedef.RoutingRule{Type: "http", Method: http.MethodGet, Path: "/users/{id}"},
+			},
+		},
+	}
+}
+
+func (s *routed) Get(ctx context.Context, input fooInput) string  { return input.Bar }
+func (s *routed) List(ctx context.Context, input fooInput) string { return input.Bar }
+
+func TestRoutingRule(t *testing.T) {
+	o := New()
+	o.Register(&routed{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules := map[string]servicedef.RoutingRule{}
+	for _, op := range h.ServiceDefinitions().Services[0].Operations {
+		rules[op.ID] = op.RoutingRule
+	}
+
+	assert.Equal(t, servicedef.RoutingRule{Type: "http", Method: http.MethodGet, Path: "/users/{id}"}, rules["Get"])
+	assert.Equal(t, servicedef.RoutingRule{Type: "http", Method: http.MethodPost, Path: "/users/List"}, rules["List"])
+
+	// the handler still serves the operation at /{service}/{operation}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/users/Get", strings.NewReader(`{"bar": "test"}`)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+type addInput struct {
+	A int `json:"a"`
+	B int `json:"b"`
+}
+
+type addResult struct {
+	Sum int `json:"sum"`
+}
+
+type calc struct {
+}
+
+func (calc) Metadata() ServiceMetadata {
+	return ServiceMetadata{
+		ID: "calc",
+	}
+}
+
+func (s *calc) Add(input addInput) addResult {
+	return addResult{Sum: input.A + input.B}
+}
+
+func TestCallWithoutContext(t *testing.T) {
+	o := New()
+	o.Register(&calc{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := h.Call(context.Background(), "calc", "Add", json.RawMessage(`{"a": 1, "b": 2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `{"sum":3}`, string(got))
+
+	op := h.ServiceDefinitions().Services[0].Operations[0]
+	assert.NotNil(t, op.RequestBody)
+}
+
+func TestMetaPathPrefix(t *testing.T) {
+	o := New()
+	o.Register(&example{})
+	o.MetaPathPrefix = "/_meta/"
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, get("/_meta/operations"))
+	assert.Equal(t, http.StatusOK, get("/_meta/operations/example/Foo"))
+	assert.Equal(t, http.StatusOK, get("/_meta/healthz"))
+	assert.Equal(t, http.StatusOK, get("/_meta/readyz"))
+	assert.Equal(t, http.StatusMethodNotAllowed, get("/.lightwave/operations"))
+
+	o = New()
+	o.RegisterAs("_meta", &example{})
+	o.MetaPathPrefix = "/_meta"
+	_, err = o.Build()
+	assert.ErrorContains(t, err, "the service ID '_meta' collides with the discovery path prefix '/_meta'")
+}
+
+type customer struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type customerLoader map[string]customer
+
+func (l customerLoader) Load(ctx context.Context, id string) (*customer, error) {
+	if id == "broken" {
+		return nil, errors.New("database unavailable")
+	}
+	c, ok := l[id]
+	if !ok {
+		return nil, nil
+	}
+	return &c, nil
+}
+
+type billing struct{}
+
+type chargeInput struct {
+	CustomerID string `json:"customerId" resource:"id"`
+	Amount     int    `json:"amount"`
+}
+
+func (billing) Charge(ctx context.Context, c *customer, in chargeInput) (string, error) {
+	return fmt.Sprintf("charged %s %d", c.Name, in.Amount), nil
+}
+
+func TestCallLoadsResource(t *testing.T) {
+	o := New()
+	o.RegisterResource(NewResource[customer](customerLoader{"cus_1": {ID: "cus_1", Name: "Alice"}}))
+	o.Register(&billing{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := h.Call(context.Background(), "billing", "Charge", json.RawMessage(`{"customerId": "cus_1", "amount": 10}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `"charged Alice 10"`, string(got))
+
+	_, err = h.Call(context.Background(), "billing", "Charge", json.RawMessage(`{"customerId": "cus_2"}`))
+	assert.Equal(t, protocol.CodeNotFound, errorCode(err))
+
+	_, err = h.Call(context.Background(), "billing", "Charge", json.RawMessage(`{}`))
+	assert.Equal(t, protocol.CodeBadRequest, errorCode(err))
+
+	_, err = h.Call(context.Background(), "billing", "Charge", json.RawMessage(`{"customerId": "broken"}`))
+	assert.Equal(t, protocol.CodeServerError, errorCode(err))
+	assert.ErrorContains(t, err, "database unavailable")
+
+	// a resource can't be loaded without an ID field in the input.
+	o = New()
+	o.RegisterResource(NewResource[customer](customerLoader{}))
+	o.Register(&unsupportedResource{})
+	_, err = o.Build()
+	assert.ErrorContains(t, err, "has no resource ID field")
+}
+
+type unsupportedResource struct{}
+
+func (unsupportedResource) Get(ctx context.Context, c *customer, in fooInput) (string, error) {
+	return c.Name, nil
+}
+
+func TestResourceDefinitions(t *testing.T) {
+	o := New()
+	o.RegisterResource(NewResource[customer](customerLoader{}))
+	o.Register(&billing{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defs := h.ServiceDefinitions()
+	if assert.Len(t, defs.Resources, 1) {
+		assert.Equal(t, "customer", defs.Resources[0].ID)
+		snaps.MatchJSON(t, defs.Resources[0].Schema)
+	}
+
+	o.RegisterResource(NewResource[customer](customerLoader{}))
+	_, err = o.Build()
+	assert.ErrorContains(t, err, "the resource ops.customer has already been registered")
+}
+
+type bulk struct{}
+
+type echoInput struct {
+	Text   string `json:"text"`
+	Repeat int    `json:"repeat"`
+}
+
+func (bulk) Echo(ctx context.Context, in echoInput) (string, error) {
+	return strings.Repeat(in.Text, in.Repeat), nil
+}
+
+func TestServeHTTPCompression(t *testing.T) {
+	o := New()
+	o.Register(&bulk{})
+	o.Compression = &Compression{}
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	call := func(body io.Reader, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/bulk/Echo", body)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	want := `"` + strings.Repeat("a", 2048) + `"`
+
+	rec := call(strings.NewReader(`{"text": "a", "repeat": 2048}`), http.Header{"Accept-Encoding": {"gzip, br"}})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	gz, err := Gzip.Decompress(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, want, string(got))
+
+	// zstd is preferred, and request bodies are decompressed.
+	var reqBody strings.Builder
+	zw, err := Zstd.Compress(&reqBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = zw.Write([]byte(`{"text": "a", "repeat": 2048}`))
+	_ = zw.Close()
+
+	rec = call(strings.NewReader(reqBody.String()), http.Header{"Accept-Encoding": {"gzip;q=0.5, zstd"}, "Content-Encoding": {"zstd"}})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "zstd", rec.Header().Get("Content-Encoding"))
+	zr, err := Zstd.Decompress(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, want, string(got))
+
+	// responses below the minimum size aren't compressed.
+	rec = call(strings.NewReader(`{"text": "a", "repeat": 10}`), http.Header{"Accept-Encoding": {"gzip"}})
+	assert.Equal(t, "", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, `"aaaaaaaaaa"`, rec.Body.String())
+
+	// nor are responses for callers which don't accept an encoding.
+	rec = call(strings.NewReader(`{"text": "a", "repeat": 2048}`), nil)
+	assert.Equal(t, "", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, want, rec.Body.String())
+
+	rec = call(strings.NewReader(`{}`), http.Header{"Content-Encoding": {"br"}})
+	assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+}
+
+// closeRecorder records whether it was closed.
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+// plainCompressor is a Compressor which passes bodies through
+// unchanged, recording the decompressors it returns.
+type plainCompressor struct {
+	decompressors []*closeRecorder
+}
+
+func (*plainCompressor) Encoding() string { return "plain" }
+
+func (*plainCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (c *plainCompressor) Decompress(r io.Reader) (io.ReadCloser, error) {
+	dec := &closeRecorder{Reader: r}
+	c.decompressors = append(c.decompressors, dec)
+	return dec, nil
+}
+
+func TestServeHTTPClosesDecompressor(t *testing.T) {
+	compressor := &plainCompressor{}
+
+	o := New()
+	o.Register(&example{})
+	o.Compression = &Compression{Compressors: []Compressor{compressor}}
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/example/Foo", "/.lightwave/batch"} {
+		input := `{"bar": "test"}`
+		if path == "/.lightwave/batch" {
+			input = `[{"service": "example", "operation": "Foo", "input": {"bar": "test"}}]`
+		}
+		body := &closeRecorder{Reader: strings.NewReader(input)}
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Body = body
+		req.Header.Set("Content-Encoding", "plain")
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		assert.Less(t, rec.Code, 300, path)
+		assert.True(t, body.closed, "the request body to %s is closed", path)
+		if assert.Len(t, compressor.decompressors, 1, path) {
+			assert.True(t, compressor.decompressors[0].closed, "the decompressor for %s is closed", path)
+		}
+		compressor.decompressors = nil
+	}
+}
+
+type upperCodec struct {
+	JSONCodec
+}
+
+func (c upperCodec) Marshal(v any) ([]byte, error) {
+	b, err := c.JSONCodec.Marshal(v)
+	return []byte(strings.ToUpper(string(b))), err
+}
+
+func TestCodec(t *testing.T) {
+	o := New()
+	o.Register(&example{})
+	o.Codec = JSONCodec{DisallowUnknownFields: true}
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = h.Call(context.Background(), "example", "Foo", json.RawMessage(`{"bar": "baz"}`))
+	assert.NoError(t, err)
+
+	_, err = h.Call(context.Background(), "example", "Foo", json.RawMessage(`{"baz": "typo"}`))
+	assert.Equal(t, protocol.CodeBadRequest, errorCode(err))
+	assert.ErrorContains(t, err, `unknown field "baz"`)
+
+	_, err = h.Call(context.Background(), "example", "Foo", json.RawMessage(`{"bar": "baz"} {}`))
+	assert.Equal(t, protocol.CodeBadRequest, errorCode(err))
+
+	o.Codec = upperCodec{}
+	h, err = o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := h.Call(context.Background(), "example", "Foo", json.RawMessage(`{"bar": "baz", "unknown": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `"HELLO BAZ"`, string(got))
+}
+
+type panicky struct{}
+
+func (panicky) Explode(ctx context.Context) (string, error) {
+	panic("boom")
+}
+
+func (panicky) Ping(ctx context.Context) (string, error) {
+	return "pong", nil
+}
+
+func TestServeHTTPRecoversFromPanics(t *testing.T) {
+	o := New()
+	o.Register(&panicky{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	res, err := http.Post(srv.URL+"/panicky/Explode", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, res.StatusCode)
+	assert.Equal(t, "operation Explode for service panicky panicked: boom", errorMessage(t, bytes.NewReader(body)))
+
+	// the server keeps serving other requests.
+	res, err = http.Post(srv.URL+"/panicky/Ping", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, `"pong"`, string(body))
+}
+
+func TestServeHTTPAccessLog(t *testing.T) {
+	var buf strings.Builder
+	o := New()
+	o.Register(&example{})
+	o.Logger = slog.New(slog.NewJSONHandler(&buf, nil))
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// requests aren't logged by default.
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/example/Foo", strings.NewReader(`{"bar": "baz"}`)))
+	assert.Empty(t, buf.String())
+
+	o.AccessLog = true
+	h, err = o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/.lightwave/healthz", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/example/Foo", strings.NewReader(`{"bar": "baz"}`)))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if !assert.Len(t, lines, 1) {
+		return
+	}
+
+	var entry map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "served operation", entry["msg"])
+	assert.Equal(t, "INFO", entry["level"])
+	assert.Equal(t, "example", entry["service"])
+	assert.Equal(t, "Foo", entry["operation"])
+	assert.Equal(t, 200.0, entry["status"])
+	assert.Equal(t, float64(len(`"hello baz"`)), entry["bytes"])
+	assert.Contains(t, entry, "duration")
+
+	// requests aren't logged below the logger's level.
+	buf.Reset()
+	o.AccessLogLevel = slog.LevelDebug
+	h, err = o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/example/Foo", strings.NewReader(`{"bar": "baz"}`)))
+	assert.Empty(t, buf.String())
+}
+
+type limited struct{}
+
+func (limited) Metadata() ServiceMetadata {
+	return ServiceMetadata{
+		ID: "limited",
+		OperationMetadata: map[string]OperationMetadata{
+			"Slow":   {RateLimit: 1},
+			"Scoped": {RateLimit: 1, TenantScoped: true},
+		},
+	}
+}
+
+func (limited) Scoped(ctx context.Context) (string, error) {
+	return "ok", nil
+}
+
+func (limited) Slow(ctx context.Context) (string, error) {
+	return "ok", nil
+}
+
+func (limited) Fast(ctx context.Context) (string, error) {
+	return "ok", nil
+}
+
+func TestRateLimit(t *testing.T) {
+	o := New()
+	o.Register(&limited{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	call := func(op string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/limited/"+op, nil))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, call("Slow"))
+	assert.Equal(t, http.StatusTooManyRequests, call("Slow"))
+
+	// limits are per operation.
+	assert.Equal(t, http.StatusOK, call("Fast"))
+	assert.Equal(t, http.StatusOK, call("Fast"))
+
+	_, err = h.Call(context.Background(), "limited", "Slow", nil)
+	assert.Equal(t, protocol.CodeTooManyRequests, errorCode(err))
+
+	// calls without a tenant don't use up the limit.
+	for i := 0; i < 3; i++ {
+		_, err = h.Call(context.Background(), "limited", "Scoped", nil)
+		assert.Equal(t, protocol.CodeUnauthorized, errorCode(err))
+	}
+	_, err = h.Call(WithTenant(context.Background(), "acme"), "limited", "Scoped", nil)
+	assert.NoError(t, err)
+	_, err = h.Call(WithTenant(context.Background(), "acme"), "limited", "Scoped", nil)
+	assert.Equal(t, protocol.CodeTooManyRequests, errorCode(err))
+}
+
+func TestServeHTTPBatch(t *testing.T) {
+	for _, concurrency := range []int{0, 4} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			o := New()
+			o.Register(&example{})
+			o.Register(&panicky{})
+			o.Register(&watcher{})
+			o.BatchConcurrency = concurrency
+			h, err := o.Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body := `[
+				{"service": "example", "operation": "Foo", "input": {"bar": "one"}},
+				{"service": "example", "operation": "Missing"},
+				{"service": "panicky", "operation": "Explode"},
+				{"service": "watcher", "operation": "Forever"},
+				{"service": "example", "operation": "Foo", "input": {"bar": "two"}}
+			]`
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/.lightwave/batch", strings.NewReader(body)))
+			assert.Equal(t, http.StatusMultiStatus, rec.Code)
+
+			var res BatchResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, BatchResponse{
+				Results: []BatchResult{
+					{Status: http.StatusOK, Result: json.RawMessage(`"hello one"`)},
+					{Status: http.StatusNotFound, Error: "operation Missing not found for service example"},
+					{Status: http.StatusInternalServerError, Error: "operation Explode for service panicky panicked: boom"},
+					{Status: http.StatusBadRequest, Error: "operation Forever for service watcher can't be called in a batch"},
+					{Status: http.StatusOK, Result: json.RawMessage(`"hello two"`)},
+				},
+				Summary: BatchSummary{Succeeded: 2, Failed: 3},
+			}, res)
+		})
+	}
+
+	o := New()
+	o.Register(&example{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/.lightwave/batch", strings.NewReader(`{}`)))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestServeHTTPBatchOKOnSuccess(t *testing.T) {
+	succeeding := `[
+		{"service": "example", "operation": "Foo", "input": {"bar": "one"}},
+		{"service": "example", "operation": "Foo", "input": {"bar": "two"}}
+	]`
+	mixed := `[
+		{"service": "example", "operation": "Foo", "input": {"bar": "one"}},
+		{"service": "example", "operation": "Missing"}
+	]`
+
+	tests := []struct {
+		name        string
+		okOnSuccess bool
+		body        string
+		wantStatus  int
+		wantSummary BatchSummary
+	}{
+		{name: "all succeed", body: succeeding, wantStatus: http.StatusMultiStatus, wantSummary: BatchSummary{Succeeded: 2}},
+		{name: "all succeed with BatchOKOnSuccess", okOnSuccess: true, body: succeeding, wantStatus: http.StatusOK, wantSummary: BatchSummary{Succeeded: 2}},
+		{name: "mixed with BatchOKOnSuccess", okOnSuccess: true, body: mixed, wantStatus: http.StatusMultiStatus, wantSummary: BatchSummary{Succeeded: 1, Failed: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := New()
+			o.Register(&example{})
+			o.BatchOKOnSuccess = tt.okOnSuccess
+			h, err := o.Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/.lightwave/batch", strings.NewReader(tt.body)))
+			assert.Equal(t, tt.wantStatus, rec.Code)
+
+			var res BatchResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.wantSummary, res.Summary)
+			assert.Len(t, res.Results, tt.wantSummary.Succeeded+tt.wantSummary.Failed)
+		})
+	}
+}
+
+func TestServeHTTPJSONRPC(t *testing.T) {
+	o := New()
+	o.Register(&example{})
+	o.Register(&panicky{})
+	o.Register(&watcher{})
+	o.Register(&validated{})
+	o.Register(&errorOnly{})
+	o.ValidateInputs = true
+	o.JSONRPC = true
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	call := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/.lightwave/jsonrpc", strings.NewReader(body)))
+		return rec
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "result",
+			body: `{"jsonrpc": "2.0", "method": "example.Foo", "params": {"bar": "baz"}, "id": 1}`,
+			want: `{"jsonrpc": "2.0", "result": "hello baz", "id": 1}`,
+		},
+		{
+			name: "error only result",
+			body: `{"jsonrpc": "2.0", "method": "errorOnly.Delete", "params": {"bar": "baz"}, "id": 6}`,
+			want: `{"jsonrpc": "2.0", "result": null, "id": 6}`,
+		},
+		{
+			name: "method not found",
+			body: `{"jsonrpc": "2.0", "method": "example.Missing", "id": "a"}`,
+			want: `{"jsonrpc": "2.0", "error": {"code": -32601, "message": "method 'example.Missing' not found"}, "id": "a"}`,
+		},
+		{
+			name: "operation error",
+			body: `{"jsonrpc": "2.0", "method": "panicky.Explode", "id": 2}`,
+			want: `{"jsonrpc": "2.0", "error": {"code": -32603, "message": "operation Explode for service panicky panicked: boom", "data": {"code": "CodeServerError"}}, "id": 2}`,
+		},
+		{
+			name: "invalid params",
+			body: `{"jsonrpc": "2.0", "method": "validated.Create", "params": {"name": "test"}, "id": 3}`,
+			want: `{"jsonrpc": "2.0", "error": {"code": -32602, "message": "input validation failed: limit failed on the 'min=1' rule", "data": {"code": "CodeBadRequest", "fields": [{"field": "limit", "rule": "min", "message": "limit failed on the 'min=1' rule"}]}}, "id": 3}`,
+		},
+		{
+			name: "subscription",
+			body: `{"jsonrpc": "2.0", "method": "watcher.Forever", "id": 4}`,
+			want: `{"jsonrpc": "2.0", "error": {"code": -32600, "message": "operation Forever for service watcher can't be called with JSON-RPC"}, "id": 4}`,
+		},
+		{
+			name: "version",
+			body: `{"jsonrpc": "1.0", "method": "example.Foo", "id": 5}`,
+			want: `{"jsonrpc": "2.0", "error": {"code": -32600, "message": "unsupported JSON-RPC version '1.0', expected '2.0'"}, "id": 5}`,
+		},
+		{
+			name: "parse error",
+			body: `{"jsonrpc": `,
+			want: `{"jsonrpc": "2.0", "error": {"code": -32700, "message": "error unmarshalling request: unexpected end of JSON input"}, "id": null}`,
+		},
+		{
+			name: "batch",
+			body: `[
+				{"jsonrpc": "2.0", "method": "example.Foo", "params": {"bar": "one"}, "id": 1},
+				{"jsonrpc": "2.0", "method": "example.Foo", "params": {"bar": "notified"}},
+				{"jsonrpc": "2.0", "method": "example.Foo", "params": {"bar": "two"}, "id": 2}
+			]`,
+			want: `[
+				{"jsonrpc": "2.0", "result": "hello one", "id": 1},
+				{"jsonrpc": "2.0", "result": "hello two", "id": 2}
+			]`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := call(tc.body)
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.JSONEq(t, tc.want, rec.Body.String())
+		})
+	}
+
+	rec := call(`{"jsonrpc": "2.0", "method": "errorOnly.Delete", "params": {"bar": "baz"}, "id": 7}`)
+	assert.Contains(t, rec.Body.String(), `"result":null`, "successful responses must have a result")
+
+	rec = call(`{"jsonrpc": "2.0", "method": "example.Foo", "params": {"bar": "baz"}}`)
+	assert.Equal(t, http.StatusNoContent, rec.Code, "notifications have no response")
+
+	o.JSONRPC = false
+	h, err = o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = call(`{"jsonrpc": "2.0", "method": "example.Foo", "id": 1}`)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+type payments struct {
+	charges int
+}
+
+func (p *payments) Metadata() ServiceMetadata {
+	return ServiceMetadata{
+		ID: "payments",
+		OperationMetadata: map[string]OperationMetadata{
+			"Charge": {Idempotent: true},
+		},
+	}
+}
+
+func (p *payments) Charge(ctx context.Context) (int, error) {
+	p.charges++
+	return p.charges, nil
+}
+
+func (p *payments) Refund(ctx context.Context) (int, error) {
+	p.charges--
+	return p.charges, nil
+}
+
+func TestIdempotency(t *testing.T) {
+	svc := &payments{}
+	o := New()
+	o.Register(svc)
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	call := func(op string, key string) string {
+		req := httptest.NewRequest(http.MethodPost, "/payments/"+op, nil)
+		if key != "" {
+			req.Header.Set(IdempotencyKeyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+
+	assert.Equal(t, "1", call("Charge", "a"))
+	assert.Equal(t, "1", call("Charge", "a"))
+	assert.Equal(t, "2", call("Charge", "b"))
+	assert.Equal(t, "3", call("Charge", ""))
+	assert.Equal(t, 3, svc.charges)
+
+	// keys are scoped to the tenant.
+	got, err := h.Call(WithIdempotencyKey(WithTenant(context.Background(), "t1"), "a"), "payments", "Charge", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "4", string(got))
+
+	// operations which aren't marked as idempotent ignore the key.
+	assert.Equal(t, "3", call("Refund", "c"))
+	assert.Equal(t, "2", call("Refund", "c"))
+}
+
+type members struct{}
+
+func (members) Metadata() ServiceMetadata {
+	return ServiceMetadata{
+		ID: "members",
+		OperationMetadata: map[string]OperationMetadata{
+			"Get": {Parameters: []string{"orgID", "index"}},
+		},
+	}
+}
+
+func (members) Get(ctx context.Context, orgID string, index int, input fooInput) (string, error) {
+	return fmt.Sprintf("%s/%d/%s", orgID, index, input.Bar), nil
+}
+
+func TestParameters(t *testing.T) {
+	o := New()
+	o.Register(&members{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	call := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"bar": "baz"}`)))
+		return rec
+	}
+
+	rec := call("/members/Get/org%2F1/2")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `"org/1/2/baz"`, rec.Body.String())
+
+	rec = call("/members/Get/org_1/two")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "invalid parameter index")
+
+	rec = call("/members/Get/org_1")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	got, err := h.Call(WithParameters(context.Background(), map[string]string{"orgID": "org_1", "index": "3"}), "members", "Get", json.RawMessage(`{"bar": "baz"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, `"org_1/3/baz"`, string(got))
+
+	_, err = h.Call(context.Background(), "members", "Get", json.RawMessage(`{"bar": "baz"}`))
+	assert.EqualError(t, err, "missing parameter orgID")
+
+	op := h.ServiceDefinitions().Services[0].Operations[0]
+	assert.Equal(t, "/members/Get/{orgID}/{index}", op.RoutingRule.Path)
+	assert.Equal(t, []servicedef.Parameter{
+		{Name: "orgID", In: "path", Schema: jsonschema.Schema{Type: "string"}},
+		{Name: "index", In: "path", Schema: jsonschema.Schema{Type: "integer"}},
+	}, op.Parameters)
+}
+
+func TestRegistryHandler(t *testing.T) {
+	o := New()
+	o.Register(&example{})
+
+	handlers := make(chan *Handler, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h, err := o.Handler()
+			assert.NoError(t, err)
+			handlers <- h
+		}()
+	}
+	wg.Wait()
+	close(handlers)
+
+	first := <-handlers
+	assert.NotNil(t, first)
+	for h := range handlers {
+		assert.Same(t, first, h)
+	}
+
+	o.Register(&second{})
+	_, err := o.Handler()
+	assert.EqualError(t, err, "Register(*ops.second) was called after the handler was built by Registry.Handler and has no effect")
+}
+
+func TestNewTunnelSharesHandler(t *testing.T) {
+	metrics := NewMetrics()
+
+	o := New()
+	o.Register(&example{})
+	h, err := o.Handler()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each tunnel serves a copy of the handler sharing its operations,
+	// with its own metrics, request size limit and readiness.
+	var handlers []*Handler
+	for i := 0; i < 2; i++ {
+		tun, err := o.NewTunnel(StartOpts{Metrics: metrics, MaxRequestBytes: 8})
+		if err != nil {
+			t.Fatal(err)
+		}
+		th, ok := tun.Handler.(*Handler)
+		if !ok {
+			t.Fatalf("the tunnel's handler is a %T", tun.Handler)
+		}
+		assert.NotSame(t, h, th)
+		assert.False(t, th.Ready(), "the tunnel's handler isn't ready until the tunnel connects")
+		handlers = append(handlers, th)
+	}
+	assert.True(t, h.Ready(), "tunnels don't change the readiness of the shared handler")
+
+	handlers[0].SetReady(true)
+	assert.False(t, handlers[1].Ready(), "each tunnel tracks its own readiness")
+
+	_, _ = h.Call(context.Background(), "example", "Foo", json.RawMessage(`{"bar": "test"}`))
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.calls.WithLabelValues("example", "Foo", "CodeOK")), "calls which aren't served by a tunnel aren't recorded")
+
+	_, _ = handlers[0].Call(context.Background(), "example", "Foo", json.RawMessage(`{"bar": "test"}`))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.calls.WithLabelValues("example", "Foo", "CodeOK")))
+	assert.Len(t, metrics.handlers, 1, "the shared circuit breakers are observed once")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/example/Foo", strings.NewReader(`{"bar": "test"}`)))
+	assert.Equal(t, http.StatusOK, rec.Code, "the tunnel's request size limit doesn't apply to the shared handler")
+
+	rec = httptest.NewRecorder()
+	handlers[0].ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/example/Foo", strings.NewReader(`{"bar": "test"}`)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	o.Register(&second{})
+	_, err = o.NewTunnel(StartOpts{})
+	assert.EqualError(t, err, "Register(*ops.second) was called after the handler was built by Registry.Handler and has no effect")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	err = o.Serve(context.Background(), ln)
+	assert.EqualError(t, err, "Register(*ops.second) was called after the handler was built by Registry.Handler and has no effect")
+}
+
+func TestServeHTTPMaxRequestBytes(t *testing.T) {
+	o := New()
+	o.Register(&example{})
+	o.MaxRequestBytes = 64
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/example/Foo", strings.NewReader(`{"bar": "baz"}`)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/example/Foo", strings.NewReader(`{"bar": "`+strings.Repeat("a", 64)+`"}`)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	assert.Contains(t, rec.Body.String(), "request body exceeds the limit of 64 bytes")
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/.lightwave/batch", strings.NewReader(`[{"service": "example", "operation": "Foo", "input": {"bar": "`+strings.Repeat("a", 64)+`"}}]`)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+}
+
+func TestRegisterOperation(t *testing.T) {
+	o := New()
+	o.RegisterOperation("calc", "Add", func(input addInput) addResult {
+		return addResult{Sum: input.A + input.B}
+	})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := h.Call(context.Background(), "calc", "Add", json.RawMessage(`{"a": 1, "b": 2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `{"sum":3}`, string(got))
+
+	// the definition matches that of the equivalent method.
+	methods := New()
+	methods.Register(&calc{})
+	mh, err := methods.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, mh.ServiceDefinitions(), h.ServiceDefinitions())
+
+	// operations are added to registered services.
+	o = New()
+	o.Register(&example{})
+	o.RegisterOperation("example", "Ping", func(ctx context.Context) (string, error) {
+		return "pong", nil
+	})
+	o.RegisterOperation("example", "Foo", func(ctx context.Context) error { return nil })
+	o.RegisterOperation("example", "Bad", "not a function")
+	_, err = o.Build()
+	assert.ErrorContains(t, err, "example.Foo: an operation with ID 'Foo' has already been registered for the service")
+	assert.ErrorContains(t, err, "example.Bad: expected a function, got string")
+	assert.NotContains(t, err.Error(), "Ping")
+
+	o = New()
+	o.Register(&example{})
+	o.RegisterOperation("example", "Ping", func(ctx context.Context) (string, error) {
+		return "pong", nil
+	})
+	h, err = o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = h.Call(context.Background(), "example", "Ping", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `"pong"`, string(got))
+	assert.Len(t, h.ServiceDefinitions().Services, 1)
+}
+
+func TestListOperations(t *testing.T) {
+	o := New()
+	o.Register(&example{})
+	o.Register(&invoices{version: "v2"})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"v2/billing", "example"}, h.Services())
+
+	ops, ok := h.Operations("example")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"Bar", "Foo"}, ops)
+
+	_, ok = h.Operations("missing")
+	assert.False(t, ok)
+
+	assert.True(t, h.HasOperation("example", "Foo"))
+	assert.True(t, h.HasOperation("v2/billing", "CreateInvoice"))
+	assert.False(t, h.HasOperation("example", "Missing"))
+	assert.False(t, h.HasOperation("billing", "CreateInvoice"))
+}
+
+func TestDefinitionsAreSorted(t *testing.T) {
+	build := func(services ...any) servicedef.Definitions {
+		o := New()
+		for _, svc := range services {
+			o.Register(svc)
+		}
+		o.RegisterOperation("calc", "Subtract", func(input addInput) addResult {
+			return addResult{Sum: input.A - input.B}
+		})
+		h, err := o.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h.ServiceDefinitions()
+	}
+
+	a := build(&example{}, &calc{}, &noInput{})
+	b := build(&noInput{}, &calc{}, &example{})
+	assert.Equal(t, a, b)
+
+	var ids []string
+	for _, svc := range a.Services {
+		ids = append(ids, svc.ID)
+	}
+	assert.Equal(t, []string{"calc", "example", "noInput"}, ids)
+	assert.Equal(t, "Add", a.Services[0].Operations[0].ID)
+	assert.Equal(t, "Subtract", a.Services[0].Operations[1].ID)
+}
+
+func TestServeHTTPContentType(t *testing.T) {
+	post := func(h *Handler, path string, contentType string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"bar": "baz"}`))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	o := New()
+	o.Register(&example{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := post(h, "/example/Foo", "text/plain")
+	assert.Equal(t, http.StatusOK, rec.Code, "content types aren't checked by default")
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	rec = post(h, "/example/Missing", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"), "errors are described by an ErrorResponse")
+
+	o = New()
+	o.Register(&example{})
+	o.ContentTypeCheck = ContentTypeAllowMissing
+	h, err = o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, http.StatusOK, post(h, "/example/Foo", "").Code)
+	assert.Equal(t, http.StatusOK, post(h, "/example/Foo", "application/json; charset=utf-8").Code)
+	rec = post(h, "/example/Foo", "text/plain")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, `unsupported Content-Type "text/plain", requests must be application/json`, errorMessage(t, rec.Body))
+
+	o = New()
+	o.Register(&example{})
+	o.ContentTypeCheck = ContentTypeRequired
+	h, err = o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, post(h, "/example/Foo", "").Code)
+	assert.Equal(t, http.StatusBadRequest, post(h, "/.lightwave/batch", "").Code)
+	assert.Equal(t, http.StatusOK, post(h, "/example/Foo", "application/vnd.example+json").Code)
+}
+
+type metadataReader struct{}
+
+func (metadataReader) Metadata() ServiceMetadata {
+	return ServiceMetadata{ID: "metadata"}
+}
+
+func (metadataReader) Get(ctx context.Context) Metadata {
+	return MetadataFromContext(ctx)
+}
+
+func TestMetadataFromContext(t *testing.T) {
+	o := New()
+	o.Register(&metadataReader{})
+	o.MetadataHeaders = []string{"X-Request-Id", "X-Region"}
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/metadata/Get", nil)
+	req.Header.Set("x-request-id", "req_1")
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"X-Request-Id": "req_1"}`, rec.Body.String(), "only the listed headers should be exposed")
+
+	ctx := WithMetadata(context.Background(), map[string]string{"x-region": "eu"})
+	got, err := h.Call(ctx, "metadata", "Get", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.JSONEq(t, `{"X-Region": "eu"}`, string(got))
+
+	region, ok := MetadataFromContext(ctx).Get("x-region")
+	assert.True(t, ok)
+	assert.Equal(t, "eu", region)
+	assert.NotNil(t, MetadataFromContext(context.Background()))
+}
+
+type legacy struct{}
+
+func (legacy) Metadata() ServiceMetadata {
+	return ServiceMetadata{
+		ID: "legacy",
+		OperationMetadata: map[string]OperationMetadata{
+			"Old": {Deprecated: true, DeprecationMessage: `use "New" instead`},
+		},
+	}
+}
+
+func (legacy) Old(ctx context.Context) string { return "old" }
+func (legacy) New(ctx context.Context) string { return "new" }
+
+func TestDeprecatedOperations(t *testing.T) {
+	o := New()
+	o.Register(&legacy{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/legacy/Old", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "true", rec.Header().Get("Deprecation"))
+	assert.Equal(t, `299 - "use \"New\" instead"`, rec.Header().Get("Warning"))
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/legacy/New", nil))
+	assert.Empty(t, rec.Header().Get("Deprecation"))
+	assert.Empty(t, rec.Header().Get("Warning"))
+
+	ops := map[string]string{}
+	for _, op := range h.ServiceDefinitions().Services[0].Operations {
+		b, err := json.Marshal(op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ops[op.ID] = string(b)
+	}
+	assert.Contains(t, ops["Old"], `"deprecated":true,"deprecationMessage":"use \"New\" instead"`)
+	assert.NotContains(t, ops["New"], "deprecat")
+}
+
+var errMissing = errors.New("missing")
+
+type sentinels struct{}
+
+func (sentinels) Metadata() ServiceMetadata {
+	return ServiceMetadata{ID: "sentinels"}
+}
+
+func (sentinels) Get(ctx context.Context, input fooInput) (string, error) {
+	switch input.Bar {
+	case "missing":
+		return "", fmt.Errorf("getting %s: %w", input.Bar, errMissing)
+	case "explicit":
+		return "", &Error{Code: protocol.CodeUnauthorized, Err: errMissing}
+	default:
+		return "", errors.New("unexpected")
+	}
+}
+
+func TestErrorMapper(t *testing.T) {
+	o := New()
+	o.Register(&sentinels{})
+	o.ErrorMapper = func(err error) protocol.ResponseCode {
+		if errors.Is(err, errMissing) {
+			return protocol.CodeNotFound
+		}
+		return protocol.CodeOK
+	}
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := func(bar string) protocol.ResponseCode {
+		_, err := h.Call(context.Background(), "sentinels", "Get", json.RawMessage(`{"bar": "`+bar+`"}`))
+		return errorCode(err)
+	}
+
+	assert.Equal(t, protocol.CodeNotFound, code("missing"))
+	assert.Equal(t, protocol.CodeUnauthorized, code("explicit"), "the code of an *Error should be used as-is")
+	assert.Equal(t, protocol.CodeServerError, code("other"))
+}
+
+func TestConcurrentCalls(t *testing.T) {
+	o := New()
+	o.Register(&example{})
+	o.Register(&lister{})
+	o.Register(&invoices{version: "v2"})
+	o.RegisterOperation("math", "Double", func(ctx context.Context, n int) int { return n * 2 })
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type call struct {
+		service, operation, input, want string
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 100; i++ {
+		calls := []call{
+			{"example", "Foo", fmt.Sprintf(`{"bar": "%d"}`, i), fmt.Sprintf(`"hello %d"`, i)},
+			{"lister", "List", fmt.Sprintf(`{"query": "%d"}`, i), fmt.Sprintf(`{"limit": 50, "cursor": "start", "paging": {"size": 10}, "query": "%d"}`, i)},
+			{"v2/billing", "CreateInvoice", fmt.Sprintf(`{"bar": "%d"}`, i), fmt.Sprintf(`"%d v2"`, i)},
+			{"math", "Double", fmt.Sprint(i), fmt.Sprint(i * 2)},
+		}
+
+		for _, c := range calls {
+			wg.Add(1)
+			go func(c call) {
+				defer wg.Done()
+
+				// alternate between Call and ServeHTTP.
+				var got string
+				if len(c.input)%2 == 0 {
+					res, err := h.Call(context.Background(), c.service, c.operation, json.RawMessage(c.input))
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					got = string(res)
+				} else {
+					rec := httptest.NewRecorder()
+					h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/"+c.service+"/"+c.operation, strings.NewReader(c.input)))
+					got = rec.Body.String()
+				}
+
+				assert.JSONEq(t, c.want, got, "%s.%s(%s)", c.service, c.operation, c.input)
+			}(c)
+		}
+	}
+
+	wg.Wait()
+}
+
+func TestShareSchemaDefinitions(t *testing.T) {
+	build := func(share bool) servicedef.Definitions {
+		o := New()
+		o.ShareSchemaDefinitions = share
+		o.Register(&example{})
+		o.Register(&lister{})
+		h, err := o.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h.ServiceDefinitions()
+	}
+
+	inlined, shared := build(false), build(true)
+
+	assert.Contains(t, shared.Defs, "fooInput")
+	assert.Contains(t, shared.Defs, "listPaging")
+	for _, svc := range shared.Services {
+		for _, op := range svc.Operations {
+			assert.Empty(t, op.RequestBody.Schema.Definitions, "%s.%s", svc.ID, op.ID)
+		}
+	}
+	assert.NotEmpty(t, inlined.Services[0].Operations[0].RequestBody.Schema.Definitions, "definitions are inlined by default")
+
+	a, err := json.Marshal(inlined)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Less(t, len(b), len(a))
+
+	// clients generated from either are the same.
+	want, err := inlined.GoClient("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := shared.GoClient("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(want), string(got))
+}
+
+type baseService struct{}
+
+func (baseService) Health(ctx context.Context) string { return "ok" }
+
+// Connect is a helper which can't be an operation.
+func (baseService) Connect(dsn string, retries int) (string, int) { return dsn, retries }
+
+type composed struct {
+	baseService
+}
+
+func (composed) Metadata() ServiceMetadata {
+	return ServiceMetadata{
+		ID: "composed",
+		OperationMetadata: map[string]OperationMetadata{
+			"Connect": {Hidden: true},
+			"Reset":   {Hidden: true},
+		},
+	}
+}
+
+func (composed) Get(ctx context.Context) string { return "get" }
+func (composed) Reset(ctx context.Context)      {}
+
+func TestEmbeddedServices(t *testing.T) {
+	o := New()
+	o.Register(&composed{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ops, ok := h.Operations("composed")
+	assert.True(t, ok)
+	assert.ElementsMatch(t, []string{"Get", "Health"}, ops)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/composed/Health", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `"ok"`, strings.TrimSpace(rec.Body.String()))
+
+	for _, op := range []string{"Connect", "Reset"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/composed/"+op, nil))
+		assert.Equal(t, http.StatusNotFound, rec.Code, op)
+	}
+}
+
+type admin struct{}
+
+func (admin) Metadata() ServiceMetadata {
+	return ServiceMetadata{
+		ID: "admin",
+		OperationMetadata: map[string]OperationMetadata{
+			"Delete": {Scopes: []string{"admin:write"}},
+		},
+	}
+}
+
+func (admin) Delete(ctx context.Context) string { return "deleted" }
+func (admin) List(ctx context.Context) string   { return "listed" }
+
+func TestAuthorizer(t *testing.T) {
+	o := New()
+	o.Register(&admin{})
+	_, err := o.Build()
+	assert.EqualError(t, err, "the operation Delete for service admin requires scopes, but Registry.Authorizer isn't set")
+
+	var calls int
+	o.Authorizer = AuthorizerFunc(func(ctx context.Context, service, operation string, required []string) error {
+		calls++
+		assert.Equal(t, "admin", service)
+		assert.Equal(t, "Delete", operation)
+		assert.Equal(t, []string{"admin:write"}, required)
+
+		scope, _ := MetadataFromContext(ctx).Get("X-Scope")
+		if scope == "forbidden" {
+			return &Error{Code: protocol.CodeNotFound, Err: errors.New("hidden")}
+		}
+		if scope != "admin:write" {
+			return errors.New("missing scope admin:write")
+		}
+		return nil
+	})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = h.Call(context.Background(), "admin", "Delete", nil)
+	assert.EqualError(t, err, "operation Delete for service admin: missing scope admin:write")
+	assert.Equal(t, protocol.CodeUnauthorized, errorCode(err))
+
+	_, err = h.Call(WithMetadata(context.Background(), map[string]string{"X-Scope": "forbidden"}), "admin", "Delete", nil)
+	assert.Equal(t, protocol.CodeNotFound, errorCode(err))
+
+	res, err := h.Call(WithMetadata(context.Background(), map[string]string{"X-Scope": "admin:write"}), "admin", "Delete", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `"deleted"`, strings.TrimSpace(string(res)))
+
+	_, err = h.Call(context.Background(), "admin", "List", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls, "operations without scopes shouldn't be authorized")
+
+	assert.Equal(t, []string{"admin:write"}, h.ServiceDefinitions().Services[0].Operations[0].Scopes)
+}
+
+type nothing struct{}
+
+func (nothing) Metadata() ServiceMetadata {
+	return ServiceMetadata{ID: "nothing"}
+}
+
+func (nothing) Pointer(ctx context.Context) (*fooInput, error) { return nil, nil }
+func (nothing) Slice(ctx context.Context) ([]string, error)    { return nil, nil }
+func (nothing) Map(ctx context.Context) map[string]int         { return nil }
+func (nothing) Any(ctx context.Context) any                    { return nil }
+
+func TestNilResults(t *testing.T) {
+	o := New()
+	o.Register(&nothing{})
+	o.FieldNaming = SnakeCase
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, op := range []string{"Pointer", "Slice", "Map", "Any"} {
+		res, err := h.Call(context.Background(), "nothing", op, nil)
+		assert.NoError(t, err, op)
+		assert.Equal(t, "null", string(res), op)
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/nothing/"+op, nil))
+		assert.Equal(t, http.StatusOK, rec.Code, op)
+		assert.Equal(t, "null", strings.TrimSpace(rec.Body.String()), op)
+	}
+}
+
+type pointers struct{}
+
+func (pointers) Metadata() ServiceMetadata {
+	return ServiceMetadata{ID: "pointers"}
+}
+
+func (pointers) Greet(ctx context.Context, input *listInput) (string, error) {
+	if input == nil {
+		return "", errors.New("nil input")
+	}
+	return fmt.Sprintf("%s %d", input.Query, input.Limit), nil
+}
+
+func TestPointerInput(t *testing.T) {
+	o := New()
+	o.Register(&pointers{})
+	o.ValidateInputs = true
+
+	var validated any
+	o.InputValidator = InputValidatorFunc(func(ctx context.Context, req ValidationRequest) error {
+		validated = req.Input
+		return nil
+	})
+
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op, ok := h.operationDefinition("pointers", "Greet")
+	assert.True(t, ok)
+	b, err := json.Marshal(op.RequestBody.Schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(b), `"query"`, "the schema should describe the struct rather than a pointer")
+
+	res, err := h.Call(context.Background(), "pointers", "Greet", json.RawMessage(`{"query": "hello"}`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `"hello 50"`, string(res))
+	assert.IsType(t, &listInput{}, validated)
+
+	res, err = h.Call(context.Background(), "pointers", "Greet", json.RawMessage(`null`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `" 50"`, string(res), "a null input should be passed as a pointer to the defaults")
+}
+
+type flaky struct{}
+
+func (flaky) Metadata() ServiceMetadata {
+	return ServiceMetadata{
+		ID: "flaky",
+		OperationMetadata: map[string]OperationMetadata{
+			"Fetch":   {Retryable: true, RetryAfter: 1500 * time.Millisecond},
+			"Refresh": {Retryable: true},
+		},
+	}
+}
+
+func (flaky) Fetch(ctx context.Context, input fooInput) error {
+	if input.Bar == "bad" {
+		return &Error{Code: protocol.CodeBadRequest, Err: errors.New("bad input")}
+	}
+	return errors.New("unavailable")
+}
+
+func (flaky) Refresh(ctx context.Context) error { return errors.New("unavailable") }
+func (flaky) Charge(ctx context.Context) error  { return errors.New("unavailable") }
+
+func TestRetryableOperations(t *testing.T) {
+	o := New()
+	o.Register(&flaky{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	call := func(op string, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/flaky/"+op, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := call("Fetch", `{"bar": "baz"}`)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("Retry-After"))
+
+	rec = call("Fetch", `{"bar": "bad"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Empty(t, rec.Header().Get("Retry-After"), "bad requests shouldn't be retried")
+
+	rec = call("Refresh", "")
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+
+	rec = call("Charge", "")
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Empty(t, rec.Header().Get("Retry-After"), "operations aren't retryable by default")
+
+	retryable := map[string]bool{}
+	for _, op := range h.ServiceDefinitions().Services[0].Operations {
+		retryable[op.ID] = op.Retryable
+	}
+	assert.Equal(t, map[string]bool{"Charge": false, "Fetch": true, "Refresh": true}, retryable)
+}
+
+type reports struct{}
+
+func (reports) Metadata() ServiceMetadata {
+	return ServiceMetadata{ID: "reports"}
+}
+
+func (reports) Export(ctx context.Context) (RawResponse, error) {
+	return RawResponse{ContentType: "text/csv", Body: []byte("id,name\n1,alice\n")}, nil
+}
+
+func (reports) Download(ctx context.Context) *RawResponse {
+	return &RawResponse{Body: []byte{0x00, 0x01}}
+}
+
+func TestRawResponse(t *testing.T) {
+	o := New()
+	o.Register(&reports{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := h.Call(context.Background(), "reports", "Export", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "id,name\n1,alice\n", string(res))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/reports/Export", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/csv", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "id,name\n1,alice\n", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/reports/Download", nil))
+	assert.Equal(t, "application/octet-stream", rec.Header().Get("Content-Type"))
+	assert.Equal(t, []byte{0x00, 0x01}, rec.Body.Bytes())
+
+	op, ok := h.operationDefinition("reports", "Export")
+	assert.True(t, ok)
+	assert.True(t, op.RawResponse)
+	res200 := op.ResponseBody["200"]
+	assert.Equal(t, "binary", res200.Format)
+
+	results := h.callBatch(context.Background(), []BatchCall{{Service: "reports", Operation: "Export"}})
+	assert.Equal(t, http.StatusBadRequest, results[0].Status)
+}
+
+func TestTestClient(t *testing.T) {
+	ctx := context.Background()
+
+	o := New()
+	o.Register(&example{})
+	o.Register(&untagged{})
+	o.Register(&reports{})
+	o.Register(&sentinels{})
+	o.FieldNaming = SnakeCase
+	c, err := NewTestClient(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := CallAs[string](ctx, c, "example", "Foo", fooInput{Bar: "testing"})
+	assert.NoError(t, err)
+	assert.Equal(t, "hello testing", got)
+
+	out, err := CallAs[untaggedOutput](ctx, c, "untagged", "Get", untaggedInput{
+		UserID:   "abc",
+		Tagged:   "tag",
+		Paging:   untaggedNested{PageSize: 10},
+		Optional: &untaggedNested{PageSize: 20},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, untaggedOutput{DisplayName: "abc tag", Items: []untaggedNested{{PageSize: 10}, {PageSize: 20}}}, out)
+
+	csv, err := CallAs[[]byte](ctx, c, "reports", "Export", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "id,name\n1,alice\n", string(csv))
+
+	_, err = CallAs[string](ctx, c, "sentinels", "Get", fooInput{Bar: "explicit"})
+	assert.Equal(t, protocol.CodeUnauthorized, errorCode(err))
+
+	err = c.Call(ctx, "example", "Missing", nil, nil)
+	assert.Equal(t, protocol.CodeNotFound, errorCode(err))
+
+	bad := New()
+	bad.Register(example{})
+	_, err = NewTestClient(bad)
+	assert.Error(t, err, "build errors should be returned")
+}
+
+func TestPartialBuild(t *testing.T) {
+	newRegistry := func() *Registry {
+		o := New()
+		o.Register(&example{})
+		o.Register(&unsupported{})
+		o.Register(second{})
+		o.RegisterAs("example", &noInput{})
+		o.RegisterOperation("example", "Extra", func(ctx context.Context) {})
+		return o
+	}
+
+	_, err := newRegistry().Build()
+	assert.Error(t, err, "builds should fail on the first error by default")
+
+	o := newRegistry()
+	o.PartialBuild = true
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"example"}, h.Services())
+	res, err := h.Call(context.Background(), "example", "Foo", json.RawMessage(`{"bar": "ok"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, `"hello ok"`, string(res))
+
+	var errs []string
+	for _, err := range h.BuildErrors() {
+		errs = append(errs, strings.SplitN(err.Error(), "\n", 2)[0])
+	}
+	assert.Equal(t, []string{
+		"unsupported operation signatures:",
+		"received a struct that wasn't a pointer for ops.second: ensure that you call Register() with the address of the struct, e.g. Register(&MyService{})",
+		"a service with ID 'example' has already been registered, please rename the service or remove the second registration (you can update the ID by setting it in Metadata(), or by registering the service with RegisterAs())",
+		"example.Extra: operations must return a value, an error, or both",
+	}, errs)
+
+	o = New()
+	o.Register(&example{})
+	o.PartialBuild = true
+	h, err = o.Build()
+	assert.NoError(t, err)
+	assert.Empty(t, h.BuildErrors())
+}
+
+func TestRegistryValidate(t *testing.T) {
+	o := New()
+	o.Register(&example{})
+	o.Register(&unsupported{})
+	o.Register(second{})
+	o.RegisterAs("example", &noInput{})
+	o.RegisterOperation("example", "Extra", func(ctx context.Context) {})
+
+	err := o.Validate()
+	if assert.Error(t, err) {
+		assert.Equal(t, []string{
+			"received a struct that wasn't a pointer for ops.second: ensure that you call Register() with the address of the struct, e.g. Register(&MyService{})",
+			"a service with ID 'example' has already been registered, please rename the service or remove the second registration (you can update the ID by setting it in Metadata(), or by registering the service with RegisterAs())",
+			"unsupported operation signatures:",
+			"unsupported.NoContext: the first argument must be a context.Context, got ops.fooInput",
+			"unsupported.NoReturn: operations must return a value, an error, or both",
+			"unsupported.NotError: the second return value must be an error, got string",
+			"unsupported.TwoInputs: only one input argument is supported, got ops.fooInput and ops.fooInput",
+			"example.Extra: operations must return a value, an error, or both",
+		}, strings.Split(err.Error(), "\n"), "every problem is reported")
+
+		_, buildErr := o.Build()
+		assert.EqualError(t, buildErr, err.Error(), "Build fails with the same problems")
+	}
+
+	// registrations which a partial build would skip are still reported.
+	o.PartialBuild = true
+	_, err = o.Build()
+	assert.NoError(t, err)
+	assert.Error(t, o.Validate())
+
+	// schema definitions are checked when they're shared.
+	o = New()
+	o.ShareSchemaDefinitions = true
+	o.RegisterOperation("first", "Get", func(ctx context.Context, in sharedName) string { return in.Name })
+	{
+		type sharedName struct {
+			ID int `json:"id"`
+		}
+		o.RegisterOperation("second", "Get", func(ctx context.Context, in sharedName) int { return in.ID })
+	}
+	err = o.Validate()
+	assert.ErrorContains(t, err, "sharing schema definitions")
+	assert.ErrorContains(t, err, "the definition sharedName differs from a shared definition with the same name")
+	_, buildErr := o.Build()
+	assert.EqualError(t, buildErr, err.Error())
+
+	o = New()
+	o.Register(&example{})
+	assert.NoError(t, o.Validate())
+
+	h, err := o.Build()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"example"}, h.Services(), "validating doesn't affect the build")
+
+	// Validate can be called alongside Handler.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, o.Validate())
+			_, err := o.Handler()
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+}
+
+// sharedName has the same name as a type declared in TestRegistryValidate.
+type sharedName struct {
+	Name string `json:"name"`
+}
+
+func TestWarnThresholds(t *testing.T) {
+	var buf strings.Builder
+	o := New()
+	o.Register(&example{})
+	o.RegisterOperation("timing", "Sleep", func(ctx context.Context) error {
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	})
+	o.Logger = slog.New(slog.NewJSONHandler(&buf, nil))
+	o.WarnResponseBytes = 10
+	o.WarnDuration = 10 * time.Millisecond
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := func() []map[string]any {
+		var entries []map[string]any
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			if line == "" {
+				continue
+			}
+			var entry map[string]any
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, entry)
+		}
+		buf.Reset()
+		return entries
+	}
+
+	_, err = h.Call(context.Background(), "example", "Foo", json.RawMessage(`{"bar": "a"}`))
+	assert.NoError(t, err)
+	assert.Empty(t, entries(), "calls within the thresholds shouldn't be logged")
+
+	_, err = h.Call(context.Background(), "example", "Foo", json.RawMessage(`{"bar": "large"}`))
+	assert.NoError(t, err)
+	logged := entries()
+	if assert.Len(t, logged, 1) {
+		assert.Equal(t, "WARN", logged[0]["level"])
+		assert.Equal(t, "operation exceeded threshold", logged[0]["msg"])
+		assert.Equal(t, "example", logged[0]["service"])
+		assert.Equal(t, "Foo", logged[0]["operation"])
+		assert.Equal(t, float64(len(`"hello large"`)), logged[0]["response_bytes"])
+		assert.Equal(t, true, logged[0]["large_response"])
+		assert.Equal(t, false, logged[0]["slow"])
+	}
+
+	_, err = h.Call(context.Background(), "timing", "Sleep", nil)
+	assert.NoError(t, err)
+	logged = entries()
+	if assert.Len(t, logged, 1) {
+		assert.Equal(t, "Sleep", logged[0]["operation"])
+		assert.Equal(t, true, logged[0]["slow"])
+		assert.GreaterOrEqual(t, logged[0]["duration"], float64(20*time.Millisecond))
+	}
+}
+
+func TestCLINameFunc(t *testing.T) {
+	cliNames := func(o *Registry) map[string]string {
+		o.Register(&untagged{})
+		o.RegisterOperation("userAdmin", "ResetHTTPPassword", func(ctx context.Context) error { return nil })
+		h, err := o.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := map[string]string{}
+		for _, svc := range h.ServiceDefinitions().Services {
+			names[svc.ID] = svc.CLIName
+			for _, op := range svc.Operations {
+				names[svc.ID+"."+op.ID] = op.CLIName
+			}
+		}
+		return names
+	}
+
+	assert.Equal(t, map[string]string{
+		"untagged":                    "",
+		"untagged.Get":                "",
+		"userAdmin":                   "",
+		"userAdmin.ResetHTTPPassword": "",
+	}, cliNames(New()), "CLINames should be empty by default")
+
+	o := New()
+	o.CLINameFunc = KebabCase
+	assert.Equal(t, map[string]string{
+		"untagged":                    "untagged",
+		"untagged.Get":                "get",
+		"userAdmin":                   "user-admin",
+		"userAdmin.ResetHTTPPassword": "reset-http-password",
+	}, cliNames(o))
+}
+
+func TestUnmarshalFieldErrors(t *testing.T) {
+	o := New()
+	o.FieldNaming = SnakeCase
+	o.Register(&untagged{})
+	o.Register(&example{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		service string
+		input   string
+		want    FieldError
+	}{
+		{
+			service: "untagged",
+			input:   `{"paging": {"page_size": "ten"}}`,
+			want:    FieldError{Field: "paging.page_size", Rule: "type", Message: "paging.page_size must be an integer, got string"},
+		},
+		{
+			service: "example",
+			input:   `{"bar": 1}`,
+			want:    FieldError{Field: "bar", Rule: "type", Message: "bar must be a string, got number"},
+		},
+		{
+			service: "example",
+			input:   `["bar"]`,
+			want:    FieldError{Rule: "type", Message: "input must be an object, got array"},
+		},
+		{
+			service: "example",
+			input:   `{"bar": }`,
+			want:    FieldError{Rule: "syntax", Message: "invalid JSON at offset 9: invalid character '}' looking for beginning of value"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.input, func(t *testing.T) {
+			op := "Foo"
+			if tc.service == "untagged" {
+				op = "Get"
+			}
+
+			_, err := h.Call(context.Background(), tc.service, op, json.RawMessage(tc.input))
+			assert.Equal(t, protocol.CodeBadRequest, errorCode(err))
+
+			var verr *ValidationError
+			if assert.ErrorAs(t, err, &verr) {
+				assert.Equal(t, []FieldError{tc.want}, verr.Fields)
+			}
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/"+tc.service+"/"+op, strings.NewReader(tc.input)))
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+			assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		})
+	}
+}
+
+type blocking struct {
+	started   chan struct{}
+	cancelled chan error
+}
+
+func (blocking) Metadata() ServiceMetadata {
+	return ServiceMetadata{ID: "blocking"}
+}
+
+func (b *blocking) Wait(ctx context.Context) (string, error) {
+	close(b.started)
+	<-ctx.Done()
+	b.cancelled <- ctx.Err()
+	return "", ctx.Err()
+}
+
+func TestServeHTTPClientDisconnect(t *testing.T) {
+	var buf syncBuffer
+	svc := &blocking{started: make(chan struct{}), cancelled: make(chan error, 1)}
+	o := New()
+	o.Register(svc)
+	o.Logger = slog.New(slog.NewJSONHandler(&buf, nil))
+	o.AccessLog = true
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/blocking/Wait", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := http.DefaultClient.Do(req)
+		done <- err
+	}()
+
+	<-svc.started
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+
+	select {
+	case err := <-svc.cancelled:
+		assert.ErrorIs(t, err, context.Canceled, "the operation's context should be cancelled when the client disconnects")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the operation's context wasn't cancelled")
+	}
+
+	assert.Eventually(t, func() bool {
+		return strings.Contains(buf.String(), `"status":499`)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	logs := buf.String()
+	assert.Contains(t, logs, `"msg":"client cancelled request"`)
+	assert.NotContains(t, logs, `"status":500`)
+}
+
+// syncBuffer is a strings.Builder which is safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+type requestIDs struct{}
+
+func (requestIDs) Metadata() ServiceMetadata {
+	return ServiceMetadata{ID: "ids"}
+}
+
+func (requestIDs) Get(ctx context.Context) string {
+	id, _ := RequestIDFromContext(ctx)
+	return id
+}
+
+func TestRequestIDs(t *testing.T) {
+	var buf strings.Builder
+	o := New()
+	o.Register(&requestIDs{})
+	o.Logger = slog.New(slog.NewJSONHandler(&buf, nil))
+	o.AccessLog = true
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/ids/Get", nil)
+	req.Header.Set(RequestIDHeader, "req_123")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, `"req_123"`, rec.Body.String())
+	assert.Equal(t, "req_123", rec.Header().Get(RequestIDHeader))
+	assert.Contains(t, buf.String(), `"request_id":"req_123"`, "the access log should include the request ID")
+
+	for _, id := range []string{"", "has spaces", strings.Repeat("a", 129)} {
+		req := httptest.NewRequest(http.MethodPost, "/ids/Get", nil)
+		req.Header.Set(RequestIDHeader, id)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		generated := rec.Header().Get(RequestIDHeader)
+		assert.Regexp(t, `^[0-9a-f]{32}$`, generated, "an ID should be generated for %q", id)
+		assert.Equal(t, `"`+generated+`"`, rec.Body.String())
+	}
+
+	res, err := h.Call(WithRequestID(context.Background(), "req_456"), "ids", "Get", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `"req_456"`, string(res))
+
+	res, err = h.Call(context.Background(), "ids", "Get", nil)
+	assert.NoError(t, err)
+	assert.Regexp(t, `^"[0-9a-f]{32}"$`, string(res))
+}
+
+type memberUser struct {
+	Name string `json:"name"`
+}
+
+type memberOrg struct {
+	OrgName string
+}
+
+type lookup struct{}
+
+func (lookup) Metadata() ServiceMetadata {
+	return ServiceMetadata{ID: "lookup"}
+}
+
+func (lookup) Get(ctx context.Context, input fooInput) (memberUser, *memberOrg, error) {
+	if input.Bar == "missing" {
+		return memberUser{}, nil, &Error{Code: protocol.CodeNotFound, Err: errors.New("user not found")}
+	}
+	return memberUser{Name: input.Bar}, &memberOrg{OrgName: "acme"}, nil
+}
+
+func (lookup) Pair(ctx context.Context) (memberUser, memberOrg) {
+	return memberUser{Name: "alice"}, memberOrg{OrgName: "acme"}
+}
+
+type badResults struct{}
+
+func (badResults) Metadata() ServiceMetadata {
+	return ServiceMetadata{ID: "badResults"}
+}
+
+func (badResults) Strings(ctx context.Context) (memberUser, string, error) {
+	return memberUser{}, "", nil
+}
+func (badResults) Twice(ctx context.Context) (memberUser, *memberUser, error) {
+	return memberUser{}, nil, nil
+}
+
+func TestMultipleResults(t *testing.T) {
+	o := New()
+	o.FieldNaming = SnakeCase
+	o.Register(&lookup{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := h.Call(context.Background(), "lookup", "Get", json.RawMessage(`{"bar": "alice"}`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"member_user": {"name": "alice"}, "member_org": {"org_name": "acme"}}`, string(res))
+
+	_, err = h.Call(context.Background(), "lookup", "Get", json.RawMessage(`{"bar": "missing"}`))
+	assert.Equal(t, protocol.CodeNotFound, errorCode(err))
+
+	res, err = h.Call(context.Background(), "lookup", "Pair", nil)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"member_user": {"name": "alice"}, "member_org": {"org_name": "acme"}}`, string(res))
+
+	op, _ := h.operationDefinition("lookup", "Get")
+	schema, err := json.Marshal(op.ResponseBody["200"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{`"member_user"`, `"member_org"`, `"org_name"`} {
+		assert.Contains(t, string(schema), key)
+	}
+
+	o = New()
+	o.Register(&badResults{})
+	_, err = o.Build()
+	assert.EqualError(t, err, `unsupported operation signatures:
+badResults.Strings: operations returning several values must return named struct types, got string
+badResults.Twice: operations returning several values must return types with different names, got MemberUser more than once`)
+}
+
+type contact struct {
+	Name string `json:"name"`
+}
+
+type listContactsInput struct {
+	PageRequest
+	Team string `json:"team"`
+}
+
+type contacts struct {
+}
+
+func (contacts) Metadata() ServiceMetadata {
+	return ServiceMetadata{ID: "contacts"}
+}
+
+func (c *contacts) List(ctx context.Context, input listContactsInput) (*Paginated[contact], error) {
+	names := []string{"alice", "bob", "carol"}
+	start, _ := strconv.Atoi(input.Cursor)
+	end := min(start+input.Limit, len(names))
+
+	page := &Paginated[contact]{}
+	for _, name := range names[start:end] {
+		page.Items = append(page.Items, contact{Name: name})
+	}
+	if end < len(names) {
+		page.NextCursor = strconv.Itoa(end)
+	}
+	return page, nil
+}
+
+func (c *contacts) Get(ctx context.Context, input contact) (contact, error) {
+	return input, nil
+}
+
+func TestPaginated(t *testing.T) {
+	o := New()
+	o.Register(&contacts{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op, ok := h.operationDefinition("contacts", "List")
+	assert.True(t, ok)
+	assert.True(t, op.Paginated)
+
+	op, ok = h.operationDefinition("contacts", "Get")
+	assert.True(t, ok)
+	assert.False(t, op.Paginated)
+
+	op, _ = h.operationDefinition("contacts", "List")
+	schema, err := json.Marshal(op.ResponseBody["200"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.JSONEq(t, `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"$ref": "#/$defs/PaginatedContact",
+		"$defs": {
+			"PaginatedContact": {
+				"properties": {
+					"items": {"items": {"$ref": "#/$defs/contact"}, "type": "array"},
+					"nextCursor": {"type": "string"}
+				},
+				"additionalProperties": false,
+				"type": "object",
+				"required": ["items"]
+			},
+			"contact": {
+				"properties": {"name": {"type": "string"}},
+				"additionalProperties": false,
+				"type": "object",
+				"required": ["name"]
+			}
+		}
+	}`, string(schema))
+
+	res, err := h.Call(context.Background(), "contacts", "List", json.RawMessage(`{"limit": 2}`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"items": [{"name": "alice"}, {"name": "bob"}], "nextCursor": "2"}`, string(res))
+
+	res, err = h.Call(context.Background(), "contacts", "List", json.RawMessage(`{"limit": 2, "cursor": "2"}`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"items": [{"name": "carol"}]}`, string(res))
+}
+
+type settings struct {
+}
+
+func (settings) Metadata() ServiceMetadata {
+	return ServiceMetadata{
+		ID: "settings",
+		OperationMetadata: map[string]OperationMetadata{
+			"SetPassword": {StrictInput: true},
+		},
+	}
+}
+
+func (s *settings) SetPassword(ctx context.Context, input fooInput) string {
+	return "set " + input.Bar
+}
+
+func (s *settings) Ingest(ctx context.Context, input fooInput) string {
+	return "ingested " + input.Bar
+}
+
+func TestStrictInput(t *testing.T) {
+	o := New()
+	o.Register(&settings{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	input := json.RawMessage(`{"bar": "baz", "extra": true}`)
+
+	res, err := h.Call(ctx, "settings", "Ingest", input)
+	assert.NoError(t, err, "operations tolerate unknown fields by default")
+	assert.JSONEq(t, `"ingested baz"`, string(res))
+
+	_, err = h.Call(ctx, "settings", "SetPassword", input)
+	assert.Equal(t, protocol.CodeBadRequest, errorCode(err))
+
+	var verr *ValidationError
+	if assert.ErrorAs(t, err, &verr) {
+		assert.Equal(t, []FieldError{{Field: "extra", Rule: "unknown", Message: `unknown field "extra"`}}, verr.Fields)
+	}
+
+	res, err = h.Call(ctx, "settings", "SetPassword", json.RawMessage(`{"bar": "baz"}`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `"set baz"`, string(res))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/settings/SetPassword", strings.NewReader(string(input))))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+type downstream struct {
+	down  atomic.Bool
+	calls atomic.Int32
+}
+
+func (d *downstream) Metadata() ServiceMetadata {
+	return ServiceMetadata{
+		ID: "downstream",
+		OperationMetadata: map[string]OperationMetadata{
+			"Fetch": {
+				CircuitBreaker: &CircuitBreaker{FailureThreshold: 2, Cooldown: 20 * time.Millisecond},
+			},
+		},
+	}
+}
+
+func (d *downstream) Fetch(ctx context.Context, input fooInput) (string, error) {
+	d.calls.Add(1)
+	if input.Bar == "" {
+		return "", &Error{Code: protocol.CodeBadRequest, Err: errors.New("bar is required")}
+	}
+	if d.down.Load() {
+		return "", errors.New("connection refused")
+	}
+	return "fetched " + input.Bar, nil
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	svc := &downstream{}
+	o := New()
+	o.Register(svc)
+	o.Register(&example{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := NewMetrics()
+	metrics.ObserveCircuitBreakers(h)
+
+	ctx := context.Background()
+	fetch := func() error {
+		_, err := h.Call(ctx, "downstream", "Fetch", json.RawMessage(`{"bar": "x"}`))
+		return err
+	}
+
+	_, ok := h.CircuitState("example", "Foo")
+	assert.False(t, ok, "operations don't have a breaker by default")
+
+	svc.down.Store(true)
+	for i := 0; i < 3; i++ {
+		_, err := h.Call(ctx, "downstream", "Fetch", json.RawMessage(`{}`))
+		assert.Equal(t, protocol.CodeBadRequest, errorCode(err))
+	}
+	state, ok := h.CircuitState("downstream", "Fetch")
+	assert.True(t, ok)
+	assert.Equal(t, CircuitClosed, state, "client errors shouldn't open the breaker")
+
+	assert.Error(t, fetch())
+	assert.Error(t, fetch())
+	state, _ = h.CircuitState("downstream", "Fetch")
+	assert.Equal(t, CircuitOpen, state)
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics))
+
+	calls := svc.calls.Load()
+	err = fetch()
+	assert.Equal(t, protocol.CodeServerError, errorCode(err))
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, calls, svc.calls.Load(), "the operation shouldn't be called while the breaker is open")
+
+	time.Sleep(30 * time.Millisecond)
+	state, _ = h.CircuitState("downstream", "Fetch")
+	assert.Equal(t, CircuitHalfOpen, state)
+
+	// a failed probe opens the breaker again.
+	assert.Error(t, fetch())
+	assert.ErrorIs(t, fetch(), ErrCircuitOpen)
+
+	time.Sleep(30 * time.Millisecond)
+	svc.down.Store(false)
+	assert.NoError(t, fetch())
+	state, _ = h.CircuitState("downstream", "Fetch")
+	assert.Equal(t, CircuitClosed, state)
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics))
+}
+
+type documented struct {
+	meta map[string]OperationMetadata
+}
+
+func (d *documented) Metadata() ServiceMetadata {
+	return ServiceMetadata{ID: "documented", OperationMetadata: d.meta}
+}
+
+func (d *documented) Lookup(ctx context.Context, input fooInput) (*contact, error) {
+	return &contact{Name: input.Bar}, nil
+}
+
+func TestOperationExamples(t *testing.T) {
+	o := New()
+	o.Register(&documented{meta: map[string]OperationMetadata{
+		"Lookup": {
+			RequestExample:  fooInput{Bar: "alice"},
+			ResponseExample: &contact{Name: "alice"},
+		},
+	}})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op := h.ServiceDefinitions().Services[0].Operations[0]
+	assert.JSONEq(t, `{"bar": "alice"}`, string(op.RequestExample))
+	assert.JSONEq(t, `{"name": "alice"}`, string(op.ResponseExample))
+
+	spec, err := h.ServiceDefinitions().OpenAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(spec), `"example":{"bar":"alice"}`)
+	assert.Contains(t, string(spec), `"example":{"name":"alice"}`)
+
+	for name, meta := range map[string]OperationMetadata{
+		"stale request example":  {RequestExample: map[string]string{"bar": "alice"}},
+		"stale response example": {ResponseExample: "alice"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			o := New()
+			o.Register(&documented{meta: map[string]OperationMetadata{"Lookup": meta}})
+			_, err := o.Build()
+			assert.Error(t, err)
+		})
+	}
+}
+
+type chat struct{}
+
+func (*chat) Metadata() ServiceMetadata {
+	return ServiceMetadata{ID: "chat"}
+}
+
+type chatMessage struct {
+	Text string `json:"text"`
+}
+
+func (*chat) Echo(ctx context.Context, in <-chan chatMessage, out chan<- chatMessage) error {
+	for msg := range in {
+		if msg.Text == "bye" {
+			return &Error{Code: protocol.CodeBadRequest, Err: errors.New("goodbye")}
+		}
+		select {
+		case out <- chatMessage{Text: strings.ToUpper(msg.Text)}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// chatRequest returns an HTTP/2 request to chat.Echo with a frame for each message.
+func chatRequest(messages ...string) *http.Request {
+	var body bytes.Buffer
+	enc := protocol.NewEncoder[protocol.StreamFrame](nopWriteCloser{&body})
+	defer enc.Close()
+	for _, msg := range messages {
+		data, _ := json.Marshal(chatMessage{Text: msg})
+		_ = enc.Encode(&protocol.StreamFrame{Data: data})
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/chat/Echo", &body)
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	return req
+}
+
+// readFrames decodes the frames of a bidirectional response.
+func readFrames(t *testing.T, body io.Reader) []protocol.StreamFrame {
+	dec := protocol.NewDecoder[protocol.StreamFrame](io.NopCloser(body))
+	defer dec.Close()
+
+	var frames []protocol.StreamFrame
+	for {
+		frame, err := dec.Decode()
+		if errors.Is(err, io.EOF) {
+			return frames
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+}
+
+func TestBidirectional(t *testing.T) {
+	o := New()
+	o.Register(&chat{})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op := h.ServiceDefinitions().Services[0].Operations[0]
+	assert.True(t, op.Bidirectional)
+	assert.False(t, op.InputStream)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, chatRequest("hello", "world"))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, protocol.StreamFrameContentType, rec.Header().Get("Content-Type"))
+	assert.Equal(t, []protocol.StreamFrame{
+		{Data: []byte(`{"text":"HELLO"}`)},
+		{Data: []byte(`{"text":"WORLD"}`)},
+	}, readFrames(t, rec.Body))
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, chatRequest("hello", "bye"))
+	assert.Equal(t, []protocol.StreamFrame{
+		{Data: []byte(`{"text":"HELLO"}`)},
+		{Code: protocol.CodeBadRequest, Error: "goodbye"},
+	}, readFrames(t, rec.Body))
+
+	// HTTP/1.x can't stream the request and response at the same time.
+	req := chatRequest("hello")
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/1.1", 1, 1
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	_, err = h.Call(context.Background(), "chat", "Echo", nil)
+	assert.Equal(t, protocol.CodeBadRequest, errorCode(err))
+}
+
+func TestErrorResponse(t *testing.T) {
+	o := New()
+	o.Register(&example{})
+	o.RegisterOperation("example", "Unavailable", func(ctx context.Context) error {
+		return &Error{Code: protocol.CodeTooManyRequests, Err: errors.New("try again later")}
+	})
+	h, err := o.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		wantCode int
+		want     ErrorResponse
+	}{
+		{
+			name:     "service not found",
+			path:     "/missing/Foo",
+			wantCode: http.StatusNotFound,
+			want:     ErrorResponse{Code: "CodeNotFound", Message: "service missing not found"},
+		},
+		{
+			name:     "operation not found",
+			path:     "/example/Missing",
+			wantCode: http.StatusNotFound,
+			want:     ErrorResponse{Code: "CodeNotFound", Message: "operation Missing not found for service example"},
+		},
+		{
+			name:     "unmarshalling",
+			path:     "/example/Foo",
+			body:     `{"bar": 1}`,
+			wantCode: http.StatusBadRequest,
+			want: ErrorResponse{
+				Code:    "CodeBadRequest",
+				Message: "input validation failed: bar must be a string, got number",
+				Details: json.RawMessage(`{"fields":[{"field":"bar","rule":"type","message":"bar must be a string, got number"}]}`),
+			},
+		},
+		{
+			name:     "operation error",
+			path:     "/example/Unavailable",
+			wantCode: http.StatusTooManyRequests,
+			want:     ErrorResponse{Code: "CodeTooManyRequests", Message: "try again later"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body)))
+			assert.Equal(t, tt.wantCode, rec.Code)
+			assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+			var got ErrorResponse
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want.Code, got.Code)
+			assert.Equal(t, tt.want.Message, got.Message)
+			if tt.want.Details != nil {
+				assert.JSONEq(t, string(tt.want.Details), string(got.Details))
+			}
+
+			code, ok := got.ResponseCode()
+			assert.True(t, ok)
+			assert.Equal(t, tt.want.Code, code.String())
+		})
+	}
+}
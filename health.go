@@ -0,0 +1,42 @@
+package ops
+
+import (
+	"net/http"
+)
+
+// SetReady sets whether the handler reports itself as ready on GET {prefix}/readyz.
+//
+// Handlers are ready once built. A handler served over a tunnel created with
+// Registry.NewTunnel or Registry.Start is only ready while the tunnel is
+// connected: it becomes ready when the connection is registered, and not
+// ready when the connection is lost and the tunnel is reconnecting. Each
+// tunnel's handler tracks its own readiness, so a disconnected tunnel doesn't
+// affect other tunnels or the handler returned by Registry.Handler.
+func (h *Handler) SetReady(ready bool) {
+	h.notReady.Store(!ready)
+}
+
+// Ready returns whether the handler is ready to serve operations. See SetReady.
+func (h *Handler) Ready() bool {
+	return !h.notReady.Load()
+}
+
+// serveHealthz serves GET {prefix}/healthz, which
+// returns 200 as long as the handler has been built.
+func (h *Handler) serveHealthz(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// serveReadyz serves GET {prefix}/readyz, which returns 200 if the
+// handler is ready, and 503 Service Unavailable if it isn't.
+func (h *Handler) serveReadyz(w http.ResponseWriter) {
+	if !h.Ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("not ready"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
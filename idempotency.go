@@ -0,0 +1,152 @@
+package ops
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyHeader is the header carrying the idempotency key of a call.
+//
+// Operations with OperationMetadata.Idempotent set only execute once per key:
+// the result of the first successful call with a key is stored in the
+// Registry.IdempotencyStore, and later calls with the same key return the
+// stored result without calling the operation again. Calls which fail aren't
+// stored, so they can be retried. If a call with the same key is already in
+// progress, later calls wait for it to finish.
+//
+// Keys are scoped to the service, operation and tenant of the call.
+// Subscriptions and operations which stream their input are never stored.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// DefaultIdempotencyTTL is how long results are stored for by the default IdempotencyStore.
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+type idempotencyKeyContextKey struct{}
+
+// WithIdempotencyKey returns a copy of ctx carrying an idempotency key for a call to
+// Handler.Call. Calls served over HTTP use the key in the IdempotencyKeyHeader.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyContextKey{}, key)
+}
+
+// IdempotencyKeyFromContext returns the idempotency key of a call.
+// It returns false if the call doesn't have a key.
+func IdempotencyKeyFromContext(ctx context.Context) (string, bool) {
+	key, _ := ctx.Value(idempotencyKeyContextKey{}).(string)
+	return key, key != ""
+}
+
+// IdempotencyStore stores the results of calls to idempotent operations.
+type IdempotencyStore interface {
+	// Get returns the stored result for a key.
+	// It returns false if there is no result stored.
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	// Set stores the result of the call made with a key.
+	Set(ctx context.Context, key string, result []byte) error
+}
+
+// MemoryIdempotencyStore is an IdempotencyStore which keeps
+// results in memory until their TTL has passed.
+type MemoryIdempotencyStore struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	results map[string]storedResult
+}
+
+type storedResult struct {
+	result  []byte
+	expires time.Time
+}
+
+// NewMemoryIdempotencyStore returns a store keeping results in memory for ttl.
+func NewMemoryIdempotencyStore(ttl time.Duration) *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		ttl:     ttl,
+		results: map[string]storedResult{},
+	}
+}
+
+func (s *MemoryIdempotencyStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.results[key]
+	if !ok || time.Now().After(stored.expires) {
+		return nil, false, nil
+	}
+	return stored.result, true, nil
+}
+
+func (s *MemoryIdempotencyStore) Set(ctx context.Context, key string, result []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, stored := range s.results {
+		if now.After(stored.expires) {
+			delete(s.results, k)
+		}
+	}
+
+	s.results[key] = storedResult{result: result, expires: now.Add(s.ttl)}
+	return nil
+}
+
+// idempotentCalls tracks the calls in progress for each idempotency key.
+type idempotentCalls struct {
+	mu       sync.Mutex
+	inflight map[string]chan struct{}
+}
+
+// callIdempotent returns the stored result for the call's key, or makes the call
+// and stores its result. Calls with the same key are made one at a time.
+func (h *Handler) callIdempotent(ctx context.Context, service string, operation string, key string, call func() ([]byte, error)) ([]byte, error) {
+	tenant, _ := TenantFromContext(ctx)
+	key = service + "/" + operation + "/" + tenant + "/" + key
+
+	for {
+		h.idempotent.mu.Lock()
+		wait, ok := h.idempotent.inflight[key]
+		if !ok {
+			done := make(chan struct{})
+			h.idempotent.inflight[key] = done
+			h.idempotent.mu.Unlock()
+
+			defer func() {
+				h.idempotent.mu.Lock()
+				delete(h.idempotent.inflight, key)
+				h.idempotent.mu.Unlock()
+				close(done)
+			}()
+			break
+		}
+		h.idempotent.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	res, found, err := h.idempotencyStore.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return res, nil
+	}
+
+	res, err = call()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.idempotencyStore.Set(ctx, key, res); err != nil {
+		h.logger.ErrorContext(ctx, "error storing idempotent result", "service", service, "operation", operation, "error", err)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,235 @@
+package ops
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/common-fate/ops/protocol"
+)
+
+// When Registry.JSONRPC is set, operations can also be called with JSON-RPC 2.0
+// requests to POST {prefix}/jsonrpc. The method is the service and operation
+// separated by a dot, and the params are the operation's input:
+//
+//	{"jsonrpc": "2.0", "method": "example.Foo", "params": {"bar": "baz"}, "id": 1}
+//
+// The response contains the result of the call, or an error whose code is
+// mapped from the protocol.ResponseCode of the failure (see jsonrpcErrorCode):
+//
+//	{"jsonrpc": "2.0", "result": "hello baz", "id": 1}
+//
+// Each call is made with Call, so runs through the middleware. A JSON-RPC
+// batch, an array of requests, is called in the same way as a batch request
+// to POST {prefix}/batch, so runs concurrently if Registry.BatchConcurrency is
+// set. Operations which can't be batched can't be called with JSON-RPC.
+//
+// JSON-RPC responses always have a 200 status, unless the body can't be read.
+
+// jsonrpcVersion is the only JSON-RPC version supported.
+const jsonrpcVersion = "2.0"
+
+// JSON-RPC 2.0 error codes.
+const (
+	jsonrpcParseError     = -32700
+	jsonrpcInvalidRequest = -32600
+	jsonrpcMethodNotFound = -32601
+	jsonrpcInvalidParams  = -32602
+	jsonrpcInternalError  = -32603
+	// jsonrpcServerError is the start of the range of codes reserved for
+	// implementation-defined server errors, which runs down to -32099.
+	jsonrpcServerError = -32000
+)
+
+// jsonrpcRequest is a JSON-RPC 2.0 request. Requests without an
+// ID are notifications, which are called without a response.
+type jsonrpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+type jsonrpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *jsonrpcError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type jsonrpcError struct {
+	Code    int               `json:"code"`
+	Message string            `json:"message"`
+	Data    *jsonrpcErrorData `json:"data,omitempty"`
+}
+
+// jsonrpcErrorData describes an error returned by an operation.
+type jsonrpcErrorData struct {
+	// Code is the name of the protocol.ResponseCode, e.g. 'CodeNotFound'.
+	Code string `json:"code"`
+	// Fields are set if the input failed validation.
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// jsonrpcErrorCode maps the response code of a failed call to a JSON-RPC error code.
+// Bad requests are reported as invalid params, and server errors as internal errors.
+// Other codes use the server error range, counting down from -32000 by the
+// value of the response code, so CodeNotFound is reported as -32002.
+func jsonrpcErrorCode(code protocol.ResponseCode) int {
+	switch code {
+	case protocol.CodeBadRequest:
+		return jsonrpcInvalidParams
+	case protocol.CodeServerError:
+		return jsonrpcInternalError
+	}
+	return jsonrpcServerError - int(code)
+}
+
+// serveJSONRPC serves POST {prefix}/jsonrpc.
+func (h *Handler) serveJSONRPC(w http.ResponseWriter, r *http.Request) {
+	body, ok := h.readEnvelope(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel, err := withRequestTimeout(h.envelopeContext(r), r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	defer cancel()
+
+	var res any
+
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(body, &batch); err != nil {
+			res = jsonrpcFailure(nil, jsonrpcParseError, fmt.Sprintf("error unmarshalling batch: %s", err))
+		} else if len(batch) == 0 {
+			res = jsonrpcFailure(nil, jsonrpcInvalidRequest, "the batch is empty")
+		} else if responses := h.callJSONRPCBatch(ctx, batch); len(responses) > 0 {
+			res = responses
+		}
+	} else if resp := h.callJSONRPC(ctx, body); resp != nil {
+		res = resp
+	}
+
+	// notifications, and batches of only notifications, have no response.
+	if res == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		h.logger.Error("error marshalling JSON-RPC response", "error", err)
+	}
+}
+
+// callJSONRPCBatch makes each call in a JSON-RPC batch,
+// returning the responses to the calls which aren't notifications.
+func (h *Handler) callJSONRPCBatch(ctx context.Context, batch []json.RawMessage) []*jsonrpcResponse {
+	results := make([]*jsonrpcResponse, len(batch))
+
+	h.forEachBatched(len(batch), func(i int) {
+		results[i] = h.callJSONRPC(ctx, batch[i])
+	})
+
+	var responses []*jsonrpcResponse
+	for _, res := range results {
+		if res != nil {
+			responses = append(responses, res)
+		}
+	}
+	return responses
+}
+
+// callJSONRPC makes a single JSON-RPC call, returning nil if it is a notification.
+func (h *Handler) callJSONRPC(ctx context.Context, body json.RawMessage) *jsonrpcResponse {
+	var req jsonrpcRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return jsonrpcFailure(nil, jsonrpcParseError, fmt.Sprintf("error unmarshalling request: %s", err))
+		}
+		return jsonrpcFailure(nil, jsonrpcInvalidRequest, fmt.Sprintf("error unmarshalling request: %s", err))
+	}
+
+	if req.JSONRPC != jsonrpcVersion {
+		return jsonrpcFailure(req.ID, jsonrpcInvalidRequest, fmt.Sprintf("unsupported JSON-RPC version '%s', expected '%s'", req.JSONRPC, jsonrpcVersion))
+	}
+
+	res := h.callJSONRPCMethod(ctx, req)
+	if req.ID == nil {
+		return nil
+	}
+	return res
+}
+
+func (h *Handler) callJSONRPCMethod(ctx context.Context, req jsonrpcRequest) *jsonrpcResponse {
+	dot := strings.LastIndex(req.Method, ".")
+	if dot < 0 {
+		return jsonrpcFailure(req.ID, jsonrpcMethodNotFound, fmt.Sprintf("method '%s' must be the service and operation separated by a dot", req.Method))
+	}
+	service, operation := req.Method[:dot], req.Method[dot+1:]
+
+	fn, ok := h.routes[service][operation]
+	if !ok {
+		return jsonrpcFailure(req.ID, jsonrpcMethodNotFound, fmt.Sprintf("method '%s' not found", req.Method))
+	}
+	if !fn.batchable() {
+		return jsonrpcFailure(req.ID, jsonrpcInvalidRequest, fmt.Sprintf("operation %s for service %s can't be called with JSON-RPC", operation, service))
+	}
+
+	params := bytes.TrimSpace(req.Params)
+	if len(params) > 0 && params[0] == '[' {
+		return jsonrpcFailure(req.ID, jsonrpcInvalidParams, "params must be an object, positional params aren't supported")
+	}
+
+	result, err := h.Call(ctx, service, operation, req.Params)
+	if err != nil {
+		code := errorCode(err)
+
+		jerr := &jsonrpcError{
+			Code:    jsonrpcErrorCode(code),
+			Message: err.Error(),
+			Data:    &jsonrpcErrorData{Code: code.String()},
+		}
+
+		var verr *ValidationError
+		if errors.As(err, &verr) {
+			jerr.Data.Fields = verr.Fields
+		}
+
+		return &jsonrpcResponse{JSONRPC: jsonrpcVersion, Error: jerr, ID: jsonrpcID(req.ID)}
+	}
+
+	// a successful response must contain a result, so operations
+	// which only return an error succeed with the result null.
+	if result == nil {
+		result = json.RawMessage("null")
+	}
+
+	return &jsonrpcResponse{JSONRPC: jsonrpcVersion, Result: result, ID: jsonrpcID(req.ID)}
+}
+
+func jsonrpcFailure(id json.RawMessage, code int, message string) *jsonrpcResponse {
+	return &jsonrpcResponse{
+		JSONRPC: jsonrpcVersion,
+		Error:   &jsonrpcError{Code: code, Message: message},
+		ID:      jsonrpcID(id),
+	}
+}
+
+// jsonrpcID returns the ID for a response, which is null
+// if the ID of the request couldn't be determined.
+func jsonrpcID(id json.RawMessage) json.RawMessage {
+	if id == nil {
+		return json.RawMessage("null")
+	}
+	return id
+}
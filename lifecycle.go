@@ -0,0 +1,77 @@
+package ops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// Lifecycle is implemented by services which acquire resources, such as database
+// pools or caches, when the server starts, and release them when it stops.
+//
+// Registry.Start and Registry.Serve call Start on each service before serving,
+// in the order the services were registered, and call Stop in the reverse
+// order once serving has stopped. If a service fails to start, the services
+// already started are stopped, and the error is returned without serving.
+//
+// The Start and Stop methods of a service implementing Lifecycle
+// aren't served as operations. Callers of Build manage the lifecycle
+// of the services with Handler.Start and Handler.Stop.
+type Lifecycle interface {
+	Start(ctx context.Context) error
+	Stop(ctx context.Context) error
+}
+
+var lifecycleType = reflect.TypeOf((*Lifecycle)(nil)).Elem()
+
+// lifecycleService is a registered service implementing Lifecycle.
+type lifecycleService struct {
+	id  string
+	svc Lifecycle
+}
+
+// isLifecycleMethod is true if the method is part of
+// the Lifecycle interface implemented by its receiver.
+func isLifecycleMethod(method reflect.Method) bool {
+	if method.Name != "Start" && method.Name != "Stop" {
+		return false
+	}
+	return method.Type.NumIn() > 0 && method.Type.In(0).Implements(lifecycleType)
+}
+
+// Start calls Start on each service implementing Lifecycle, in the order they were
+// registered. If a service fails to start, the services already started are
+// stopped and the error is returned.
+func (h *Handler) Start(ctx context.Context) error {
+	for i, s := range h.lifecycles {
+		if err := s.svc.Start(ctx); err != nil {
+			err = fmt.Errorf("starting service %s: %w", s.id, err)
+			return errors.Join(err, stopServices(ctx, h.lifecycles[:i]))
+		}
+	}
+	return nil
+}
+
+// Stop calls Stop on each service implementing Lifecycle, in the reverse order to
+// which they were started. Every service is stopped, even if some fail to stop.
+// Stop should only be called once Start has succeeded.
+func (h *Handler) Stop(ctx context.Context) error {
+	return stopServices(ctx, h.lifecycles)
+}
+
+func stopServices(ctx context.Context, services []lifecycleService) error {
+	var errs []error
+	for i := len(services) - 1; i >= 0; i-- {
+		if err := services[i].svc.Stop(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("stopping service %s: %w", services[i].id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// stopContext returns the context used to stop services once serving with ctx has
+// finished. It isn't cancelled with ctx, but is bounded by serveShutdownTimeout.
+func stopContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), serveShutdownTimeout)
+}
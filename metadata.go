@@ -0,0 +1,74 @@
+package ops
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/common-fate/ops/tunnel"
+)
+
+// Metadata is request metadata exposed to operations, such as the values
+// of HTTP headers or the registration metadata of a tunnel connection.
+// Keys are canonicalized like HTTP header keys, so "x-region" and
+// "X-Region" refer to the same value.
+type Metadata map[string]string
+
+// Get returns the value of a metadata key.
+func (m Metadata) Get(key string) (string, bool) {
+	v, ok := m[http.CanonicalHeaderKey(key)]
+	return v, ok
+}
+
+type metadataContextKey struct{}
+
+// WithMetadata returns a copy of ctx with the metadata added, for callers of
+// Handler.Call which aren't served over HTTP. Keys are canonicalized, and
+// replace the values of the same keys already in the context.
+func WithMetadata(ctx context.Context, metadata map[string]string) context.Context {
+	merged := Metadata{}
+	for k, v := range metadataFromContext(ctx) {
+		merged[k] = v
+	}
+	for k, v := range metadata {
+		merged[http.CanonicalHeaderKey(k)] = v
+	}
+	return context.WithValue(ctx, metadataContextKey{}, merged)
+}
+
+func metadataFromContext(ctx context.Context) Metadata {
+	m, _ := ctx.Value(metadataContextKey{}).(Metadata)
+	return m
+}
+
+// MetadataFromContext returns the metadata of the request an operation is
+// called for. When served over HTTP, it includes the headers listed in
+// Registry.MetadataHeaders. When served over a tunnel, it also includes the
+// registration metadata of the connection (see tunnel.MetadataFromContext),
+// which takes precedence over headers with the same key, as headers are set
+// by the caller. The result is never nil.
+func MetadataFromContext(ctx context.Context) Metadata {
+	res := Metadata{}
+	for k, v := range metadataFromContext(ctx) {
+		res[k] = v
+	}
+	if registration, ok := tunnel.MetadataFromContext(ctx); ok {
+		for k, v := range registration {
+			res[http.CanonicalHeaderKey(k)] = v
+		}
+	}
+	return res
+}
+
+// headerMetadata adds the values of the allowlisted headers of the request to the context.
+func headerMetadata(ctx context.Context, r *http.Request, headers []string) context.Context {
+	metadata := map[string]string{}
+	for _, key := range headers {
+		if v := r.Header.Get(key); v != "" {
+			metadata[key] = v
+		}
+	}
+	if len(metadata) == 0 {
+		return ctx
+	}
+	return WithMetadata(ctx, metadata)
+}
@@ -0,0 +1,117 @@
+package ops
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/common-fate/ops/protocol"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics records Prometheus metrics for operation calls:
+//
+//   - ops_calls_total, a counter of calls partitioned by service, operation, and response code.
+//   - ops_call_duration_seconds, a histogram of call latency partitioned by service and operation.
+//   - ops_circuit_breaker_state, a gauge of the CircuitState of each operation with a circuit
+//     breaker, partitioned by service and operation: 0 if closed, 1 if half-open, and 2 if open.
+//     It is only recorded for handlers passed to ObserveCircuitBreakers.
+//
+// Metrics implements prometheus.Collector, so it can be registered with a registry:
+//
+//	metrics := ops.NewMetrics()
+//	prometheus.MustRegister(metrics)
+//
+// Calls are only recorded once the metrics are added to a handler, either by passing
+// them in StartOpts, or with Registry.Use(metrics.Middleware()) for handlers which
+// aren't served over a tunnel. Both calls made over HTTP and direct calls to Handler.Call
+// are recorded. Handlers served with StartOpts.Metrics have their circuit breakers observed.
+type Metrics struct {
+	calls    *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+
+	breakerState *prometheus.Desc
+	mu           sync.Mutex
+	handlers     []*Handler
+}
+
+// NewMetrics creates a new set of operation metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		calls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ops_calls_total",
+			Help: "The number of operation calls, by response code.",
+		}, []string{"service", "operation", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ops_call_duration_seconds",
+			Help:    "The latency of operation calls.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"service", "operation"}),
+		breakerState: prometheus.NewDesc(
+			"ops_circuit_breaker_state",
+			"The state of operation circuit breakers: 0 if closed, 1 if half-open, and 2 if open.",
+			[]string{"service", "operation"}, nil,
+		),
+	}
+}
+
+// ObserveCircuitBreakers records the state of the circuit breakers of the handler's operations.
+// Handlers which are already observed are ignored.
+func (m *Metrics) ObserveCircuitBreakers(h *Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if slices.Contains(m.handlers, h) {
+		return
+	}
+	m.handlers = append(m.handlers, h)
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.calls.Describe(ch)
+	m.duration.Describe(ch)
+	ch <- m.breakerState
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.calls.Collect(ch)
+	m.duration.Collect(ch)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, h := range m.handlers {
+		for service, routes := range h.routes {
+			for operation, fn := range routes {
+				if fn.breaker == nil {
+					continue
+				}
+				ch <- prometheus.MustNewConstMetric(m.breakerState, prometheus.GaugeValue, float64(fn.breaker.current()), service, operation)
+			}
+		}
+	}
+}
+
+// Middleware returns middleware which records every call.
+func (m *Metrics) Middleware() Middleware {
+	return func(next Invoker) Invoker {
+		return func(ctx context.Context, service, operation string, input json.RawMessage) ([]byte, error) {
+			start := time.Now()
+
+			res, err := next(ctx, service, operation, input)
+
+			code := protocol.CodeOK
+			if err != nil {
+				code = errorCode(err)
+			}
+
+			m.duration.WithLabelValues(service, operation).Observe(time.Since(start).Seconds())
+			m.calls.WithLabelValues(service, operation, code.String()).Inc()
+
+			return res, err
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package ops
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Invoker calls an operation on a service.
+type Invoker func(ctx context.Context, service, operation string, input json.RawMessage) ([]byte, error)
+
+// Middleware wraps an Invoker to run logic around every operation call,
+// such as logging, timing, or authorization checks.
+//
+// A Middleware may short-circuit the call by returning
+// without calling next.
+type Middleware func(next Invoker) Invoker
+
+// Use adds middleware which runs on every call to the built Handler.
+//
+// Middleware runs in the order it is added: the first
+// middleware added is the outermost.
+func (r *Registry) Use(mw ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.registeredAfterBuild("Use") {
+		return
+	}
+	r.middleware = append(r.middleware, mw...)
+}
+
+// chain wraps the invoker in the provided middleware,
+// with the first middleware being the outermost.
+func chain(invoke Invoker, mw []Middleware) Invoker {
+	for i := len(mw) - 1; i >= 0; i-- {
+		invoke = mw[i](invoke)
+	}
+	return invoke
+}
@@ -0,0 +1,66 @@
+package ops
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Paginated is returned by operations which list results a page at a time.
+// Operations returning a Paginated[T], or a pointer to one, are marked as
+// Paginated in their definition, so that clients can offer uniform paging
+// controls. The items of the page are described by the schema of T.
+//
+// Inputs of paginated operations should embed PageRequest, and
+// the NextCursor of a page is passed as the Cursor of the next request.
+type Paginated[T any] struct {
+	Items []T `json:"items"`
+	// NextCursor is empty on the last page.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+func (Paginated[T]) paginated() {}
+
+// PageRequest is embedded in the inputs of paginated operations.
+type PageRequest struct {
+	// Limit is the maximum number of items to return.
+	Limit int `json:"limit,omitempty"`
+	// Cursor is the NextCursor of the previous page,
+	// or empty to request the first page.
+	Cursor string `json:"cursor,omitempty"`
+}
+
+var paginatedType = reflect.TypeOf((*interface{ paginated() })(nil)).Elem()
+
+// isPaginated returns whether an operation result of type t is a Paginated[T].
+func isPaginated(t reflect.Type) bool {
+	return t.Implements(paginatedType)
+}
+
+// packagePath matches the package path qualifying a type argument in the name
+// of an instantiated generic type, e.g. github.com/common-fate/ops. in
+// Paginated[github.com/common-fate/ops.User].
+var packagePath = regexp.MustCompile(`[\w\-./]*\.`)
+
+// genericTypeName names the schema definitions of instantiated generic types
+// after the type and its type arguments, so Paginated[User] is named PaginatedUser,
+// as reflect names them with the package paths of the type arguments, which
+// can't be used in a reference to the definition. Other types use their default name.
+func genericTypeName(t reflect.Type) string {
+	base, args, ok := strings.Cut(t.Name(), "[")
+	if !ok {
+		return ""
+	}
+
+	words := strings.FieldsFunc(packagePath.ReplaceAllString(args, ""), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+
+	var b strings.Builder
+	b.WriteString(base)
+	for _, w := range words {
+		b.WriteString(strings.ToUpper(w[:1]) + w[1:])
+	}
+	return b.String()
+}
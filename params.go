@@ -0,0 +1,162 @@
+package ops
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/common-fate/ops/protocol"
+	"github.com/common-fate/ops/servicedef"
+	"github.com/invopop/jsonschema"
+)
+
+// Operations may take scalar parameters (strings, booleans and numbers)
+// between the context and the input, which are bound from the URL path
+// rather than the request body:
+//
+//	func (s *Service) GetMember(ctx context.Context, orgID string, in GetMemberInput) (Member, error)
+//
+// When served over HTTP, parameters follow the operation in the path, in the
+// order they are declared: POST /{service}/{operation}/{orgID}. Parameters are
+// named with OperationMetadata.Parameters, or param1, param2 and so on if
+// names aren't provided. Callers of Handler.Call provide parameters with WithParameters.
+//
+// A scalar argument is only treated as a parameter if it isn't the last argument,
+// so operations which take a single scalar input still read it from the body.
+
+type parametersContextKey struct{}
+
+// WithParameters returns a copy of ctx carrying the named parameters of a call to Handler.Call.
+func WithParameters(ctx context.Context, params map[string]string) context.Context {
+	return context.WithValue(ctx, parametersContextKey{}, params)
+}
+
+func parametersFromContext(ctx context.Context) map[string]string {
+	params, _ := ctx.Value(parametersContextKey{}).(map[string]string)
+	return params
+}
+
+// parameter is a scalar argument of an operation bound from the URL path.
+type parameter struct {
+	name string
+	typ  reflect.Type
+}
+
+// isParameterType returns whether values of t can be bound from a path segment.
+func isParameterType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// parameterSchema returns the schema of a parameter.
+func parameterSchema(t reflect.Type) jsonschema.Schema {
+	switch t.Kind() {
+	case reflect.String:
+		return jsonschema.Schema{Type: "string"}
+	case reflect.Bool:
+		return jsonschema.Schema{Type: "boolean"}
+	case reflect.Float32, reflect.Float64:
+		return jsonschema.Schema{Type: "number"}
+	default:
+		return jsonschema.Schema{Type: "integer"}
+	}
+}
+
+// namedParameters names the parameters of an operation, using the names from its metadata.
+func namedParameters(types []reflect.Type, names []string) ([]parameter, error) {
+	if len(names) > 0 && len(names) != len(types) {
+		return nil, fmt.Errorf("OperationMetadata.Parameters names %d parameters, but the operation takes %d", len(names), len(types))
+	}
+
+	params := make([]parameter, len(types))
+	for i, t := range types {
+		params[i] = parameter{name: fmt.Sprintf("param%d", i+1), typ: t}
+		if len(names) > 0 {
+			params[i].name = names[i]
+		}
+	}
+
+	return params, nil
+}
+
+// parameterDefinitions returns the definitions of an operation's parameters.
+func parameterDefinitions(params []parameter) []servicedef.Parameter {
+	var defs []servicedef.Parameter
+	for _, p := range params {
+		defs = append(defs, servicedef.Parameter{
+			Name:   p.name,
+			In:     "path",
+			Schema: parameterSchema(p.typ),
+		})
+	}
+	return defs
+}
+
+// parameterPath returns the path segments for parameters in a routing rule.
+func parameterPath(params []parameter) string {
+	var b strings.Builder
+	for _, p := range params {
+		b.WriteString("/{" + p.name + "}")
+	}
+	return b.String()
+}
+
+// bindParameter parses the value of a parameter from the call's context.
+func bindParameter(ctx context.Context, p parameter) (reflect.Value, error) {
+	s, ok := parametersFromContext(ctx)[p.name]
+	if !ok {
+		return reflect.Value{}, &Error{Code: protocol.CodeBadRequest, Err: fmt.Errorf("missing parameter %s", p.name)}
+	}
+
+	v := reflect.New(p.typ).Elem()
+
+	var err error
+	switch p.typ.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		var b bool
+		b, err = strconv.ParseBool(s)
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		i, err = strconv.ParseInt(s, 10, p.typ.Bits())
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var u uint64
+		u, err = strconv.ParseUint(s, 10, p.typ.Bits())
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		f, err = strconv.ParseFloat(s, p.typ.Bits())
+		v.SetFloat(f)
+	}
+	if err != nil {
+		return reflect.Value{}, &Error{Code: protocol.CodeBadRequest, Err: fmt.Errorf("invalid parameter %s: %w", p.name, err)}
+	}
+
+	return v, nil
+}
+
+// splitPath splits a request path into its unescaped segments.
+func splitPath(r *http.Request) ([]string, error) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+	for i, part := range parts {
+		var err error
+		parts[i], err = url.PathUnescape(part)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return parts, nil
+}
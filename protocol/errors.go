@@ -0,0 +1,48 @@
+package protocol
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// ErrorResponse is the JSON body of HTTP error responses, written by both the
+// ops handler and the tunnel, so that clients can handle errors the same way
+// wherever they're reported:
+//
+//	{"code": "CodeNotFound", "message": "operation Foo not found for service example"}
+//
+// Code is the name of the ResponseCode of the error, as returned by its String
+// method. Details are set for some errors, such as the fields of a validation error.
+type ErrorResponse struct {
+	Code    string          `json:"code"`
+	Message string          `json:"message"`
+	Details json.RawMessage `json:"details,omitempty"`
+}
+
+func (e *ErrorResponse) Error() string {
+	return e.Message
+}
+
+// ResponseCode returns the ResponseCode named by Code.
+// It returns false if the code isn't known to this package.
+func (e *ErrorResponse) ResponseCode() (ResponseCode, bool) {
+	for code := CodeOK; !strings.HasPrefix(code.String(), "ResponseCode("); code++ {
+		if code.String() == e.Code {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
+// WriteError writes an ErrorResponse with the HTTP status, the response code and the message.
+func WriteError(w http.ResponseWriter, status int, code ResponseCode, message string) {
+	WriteErrorResponse(w, status, &ErrorResponse{Code: code.String(), Message: message})
+}
+
+// WriteErrorResponse writes res as the JSON body of a response with the HTTP status.
+func WriteErrorResponse(w http.ResponseWriter, status int, res *ErrorResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(res)
+}
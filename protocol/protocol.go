@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"fmt"
 	"io"
 
 	"github.com/vmihailenco/msgpack/v5"
@@ -9,7 +10,11 @@ import (
 const (
 	Name = "quic-h3-tunnel"
 
+	// Version is the newest protocol version spoken by this package.
 	Version uint8 = 1
+
+	// MinVersion is the oldest protocol version spoken by this package.
+	MinVersion uint8 = 1
 )
 
 type ResponseCode uint8
@@ -20,6 +25,16 @@ const (
 	CodeNotFound
 	CodeUnauthorized
 	CodeServerError
+	CodeTimeout
+	CodeTooManyRequests
+	// CodeUnsupportedVersion is returned when registering a listener
+	// if none of the client's protocol versions are supported.
+	CodeUnsupportedVersion
+	// CodeChallenge is returned when registering a listener if the server
+	// requires the client to sign the response's Challenge. The client replies
+	// with a ChallengeResponse, and the server then sends a further response
+	// accepting or rejecting the connection.
+	CodeChallenge
 )
 
 // ApplicationCode is returned on stream and connection errors
@@ -32,20 +47,120 @@ const (
 	// ApplicationError is returned when something went wrong
 	// The client can attempt to reconnect in this situation
 	ApplicationError = 0x1
+	// ApplicationShutdown is returned when the client is shutting down
+	// gracefully, for example during a deploy. The reason is sent as the
+	// error message.
+	ApplicationShutdown = 0x2
+	// ApplicationCancelled is returned when the client closes the
+	// connection because its context was cancelled.
+	ApplicationCancelled = 0x3
 )
 
 type RegisterListenerRequest struct {
-	Version     uint8
+	// Version is the newest protocol version the client speaks.
+	Version uint8
+	// MinVersion is the oldest protocol version the client speaks.
+	// Clients which predate negotiation only speak Version.
+	MinVersion  uint8
 	Service     string
 	Environment string
 	Metadata    map[string]string
+	// Namespaces are further services served over the same connection,
+	// in addition to Service. Servers forwarding a request to one of them
+	// set the NamespaceHeader to the namespace the request was made to.
+	// Servers which don't support multiplexing ignore them.
+	Namespaces []string `msgpack:",omitempty"`
+}
+
+// NamespaceHeader is set on requests forwarded over a connection registered
+// for several namespaces, to the namespace the request was made to. Requests
+// without the header are for the registration's Service.
+const NamespaceHeader = "X-Tunnel-Namespace"
+
+// RequestIDHeader carries the ID correlating a request with its response,
+// which is echoed back in the response. Servers generate an ID for requests
+// which don't have one.
+const RequestIDHeader = "X-Request-Id"
+
+// Services returns Service and the Namespaces multiplexed with it.
+func (r *RegisterListenerRequest) Services() []string {
+	services := []string{r.Service}
+	for _, ns := range r.Namespaces {
+		if ns != r.Service {
+			services = append(services, ns)
+		}
+	}
+	return services
 }
 
 type RegisterListenerResponse struct {
+	// Version is the negotiated protocol version used for the connection.
 	Version  uint8
 	Code     ResponseCode
 	Metadata map[string]string
 	Body     []byte
+
+	// MinVersion and MaxVersion are the range of protocol versions
+	// supported by the server. They are set when Code is CodeUnsupportedVersion.
+	MinVersion uint8
+	MaxVersion uint8
+
+	// Challenge is a nonce for the client to sign, set when Code is CodeChallenge.
+	// Servers must send a fresh random nonce for each registration.
+	Challenge []byte `msgpack:",omitempty"`
+}
+
+// ChallengeResponse is sent by the client on the registration stream in reply to
+// a RegisterListenerResponse with CodeChallenge, carrying its signature of the challenge.
+type ChallengeResponse struct {
+	Signature []byte
+}
+
+// VersionMismatchError is returned when the client and server
+// don't share a supported protocol version.
+type VersionMismatchError struct {
+	ClientMin, ClientMax uint8
+	ServerMin, ServerMax uint8
+}
+
+func (e *VersionMismatchError) Error() string {
+	return fmt.Sprintf("unsupported protocol version: client supports versions %d-%d, server supports versions %d-%d", e.ClientMin, e.ClientMax, e.ServerMin, e.ServerMax)
+}
+
+// NegotiateVersion returns the newest protocol version supported by both the
+// client which sent the request and a server supporting versions min to max.
+// Servers should reply with CodeUnsupportedVersion if a *VersionMismatchError is returned.
+func NegotiateVersion(req *RegisterListenerRequest, min, max uint8) (uint8, error) {
+	clientMin := req.MinVersion
+	if clientMin == 0 || clientMin > req.Version {
+		clientMin = req.Version
+	}
+
+	version := req.Version
+	if version > max {
+		version = max
+	}
+
+	if version < min || version < clientMin {
+		return 0, &VersionMismatchError{ClientMin: clientMin, ClientMax: req.Version, ServerMin: min, ServerMax: max}
+	}
+
+	return version, nil
+}
+
+// StreamFrameContentType is the Content-Type of the request and response
+// bodies of bidirectional operations, which are streams of StreamFrames.
+const StreamFrameContentType = "application/vnd.ops.frames+msgpack"
+
+// StreamFrame is a frame of the request or response stream of a
+// bidirectional operation, encoded with an Encoder and read with a Decoder.
+type StreamFrame struct {
+	// Data is a JSON-encoded message of the operation's input or output type.
+	Data []byte `msgpack:",omitempty"`
+	// Code and Error are set on the final frame of a
+	// response if the operation failed.
+	Code  ResponseCode `msgpack:",omitempty"`
+	Error string       `msgpack:",omitempty"`
 }
 
 type AuthenticationHandler interface {
@@ -12,11 +12,15 @@ func _() {
 	_ = x[CodeNotFound-2]
 	_ = x[CodeUnauthorized-3]
 	_ = x[CodeServerError-4]
+	_ = x[CodeTimeout-5]
+	_ = x[CodeTooManyRequests-6]
+	_ = x[CodeUnsupportedVersion-7]
+	_ = x[CodeChallenge-8]
 }
 
-const _ResponseCode_name = "CodeOKCodeBadRequestCodeNotFoundCodeUnauthorizedCodeServerError"
+const _ResponseCode_name = "CodeOKCodeBadRequestCodeNotFoundCodeUnauthorizedCodeServerErrorCodeTimeoutCodeTooManyRequestsCodeUnsupportedVersionCodeChallenge"
 
-var _ResponseCode_index = [...]uint8{0, 6, 20, 32, 48, 63}
+var _ResponseCode_index = [...]uint8{0, 6, 20, 32, 48, 63, 74, 93, 115, 128}
 
 func (i ResponseCode) String() string {
 	if i >= ResponseCode(len(_ResponseCode_index)-1) {
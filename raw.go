@@ -0,0 +1,58 @@
+package ops
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+
+	"github.com/invopop/jsonschema"
+)
+
+// RawResponse is returned by operations which respond with a body other
+// than their JSON-encoded result, such as a CSV report or a file. The Body is
+// returned by Call verbatim, and served over HTTP with the ContentType, which
+// defaults to application/octet-stream.
+//
+// Operations returning a RawResponse can't be batched, and the 200 response
+// of their definition is an opaque binary string.
+type RawResponse struct {
+	ContentType string
+	Body        []byte
+}
+
+var (
+	rawResponseType        = reflect.TypeOf(RawResponse{})
+	rawResponsePointerType = reflect.TypeOf(&RawResponse{})
+)
+
+// isRawResponse returns whether an operation result of type t is passed through verbatim.
+func isRawResponse(t reflect.Type) bool {
+	return t == rawResponseType || t == rawResponsePointerType
+}
+
+// rawResponseSchema describes the body of a RawResponse.
+func rawResponseSchema() *jsonschema.Schema {
+	return &jsonschema.Schema{Type: "string", Format: "binary"}
+}
+
+// writeRawResponse returns the body of a RawResponse, setting the Content-Type
+// of the response if the operation is being called over HTTP.
+func writeRawResponse(ctx context.Context, result reflect.Value) []byte {
+	var raw RawResponse
+	switch {
+	case result.Kind() == reflect.Pointer && !result.IsNil():
+		raw = *result.Interface().(*RawResponse)
+	case result.Kind() == reflect.Struct:
+		raw = result.Interface().(RawResponse)
+	}
+
+	if w, ok := ctx.Value(responseWriterContextKey{}).(http.ResponseWriter); ok {
+		contentType := raw.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", contentType)
+	}
+
+	return raw.Body
+}
@@ -0,0 +1,103 @@
+package ops
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+
+	"github.com/common-fate/ops/protocol"
+)
+
+// RequestIDHeader carries the ID of a request served over HTTP, including
+// over the tunnel. The handler uses the ID sent by the client, or generates
+// one if it's missing, and echoes it in the response. The ID is available to
+// the operation with RequestIDFromContext, and is added to the handler's logs.
+const RequestIDHeader = protocol.RequestIDHeader
+
+// maxRequestIDLength limits the length of request IDs sent by clients.
+const maxRequestIDLength = 128
+
+type requestIDContextKey struct{}
+
+// WithRequestID returns a copy of ctx with a request ID, which is used
+// rather than a generated ID when calling Handler.Call.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, id)
+}
+
+// RequestIDFromContext returns the ID of the request being served.
+// Every call made with Handler.Call has a request ID.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDContextKey{}).(string)
+	return id, ok && id != ""
+}
+
+// ensureRequestID returns ctx with a generated request ID if it doesn't have one.
+func ensureRequestID(ctx context.Context) context.Context {
+	if _, ok := RequestIDFromContext(ctx); ok {
+		return ctx
+	}
+	return WithRequestID(ctx, newRequestID())
+}
+
+// withRequestID returns the request with the ID sent by the client, or a
+// generated ID if the client didn't send a valid one, and sets the ID on the response.
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get(RequestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	w.Header().Set(RequestIDHeader, id)
+	return r.WithContext(WithRequestID(r.Context(), id))
+}
+
+// validRequestID returns whether a request ID sent by a client can be used, which
+// rules out IDs which are too long or contain characters which could corrupt logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestIDLogHandler adds the request ID to records logged with a context which has one.
+type requestIDLogHandler struct {
+	slog.Handler
+}
+
+// withRequestIDLogging returns a logger which adds request IDs to its records.
+func withRequestIDLogging(log *slog.Logger) *slog.Logger {
+	if _, ok := log.Handler().(requestIDLogHandler); ok {
+		return log
+	}
+	return slog.New(requestIDLogHandler{log.Handler()})
+}
+
+func (h requestIDLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id, ok := RequestIDFromContext(ctx); ok {
+		r = r.Clone()
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDLogHandler) WithGroup(name string) slog.Handler {
+	return requestIDLogHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,98 @@
+package ops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/common-fate/ops/protocol"
+)
+
+// Operations may take a pointer to a registered resource type, which is
+// loaded before the operation is called:
+//
+//	func (s *Service) GetCustomer(ctx context.Context, customer *Customer, in GetCustomerInput) (Customer, error)
+//
+// The ID of the resource to load is read from the operation's input, which must be a struct.
+// The ID is taken from the string field tagged `resource:"id"`, or if no field is tagged,
+// from the string field named 'id' in the encoded input.
+//
+// If the loader returns an *Error, it is returned to the caller as-is. If the loader returns
+// a nil resource the call fails with protocol.CodeNotFound, and other errors fail the call
+// with protocol.CodeServerError.
+
+// resourceIDTag is the struct tag which marks the input field holding a resource's ID.
+const resourceIDTag = "resource"
+
+// resourceIDField returns the index of the field holding the resource ID in an input struct.
+func resourceIDField(t reflect.Type, naming FieldNaming) ([]int, error) {
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("operations taking a resource must have a struct input to read the resource ID from, got %s", t)
+	}
+
+	var field *reflect.StructField
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Tag.Get(resourceIDTag) == "id" {
+			field = &f
+			break
+		}
+	}
+
+	if field == nil {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.IsExported() && wireName(f, naming) == "id" {
+				field = &f
+				break
+			}
+		}
+	}
+
+	if field == nil {
+		return nil, fmt.Errorf("the input %s has no resource ID field: tag a string field with `%s:\"id\"`", t, resourceIDTag)
+	}
+
+	if field.Type.Kind() != reflect.String {
+		return nil, fmt.Errorf("the resource ID field %s.%s must be a string, got %s", t, field.Name, field.Type)
+	}
+
+	return field.Index, nil
+}
+
+// wireName returns the name of a struct field when encoded as JSON.
+func wireName(f reflect.StructField, naming FieldNaming) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name != "" {
+		return name
+	}
+	if naming != nil {
+		return naming(f.Name)
+	}
+	return f.Name
+}
+
+// loadResource loads the resource for a call, using the ID from the decoded input.
+func loadResource(ctx context.Context, fn function, input reflect.Value) (reflect.Value, error) {
+	id := input.FieldByIndex(fn.resourceIDField).String()
+	if id == "" {
+		return reflect.Value{}, &Error{Code: protocol.CodeBadRequest, Err: errors.New("a resource ID is required")}
+	}
+
+	res, found, err := fn.resource.load(ctx, id)
+	if err != nil {
+		var opErr *Error
+		if errors.As(err, &opErr) {
+			return reflect.Value{}, err
+		}
+		return reflect.Value{}, &Error{Code: protocol.CodeServerError, Err: fmt.Errorf("loading resource %s: %w", id, err)}
+	}
+	if !found {
+		return reflect.Value{}, &Error{Code: protocol.CodeNotFound, Err: fmt.Errorf("resource %s not found", id)}
+	}
+
+	return res, nil
+}
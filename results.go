@@ -0,0 +1,64 @@
+package ops
+
+import (
+	"fmt"
+	"go/token"
+	"reflect"
+	"unicode"
+)
+
+// resultsType returns the struct type which the first n return values of an
+// operation are packaged into, so that an operation can return several related
+// values, such as (User, Org, error). The result is an object with a field per
+// value, named after the value's type in the same way as an untagged struct
+// field, so Registry.FieldNaming applies:
+//
+//	{"User": {...}, "Org": {...}}
+//
+// Each value must be a named struct type, or a pointer to one, and the
+// types must have different names.
+func resultsType(f reflect.Type, n int) (reflect.Type, error) {
+	fields := make([]reflect.StructField, 0, n)
+	seen := map[string]bool{}
+
+	for i := 0; i < n; i++ {
+		t := f.Out(i)
+
+		named := t
+		if named.Kind() == reflect.Pointer {
+			named = named.Elem()
+		}
+		if named.Kind() != reflect.Struct || named.Name() == "" || isRawResponse(t) || t.Implements(subscriptionType) {
+			return nil, fmt.Errorf("operations returning several values must return named struct types, got %s", t)
+		}
+
+		name := exportedFieldName(named.Name())
+		if !token.IsIdentifier(name) {
+			return nil, fmt.Errorf("operations returning several values can't return generic types, got %s", t)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("operations returning several values must return types with different names, got %s more than once", name)
+		}
+		seen[name] = true
+
+		fields = append(fields, reflect.StructField{Name: name, Type: t})
+	}
+
+	return reflect.StructOf(fields), nil
+}
+
+// packResults packages the return values of an operation into a value of its results type.
+func packResults(t reflect.Type, output []reflect.Value) reflect.Value {
+	v := reflect.New(t).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		v.Field(i).Set(output[i])
+	}
+	return v
+}
+
+// exportedFieldName returns a type name with its first letter in upper case.
+func exportedFieldName(name string) string {
+	r := []rune(name)
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
@@ -0,0 +1,36 @@
+package ops
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/common-fate/ops/protocol"
+)
+
+// DefaultRetryAfter is the delay advertised to clients when
+// a retryable operation fails and OperationMetadata.RetryAfter isn't set.
+const DefaultRetryAfter = time.Second
+
+// retryableCode returns whether a call which failed with code may succeed if
+// it's retried. Calls which were rejected because of their input aren't retried.
+func retryableCode(code protocol.ResponseCode) bool {
+	switch code {
+	case protocol.CodeServerError, protocol.CodeTimeout, protocol.CodeTooManyRequests:
+		return true
+	}
+	return false
+}
+
+// setRetryAfter sets the Retry-After header of an error response to a
+// retryable operation, in whole seconds rounded up.
+func setRetryAfter(header http.Header, code protocol.ResponseCode, retryAfter time.Duration) {
+	if !retryableCode(code) {
+		return
+	}
+	if retryAfter <= 0 {
+		retryAfter = DefaultRetryAfter
+	}
+	header.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+}
@@ -0,0 +1,270 @@
+package servicedef
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Change is a difference between two versions of the definitions.
+type Change struct {
+	Service   string
+	Operation string
+	// Breaking is true if clients of the baseline
+	// definitions may fail against the current definitions.
+	Breaking    bool
+	Description string
+}
+
+func (c Change) String() string {
+	target := c.Service
+	if c.Operation != "" {
+		target = c.Service + "." + c.Operation
+	}
+	return target + ": " + c.Description
+}
+
+// Compare returns the changes made to the baseline definitions
+// in the current definitions, classifying each as breaking or not.
+//
+// Removing a service or operation is breaking, as is changing an operation
+// so that existing clients can no longer call it: adding a required input
+// field, changing the type of a field, removing a field from a response, or
+// requiring HTTP, a tenant, or a subscription where it wasn't before.
+func Compare(baseline, current Definitions) []Change {
+	var changes []Change
+
+	currentServices := map[string]Service{}
+	for _, svc := range current.Services {
+		currentServices[svc.Path()] = svc
+	}
+
+	baselineServices := map[string]bool{}
+
+	for _, old := range baseline.Services {
+		baselineServices[old.Path()] = true
+
+		svc, ok := currentServices[old.Path()]
+		if !ok {
+			changes = append(changes, Change{Service: old.Path(), Breaking: true, Description: "service was removed"})
+			continue
+		}
+
+		changes = append(changes, compareService(old, svc)...)
+	}
+
+	for _, svc := range current.Services {
+		if !baselineServices[svc.Path()] {
+			changes = append(changes, Change{Service: svc.Path(), Description: "service was added"})
+		}
+	}
+
+	return changes
+}
+
+func compareService(baseline, current Service) []Change {
+	var changes []Change
+
+	currentOps := map[string]Operation{}
+	for _, op := range current.Operations {
+		currentOps[op.ID] = op
+	}
+
+	baselineOps := map[string]bool{}
+
+	for _, old := range baseline.Operations {
+		baselineOps[old.ID] = true
+
+		op, ok := currentOps[old.ID]
+		if !ok {
+			changes = append(changes, Change{Service: current.Path(), Operation: old.ID, Breaking: true, Description: "operation was removed"})
+			continue
+		}
+
+		for _, c := range compareOperation(old, op) {
+			c.Service = current.Path()
+			c.Operation = op.ID
+			changes = append(changes, c)
+		}
+	}
+
+	for _, op := range current.Operations {
+		if !baselineOps[op.ID] {
+			changes = append(changes, Change{Service: current.Path(), Operation: op.ID, Description: "operation was added"})
+		}
+	}
+
+	return changes
+}
+
+func compareOperation(baseline, current Operation) []Change {
+	var changes []Change
+
+	breaking := func(format string, args ...any) {
+		changes = append(changes, Change{Breaking: true, Description: fmt.Sprintf(format, args...)})
+	}
+
+	if !baseline.HTTPOnly && current.HTTPOnly {
+		breaking("operation now requires an HTTP transport")
+	}
+	if !baseline.TenantScoped && current.TenantScoped {
+		breaking("operation now requires a tenant")
+	}
+	if baseline.Subscription != current.Subscription {
+		breaking("operation subscription behaviour changed")
+	}
+	if baseline.InputStream != current.InputStream {
+		breaking("operation input streaming behaviour changed")
+	}
+	if baseline.RawResponse != current.RawResponse {
+		breaking("operation raw response behaviour changed")
+	}
+
+	switch {
+	case baseline.RequestBody == nil && current.RequestBody != nil:
+		breaking("operation now requires a request body")
+	case baseline.RequestBody != nil && current.RequestBody != nil:
+		c := newSchemaComparison(baseline.RequestBody.Schema, current.RequestBody.Schema, true)
+		changes = append(changes, c.compare("request", c.oldRoot, c.newRoot)...)
+	}
+
+	for status, oldBody := range baseline.ResponseBody {
+		newBody, ok := current.ResponseBody[status]
+		if !ok {
+			breaking("%s response was removed", status)
+			continue
+		}
+
+		c := newSchemaComparison(oldBody, newBody, false)
+		changes = append(changes, c.compare(status+" response", c.oldRoot, c.newRoot)...)
+	}
+
+	return changes
+}
+
+// schemaComparison compares two JSON schemas in their generic
+// map form, resolving references to their $defs.
+type schemaComparison struct {
+	oldRoot, newRoot map[string]any
+	oldDefs, newDefs map[string]any
+	// input is true if the schemas describe a request body.
+	input bool
+	// seen prevents infinite recursion for self-referencing schemas.
+	seen map[string]bool
+}
+
+func newSchemaComparison(baseline, current any, input bool) *schemaComparison {
+	c := &schemaComparison{
+		oldRoot: schemaMap(baseline),
+		newRoot: schemaMap(current),
+		input:   input,
+		seen:    map[string]bool{},
+	}
+	c.oldDefs, _ = c.oldRoot["$defs"].(map[string]any)
+	c.newDefs, _ = c.newRoot["$defs"].(map[string]any)
+	return c
+}
+
+func schemaMap(schema any) map[string]any {
+	var m map[string]any
+	b, err := json.Marshal(schema)
+	if err == nil {
+		_ = json.Unmarshal(b, &m)
+	}
+	return m
+}
+
+func resolve(schema map[string]any, defs map[string]any) (map[string]any, string) {
+	ref, ok := schema["$ref"].(string)
+	if !ok {
+		return schema, ""
+	}
+	def, _ := defs[strings.TrimPrefix(ref, "#/$defs/")].(map[string]any)
+	return def, ref
+}
+
+func (c *schemaComparison) compare(path string, oldSchema, newSchema map[string]any) []Change {
+	var changes []Change
+
+	breaking := func(format string, args ...any) {
+		changes = append(changes, Change{Breaking: true, Description: fmt.Sprintf(format, args...)})
+	}
+
+	oldSchema, oldRef := resolve(oldSchema, c.oldDefs)
+	newSchema, newRef := resolve(newSchema, c.newDefs)
+	if oldSchema == nil || newSchema == nil {
+		return nil
+	}
+
+	if oldRef != "" || newRef != "" {
+		key := oldRef + "|" + newRef
+		if c.seen[key] {
+			return nil
+		}
+		c.seen[key] = true
+	}
+
+	if oldType, newType := fmt.Sprint(oldSchema["type"]), fmt.Sprint(newSchema["type"]); oldType != newType {
+		breaking("%s type changed from %s to %s", path, oldType, newType)
+		return changes
+	}
+
+	oldProps, _ := oldSchema["properties"].(map[string]any)
+	newProps, _ := newSchema["properties"].(map[string]any)
+
+	for _, name := range sortedKeys(oldProps) {
+		oldProp, _ := oldProps[name].(map[string]any)
+		newProp, ok := newProps[name].(map[string]any)
+		if !ok {
+			if c.input {
+				changes = append(changes, Change{Description: fmt.Sprintf("%s field %s was removed", path, name)})
+			} else {
+				breaking("%s field %s was removed", path, name)
+			}
+			continue
+		}
+		changes = append(changes, c.compare(path+"."+name, oldProp, newProp)...)
+	}
+
+	oldRequired := stringSet(oldSchema["required"])
+	for _, name := range sortedKeys(newProps) {
+		_, existed := oldProps[name]
+		required := stringSet(newSchema["required"])[name]
+
+		switch {
+		case c.input && required && !oldRequired[name]:
+			breaking("%s field %s is now required", path, name)
+		case !existed:
+			changes = append(changes, Change{Description: fmt.Sprintf("%s field %s was added", path, name)})
+		}
+	}
+
+	oldItems, _ := oldSchema["items"].(map[string]any)
+	newItems, _ := newSchema["items"].(map[string]any)
+	if oldItems != nil && newItems != nil {
+		changes = append(changes, c.compare(path+"[]", oldItems, newItems)...)
+	}
+
+	return changes
+}
+
+func stringSet(v any) map[string]bool {
+	res := map[string]bool{}
+	items, _ := v.([]any)
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			res[s] = true
+		}
+	}
+	return res
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
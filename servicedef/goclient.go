@@ -0,0 +1,441 @@
+package servicedef
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"go/token"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/invopop/jsonschema"
+)
+
+// GoClient generates the source of a Go package named pkg, containing a typed
+// client for the services in the definitions.
+//
+// The client has a field per service, with a method per operation which POSTs
+// the input to /{service}/{operation} and decodes the result, matching the HTTP
+// handler. Services and operations are named after their CLIName if it is set,
+// or their ID otherwise. Go types are generated for the schema definitions of
+// each request and response body. Operations without a 200 response schema
+// return the response body as a json.RawMessage, operations with a raw response
+// return the response body as a []byte, and operations with an empty 200
+// response schema only return an error.
+//
+// Subscriptions, bidirectional operations and operations which stream their input
+// aren't included in the client.
+func (d Definitions) GoClient(pkg string) ([]byte, error) {
+	g := &goClientGenerator{
+		defs:    map[string]*jsonschema.Schema{},
+		imports: map[string]bool{"bytes": true, "context": true, "encoding/json": true, "fmt": true, "io": true, "net/http": true, "net/url": true, "strings": true},
+	}
+
+	for name, def := range d.Defs {
+		g.defs[name] = def
+	}
+
+	var services bytes.Buffer
+
+	g.printf(&services, "// Client calls operations over HTTP.\ntype Client struct {\n")
+	for _, svc := range d.Services {
+		if svc.Description != "" {
+			g.comment(&services, svc.Description)
+		}
+		g.printf(&services, "%s *%sClient\n", serviceName(svc), serviceName(svc))
+	}
+	g.printf(&services, "}\n\n")
+
+	g.printf(&services, `// New returns a client for the operations served at baseURL.
+// If httpClient is nil, http.DefaultClient is used.
+func New(baseURL string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	c := &client{baseURL: strings.TrimSuffix(baseURL, "/"), httpClient: httpClient}
+	return &Client{
+`)
+	for _, svc := range d.Services {
+		g.printf(&services, "%s: &%sClient{c: c},\n", serviceName(svc), serviceName(svc))
+	}
+	g.printf(&services, "}\n}\n\n")
+
+	for _, svc := range d.Services {
+		g.service(&services, svc)
+	}
+
+	var types bytes.Buffer
+
+	names := make([]string, 0, len(g.defs))
+	for name := range g.defs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		def := g.defs[name]
+		if def.Description != "" {
+			g.comment(&types, def.Description)
+		}
+		g.printf(&types, "type %s %s\n\n", exportedName(name), g.goType(def))
+	}
+
+	var out bytes.Buffer
+
+	g.printf(&out, "// Code generated by opsgen. DO NOT EDIT.\n\n")
+	g.printf(&out, "package %s\n\nimport (\n", pkg)
+
+	imports := make([]string, 0, len(g.imports))
+	for imp := range g.imports {
+		imports = append(imports, imp)
+	}
+	sort.Strings(imports)
+	for _, imp := range imports {
+		g.printf(&out, "%q\n", imp)
+	}
+	g.printf(&out, ")\n\n")
+
+	out.Write(services.Bytes())
+	out.Write(types.Bytes())
+	out.WriteString(goClientRuntime)
+
+	if g.err != nil {
+		return nil, g.err
+	}
+
+	src, err := format.Source(out.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("formatting generated client: %w", err)
+	}
+
+	return src, nil
+}
+
+type goClientGenerator struct {
+	// defs are the schema definitions collected from
+	// every request and response body, by name.
+	defs    map[string]*jsonschema.Schema
+	imports map[string]bool
+	err     error
+}
+
+func (g *goClientGenerator) printf(buf *bytes.Buffer, format string, args ...any) {
+	if _, err := fmt.Fprintf(buf, format, args...); err != nil && g.err == nil {
+		g.err = err
+	}
+}
+
+func (g *goClientGenerator) comment(buf *bytes.Buffer, text string) {
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		g.printf(buf, "// %s\n", strings.TrimSpace(line))
+	}
+}
+
+func (g *goClientGenerator) service(buf *bytes.Buffer, svc Service) {
+	name := serviceName(svc)
+
+	g.printf(buf, "// %sClient calls operations on the %s service.\n", name, svc.Path())
+	g.printf(buf, "type %sClient struct {\nc *client\n}\n\n", name)
+
+	for _, op := range svc.Operations {
+		if op.Subscription || op.InputStream || op.Bidirectional {
+			continue
+		}
+
+		method := exportedName(op.ID)
+		if op.CLIName != "" {
+			method = exportedName(op.CLIName)
+		}
+
+		params := "ctx context.Context"
+		var pathArgs string
+		for _, param := range op.Parameters {
+			name := unexportedName(param.Name)
+			params += ", " + name + " " + g.goType(&param.Schema)
+			if param.Schema.Type == "string" {
+				pathArgs += ", " + name
+			} else {
+				pathArgs += ", fmt.Sprint(" + name + ")"
+			}
+		}
+
+		input := "nil"
+		if op.RequestBody != nil {
+			g.collect(&op.RequestBody.Schema)
+			params += ", input " + g.goType(&op.RequestBody.Schema)
+			input = "input"
+		}
+
+		if op.Description != "" {
+			g.comment(buf, method+" "+op.Description)
+		}
+		if op.Deprecated {
+			if op.Description != "" {
+				g.printf(buf, "//\n")
+			}
+			message := op.DeprecationMessage
+			if message == "" {
+				message = "the operation is deprecated."
+			}
+			g.comment(buf, "Deprecated: "+message)
+		}
+
+		res, ok := op.ResponseBody["200"]
+		if ok && isEmptySchema(&res) {
+			// the operation only returns an error.
+			g.printf(buf, "func (c *%sClient) %s(%s) error {\n", name, method, params)
+			g.printf(buf, "return c.c.call(ctx, %q, %q, %s, nil%s)\n}\n\n", svc.Path(), op.ID, input, pathArgs)
+			continue
+		}
+
+		result := "json.RawMessage"
+		switch {
+		case op.RawResponse:
+			result = "[]byte"
+		case ok:
+			g.collect(&res)
+			result = g.goType(&res)
+		}
+
+		g.printf(buf, "func (c *%sClient) %s(%s) (%s, error) {\n", name, method, params, result)
+		g.printf(buf, "var out %s\n", result)
+		g.printf(buf, "err := c.c.call(ctx, %q, %q, %s, &out%s)\n", svc.Path(), op.ID, input, pathArgs)
+		g.printf(buf, "return out, err\n}\n\n")
+	}
+}
+
+// collect adds the definitions of a root schema to the generated types.
+// Definitions with the same name are assumed to describe the same type.
+func (g *goClientGenerator) collect(schema *jsonschema.Schema) {
+	for name, def := range schema.Definitions {
+		if _, ok := g.defs[name]; !ok {
+			g.defs[name] = def
+		}
+	}
+}
+
+// goType returns the Go type for a schema.
+func (g *goClientGenerator) goType(s *jsonschema.Schema) string {
+	if s == nil {
+		return "json.RawMessage"
+	}
+
+	if s.Ref != "" {
+		return exportedName(strings.TrimPrefix(s.Ref, "#/$defs/"))
+	}
+
+	switch s.Type {
+	case "string":
+		if s.Format == "date-time" {
+			g.imports["time"] = true
+			return "time.Time"
+		}
+		return "string"
+	case "integer":
+		return "int64"
+	case "number":
+		return "float64"
+	case "boolean":
+		return "bool"
+	case "array":
+		return "[]" + g.goType(s.Items)
+	case "object":
+		if s.Properties != nil && s.Properties.Len() > 0 {
+			return g.structType(s)
+		}
+		if s.AdditionalProperties != nil && !isBoolSchema(s.AdditionalProperties) {
+			return "map[string]" + g.goType(s.AdditionalProperties)
+		}
+		return "map[string]any"
+	}
+
+	return "any"
+}
+
+func (g *goClientGenerator) structType(s *jsonschema.Schema) string {
+	required := map[string]bool{}
+	for _, r := range s.Required {
+		required[r] = true
+	}
+
+	var buf bytes.Buffer
+	g.printf(&buf, "struct {\n")
+
+	for prop := s.Properties.Oldest(); prop != nil; prop = prop.Next() {
+		if prop.Value.Description != "" {
+			g.comment(&buf, prop.Value.Description)
+		}
+
+		tag := prop.Key
+		if !required[prop.Key] {
+			tag += ",omitempty"
+		}
+
+		g.printf(&buf, "%s %s `json:%q`\n", exportedName(prop.Key), g.goType(prop.Value), tag)
+	}
+
+	g.printf(&buf, "}")
+	return buf.String()
+}
+
+// isEmptySchema returns whether a schema has no keywords,
+// which is used to describe a response without a body.
+func isEmptySchema(s *jsonschema.Schema) bool {
+	b, err := json.Marshal(s)
+	return err == nil && string(b) == "{}"
+}
+
+// isBoolSchema returns whether a schema is the boolean schema true or false.
+func isBoolSchema(s *jsonschema.Schema) bool {
+	b, err := json.Marshal(s)
+	return err == nil && (string(b) == "true" || string(b) == "false")
+}
+
+func serviceName(svc Service) string {
+	name := svc.ID
+	if svc.CLIName != "" {
+		name = svc.CLIName
+	}
+	// versions of a service are named like BillingV2.
+	return exportedName(name) + exportedName(svc.Version)
+}
+
+// exportedName converts a name such as 'fooInput', 'first_name'
+// or 'get-user' into an exported Go identifier.
+func exportedName(name string) string {
+	var b strings.Builder
+	upper := true
+
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if b.Len() == 0 && unicode.IsDigit(r) {
+			b.WriteRune('X')
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// unexportedName converts a parameter name into an unexported Go identifier
+// which doesn't collide with keywords or the other identifiers in client methods.
+func unexportedName(name string) string {
+	exported := []rune(exportedName(name))
+	if len(exported) == 0 {
+		return "param"
+	}
+
+	ident := string(unicode.ToLower(exported[0])) + string(exported[1:])
+	switch ident {
+	case "c", "ctx", "input", "out", "err":
+		return ident + "Param"
+	}
+	if token.IsKeyword(ident) {
+		return ident + "Param"
+	}
+	return ident
+}
+
+// goClientRuntime is included in every generated client.
+const goClientRuntime = `
+// Error is returned when an operation responds with a non-2xx status. Code
+// and Message are decoded from the JSON error response. If the response
+// isn't JSON, Code is empty and Message is the text of the response.
+type Error struct {
+	StatusCode int
+	// Code is the name of the response code, such as "CodeNotFound".
+	Code    string
+	Message string
+	// RequestID is the X-Request-Id header of the response, if set.
+	RequestID string
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("operation failed with status %d", e.StatusCode)
+	if e.Code != "" {
+		msg += " (" + e.Code + ")"
+	}
+	msg += ": " + e.Message
+	if e.RequestID != "" {
+		msg += " (request ID " + e.RequestID + ")"
+	}
+	return msg
+}
+
+// errorResponse is the JSON body of an error response.
+type errorResponse struct {
+	Code    string ` + "`json:\"code\"`" + `
+	Message string ` + "`json:\"message\"`" + `
+}
+
+type client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// call makes a call to an operation, with any parameters added to the path.
+func (c *client) call(ctx context.Context, service string, operation string, input any, out any, params ...string) error {
+	var body []byte
+	if input != nil {
+		var err error
+		body, err = json.Marshal(input)
+		if err != nil {
+			return err
+		}
+	}
+
+	path := "/" + service + "/" + operation
+	for _, p := range params {
+		path += "/" + url.PathEscape(p)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		e := &Error{StatusCode: res.StatusCode, RequestID: res.Header.Get("X-Request-Id")}
+		var body errorResponse
+		if err := json.Unmarshal(b, &body); err == nil && body.Code != "" {
+			e.Code, e.Message = body.Code, body.Message
+		} else {
+			e.Message = strings.TrimSpace(string(b))
+		}
+		return e
+	}
+
+	if out == nil || len(b) == 0 {
+		return nil
+	}
+
+	// raw responses aren't JSON.
+	if raw, ok := out.(*[]byte); ok {
+		*raw = b
+		return nil
+	}
+
+	return json.Unmarshal(b, out)
+}
+`
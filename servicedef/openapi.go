@@ -0,0 +1,231 @@
+package servicedef
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// OpenAPI document types. Only the parts of the
+// specification used by OpenAPI() are defined here.
+type openAPIDocument struct {
+	OpenAPI    string                          `json:"openapi"`
+	Info       openAPIInfo                     `json:"info"`
+	Paths      map[string]map[string]openAPIOp `json:"paths"`
+	Components openAPIComponents               `json:"components"`
+	Tags       []openAPITag                    `json:"tags,omitempty"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPITag struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+type openAPIOp struct {
+	OperationID string                     `json:"operationId"`
+	Summary     string                     `json:"summary,omitempty"`
+	Description string                     `json:"description,omitempty"`
+	Tags        []string                   `json:"tags"`
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIBody               `json:"requestBody,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+	Deprecated  bool                       `json:"deprecated,omitempty"`
+}
+
+type openAPIParameter struct {
+	Name     string         `json:"name"`
+	In       string         `json:"in"`
+	Required bool           `json:"required"`
+	Schema   map[string]any `json:"schema"`
+}
+
+type openAPIBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema  map[string]any  `json:"schema"`
+	Example json.RawMessage `json:"example,omitempty"`
+}
+
+type openAPIComponents struct {
+	Schemas map[string]any `json:"schemas"`
+}
+
+// OpenAPI converts the definitions into an OpenAPI 3.0 document.
+//
+// Each operation is exposed as a POST to /{service}/{operation}, matching the
+// HTTP handler, unless the operation has a RoutingRule with a path, in which case
+// the routing rule path and method are used. Schema definitions are moved into
+// the document's components and references are rewritten to point to them.
+func (d Definitions) OpenAPI() ([]byte, error) {
+	doc := openAPIDocument{
+		OpenAPI: "3.0.3",
+		Info: openAPIInfo{
+			Title:   "Operations",
+			Version: "1",
+		},
+		Paths: map[string]map[string]openAPIOp{},
+		Components: openAPIComponents{
+			Schemas: map[string]any{},
+		},
+	}
+
+	for name, def := range d.Defs {
+		schema, err := doc.componentSchema(def)
+		if err != nil {
+			return nil, fmt.Errorf("converting definition %s: %w", name, err)
+		}
+		doc.Components.Schemas[name] = schema
+	}
+
+	for _, svc := range d.Services {
+		doc.Tags = append(doc.Tags, openAPITag{Name: svc.Path(), Description: svc.Description})
+
+		for _, op := range svc.Operations {
+			path := "/" + svc.Path() + "/" + op.ID
+			method := "post"
+			if op.RoutingRule.Path != "" {
+				path = op.RoutingRule.Path
+			}
+			if op.RoutingRule.Method != "" {
+				method = strings.ToLower(op.RoutingRule.Method)
+			}
+
+			oop := openAPIOp{
+				OperationID: svc.Path() + "." + op.ID,
+				Summary:     op.Name,
+				Description: op.Description,
+				Tags:        []string{svc.Path()},
+				Responses:   map[string]openAPIResponse{},
+				Deprecated:  op.Deprecated,
+			}
+
+			for _, param := range op.Parameters {
+				schema, err := doc.componentSchema(param.Schema)
+				if err != nil {
+					return nil, fmt.Errorf("converting parameter %s for %s: %w", param.Name, oop.OperationID, err)
+				}
+
+				oop.Parameters = append(oop.Parameters, openAPIParameter{
+					Name:     param.Name,
+					In:       param.In,
+					Required: true,
+					Schema:   schema,
+				})
+			}
+
+			if op.RequestBody != nil {
+				schema, err := doc.componentSchema(op.RequestBody.Schema)
+				if err != nil {
+					return nil, fmt.Errorf("converting request body for %s: %w", oop.OperationID, err)
+				}
+
+				oop.RequestBody = &openAPIBody{
+					Required: true,
+					Content: map[string]openAPIMediaType{
+						"application/json": {Schema: schema, Example: op.RequestExample},
+					},
+				}
+			}
+
+			for status, body := range op.ResponseBody {
+				schema, err := doc.componentSchema(body)
+				if err != nil {
+					return nil, fmt.Errorf("converting %s response for %s: %w", status, oop.OperationID, err)
+				}
+
+				if len(schema) == 0 {
+					// an empty schema means the response has no body.
+					oop.Responses[status] = openAPIResponse{Description: status}
+					continue
+				}
+
+				mediaType := "application/json"
+				if op.RawResponse && status == "200" {
+					// the operation sets its own content type.
+					mediaType = "application/octet-stream"
+				}
+
+				content := openAPIMediaType{Schema: schema}
+				if status == "200" {
+					content.Example = op.ResponseExample
+				}
+
+				oop.Responses[status] = openAPIResponse{
+					Description: status,
+					Content:     map[string]openAPIMediaType{mediaType: content},
+				}
+			}
+
+			// OpenAPI requires at least one response to be documented.
+			if len(oop.Responses) == 0 {
+				oop.Responses["200"] = openAPIResponse{Description: "OK"}
+			}
+
+			if doc.Paths[path] == nil {
+				doc.Paths[path] = map[string]openAPIOp{}
+			}
+			doc.Paths[path][method] = oop
+		}
+	}
+
+	return json.Marshal(doc)
+}
+
+// componentSchema converts a JSON schema into an OpenAPI schema,
+// moving any $defs into the document components.
+func (doc *openAPIDocument) componentSchema(schema any) (map[string]any, error) {
+	b, err := json.Marshal(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	var m map[string]any
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+
+	if defs, ok := m["$defs"].(map[string]any); ok {
+		for name, def := range defs {
+			doc.Components.Schemas[name] = rewriteRefs(def)
+		}
+	}
+
+	delete(m, "$defs")
+	delete(m, "$schema")
+	delete(m, "$id")
+
+	return rewriteRefs(m).(map[string]any), nil
+}
+
+// rewriteRefs rewrites JSON schema $defs references
+// to OpenAPI component references.
+func rewriteRefs(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			if ref, ok := child.(string); ok && k == "$ref" {
+				v[k] = strings.Replace(ref, "#/$defs/", "#/components/schemas/", 1)
+				continue
+			}
+			v[k] = rewriteRefs(child)
+		}
+	case []any:
+		for i, child := range v {
+			v[i] = rewriteRefs(child)
+		}
+	}
+	return v
+}
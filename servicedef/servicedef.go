@@ -3,11 +3,26 @@
 package servicedef
 
 import (
+	"encoding/json"
+
 	"github.com/invopop/jsonschema"
 )
 
 type Definitions struct {
 	Services []Service `json:"services"`
+
+	// Resources are the resource types which
+	// operations may load, see ops.RegisterResource.
+	Resources []Resource `json:"resources,omitempty"`
+
+	// Defs are the type definitions shared by the schemas of operations
+	// and resources, if they've been moved here by ShareDefinitions.
+	Defs jsonschema.Definitions `json:"$defs,omitempty"`
+}
+
+type Resource struct {
+	ID     string     `json:"id"`
+	Schema RootSchema `json:"schema"`
 }
 
 type Service struct {
@@ -16,6 +31,57 @@ type Service struct {
 	Name        string      `json:"name"`
 	Description string      `json:"description"`
 	Operations  []Operation `json:"operations"`
+
+	// Version, if set, prefixes the path of the service, so that
+	// several versions of a service with the same ID can be served.
+	Version string `json:"version,omitempty"`
+}
+
+// ServiceSummary describes a service by the IDs of its operations, without any schemas.
+type ServiceSummary struct {
+	ID          string   `json:"id"`
+	Version     string   `json:"version,omitempty"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Operations  []string `json:"operations"`
+}
+
+// Summary returns the summary of the service.
+func (s Service) Summary() ServiceSummary {
+	ops := make([]string, 0, len(s.Operations))
+	for _, op := range s.Operations {
+		ops = append(ops, op.ID)
+	}
+	return ServiceSummary{
+		ID:          s.ID,
+		Version:     s.Version,
+		Name:        s.Name,
+		Description: s.Description,
+		Operations:  ops,
+	}
+}
+
+// DefinitionsSummary summarizes the services of the definitions.
+type DefinitionsSummary struct {
+	Services []ServiceSummary `json:"services"`
+}
+
+// Summary returns the summary of the definitions.
+func (d Definitions) Summary() DefinitionsSummary {
+	services := make([]ServiceSummary, 0, len(d.Services))
+	for _, svc := range d.Services {
+		services = append(services, svc.Summary())
+	}
+	return DefinitionsSummary{Services: services}
+}
+
+// Path returns the path of the service, which is its ID prefixed
+// by its Version if set, such as "v2/billing".
+func (s Service) Path() string {
+	if s.Version == "" {
+		return s.ID
+	}
+	return s.Version + "/" + s.ID
 }
 
 type Operation struct {
@@ -25,11 +91,75 @@ type Operation struct {
 	Description string      `json:"description"`
 	RoutingRule RoutingRule `json:"routingRule"`
 
+	// HTTPOnly is true if the operation accepts the raw *http.Request
+	// and can only be called over an HTTP transport.
+	HTTPOnly bool `json:"httpOnly,omitempty"`
+
+	// TenantScoped is true if the operation can only
+	// be called on behalf of a tenant.
+	TenantScoped bool `json:"tenantScoped,omitempty"`
+
+	// Scopes are required of the caller to call the operation.
+	Scopes []string `json:"scopes,omitempty"`
+
+	// Retryable is true if the operation is safe to call again after
+	// failing with a server error, a timeout or a rate limit.
+	Retryable bool `json:"retryable,omitempty"`
+
+	// Subscription is true if the operation keeps the response open
+	// and pushes a stream of newline-delimited JSON events to the client.
+	Subscription bool `json:"subscription,omitempty"`
+
+	// RawResponse is true if the operation responds with an opaque body,
+	// described by a binary string schema, with its own content type
+	// rather than JSON.
+	RawResponse bool `json:"rawResponse,omitempty"`
+
+	// Paginated is true if the operation returns a page of items, with an
+	// items array and a nextCursor to pass as the cursor of the next request.
+	Paginated bool `json:"paginated,omitempty"`
+
+	// InputStream is true if the request body is a stream of
+	// newline-delimited JSON records, each matching RequestBody.
+	InputStream bool `json:"inputStream,omitempty"`
+
+	// Bidirectional is true if the client streams messages matching RequestBody
+	// while the operation streams messages matching the "200" response back,
+	// as frames of a single HTTP/2 or HTTP/3 request, such as a tunnel stream.
+	Bidirectional bool `json:"bidirectional,omitempty"`
+
+	// Deprecated is true if the operation is deprecated, and is kept
+	// for compatibility. DeprecationMessage may suggest an alternative.
+	Deprecated         bool   `json:"deprecated,omitempty"`
+	DeprecationMessage string `json:"deprecationMessage,omitempty"`
+
+	// Parameters are bound from the URL path rather than the request body.
+	// They follow the operation in the path, in order.
+	Parameters []Parameter `json:"parameters,omitempty"`
+
+	// RequestBody is the schema of the operation input.
+	// It is nil if the operation doesn't take an input,
+	// in which case no request body is expected.
 	RequestBody *RootSchema `json:"requestBody"`
 
 	// ResponseBody maps the HTTP response status codes
-	// to the expected body schema.
+	// to the expected body schema. The "200" schema describes the
+	// operation's result, or each event of a subscription. It is an
+	// empty schema if the operation only returns an error, in which
+	// case the response has no body.
 	ResponseBody map[string]jsonschema.Schema `json:"responses"`
+
+	// RequestExample and ResponseExample are examples of
+	// the request body and of the "200" response body.
+	RequestExample  json.RawMessage `json:"requestExample,omitempty"`
+	ResponseExample json.RawMessage `json:"responseExample,omitempty"`
+}
+
+type Parameter struct {
+	Name string `json:"name"`
+	// In is where the parameter is read from, currently always "path".
+	In     string            `json:"in"`
+	Schema jsonschema.Schema `json:"schema"`
 }
 
 type RoutingRule struct {
@@ -0,0 +1,80 @@
+package servicedef
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/invopop/jsonschema"
+)
+
+// ShareDefinitions moves the $defs of the schemas of operations and resources
+// into Defs, so that a type used by several schemas is only defined once.
+// References such as "#/$defs/Pagination" are unchanged, as they resolve to
+// Defs from the root of the definitions document, but they no longer resolve
+// within an operation's schema on its own.
+//
+// It returns an error if schemas define different types with the same name,
+// such as types with the same name in different packages.
+func (d *Definitions) ShareDefinitions() error {
+	if d.Defs == nil {
+		d.Defs = jsonschema.Definitions{}
+	}
+
+	for i := range d.Services {
+		for j := range d.Services[i].Operations {
+			op := &d.Services[i].Operations[j]
+
+			if op.RequestBody != nil {
+				if err := d.share(&op.RequestBody.Schema); err != nil {
+					return fmt.Errorf("%s.%s request body: %w", d.Services[i].Path(), op.ID, err)
+				}
+			}
+
+			for code, res := range op.ResponseBody {
+				if err := d.share(&res); err != nil {
+					return fmt.Errorf("%s.%s response body: %w", d.Services[i].Path(), op.ID, err)
+				}
+				op.ResponseBody[code] = res
+			}
+		}
+	}
+
+	for i := range d.Resources {
+		if err := d.share(&d.Resources[i].Schema.Schema); err != nil {
+			return fmt.Errorf("resource %s: %w", d.Resources[i].ID, err)
+		}
+	}
+
+	return nil
+}
+
+// share moves the definitions of a schema into Defs. The schema's definitions
+// may be shared with other schemas, so the map is replaced rather than modified.
+func (d *Definitions) share(schema *jsonschema.Schema) error {
+	for name, def := range schema.Definitions {
+		existing, ok := d.Defs[name]
+		if !ok {
+			d.Defs[name] = def
+			continue
+		}
+		if existing == def {
+			continue
+		}
+
+		a, err := json.Marshal(existing)
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(def)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(a, b) {
+			return fmt.Errorf("the definition %s differs from a shared definition with the same name", name)
+		}
+	}
+
+	schema.Definitions = nil
+	return nil
+}
@@ -0,0 +1,182 @@
+package ops
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/common-fate/ops/protocol"
+)
+
+// Operations may accept a stream of newline-delimited JSON (NDJSON)
+// records as their input by taking a receive-only channel:
+//
+//	func (s *Service) Import(ctx context.Context, in <-chan Record) (Summary, error)
+//
+// When served over HTTP, the request body is decoded line-by-line and each
+// record is sent on the channel as it is read, so the payload isn't buffered
+// in memory. The channel is closed once the body has been read. If a line
+// can't be decoded, the channel is closed, the operation's context is
+// cancelled, and the call fails with a StreamDecodeError.
+//
+// Middleware sees a nil input for streamed operations served over HTTP.
+//
+// If OperationMetadata.FrameTimeout is set, each record must be received
+// within the timeout, otherwise the call fails with protocol.CodeTimeout
+// and an error wrapping ErrFrameTimeout.
+
+// StreamDecodeError is returned when a line of a streamed input can't be decoded.
+type StreamDecodeError struct {
+	// Line is the 1-indexed line number of the malformed record.
+	Line int
+	Err  error
+}
+
+func (e *StreamDecodeError) Error() string {
+	return fmt.Sprintf("error decoding input stream at line %d: %s", e.Line, e.Err)
+}
+
+func (e *StreamDecodeError) Unwrap() error {
+	return e.Err
+}
+
+type bodyContextKey struct{}
+
+type streamErrorContextKey struct{}
+
+// inputStreamError records the error which ended an input stream early.
+// It's kept separately to the context's cause, as the server may cancel
+// the request's context first when reading the body fails.
+type inputStreamError struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (e *inputStreamError) set(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err == nil {
+		e.err = err
+	}
+}
+
+func (e *inputStreamError) get() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
+}
+
+// contextWithBody stores the unread request body, for
+// operations which stream their input.
+func contextWithBody(ctx context.Context, body io.Reader) context.Context {
+	return context.WithValue(ctx, bodyContextKey{}, body)
+}
+
+// isInputStream returns whether a parameter type is a receive-only channel.
+func isInputStream(t reflect.Type) bool {
+	return t.Kind() == reflect.Chan && t.ChanDir() == reflect.RecvDir
+}
+
+// streamInput starts decoding NDJSON records from the request body (or the input,
+// if the call wasn't made over HTTP) onto a channel of the provided parameter type.
+//
+// The returned context is cancelled if a line is malformed, or if a record isn't
+// received within frameTimeout. streamError returns the error in either case.
+// The returned cancel function must be called once the operation has returned.
+func streamInput(ctx context.Context, paramType reflect.Type, input json.RawMessage, frameTimeout time.Duration, codec Codec) (reflect.Value, context.Context, context.CancelCauseFunc) {
+	body, ok := ctx.Value(bodyContextKey{}).(io.Reader)
+	if !ok {
+		body = bytes.NewReader(input)
+	}
+
+	// read deadlines are only available when the body is read from
+	// an HTTP request, and only if the server supports them.
+	setDeadline := func(time.Time) error { return nil }
+	if w, ok := ctx.Value(responseWriterContextKey{}).(http.ResponseWriter); ok && frameTimeout > 0 {
+		setDeadline = http.NewResponseController(w).SetReadDeadline
+	}
+
+	serr := &inputStreamError{}
+	ctx = context.WithValue(ctx, streamErrorContextKey{}, serr)
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	fail := func(err error) {
+		serr.set(err)
+		cancel(err)
+	}
+
+	ch := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, paramType.Elem()), 0)
+
+	go func() {
+		defer ch.Close()
+
+		rd := bufio.NewReader(body)
+
+		for line := 1; ; line++ {
+			if frameTimeout > 0 {
+				_ = setDeadline(time.Now().Add(frameTimeout))
+			}
+
+			b, err := rd.ReadBytes('\n')
+			if len(bytes.TrimSpace(b)) > 0 {
+				record := reflect.New(paramType.Elem())
+				if derr := codec.Unmarshal(b, record.Interface()); derr != nil {
+					fail(&StreamDecodeError{Line: line, Err: derr})
+					return
+				}
+
+				chosen, _, _ := reflect.Select([]reflect.SelectCase{
+					{Dir: reflect.SelectSend, Chan: ch, Send: record.Elem()},
+					{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+				})
+				if chosen == 1 {
+					return
+				}
+			}
+
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				fail(&Error{Code: protocol.CodeTimeout, Err: fmt.Errorf("%w: record %d was not received within %s", ErrFrameTimeout, line, frameTimeout)})
+				return
+			}
+			if err != nil {
+				fail(&StreamDecodeError{Line: line, Err: err})
+				return
+			}
+		}
+	}()
+
+	return ch.Convert(paramType), ctx, cancel
+}
+
+// streamError returns the error which ended the input stream early, if any.
+func streamError(ctx context.Context) error {
+	e, ok := ctx.Value(streamErrorContextKey{}).(*inputStreamError)
+	if !ok {
+		return nil
+	}
+	cause := e.get()
+
+	var serr *StreamDecodeError
+	if errors.As(cause, &serr) {
+		return &Error{Code: protocol.CodeBadRequest, Err: serr}
+	}
+
+	var ferr *Error
+	if errors.As(cause, &ferr) && errors.Is(ferr, ErrFrameTimeout) {
+		return ferr
+	}
+
+	return nil
+}
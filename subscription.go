@@ -0,0 +1,226 @@
+package ops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/common-fate/ops/protocol"
+)
+
+// ErrSubscriptionClosed is returned by Subscription.Send if the subscription
+// has been closed, or if the client has gone away.
+var ErrSubscriptionClosed = errors.New("subscription closed")
+
+// ErrFrameTimeout is returned when the peer doesn't read or write a frame of a
+// stream within the operation's FrameTimeout. When a subscription is ended
+// because the client stalled, Send returns an error wrapping both
+// ErrSubscriptionClosed and ErrFrameTimeout.
+var ErrFrameTimeout = errors.New("frame timeout exceeded")
+
+// Subscription is a long-lived stream of events pushed from
+// an operation to the client. Operations return a subscription
+// alongside an optional error:
+//
+//	func (s *Service) Watch(ctx context.Context, input WatchInput) (*ops.Subscription[Event], error) {
+//		sub := ops.NewSubscription[Event]()
+//		go func() {
+//			for event := range s.changes {
+//				if err := sub.Send(ctx, event); err != nil {
+//					return // the client has gone away
+//				}
+//			}
+//			sub.Close(nil)
+//		}()
+//		return sub, nil
+//	}
+//
+// The subscription is kept open until the operation calls Close, or the client
+// disconnects, in which case Done is closed and Send returns ErrSubscriptionClosed.
+// Send blocks until the client has received the previous event, so a slow client
+// applies backpressure to the operation rather than events being buffered.
+// Set OperationMetadata.FrameTimeout to end the subscription if a client
+// stalls while an event is being written to it.
+//
+// Events are written to the HTTP response as newline-delimited JSON
+// SubscriptionFrames. Over the tunnel, each request is served on its own
+// QUIC stream, so a subscription doesn't block other operations.
+// Subscriptions can't be called via Handler.Call directly.
+type Subscription[T any] struct {
+	events chan T
+	// closed is closed when the operation calls Close.
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error
+	// cancelled is closed when the client goes away.
+	cancelled  chan struct{}
+	cancelOnce sync.Once
+	// cancelErr is returned by Send once cancelled is closed.
+	cancelErr error
+}
+
+// NewSubscription creates a new subscription.
+func NewSubscription[T any]() *Subscription[T] {
+	return &Subscription[T]{
+		events:    make(chan T),
+		closed:    make(chan struct{}),
+		cancelled: make(chan struct{}),
+	}
+}
+
+// Send pushes an event to the client, blocking until the client has received it.
+func (s *Subscription[T]) Send(ctx context.Context, event T) error {
+	select {
+	case s.events <- event:
+		return nil
+	case <-s.closed:
+		return ErrSubscriptionClosed
+	case <-s.cancelled:
+		return s.cancelErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close ends the subscription. If err is not nil, it is
+// sent to the client as the final frame of the subscription.
+func (s *Subscription[T]) Close(err error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		close(s.closed)
+	})
+}
+
+// Done returns a channel which is closed when the
+// client has gone away and no more events can be sent.
+func (s *Subscription[T]) Done() <-chan struct{} {
+	return s.cancelled
+}
+
+func (s *Subscription[T]) next(ctx context.Context) (any, bool) {
+	select {
+	case event := <-s.events:
+		return event, true
+	case <-s.closed:
+		return nil, false
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+func (s *Subscription[T]) cancel(err error) {
+	s.cancelOnce.Do(func() {
+		s.cancelErr = err
+		close(s.cancelled)
+	})
+}
+
+func (s *Subscription[T]) closeErr() error {
+	return s.err
+}
+
+// subscription is implemented by Subscription[T] so that
+// the handler can serve it without knowing the event type.
+type subscription interface {
+	next(ctx context.Context) (any, bool)
+	cancel(err error)
+	closeErr() error
+}
+
+// SubscriptionFrame is a single line written to the
+// response of a subscription operation.
+type SubscriptionFrame struct {
+	// Event is set for each event sent by the operation.
+	Event any `json:"event,omitempty"`
+	// Error is set on the final frame if the
+	// operation closed the subscription with an error.
+	Error string `json:"error,omitempty"`
+}
+
+type responseWriterContextKey struct{}
+
+func contextWithResponseWriter(ctx context.Context, w http.ResponseWriter) context.Context {
+	return context.WithValue(ctx, responseWriterContextKey{}, w)
+}
+
+// serveSubscription writes events from the subscription
+// to the HTTP response until either side closes it.
+//
+// If frameTimeout is set, the subscription is ended if writing
+// any frame to the client takes longer than frameTimeout.
+func serveSubscription(ctx context.Context, service string, operation string, sub subscription, frameTimeout time.Duration, codec Codec) error {
+	defer sub.cancel(ErrSubscriptionClosed)
+
+	w, ok := ctx.Value(responseWriterContextKey{}).(http.ResponseWriter)
+	if !ok {
+		return &Error{Code: protocol.CodeBadRequest, Err: fmt.Errorf("operation %s for service %s returns a subscription and can only be called over HTTP", operation, service)}
+	}
+
+	flush := func() {}
+	if f, ok := w.(http.Flusher); ok {
+		flush = f.Flush
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flush()
+
+	rc := http.NewResponseController(w)
+
+	writeFrame := func(frame SubscriptionFrame) error {
+		if frameTimeout > 0 {
+			// servers which don't support deadlines
+			// write frames without a timeout.
+			_ = rc.SetWriteDeadline(time.Now().Add(frameTimeout))
+		}
+		b, err := codec.Marshal(frame)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(append(b, '\n')); err != nil {
+			return err
+		}
+		flush()
+		return nil
+	}
+
+	for {
+		event, ok := sub.next(ctx)
+		if !ok {
+			break
+		}
+
+		if err := writeFrame(SubscriptionFrame{Event: event}); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				// the client has stalled.
+				sub.cancel(fmt.Errorf("%w: %w", ErrSubscriptionClosed, ErrFrameTimeout))
+			}
+			// the client has gone away.
+			return nil
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	if err := sub.closeErr(); err != nil {
+		_ = writeFrame(SubscriptionFrame{Error: err.Error()})
+	}
+
+	return nil
+}
+
+var subscriptionType = reflect.TypeOf((*subscription)(nil)).Elem()
+
+// subscriptionEventType returns the event type T of a *Subscription[T].
+func subscriptionEventType(t reflect.Type) reflect.Type {
+	send, _ := t.MethodByName("Send")
+	// the receiver is the first argument, followed by the context.
+	return send.Type.In(2)
+}
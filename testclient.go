@@ -0,0 +1,90 @@
+package ops
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// TestClient calls the operations of a registry in memory, without a tunnel
+// or an HTTP server, for use in unit tests of services. Inputs and results are
+// Go values, encoded with the registry's Codec and FieldNaming, and each call
+// goes through Handler.Call, so it runs the middleware and returns the same
+// errors as a call made over a transport. Operations which require an HTTP
+// request or return a subscription can't be called with a TestClient.
+//
+//	c, err := ops.NewTestClient(registry)
+//	greeting, err := ops.CallAs[string](ctx, c, "example", "Greet", GreetInput{Name: "alice"})
+type TestClient struct {
+	handler *Handler
+}
+
+// NewTestClient builds the registry and returns a client for its operations.
+func NewTestClient(r *Registry) (*TestClient, error) {
+	h, err := r.Build()
+	if err != nil {
+		return nil, err
+	}
+	return &TestClient{handler: h}, nil
+}
+
+// Handler returns the handler built from the registry.
+func (c *TestClient) Handler() *Handler {
+	return c.handler
+}
+
+// Call calls an operation with input, which may be nil for operations
+// without an input, and decodes its result into out, which must be a pointer,
+// unless it's nil. The result of an operation returning a RawResponse is
+// copied into out if it's a *[]byte.
+func (c *TestClient) Call(ctx context.Context, service, operation string, input any, out any) error {
+	var raw json.RawMessage
+	if input != nil {
+		b, err := c.handler.codec.Marshal(input)
+		if err != nil {
+			return fmt.Errorf("encoding input: %w", err)
+		}
+		if c.handler.fieldNaming != nil {
+			b, err = c.handler.fieldNaming.transform(reflect.TypeOf(input), b, true)
+			if err != nil {
+				return fmt.Errorf("encoding input: %w", err)
+			}
+		}
+		raw = b
+	}
+
+	res, err := c.handler.Call(ctx, service, operation, raw)
+	if err != nil {
+		return err
+	}
+
+	if out == nil || len(res) == 0 {
+		return nil
+	}
+
+	if b, ok := out.(*[]byte); ok {
+		*b = res
+		return nil
+	}
+
+	if c.handler.fieldNaming != nil {
+		res, err = c.handler.fieldNaming.transform(reflect.TypeOf(out), res, false)
+		if err != nil {
+			return fmt.Errorf("decoding result: %w", err)
+		}
+	}
+
+	if err := c.handler.codec.Unmarshal(res, out); err != nil {
+		return fmt.Errorf("decoding result: %w", err)
+	}
+
+	return nil
+}
+
+// CallAs calls an operation with the TestClient and returns its result as a T.
+func CallAs[T any](ctx context.Context, c *TestClient, service, operation string, input any) (T, error) {
+	var out T
+	err := c.Call(ctx, service, operation, input, &out)
+	return out, err
+}
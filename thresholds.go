@@ -0,0 +1,27 @@
+package ops
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// checkThresholds logs a warning if a call returned a larger response or took
+// longer than the thresholds set by Registry.WarnResponseBytes and
+// Registry.WarnDuration. The call itself isn't affected.
+func (h *Handler) checkThresholds(ctx context.Context, service string, operation string, size int, duration time.Duration) {
+	large := h.warnResponseBytes > 0 && int64(size) > h.warnResponseBytes
+	slow := h.warnDuration > 0 && duration > h.warnDuration
+	if !large && !slow {
+		return
+	}
+
+	h.logger.LogAttrs(ctx, slog.LevelWarn, "operation exceeded threshold",
+		slog.String("service", service),
+		slog.String("operation", operation),
+		slog.Int("response_bytes", size),
+		slog.Duration("duration", duration),
+		slog.Bool("large_response", large),
+		slog.Bool("slow", slow),
+	)
+}
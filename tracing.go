@@ -0,0 +1,62 @@
+package ops
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/common-fate/ops/protocol"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/common-fate/ops"
+
+// traceContext propagates W3C traceparent and tracestate headers.
+var traceContext = propagation.TraceContext{}
+
+// extractTraceContext returns a context containing the remote span
+// context from the W3C trace headers of the request, if present.
+// Over the tunnel, requests are served over HTTP/3, so the
+// headers are carried in the same way as for plain HTTP.
+func extractTraceContext(ctx context.Context, r *http.Request) context.Context {
+	return traceContext.Extract(ctx, propagation.HeaderCarrier(r.Header))
+}
+
+// tracer returns the tracer used to trace calls, using the global
+// tracer provider if Registry.TracerProvider wasn't set.
+func tracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+// traceCall runs invoke inside a span named service/operation, recording
+// the response code and any error. The operation's context carries the span,
+// so that downstream calls made by the operation are part of the same trace.
+func (h *Handler) traceCall(ctx context.Context, service string, operation string, input json.RawMessage, invoke Invoker) ([]byte, error) {
+	ctx, span := h.tracer.Start(ctx, service+"/"+operation,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("ops.service", service),
+			attribute.String("ops.operation", operation),
+		),
+	)
+	defer span.End()
+
+	res, err := invoke(ctx, service, operation, input)
+
+	code := protocol.CodeOK
+	if err != nil {
+		code = errorCode(err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.SetAttributes(attribute.String("ops.response_code", code.String()))
+
+	return res, err
+}
@@ -2,13 +2,20 @@ package tunnel
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"log/slog"
+	"strings"
 
 	"github.com/common-fate/ops/protocol"
 )
 
-const authorizationMetadataKey = "Authorization"
+const (
+	authorizationMetadataKey = "Authorization"
+	keyIDMetadataKey         = "Key-Id"
+)
 
 // Authenticator is a type which adds authentication credentials to an outbound
 // register listener request.
@@ -25,11 +32,6 @@ func (a AuthenticatorFunc) Authenticate(ctx context.Context, r *protocol.Registe
 	return a(ctx, r)
 }
 
-var defaultAuthenticator Authenticator = AuthenticatorFunc(func(ctx context.Context, rlr *protocol.RegisterListenerRequest) error {
-	slog.Warn("No authenticator provided, attempting to register connection without credentials")
-	return nil
-})
-
 // BearerAuthenticator returns an instance of Authenticator which configures Bearer authentication
 // on requests passed to Authenticate using the provided token string
 func BearerAuthenticator(token string) Authenticator {
@@ -43,3 +45,247 @@ func BearerAuthenticator(token string) Authenticator {
 		return nil
 	})
 }
+
+// TokenSource returns an access token for authenticating with the tunnel.
+// Implementations should return a token which is valid at the time of the
+// call, refreshing it if it has expired.
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// TokenSourceFunc is a function which implements the TokenSource interface
+type TokenSourceFunc func(ctx context.Context) (string, error)
+
+// Token delegates to the underlying TokenSourceFunc
+func (f TokenSourceFunc) Token(ctx context.Context) (string, error) {
+	return f(ctx)
+}
+
+// TokenSourceAuthenticator returns an instance of Authenticator which configures Bearer
+// authentication using a token retrieved from src each time Authenticate is called.
+// As Authenticate is called whenever the tunnel reconnects, a reconnect after
+// a token has expired will register with a fresh token.
+func TokenSourceAuthenticator(src TokenSource) Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, rlr *protocol.RegisterListenerRequest) error {
+		token, err := src.Token(ctx)
+		if err != nil {
+			return fmt.Errorf("retrieving token: %w", err)
+		}
+
+		return BearerAuthenticator(token).Authenticate(ctx, rlr)
+	})
+}
+
+// Verifier is the server side counterpart to Authenticator, for use by the
+// accepting side of the tunnel. It checks the credentials added to a register
+// listener request by the client's Authenticator, returning an error if they're
+// invalid, in which case the server should reply with protocol.CodeUnauthorized.
+//
+// BearerVerifier verifies the credentials added by BearerAuthenticator and
+// TokenSourceAuthenticator. Credentials presented by a TLSAuthenticator are
+// verified by the server's TLS config instead, for example with ClientCAs.
+type Verifier interface {
+	Verify(context.Context, *protocol.RegisterListenerRequest) error
+}
+
+// VerifierFunc is a function which implements the Verifier interface
+type VerifierFunc func(context.Context, *protocol.RegisterListenerRequest) error
+
+// Verify delegates to the underlying VerifierFunc
+func (v VerifierFunc) Verify(ctx context.Context, r *protocol.RegisterListenerRequest) error {
+	return v(ctx, r)
+}
+
+// BearerVerifier returns an instance of Verifier which reads the token from the Bearer
+// authentication set by BearerAuthenticator and calls validate with it.
+// Requests without Bearer authentication are rejected without calling validate.
+func BearerVerifier(validate func(token string) error) Verifier {
+	return VerifierFunc(func(ctx context.Context, rlr *protocol.RegisterListenerRequest) error {
+		var header string
+		for k, v := range rlr.Metadata {
+			if strings.EqualFold(k, authorizationMetadataKey) {
+				header = v
+				break
+			}
+		}
+
+		if header == "" {
+			return fmt.Errorf("missing %s metadata", authorizationMetadataKey)
+		}
+
+		scheme, token, ok := strings.Cut(header, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			return fmt.Errorf("%s metadata must use the Bearer scheme", authorizationMetadataKey)
+		}
+
+		if err := validate(token); err != nil {
+			return fmt.Errorf("invalid bearer token: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// TLSAuthenticator is implemented by authenticators which present credentials
+// during the TLS handshake rather than in the register listener request, such
+// as a client certificate for mutual TLS.
+// If the tunnel's Authenticator implements TLSAuthenticator, ConfigureTLS is
+// called with a copy of the tunnel's TLS config before each dial.
+type TLSAuthenticator interface {
+	Authenticator
+	ConfigureTLS(*tls.Config) error
+}
+
+type clientCertificateAuthenticator struct {
+	certs []tls.Certificate
+}
+
+// ClientCertificateAuthenticator returns an instance of Authenticator which presents
+// the provided client certificates when dialing the tunnel, for mutual TLS.
+// No credentials are added to the register listener request.
+func ClientCertificateAuthenticator(certs ...tls.Certificate) Authenticator {
+	return clientCertificateAuthenticator{certs: certs}
+}
+
+func (a clientCertificateAuthenticator) Authenticate(ctx context.Context, r *protocol.RegisterListenerRequest) error {
+	return nil
+}
+
+func (a clientCertificateAuthenticator) ConfigureTLS(c *tls.Config) error {
+	if len(a.certs) == 0 {
+		return fmt.Errorf("no client certificates provided")
+	}
+
+	c.Certificates = append(c.Certificates, a.certs...)
+
+	return nil
+}
+
+// ChallengeAuthenticator is implemented by authenticators which prove their identity
+// by signing a nonce chosen by the server, rather than presenting a static credential
+// which could be replayed if the handshake were captured.
+//
+// If the server replies to the register listener request with protocol.CodeChallenge,
+// SignChallenge is called with the request and the server's challenge, and the signature
+// is sent to the server in a protocol.ChallengeResponse on the same stream. The server
+// then accepts or rejects the connection. Registration fails if the server sends a
+// challenge and the tunnel's Authenticator doesn't implement ChallengeAuthenticator.
+type ChallengeAuthenticator interface {
+	Authenticator
+	SignChallenge(ctx context.Context, req *protocol.RegisterListenerRequest, challenge []byte) ([]byte, error)
+}
+
+// ChallengeVerifier is the server side counterpart to ChallengeAuthenticator.
+// Servers using a ChallengeVerifier call Verify with the register listener request,
+// then reply with protocol.CodeChallenge and a nonce from NewChallenge, and call
+// VerifyChallenge with the signature from the client's protocol.ChallengeResponse,
+// replying with protocol.CodeUnauthorized if either returns an error.
+type ChallengeVerifier interface {
+	Verifier
+	VerifyChallenge(ctx context.Context, req *protocol.RegisterListenerRequest, challenge []byte, signature []byte) error
+}
+
+// challengeSize is the number of random bytes in a challenge.
+const challengeSize = 32
+
+// NewChallenge returns a random nonce for a server to send as the
+// Challenge of a register listener response with protocol.CodeChallenge.
+func NewChallenge() ([]byte, error) {
+	challenge := make([]byte, challengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, fmt.Errorf("generating challenge: %w", err)
+	}
+	return challenge, nil
+}
+
+// challengeMessage is the message signed in response to a challenge. It binds the
+// signature to the service being registered, so that it can't be used for another
+// service, and is prefixed by the protocol name so that the key can't be used to
+// sign challenges for other protocols.
+func challengeMessage(req *protocol.RegisterListenerRequest, challenge []byte) []byte {
+	msg := []byte(protocol.Name + " challenge\x00" + req.Service + "\x00")
+	return append(msg, challenge...)
+}
+
+type keyAuthenticator struct {
+	keyID string
+	key   ed25519.PrivateKey
+}
+
+// KeyAuthenticator returns an instance of ChallengeAuthenticator which identifies the
+// client by keyID, and signs the server's challenge with the Ed25519 private key.
+// Only the key ID is added to the register listener request, so a captured handshake
+// can't be replayed. KeyVerifier verifies the signatures on the server.
+func KeyAuthenticator(keyID string, key ed25519.PrivateKey) ChallengeAuthenticator {
+	return keyAuthenticator{keyID: keyID, key: key}
+}
+
+func (a keyAuthenticator) Authenticate(ctx context.Context, r *protocol.RegisterListenerRequest) error {
+	if r.Metadata == nil {
+		r.Metadata = map[string]string{}
+	}
+
+	r.Metadata[keyIDMetadataKey] = a.keyID
+
+	return nil
+}
+
+func (a keyAuthenticator) SignChallenge(ctx context.Context, r *protocol.RegisterListenerRequest, challenge []byte) ([]byte, error) {
+	if len(challenge) == 0 {
+		return nil, errors.New("the server sent an empty challenge")
+	}
+	return ed25519.Sign(a.key, challengeMessage(r, challenge)), nil
+}
+
+type keyVerifier struct {
+	lookup func(keyID string) (ed25519.PublicKey, error)
+}
+
+// KeyVerifier returns an instance of ChallengeVerifier which verifies the signatures made
+// by KeyAuthenticator, using the public key returned by lookup for the request's key ID.
+// Requests without a key ID are rejected without calling lookup.
+func KeyVerifier(lookup func(keyID string) (ed25519.PublicKey, error)) ChallengeVerifier {
+	return keyVerifier{lookup: lookup}
+}
+
+func (v keyVerifier) Verify(ctx context.Context, r *protocol.RegisterListenerRequest) error {
+	_, err := v.publicKey(r)
+	return err
+}
+
+func (v keyVerifier) VerifyChallenge(ctx context.Context, r *protocol.RegisterListenerRequest, challenge []byte, signature []byte) error {
+	key, err := v.publicKey(r)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(key, challengeMessage(r, challenge), signature) {
+		return errors.New("invalid challenge signature")
+	}
+
+	return nil
+}
+
+func (v keyVerifier) publicKey(r *protocol.RegisterListenerRequest) (ed25519.PublicKey, error) {
+	var keyID string
+	for k, val := range r.Metadata {
+		if strings.EqualFold(k, keyIDMetadataKey) {
+			keyID = val
+			break
+		}
+	}
+
+	if keyID == "" {
+		return nil, fmt.Errorf("missing %s metadata", keyIDMetadataKey)
+	}
+
+	key, err := v.lookup(keyID)
+	if err != nil {
+		return nil, fmt.Errorf("looking up key %s: %w", keyID, err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("key %s isn't an Ed25519 public key", keyID)
+	}
+
+	return key, nil
+}
@@ -0,0 +1,116 @@
+package tunnel
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	// DefaultHandshakeTimeout is how long the tunnel waits by default
+	// for the server to respond when registering the connection.
+	DefaultHandshakeTimeout = 10 * time.Second
+
+	// DefaultMaxHandshakeBytes is the default limit
+	// on the size of the register listener response.
+	DefaultMaxHandshakeBytes = 64 << 10
+)
+
+// deadliner is implemented by QUIC streams and network connections.
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+func (s *Tunnel) handshakeTimeout() time.Duration {
+	if s.HandshakeTimeout > 0 {
+		return s.HandshakeTimeout
+	}
+	return DefaultHandshakeTimeout
+}
+
+func (s *Tunnel) maxHandshakeBytes() int64 {
+	if s.MaxHandshakeBytes > 0 {
+		return s.MaxHandshakeBytes
+	}
+	return DefaultMaxHandshakeBytes
+}
+
+// handshakeError explains errors caused by the handshake timeout.
+func (s *Tunnel) handshakeError(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("the server didn't complete registration within the handshake timeout of %s: %w", s.handshakeTimeout(), err)
+	}
+	return err
+}
+
+// errHandshakeTooLarge is returned when the register
+// listener response exceeds MaxHandshakeBytes.
+type errHandshakeTooLarge struct {
+	limit int64
+}
+
+func (e errHandshakeTooLarge) Error() string {
+	return fmt.Sprintf("the register listener response exceeds the limit of %d bytes", e.limit)
+}
+
+// handshakeReader limits the number of bytes read for the register listener response.
+// It implements io.ByteScanner so that the decoder doesn't read past the response.
+type handshakeReader struct {
+	r         byteReader
+	remaining int64
+	limit     int64
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteScanner
+}
+
+func newHandshakeReader(r io.Reader, limit int64) *handshakeReader {
+	scanner, ok := r.(byteReader)
+	if !ok {
+		// the stream is only used for registration,
+		// so it doesn't matter if the buffer reads past the response.
+		scanner = bufio.NewReader(r)
+	}
+	return &handshakeReader{r: scanner, remaining: limit, limit: limit}
+}
+
+func (h *handshakeReader) Read(p []byte) (int, error) {
+	if h.remaining <= 0 {
+		return 0, errHandshakeTooLarge{limit: h.limit}
+	}
+	if int64(len(p)) > h.remaining {
+		p = p[:h.remaining]
+	}
+	n, err := h.r.Read(p)
+	h.remaining -= int64(n)
+	return n, err
+}
+
+func (h *handshakeReader) ReadByte() (byte, error) {
+	if h.remaining <= 0 {
+		return 0, errHandshakeTooLarge{limit: h.limit}
+	}
+	b, err := h.r.ReadByte()
+	if err == nil {
+		h.remaining--
+	}
+	return b, err
+}
+
+func (h *handshakeReader) UnreadByte() error {
+	err := h.r.UnreadByte()
+	if err == nil {
+		h.remaining++
+	}
+	return err
+}
+
+// Close doesn't close the underlying stream, which is closed by the caller.
+func (h *handshakeReader) Close() error {
+	return nil
+}
@@ -0,0 +1,32 @@
+package tunnel
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/common-fate/ops/protocol"
+)
+
+// limitRequests wraps the handler of a connection to serve at most MaxConcurrentRequests
+// at once, rejecting further requests with 429 Too Many Requests until one has finished.
+// It's called for each connection, so each connection has its own limit.
+func (s *Tunnel) limitRequests(next http.Handler) http.Handler {
+	if s.MaxConcurrentRequests <= 0 {
+		return next
+	}
+
+	sem := make(chan struct{}, s.MaxConcurrentRequests)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case sem <- struct{}{}:
+		default:
+			w.Header().Set("Retry-After", "1")
+			protocol.WriteError(w, http.StatusTooManyRequests, protocol.CodeTooManyRequests, fmt.Sprintf("the connection is already serving the maximum of %d concurrent requests", s.MaxConcurrentRequests))
+			return
+		}
+		defer func() { <-sem }()
+
+		next.ServeHTTP(w, r)
+	})
+}
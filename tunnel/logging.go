@@ -0,0 +1,73 @@
+package tunnel
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+)
+
+// defaultSensitiveMetadataKeys are never logged,
+// regardless of the Tunnel configuration.
+var defaultSensitiveMetadataKeys = []string{authorizationMetadataKey}
+
+type loggerContextKey struct{}
+
+func contextWithLogger(ctx context.Context, log *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, log)
+}
+
+// LoggerFromContext returns the logger for the tunnel connection
+// a request is being served on. The logger includes attributes
+// for the registration metadata keys listed in Tunnel.LogMetadataKeys.
+//
+// If the request isn't being served over a tunnel, slog.Default() is returned.
+func LoggerFromContext(ctx context.Context) *slog.Logger {
+	if log, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+		return log
+	}
+	return slog.Default()
+}
+
+// metadataAttrs returns log attributes for the allowlisted
+// keys in the connection metadata, skipping any sensitive keys.
+func (s *Tunnel) metadataAttrs(metadata map[string]string) []any {
+	var attrs []any
+
+	for _, key := range s.LogMetadataKeys {
+		if s.isSensitiveMetadataKey(key) {
+			continue
+		}
+
+		if v, ok := metadata[key]; ok {
+			attrs = append(attrs, slog.String(key, v))
+		}
+	}
+
+	return attrs
+}
+
+func (s *Tunnel) isSensitiveMetadataKey(key string) bool {
+	for _, sensitive := range defaultSensitiveMetadataKeys {
+		if strings.EqualFold(key, sensitive) {
+			return true
+		}
+	}
+	for _, sensitive := range s.SensitiveMetadataKeys {
+		if strings.EqualFold(key, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeMetadata combines the request and response metadata from
+// registration. Keys in the response take precedence.
+func mergeMetadata(maps ...map[string]string) map[string]string {
+	res := map[string]string{}
+	for _, m := range maps {
+		for k, v := range m {
+			res[k] = v
+		}
+	}
+	return res
+}
@@ -0,0 +1,29 @@
+package tunnel
+
+import "context"
+
+type metadataContextKey struct{}
+
+func contextWithMetadata(ctx context.Context, metadata map[string]string) context.Context {
+	return context.WithValue(ctx, metadataContextKey{}, metadata)
+}
+
+// MetadataFromContext returns the registration metadata of the tunnel connection
+// a request is being served on, combining the metadata of the register listener
+// request and response. Sensitive keys, including Authorization, are removed.
+// It returns false if the request isn't being served over a tunnel.
+func MetadataFromContext(ctx context.Context) (map[string]string, bool) {
+	metadata, ok := ctx.Value(metadataContextKey{}).(map[string]string)
+	return metadata, ok
+}
+
+// publicMetadata returns a copy of the metadata without the sensitive keys.
+func (s *Tunnel) publicMetadata(metadata map[string]string) map[string]string {
+	res := map[string]string{}
+	for k, v := range metadata {
+		if !s.isSensitiveMetadataKey(k) {
+			res[k] = v
+		}
+	}
+	return res
+}
@@ -0,0 +1,44 @@
+package tunnel
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/common-fate/ops/protocol"
+)
+
+// namespaces returns the namespaces registered in addition to s.Namespace, in order.
+func (s *Tunnel) namespaces() []string {
+	var namespaces []string
+	for ns := range s.Namespaces {
+		if ns != s.Namespace {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// handler returns the handler serving requests on the connection,
+// which routes requests by namespace if several are registered.
+func (s *Tunnel) handler() http.Handler {
+	if len(s.Namespaces) == 0 {
+		return s.Handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ns := r.Header.Get(protocol.NamespaceHeader)
+		if ns == "" || ns == s.Namespace {
+			s.Handler.ServeHTTP(w, r)
+			return
+		}
+
+		h, ok := s.Namespaces[ns]
+		if !ok {
+			protocol.WriteError(w, http.StatusNotFound, protocol.CodeNotFound, fmt.Sprintf("namespace %s isn't served by this connection", ns))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,104 @@
+package tunnel
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/common-fate/ops/protocol"
+	"github.com/quic-go/quic-go"
+)
+
+// DefaultShutdownReason is sent to the server when the tunnel is shut down with Shutdown.
+const DefaultShutdownReason = "shutdown"
+
+// Shutdown gracefully shuts down the tunnel. New requests are rejected with
+// 503 Service Unavailable and a protocol.ErrorResponse, while the requests
+// which are already in flight are allowed to finish, up to the deadline of
+// ctx. With TransportQUIC, Shutdown also waits for their responses to be
+// acknowledged by the server. The connection is then closed with
+// protocol.ApplicationShutdown and DialAndServe returns without reconnecting.
+//
+// If ctx expires before the in-flight requests finish,
+// the connection is closed anyway and ctx.Err() is returned.
+func (s *Tunnel) Shutdown(ctx context.Context) error {
+	return s.ShutdownWithReason(ctx, DefaultShutdownReason)
+}
+
+// ShutdownWithReason is like Shutdown, but sends reason (such as "deploy" or
+// "idle timeout") to the server as the message of the connection close, so
+// that the server can log why the tunnel disconnected.
+func (s *Tunnel) ShutdownWithReason(ctx context.Context, reason string) error {
+	s.mu.Lock()
+	s.shuttingDown = true
+	s.shutdownReason = reason
+	conn, stats := s.conn, s.stats
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+
+	var err error
+
+	select {
+	case <-done:
+		if stats != nil {
+			err = stats.drain(ctx)
+		}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if conn != nil {
+		_ = conn.CloseWithError(protocol.ApplicationShutdown, reason)
+	}
+
+	return err
+}
+
+func (s *Tunnel) isShuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shuttingDown
+}
+
+// connection is the tunnel's connection to the server. It's a
+// quic.Connection, or a *bufferedConn when using TransportTCP.
+type connection interface {
+	CloseWithError(code quic.ApplicationErrorCode, reason string) error
+}
+
+// setConn records the active connection so that it can be closed by Shutdown.
+// If the tunnel is already shutting down, the connection is closed and false is returned.
+func (s *Tunnel) setConn(conn connection, stats *connStats) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown {
+		_ = conn.CloseWithError(protocol.ApplicationShutdown, s.shutdownReason)
+		return false
+	}
+	s.conn = conn
+	s.stats = stats
+	return true
+}
+
+// trackRequests wraps the handler to keep count of the requests in flight,
+// rejecting new requests once the tunnel is shutting down.
+func (s *Tunnel) trackRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		if s.shuttingDown {
+			s.mu.Unlock()
+			protocol.WriteError(w, http.StatusServiceUnavailable, protocol.CodeServerError, "the tunnel is shutting down")
+			return
+		}
+		s.inflight.Add(1)
+		s.mu.Unlock()
+
+		defer s.inflight.Done()
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,180 @@
+package tunnel
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// DefaultStatsInterval is how often Tunnel.OnStats is called by default.
+const DefaultStatsInterval = 10 * time.Second
+
+// ConnectionStats describe the health of the tunnel's QUIC connection.
+// Counters are totals since the connection was dialed.
+type ConnectionStats struct {
+	// ALPN is the negotiated application protocol, which is
+	// protocol.Name unless the tunnel is configured otherwise.
+	ALPN string
+	// TLSVersion is the negotiated TLS version, such as tls.VersionTLS13.
+	TLSVersion  uint16
+	QUICVersion quic.Version
+
+	SmoothedRTT time.Duration
+	LatestRTT   time.Duration
+	MinRTT      time.Duration
+
+	BytesSent       uint64
+	BytesReceived   uint64
+	PacketsSent     uint64
+	PacketsReceived uint64
+	PacketsLost     uint64
+}
+
+// Stats returns the stats of the tunnel's connection. It returns
+// false if the tunnel isn't connected or isn't using TransportQUIC.
+func (s *Tunnel) Stats() (ConnectionStats, bool) {
+	s.mu.Lock()
+	conn, stats := s.conn, s.stats
+	s.mu.Unlock()
+
+	qconn, ok := conn.(quic.Connection)
+	if !ok || stats == nil || qconn.Context().Err() != nil {
+		return ConnectionStats{}, false
+	}
+
+	return stats.snapshot(qconn), true
+}
+
+// reportStats calls OnStats with the connection's stats every StatsInterval until the connection closes.
+func (s *Tunnel) reportStats(conn quic.Connection, stats *connStats) {
+	interval := s.StatsInterval
+	if interval <= 0 {
+		interval = DefaultStatsInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-conn.Context().Done():
+			return
+		case <-ticker.C:
+			s.OnStats(stats.snapshot(conn))
+		}
+	}
+}
+
+// connStats collects transport statistics for a connection from quic-go's tracing events.
+type connStats struct {
+	mu    sync.Mutex
+	stats ConnectionStats
+	// bytesInFlight is the size of the packets sent which haven't been acknowledged.
+	bytesInFlight logging.ByteCount
+}
+
+// tracer returns a quic.Config tracer recording into the stats,
+// which also calls any tracer already set on the config.
+func (c *connStats) tracer(next func(context.Context, logging.Perspective, quic.ConnectionID) *logging.ConnectionTracer) func(context.Context, logging.Perspective, quic.ConnectionID) *logging.ConnectionTracer {
+	return func(ctx context.Context, p logging.Perspective, id quic.ConnectionID) *logging.ConnectionTracer {
+		tracer := &logging.ConnectionTracer{
+			SentLongHeaderPacket: func(_ *logging.ExtendedHeader, size logging.ByteCount, _ logging.ECN, _ *logging.AckFrame, _ []logging.Frame) {
+				c.sent(size)
+			},
+			SentShortHeaderPacket: func(_ *logging.ShortHeader, size logging.ByteCount, _ logging.ECN, _ *logging.AckFrame, _ []logging.Frame) {
+				c.sent(size)
+			},
+			ReceivedLongHeaderPacket: func(_ *logging.ExtendedHeader, size logging.ByteCount, _ logging.ECN, _ []logging.Frame) {
+				c.received(size)
+			},
+			ReceivedShortHeaderPacket: func(_ *logging.ShortHeader, size logging.ByteCount, _ logging.ECN, _ []logging.Frame) {
+				c.received(size)
+			},
+			LostPacket: func(logging.EncryptionLevel, logging.PacketNumber, logging.PacketLossReason) {
+				c.mu.Lock()
+				c.stats.PacketsLost++
+				c.mu.Unlock()
+			},
+			UpdatedMetrics: func(rtt *logging.RTTStats, _, bytesInFlight logging.ByteCount, _ int) {
+				c.mu.Lock()
+				c.bytesInFlight = bytesInFlight
+				c.stats.SmoothedRTT = rtt.SmoothedRTT()
+				c.stats.LatestRTT = rtt.LatestRTT()
+				c.stats.MinRTT = rtt.MinRTT()
+				c.mu.Unlock()
+			},
+		}
+
+		if next == nil {
+			return tracer
+		}
+		if existing := next(ctx, p, id); existing != nil {
+			return logging.NewMultiplexedConnectionTracer(tracer, existing)
+		}
+		return tracer
+	}
+}
+
+func (c *connStats) sent(size logging.ByteCount) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.PacketsSent++
+	c.stats.BytesSent += uint64(size)
+}
+
+func (c *connStats) received(size logging.ByteCount) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.PacketsReceived++
+	c.stats.BytesReceived += uint64(size)
+}
+
+func (c *connStats) snapshot(conn quic.Connection) ConnectionStats {
+	c.mu.Lock()
+	stats := c.stats
+	c.mu.Unlock()
+
+	state := conn.ConnectionState()
+	stats.ALPN = state.TLS.NegotiatedProtocol
+	stats.TLSVersion = state.TLS.Version
+	stats.QUICVersion = state.Version
+
+	return stats
+}
+
+// drainInterval is how often drain checks whether the connection has been acknowledged.
+const drainInterval = 5 * time.Millisecond
+
+// drain waits until every packet sent on the connection has been acknowledged, and
+// no packets have been sent for drainInterval, so that the responses to requests which
+// have just finished reach the server before the connection is closed. quic-go drops
+// any unsent or unacknowledged stream data when a connection is closed, and the
+// HTTP/3 server writes the end of each response after its handler returns.
+func (c *connStats) drain(ctx context.Context) error {
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+
+	c.mu.Lock()
+	sent := c.stats.PacketsSent
+	c.mu.Unlock()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+		idle := c.bytesInFlight == 0 && c.stats.PacketsSent == sent
+		sent = c.stats.PacketsSent
+		c.mu.Unlock()
+
+		if idle {
+			return nil
+		}
+	}
+}
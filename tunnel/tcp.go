@@ -0,0 +1,119 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/quic-go/quic-go"
+	"golang.org/x/net/http2"
+)
+
+// Transport is the transport used by the tunnel to connect to the server.
+type Transport string
+
+const (
+	// TransportQUIC serves requests over HTTP/3 on a QUIC connection. It's the default.
+	TransportQUIC Transport = "quic"
+	// TransportTCP serves requests over HTTP/2 on a TLS connection, for networks
+	// which block UDP. The connection is registered with the same request as
+	// over QUIC, after which the server sends requests as an HTTP/2 client over
+	// the same connection. Connection stats aren't available over TCP.
+	TransportTCP Transport = "tcp"
+)
+
+// errConnectionClosed is returned when a TCP connection stops being served,
+// as HTTP/2 doesn't report why the connection closed.
+var errConnectionClosed = errors.New("connection closed")
+
+func (s *Tunnel) dialAndServeTCP(
+	ctx context.Context,
+	log *slog.Logger,
+	addr string,
+) error {
+	tlsConf, err := s.getTLSConfig(addr)
+	if err != nil {
+		return err
+	}
+
+	netDialer := &net.Dialer{KeepAlive: s.KeepAlivePeriod}
+	if s.LocalAddr != "" {
+		netDialer.LocalAddr, err = net.ResolveTCPAddr("tcp", s.LocalAddr)
+		if err != nil {
+			return fmt.Errorf("resolving local address: %w", err)
+		}
+	}
+
+	dialer := &tls.Dialer{NetDialer: netDialer, Config: tlsConf}
+	raw, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("TCP dial error: %w", err)
+	}
+
+	conn := newBufferedConn(raw)
+
+	if !s.setConn(conn, nil) {
+		return nil
+	}
+
+	served := make(chan struct{})
+	defer close(served)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-served:
+		}
+	}()
+
+	log.Debug("Attempting to register")
+
+	metadata, err := s.registerStream(ctx, conn)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	log = log.With(s.metadataAttrs(metadata)...)
+
+	log.Info("Starting server")
+
+	server := &http2.Server{}
+	server.ServeConn(conn, &http2.ServeConnOpts{
+		Context: contextWithMetadata(contextWithLogger(ctx, log), s.publicMetadata(metadata)),
+		Handler: s.trackRequests(s.limitRequests(s.handler())),
+	})
+
+	err = errConnectionClosed
+	if s.OnDisconnect != nil {
+		s.OnDisconnect(err)
+	}
+
+	return err
+}
+
+// bufferedConn reads from a buffer in front of the connection, so that the
+// register listener response can be decoded without reading past it.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newBufferedConn(conn net.Conn) *bufferedConn {
+	return &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+func (c *bufferedConn) ReadByte() (byte, error)    { return c.r.ReadByte() }
+func (c *bufferedConn) UnreadByte() error          { return c.r.UnreadByte() }
+
+// CloseWithError closes the connection. TCP connections
+// can't send the code and reason to the server.
+func (c *bufferedConn) CloseWithError(quic.ApplicationErrorCode, string) error {
+	return c.Conn.Close()
+}
@@ -5,10 +5,13 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/common-fate/ops/protocol"
@@ -36,13 +39,110 @@ var (
 )
 
 type Tunnel struct {
-	Namespace         string
-	Handler           http.Handler
-	Logger            *slog.Logger
-	TLSConfig         *tls.Config
-	QuicConfig        *quic.Config
-	Authenticator     Authenticator
+	Namespace string
+	Handler   http.Handler
+	// Namespaces maps further namespaces to the handlers serving them,
+	// which are registered over the same connection as Namespace. Requests
+	// forwarded by the server carry their namespace in the
+	// protocol.NamespaceHeader, and are routed to its handler. Requests
+	// without the header, or for Namespace itself, are served by Handler.
+	// Requests for other namespaces are rejected with 404 Not Found and a
+	// protocol.ErrorResponse with protocol.CodeNotFound.
+	Namespaces map[string]http.Handler
+
+	Logger    *slog.Logger
+	TLSConfig *tls.Config
+	// ALPN, if set, replaces protocol.Name as the application protocol
+	// negotiated with the server, for example so that a load balancer can
+	// route each deployment by ALPN. It's only used if TLSConfig isn't set,
+	// as TLSConfig's NextProtos are used otherwise.
+	ALPN          string
+	QuicConfig    *quic.Config
+	Authenticator Authenticator
+	// Transport defaults to TransportQUIC. QuicConfig and
+	// the connection stats only apply to TransportQUIC.
+	Transport Transport
+
+	// LocalAddr, if set, is the local address the tunnel connects from, such
+	// as ":4433" to pin the source port, or "10.0.0.2:0" to use a specific
+	// interface. With TransportQUIC a UDP socket is bound to it for each
+	// connection, and with TransportTCP it's the local address of the dialer.
+	LocalAddr string
+	// PacketConn, if set, is a pre-bound socket which QUIC connections are
+	// made from, taking precedence over LocalAddr. It is used again when the
+	// tunnel reconnects, and isn't closed by the tunnel.
+	PacketConn net.PacketConn
+
+	// IdleTimeout and KeepAlivePeriod, if set, override the MaxIdleTimeout
+	// and KeepAlivePeriod of the QUIC config, which is DefaultQuicConfig
+	// unless QuicConfig is set. They take precedence over QuicConfig, so
+	// the timeouts can be tuned without reconstructing the whole config.
+	// KeepAlivePeriod is also used for TCP keepalives with TransportTCP.
+	IdleTimeout     time.Duration
+	KeepAlivePeriod time.Duration
+	// MaxConcurrentRequests, if positive, limits the number of requests served
+	// at once on each connection, as the server may open any number of streams.
+	// Further requests are rejected with 429 Too Many Requests and a
+	// protocol.ErrorResponse with protocol.CodeTooManyRequests, until one finishes.
+	MaxConcurrentRequests int
+
+	// OnConnectionReady is called once the connection is registered. The
+	// response's Version is the protocol version negotiated with the server.
 	OnConnectionReady func(protocol.RegisterListenerResponse)
+
+	// OnRegister is called after every registration attempt, successful or not,
+	// with the server's response and the error which failed the attempt. resp.Code
+	// distinguishes rejections, such as protocol.CodeUnauthorized, from transient
+	// failures. If no response was received, resp is the zero value and err is set.
+	OnRegister func(resp protocol.RegisterListenerResponse, err error)
+
+	// OnDisconnect is called when a registered connection stops being served,
+	// with the error which ended it (nil if the connection closed cleanly).
+	OnDisconnect func(error)
+
+	// OnReconnecting is called after a failed dial or a disconnect,
+	// before waiting to retry. attempt starts at 1 and counts the
+	// retries made by this call to DialAndServe. It isn't called once
+	// the steps of a limited Backoff are used up, as DialAndServe then
+	// returns the error instead of retrying.
+	OnReconnecting func(attempt int, err error)
+
+	// Backoff controls how the tunnel reconnects, defaulting to DefaultBackoff.
+	// A Backoff with zero Steps retries forever, in which case DialAndServe only
+	// returns once the context is cancelled or the tunnel is shut down. The interval
+	// grows by Factor up to Cap; if Cap isn't set the interval stays at Duration.
+	Backoff *wait.Backoff
+
+	// LogMetadataKeys is an allowlist of registration metadata keys
+	// (such as an agent version or region) which are added as attributes
+	// to the logger for the connection. The logger is available to
+	// operations served on the connection via LoggerFromContext.
+	LogMetadataKeys []string
+
+	// SensitiveMetadataKeys are never logged, even if
+	// they are included in LogMetadataKeys.
+	// The Authorization key is always treated as sensitive.
+	SensitiveMetadataKeys []string
+
+	// HandshakeTimeout bounds how long registering the connection may take,
+	// once it's dialed, defaulting to DefaultHandshakeTimeout.
+	HandshakeTimeout time.Duration
+	// MaxHandshakeBytes limits the size of the register listener
+	// response, defaulting to DefaultMaxHandshakeBytes.
+	MaxHandshakeBytes int64
+
+	// OnStats, if set, is called with the stats of the connection every
+	// StatsInterval while the tunnel is connected. See also Stats.
+	OnStats func(ConnectionStats)
+	// StatsInterval defaults to DefaultStatsInterval.
+	StatsInterval time.Duration
+
+	mu             sync.Mutex
+	conn           connection
+	stats          *connStats
+	shuttingDown   bool
+	shutdownReason string
+	inflight       sync.WaitGroup
 }
 
 func coallesce[T any](v, d *T) *T {
@@ -53,10 +153,25 @@ func coallesce[T any](v, d *T) *T {
 	return v
 }
 
+// quicConfig returns a copy of the QUIC config with IdleTimeout
+// and KeepAlivePeriod applied.
+func (s *Tunnel) quicConfig() *quic.Config {
+	conf := coallesce(s.QuicConfig, DefaultQuicConfig).Clone()
+	if s.IdleTimeout > 0 {
+		conf.MaxIdleTimeout = s.IdleTimeout
+	}
+	if s.KeepAlivePeriod > 0 {
+		conf.KeepAlivePeriod = s.KeepAlivePeriod
+	}
+	return conf
+}
+
 func (s *Tunnel) getTLSConfig(addr string) (*tls.Config, error) {
-	tlsConf := s.TLSConfig
-	if tlsConf == nil {
-		tlsConf = DefaultTLSConfig
+	// the config is cloned so that the ServerName
+	// and any credentials aren't shared between tunnels.
+	tlsConf := coallesce(s.TLSConfig, DefaultTLSConfig).Clone()
+	if s.TLSConfig == nil && s.ALPN != "" {
+		tlsConf.NextProtos = []string{s.ALPN}
 	}
 	if tlsConf.ServerName == "" {
 		// if the TLS ServerName is not explicitly supplied
@@ -70,22 +185,89 @@ func (s *Tunnel) getTLSConfig(addr string) (*tls.Config, error) {
 		tlsConf.ServerName = url.Hostname()
 	}
 
+	if auth, ok := s.Authenticator.(TLSAuthenticator); ok {
+		if err := auth.ConfigureTLS(tlsConf); err != nil {
+			return nil, fmt.Errorf("configuring TLS authentication: %w", err)
+		}
+	}
+
 	return tlsConf, nil
 }
 
+// dialQUIC dials the QUIC connection from PacketConn or LocalAddr, if either is set.
+// The returned function closes the UDP socket bound for LocalAddr once the
+// connection has been served.
+func (s *Tunnel) dialQUIC(ctx context.Context, addr string, tlsConf *tls.Config, quicConf *quic.Config) (quic.Connection, func(), error) {
+	if s.PacketConn == nil && s.LocalAddr == "" {
+		conn, err := quic.DialAddr(ctx, addr, tlsConf, quicConf)
+		return conn, func() {}, err
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pc := s.PacketConn
+	closePacketConn := func() {}
+
+	if pc == nil {
+		localAddr, err := net.ResolveUDPAddr("udp", s.LocalAddr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("resolving local address: %w", err)
+		}
+		udpConn, err := net.ListenUDP("udp", localAddr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("binding local address: %w", err)
+		}
+		pc = udpConn
+		closePacketConn = func() { _ = udpConn.Close() }
+	}
+
+	conn, err := quic.Dial(ctx, pc, udpAddr, tlsConf, quicConf)
+	if err != nil {
+		closePacketConn()
+		return nil, nil, err
+	}
+
+	return conn, closePacketConn, nil
+}
+
+// logger returns the tunnel's logger, defaulting to slog.Default().
+func (s *Tunnel) logger() *slog.Logger {
+	return coallesce(s.Logger, slog.Default())
+}
+
 func (s *Tunnel) DialAndServe(ctx context.Context, addr string) (err error) {
 	attrs := []slog.Attr{slog.String("addr", addr)}
 	if host, port, err := net.SplitHostPort(addr); err == nil {
 		attrs = []slog.Attr{slog.String("host", host), slog.String("port", port)}
 	}
 
-	log := slog.New(coallesce(s.Logger, slog.Default()).Handler().WithAttrs(attrs))
+	log := slog.New(s.logger().Handler().WithAttrs(attrs))
 	log.Debug("Dialing address")
 
+	backoff := *coallesce(s.Backoff, &DefaultBackoff)
+
 	var lastErr error
-	err = wait.ExponentialBackoffWithContext(ctx, DefaultBackoff, func(context.Context) (done bool, err error) {
-		err = s.dialAndServe(ctx, log, addr)
+	var attempt, calls int
+	err = backoffUntil(ctx, backoff, func(context.Context) (done bool, err error) {
+		calls++
+		if s.Transport == TransportTCP {
+			err = s.dialAndServeTCP(ctx, log, addr)
+		} else {
+			err = s.dialAndServe(ctx, log, addr)
+		}
+		if s.isShuttingDown() {
+			return true, nil
+		}
 		if err != nil {
+			if ctx.Err() != nil {
+				// the connection is closed when the context is cancelled,
+				// so the error it was closed with isn't returned.
+				return false, ctx.Err()
+			}
+
 			lastErr = err
 			if errors.Is(err, context.Canceled) {
 				return false, nil
@@ -97,6 +279,16 @@ func (s *Tunnel) DialAndServe(ctx context.Context, addr string) (err error) {
 			// at a higher log level
 			log.Debug("Error while attempting to dial and register", "error", err)
 
+			// there's no retry after the last step of a limited backoff.
+			if backoff.Steps > 0 && calls >= backoff.Steps {
+				return false, nil
+			}
+
+			attempt++
+			if s.OnReconnecting != nil {
+				s.OnReconnecting(attempt, err)
+			}
+
 			return false, nil
 		}
 
@@ -105,13 +297,29 @@ func (s *Tunnel) DialAndServe(ctx context.Context, addr string) (err error) {
 
 	// this signifies that the exponential backoff was exhausted or exceeded a deadline
 	// in this situation we simply return the last observed error in the dial and serve attempts
-	if !errors.Is(err, context.Canceled) && wait.Interrupted(err) {
+	if !errors.Is(err, context.Canceled) && wait.Interrupted(err) && lastErr != nil {
 		err = lastErr
 	}
 
 	return err
 }
 
+// backoffUntil runs condition until it is done, waiting between attempts according to the backoff.
+// If the backoff has no Steps, condition is retried until ctx is cancelled.
+func backoffUntil(ctx context.Context, backoff wait.Backoff, condition wait.ConditionWithContextFunc) error {
+	if backoff.Steps > 0 {
+		return wait.ExponentialBackoffWithContext(ctx, backoff, condition)
+	}
+
+	if backoff.Cap > 0 {
+		// wait.Backoff only grows the interval while there are steps remaining,
+		// and sets the steps to zero once the interval reaches the cap.
+		backoff.Steps = math.MaxInt32
+	}
+
+	return backoff.DelayFunc().Until(ctx, true, true, condition)
+}
+
 func (s *Tunnel) dialAndServe(
 	ctx context.Context,
 	log *slog.Logger,
@@ -122,77 +330,215 @@ func (s *Tunnel) dialAndServe(
 		return err
 	}
 
-	conn, err := quic.DialAddr(ctx,
-		addr,
-		tlsConf,
-		coallesce(s.QuicConfig, DefaultQuicConfig),
-	)
+	stats := &connStats{}
+	quicConf := s.quicConfig()
+	quicConf.Tracer = stats.tracer(quicConf.Tracer)
+
+	conn, closePacketConn, err := s.dialQUIC(ctx, addr, tlsConf, quicConf)
 	if err != nil {
 		return fmt.Errorf("QUIC dial error: %w", err)
 	}
+	defer closePacketConn()
 
-	go func() {
-		<-ctx.Done()
+	if !s.setConn(conn, stats) {
+		return nil
+	}
+
+	served := make(chan struct{})
+	defer close(served)
 
-		_ = conn.CloseWithError(protocol.ApplicationOK, "")
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.CloseWithError(protocol.ApplicationCancelled, "context cancelled")
+		case <-served:
+		}
 	}()
 
 	log.Debug("Attempting to register")
 
 	// register server as a listener on remote tunnel
-	if err := s.register(conn); err != nil {
+	metadata, err := s.register(ctx, conn)
+	if err != nil {
+		_ = conn.CloseWithError(protocol.ApplicationError, "registration failed")
 		return err
 	}
 
+	log = log.With(s.metadataAttrs(metadata)...)
+
 	log.Info("Starting server")
 
-	return (&http3.Server{Handler: s.Handler}).ServeQUICConn(conn)
+	if s.OnStats != nil {
+		go s.reportStats(conn, stats)
+	}
+
+	public := s.publicMetadata(metadata)
+
+	server := &http3.Server{
+		Handler: s.trackRequests(s.limitRequests(s.handler())),
+		Logger:  log,
+		ConnContext: func(ctx context.Context, c quic.Connection) context.Context {
+			return contextWithMetadata(contextWithLogger(ctx, log), public)
+		},
+	}
+
+	err = server.ServeQUICConn(conn)
+	// the connection is usually closed already, but is closed here in case
+	// the server stopped without closing it, so it isn't leaked.
+	_ = conn.CloseWithError(protocol.ApplicationError, "server closed")
+
+	if s.OnDisconnect != nil {
+		s.OnDisconnect(err)
+	}
+
+	return err
+}
+
+// checkRegisterResponse returns an error if registration failed, or if the server
+// chose a protocol version the client doesn't speak. Servers which predate version
+// negotiation don't set a version, in which case protocol.Version is assumed.
+func checkRegisterResponse(resp *protocol.RegisterListenerResponse) error {
+	if resp.Code == protocol.CodeUnsupportedVersion {
+		err := &protocol.VersionMismatchError{
+			ClientMin: protocol.MinVersion,
+			ClientMax: protocol.Version,
+			ServerMin: resp.MinVersion,
+			ServerMax: resp.MaxVersion,
+		}
+		if len(resp.Body) > 0 {
+			return fmt.Errorf("%w: %s", err, resp.Body)
+		}
+		return err
+	}
+
+	if resp.Code != protocol.CodeOK {
+		return fmt.Errorf("unexpected response code: %v", resp.Code)
+	}
+
+	if resp.Version == 0 {
+		resp.Version = protocol.Version
+	}
+
+	if resp.Version < protocol.MinVersion || resp.Version > protocol.Version {
+		return fmt.Errorf("server negotiated protocol version %d, but the client supports versions %d-%d", resp.Version, protocol.MinVersion, protocol.Version)
+	}
+
+	return nil
 }
 
-func (s *Tunnel) register(conn quic.Connection) error {
+// register the connection as a listener on the remote tunnel,
+// returning the combined request and response metadata.
+func (s *Tunnel) register(ctx context.Context, conn quic.Connection) (map[string]string, error) {
 	stream, err := conn.OpenStream()
 	if err != nil {
-		return fmt.Errorf("accepting stream: %w", err)
+		err = fmt.Errorf("accepting stream: %w", err)
+		if s.OnRegister != nil {
+			s.OnRegister(protocol.RegisterListenerResponse{}, err)
+		}
+		return nil, err
 	}
 
 	defer stream.Close()
 
+	return s.registerStream(stream.Context(), stream)
+}
+
+// registerStream registers the connection using the stream,
+// reporting the outcome to the OnRegister and OnConnectionReady callbacks.
+func (s *Tunnel) registerStream(ctx context.Context, stream io.ReadWriteCloser) (map[string]string, error) {
+	resp, metadata, err := s.handshake(ctx, stream)
+
+	if s.OnRegister != nil {
+		s.OnRegister(resp, err)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if s.OnConnectionReady != nil {
+		s.OnConnectionReady(resp)
+	}
+
+	return metadata, nil
+}
+
+// handshake writes the register listener request to the stream and reads the response,
+// answering the server's challenge first if it sends one.
+func (s *Tunnel) handshake(ctx context.Context, stream io.ReadWriteCloser) (protocol.RegisterListenerResponse, map[string]string, error) {
 	enc := protocol.NewEncoder[protocol.RegisterListenerRequest](stream)
 	defer enc.Close()
 
 	req := &protocol.RegisterListenerRequest{
-		Version: protocol.Version,
-		Service: s.Namespace,
+		Version:    protocol.Version,
+		MinVersion: protocol.MinVersion,
+		Service:    s.Namespace,
+		Namespaces: s.namespaces(),
 	}
 
-	auth := defaultAuthenticator
-	if s.Authenticator != nil {
-		auth = s.Authenticator
+	if s.Authenticator == nil {
+		s.logger().Warn("No authenticator provided, attempting to register connection without credentials")
+	} else if err := s.Authenticator.Authenticate(ctx, req); err != nil {
+		return protocol.RegisterListenerResponse{}, nil, fmt.Errorf("registering new connection: %w", err)
 	}
 
-	if err := auth.Authenticate(stream.Context(), req); err != nil {
-		return fmt.Errorf("registering new connection: %w", err)
+	if d, ok := stream.(deadliner); ok {
+		_ = d.SetDeadline(time.Now().Add(s.handshakeTimeout()))
+		// the deadline only applies to the handshake,
+		// not to requests served on the connection.
+		defer d.SetDeadline(time.Time{})
 	}
 
 	if err := enc.Encode(req); err != nil {
-		return fmt.Errorf("encoding register listener request: %w", err)
+		return protocol.RegisterListenerResponse{}, nil, fmt.Errorf("encoding register listener request: %w", s.handshakeError(err))
 	}
 
-	dec := protocol.NewDecoder[protocol.RegisterListenerResponse](stream)
+	dec := protocol.NewDecoder[protocol.RegisterListenerResponse](newHandshakeReader(stream, s.maxHandshakeBytes()))
 	defer dec.Close()
 
 	resp, err := dec.Decode()
 	if err != nil {
-		return fmt.Errorf("decoding register listener response: %w", err)
+		return protocol.RegisterListenerResponse{}, nil, fmt.Errorf("decoding register listener response: %w", s.handshakeError(err))
 	}
 
-	if resp.Code != protocol.CodeOK {
-		return fmt.Errorf("unexpected response code: %v", resp.Code)
+	if resp.Code == protocol.CodeChallenge {
+		resp, err = s.answerChallenge(ctx, stream, dec, req, resp.Challenge)
+		if err != nil {
+			return resp, nil, err
+		}
 	}
 
-	if s.OnConnectionReady != nil {
-		s.OnConnectionReady(resp)
+	if err := checkRegisterResponse(&resp); err != nil {
+		return resp, nil, err
 	}
 
-	return nil
+	return resp, mergeMetadata(req.Metadata, resp.Metadata), nil
+}
+
+// answerChallenge signs the server's challenge with the tunnel's ChallengeAuthenticator,
+// writes the signature to the stream, and reads the server's final response.
+func (s *Tunnel) answerChallenge(ctx context.Context, stream io.WriteCloser, dec protocol.Decoder[protocol.RegisterListenerResponse], req *protocol.RegisterListenerRequest, challenge []byte) (protocol.RegisterListenerResponse, error) {
+	auth, ok := s.Authenticator.(ChallengeAuthenticator)
+	if !ok {
+		return protocol.RegisterListenerResponse{}, errors.New("the server requires a challenge-response handshake, but the authenticator doesn't implement ChallengeAuthenticator")
+	}
+
+	signature, err := auth.SignChallenge(ctx, req, challenge)
+	if err != nil {
+		return protocol.RegisterListenerResponse{}, fmt.Errorf("signing challenge: %w", err)
+	}
+
+	enc := protocol.NewEncoder[protocol.ChallengeResponse](stream)
+	defer enc.Close()
+
+	if err := enc.Encode(&protocol.ChallengeResponse{Signature: signature}); err != nil {
+		return protocol.RegisterListenerResponse{}, fmt.Errorf("encoding challenge response: %w", s.handshakeError(err))
+	}
+
+	resp, err := dec.Decode()
+	if err != nil {
+		return protocol.RegisterListenerResponse{}, fmt.Errorf("decoding register listener response: %w", s.handshakeError(err))
+	}
+
+	return resp, nil
 }
@@ -0,0 +1,1308 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/common-fate/ops/protocol"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/logging"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestBackoffUntilRetriesForever(t *testing.T) {
+	backoff := wait.Backoff{
+		Duration: time.Millisecond,
+		Factor:   2.0,
+		Cap:      4 * time.Millisecond,
+	}
+
+	// more failures than DefaultBackoff would allow
+	failures := DefaultBackoff.Steps * 3
+
+	var attempts int
+	err := backoffUntil(context.Background(), backoff, func(ctx context.Context) (bool, error) {
+		attempts++
+		if attempts <= failures {
+			// dial failed
+			return false, nil
+		}
+		return true, nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, failures+1, attempts)
+}
+
+func TestBackoffUntilInfiniteReturnsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	backoff := wait.Backoff{
+		Duration: time.Millisecond,
+		Factor:   2.0,
+		Cap:      2 * time.Millisecond,
+	}
+
+	err := backoffUntil(ctx, backoff, func(ctx context.Context) (bool, error) {
+		return false, nil
+	})
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestBackoffUntilLimitedSteps(t *testing.T) {
+	backoff := wait.Backoff{
+		Steps:    3,
+		Duration: time.Millisecond,
+	}
+
+	var attempts int
+	err := backoffUntil(context.Background(), backoff, func(ctx context.Context) (bool, error) {
+		attempts++
+		return false, nil
+	})
+
+	assert.True(t, wait.Interrupted(err))
+	assert.Equal(t, 3, attempts)
+}
+
+func TestGetTLSConfigClientCertificate(t *testing.T) {
+	cert := tls.Certificate{Certificate: [][]byte{[]byte("test")}}
+
+	s := &Tunnel{Authenticator: ClientCertificateAuthenticator(cert)}
+
+	tlsConf, err := s.getTLSConfig("https://tunnel.example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []tls.Certificate{cert}, tlsConf.Certificates)
+	assert.Equal(t, "tunnel.example.com", tlsConf.ServerName)
+	assert.Equal(t, []string{protocol.Name}, tlsConf.NextProtos)
+
+	// the default config isn't modified
+	assert.Empty(t, DefaultTLSConfig.Certificates)
+	assert.Empty(t, DefaultTLSConfig.ServerName)
+}
+
+func TestGetTLSConfigBearer(t *testing.T) {
+	s := &Tunnel{Authenticator: BearerAuthenticator("token")}
+
+	tlsConf, err := s.getTLSConfig("https://tunnel.example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Empty(t, tlsConf.Certificates)
+}
+
+func TestTokenSourceAuthenticator(t *testing.T) {
+	var calls int
+	auth := TokenSourceAuthenticator(TokenSourceFunc(func(ctx context.Context) (string, error) {
+		calls++
+		return fmt.Sprintf("token-%d", calls), nil
+	}))
+
+	// each registration should use a fresh token
+	for _, want := range []string{"Bearer token-1", "Bearer token-2"} {
+		req := &protocol.RegisterListenerRequest{}
+		if err := auth.Authenticate(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, want, req.Metadata[authorizationMetadataKey])
+	}
+
+	failing := TokenSourceAuthenticator(TokenSourceFunc(func(ctx context.Context) (string, error) {
+		return "", errors.New("token expired")
+	}))
+
+	err := failing.Authenticate(context.Background(), &protocol.RegisterListenerRequest{})
+	assert.EqualError(t, err, "retrieving token: token expired")
+}
+
+func TestCheckRegisterResponse(t *testing.T) {
+	resp := protocol.RegisterListenerResponse{Code: protocol.CodeOK}
+	assert.NoError(t, checkRegisterResponse(&resp))
+	assert.Equal(t, protocol.Version, resp.Version, "servers which predate negotiation are assumed to speak the current version")
+
+	resp = protocol.RegisterListenerResponse{Code: protocol.CodeOK, Version: protocol.Version + 1}
+	assert.ErrorContains(t, checkRegisterResponse(&resp), "server negotiated protocol version 2")
+
+	resp = protocol.RegisterListenerResponse{Code: protocol.CodeUnsupportedVersion, MinVersion: 2, MaxVersion: 3}
+	err := checkRegisterResponse(&resp)
+	var mismatch *protocol.VersionMismatchError
+	if assert.ErrorAs(t, err, &mismatch) {
+		assert.Equal(t, uint8(2), mismatch.ServerMin)
+		assert.Equal(t, uint8(3), mismatch.ServerMax)
+	}
+	assert.EqualError(t, err, "unsupported protocol version: client supports versions 1-1, server supports versions 2-3")
+
+	resp = protocol.RegisterListenerResponse{Code: protocol.CodeUnauthorized}
+	assert.EqualError(t, checkRegisterResponse(&resp), "unexpected response code: CodeUnauthorized")
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	v, err := protocol.NegotiateVersion(&protocol.RegisterListenerRequest{Version: 3, MinVersion: 1}, 1, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(2), v)
+
+	// clients which predate negotiation only speak their version.
+	_, err = protocol.NegotiateVersion(&protocol.RegisterListenerRequest{Version: 1}, 2, 3)
+	assert.EqualError(t, err, "unsupported protocol version: client supports versions 1-1, server supports versions 2-3")
+
+	_, err = protocol.NegotiateVersion(&protocol.RegisterListenerRequest{Version: 4, MinVersion: 4}, 1, 3)
+	assert.Error(t, err)
+}
+
+func TestBearerVerifier(t *testing.T) {
+	verifier := BearerVerifier(func(token string) error {
+		if token != "secret" {
+			return errors.New("unknown token")
+		}
+		return nil
+	})
+
+	req := &protocol.RegisterListenerRequest{}
+	if err := BearerAuthenticator("secret").Authenticate(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, verifier.Verify(context.Background(), req))
+
+	req = &protocol.RegisterListenerRequest{}
+	if err := BearerAuthenticator("wrong").Authenticate(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualError(t, verifier.Verify(context.Background(), req), "invalid bearer token: unknown token")
+
+	err := verifier.Verify(context.Background(), &protocol.RegisterListenerRequest{})
+	assert.EqualError(t, err, "missing Authorization metadata")
+
+	err = verifier.Verify(context.Background(), &protocol.RegisterListenerRequest{Metadata: map[string]string{"Authorization": "Basic abc"}})
+	assert.EqualError(t, err, "Authorization metadata must use the Bearer scheme")
+}
+
+// selfSignedTLSConfig returns a server TLS config with a certificate for localhost.
+func selfSignedTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{protocol.Name},
+	}
+}
+
+func TestConnectionStats(t *testing.T) {
+	ln, err := quic.ListenAddr("127.0.0.1:0", selfSignedTLSConfig(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(stream, stream)
+		stream.Close()
+	}()
+
+	stats := &connStats{}
+	var wrapped bool
+	quicConf := &quic.Config{Tracer: func(context.Context, logging.Perspective, quic.ConnectionID) *logging.ConnectionTracer {
+		wrapped = true
+		return nil
+	}}
+	quicConf.Tracer = stats.tracer(quicConf.Tracer)
+
+	conn, err := quic.DialAddr(context.Background(), ln.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{protocol.Name},
+	}, quicConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(protocol.ApplicationOK, "")
+
+	tun := &Tunnel{}
+	_, ok := tun.Stats()
+	assert.False(t, ok)
+	tun.setConn(conn, stats)
+
+	stream, err := conn.OpenStreamSync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = stream.Write([]byte("ping"))
+	stream.Close()
+	got, _ := io.ReadAll(stream)
+	assert.Equal(t, "ping", string(got))
+
+	s, ok := tun.Stats()
+	assert.True(t, ok)
+	assert.True(t, wrapped, "an existing tracer should still be called")
+	assert.Equal(t, protocol.Name, s.ALPN)
+	assert.Equal(t, uint16(tls.VersionTLS13), s.TLSVersion)
+	assert.Greater(t, s.SmoothedRTT, time.Duration(0))
+	assert.Greater(t, s.BytesSent, uint64(0))
+	assert.Greater(t, s.BytesReceived, uint64(0))
+	assert.Greater(t, s.PacketsSent, uint64(0))
+}
+
+func TestDialAndServeReturnsCleanlyOnCancel(t *testing.T) {
+	ln, err := quic.ListenAddr("127.0.0.1:0", selfSignedTLSConfig(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		if _, err := protocol.NewDecoder[protocol.RegisterListenerRequest](stream).Decode(); err != nil {
+			return
+		}
+		_ = protocol.NewEncoder[protocol.RegisterListenerResponse](stream).Encode(&protocol.RegisterListenerResponse{Code: protocol.CodeOK})
+		<-conn.Context().Done()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tun := &Tunnel{
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         "localhost",
+			NextProtos:         []string{protocol.Name},
+		},
+		Authenticator: BearerAuthenticator("token"),
+		// with a single step, the backoff would otherwise give up
+		// and return the error the connection was closed with.
+		Backoff: &wait.Backoff{Steps: 1, Duration: time.Millisecond},
+		// cancel once the connection is registered and being served.
+		OnConnectionReady: func(protocol.RegisterListenerResponse) { cancel() },
+	}
+
+	err = tun.DialAndServe(ctx, ln.Addr().String())
+	if err != nil {
+		assert.ErrorIs(t, err, context.Canceled)
+	}
+}
+
+func TestDialAndServeClosesRejectedConnections(t *testing.T) {
+	ln, err := quic.ListenAddr("127.0.0.1:0", selfSignedTLSConfig(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// the server rejects every registration, keeping the connections it accepts.
+	conns := make(chan quic.Connection, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			conns <- conn
+			stream, err := conn.AcceptStream(context.Background())
+			if err != nil {
+				continue
+			}
+			if _, err := protocol.NewDecoder[protocol.RegisterListenerRequest](stream).Decode(); err != nil {
+				continue
+			}
+			_ = protocol.NewEncoder[protocol.RegisterListenerResponse](stream).Encode(&protocol.RegisterListenerResponse{Code: protocol.CodeUnauthorized})
+		}
+	}()
+
+	const attempts = 3
+	var reconnecting []int
+	tun := &Tunnel{
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         "localhost",
+			NextProtos:         []string{protocol.Name},
+		},
+		Authenticator:  BearerAuthenticator("token"),
+		Backoff:        &wait.Backoff{Steps: attempts, Duration: time.Millisecond},
+		OnReconnecting: func(attempt int, err error) { reconnecting = append(reconnecting, attempt) },
+	}
+
+	err = tun.DialAndServe(context.Background(), ln.Addr().String())
+	assert.ErrorContains(t, err, "unexpected response code: CodeUnauthorized")
+	assert.Equal(t, []int{1, 2}, reconnecting, "OnReconnecting isn't called after the last attempt")
+
+	if !assert.Len(t, conns, attempts) {
+		return
+	}
+	for i := 0; i < attempts; i++ {
+		conn := <-conns
+		select {
+		case <-conn.Context().Done():
+			var appErr *quic.ApplicationError
+			if assert.ErrorAs(t, context.Cause(conn.Context()), &appErr) {
+				assert.Equal(t, quic.ApplicationErrorCode(protocol.ApplicationError), appErr.ErrorCode)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("connection %d wasn't closed after its registration was rejected", i+1)
+		}
+	}
+}
+
+func TestDialAndServeLocalAddr(t *testing.T) {
+	// dial connects to a QUIC server which registers the connection,
+	// returning the address the connection was made from.
+	dial := func(t *testing.T, tun *Tunnel) net.Addr {
+		ln, err := quic.ListenAddr("127.0.0.1:0", selfSignedTLSConfig(t), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+
+		remote := make(chan net.Addr, 1)
+		go func() {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			remote <- conn.RemoteAddr()
+			stream, err := conn.AcceptStream(context.Background())
+			if err != nil {
+				return
+			}
+			if _, err := protocol.NewDecoder[protocol.RegisterListenerRequest](stream).Decode(); err != nil {
+				return
+			}
+			_ = protocol.NewEncoder[protocol.RegisterListenerResponse](stream).Encode(&protocol.RegisterListenerResponse{Code: protocol.CodeOK})
+			<-conn.Context().Done()
+		}()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		tun.TLSConfig = &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         "localhost",
+			NextProtos:         []string{protocol.Name},
+		}
+		tun.Authenticator = BearerAuthenticator("token")
+		tun.Backoff = &wait.Backoff{Steps: 1, Duration: time.Millisecond}
+		tun.OnConnectionReady = func(protocol.RegisterListenerResponse) { cancel() }
+
+		err = tun.DialAndServe(ctx, ln.Addr().String())
+		if err != nil {
+			assert.ErrorIs(t, err, context.Canceled)
+		}
+
+		return <-remote
+	}
+
+	t.Run("packet conn", func(t *testing.T) {
+		pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pc.Close()
+
+		remote := dial(t, &Tunnel{PacketConn: pc})
+		assert.Equal(t, pc.LocalAddr().String(), remote.String())
+	})
+
+	t.Run("local addr", func(t *testing.T) {
+		// find a free port to pin the connection to.
+		free, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		localAddr := free.LocalAddr().String()
+		free.Close()
+
+		remote := dial(t, &Tunnel{LocalAddr: localAddr})
+		assert.Equal(t, localAddr, remote.String())
+
+		// the socket is closed once the connection has been served, so the port can be bound again.
+		again, err := net.ListenUDP("udp", free.LocalAddr().(*net.UDPAddr))
+		if assert.NoError(t, err) {
+			again.Close()
+		}
+	})
+}
+
+func TestDialAndServeTCP(t *testing.T) {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", selfSignedTLSConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	type result struct {
+		req  protocol.RegisterListenerRequest
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+
+	// the server registers the connection, then sends a request as an HTTP/2 client.
+	go func() {
+		raw, err := ln.Accept()
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		conn := newBufferedConn(raw)
+		defer conn.Close()
+
+		req, err := protocol.NewDecoder[protocol.RegisterListenerRequest](conn).Decode()
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		if err := protocol.NewEncoder[protocol.RegisterListenerResponse](conn).Encode(&protocol.RegisterListenerResponse{Code: protocol.CodeOK, Metadata: map[string]string{"region": "eu"}}); err != nil {
+			results <- result{err: err}
+			return
+		}
+
+		cc, err := (&http2.Transport{}).NewClientConn(conn)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		r, _ := http.NewRequest(http.MethodGet, "http://tunnel/ping", nil)
+		res, err := cc.RoundTrip(r)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		results <- result{req: req, body: string(body), err: err}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tun := &Tunnel{
+		Namespace: "example",
+		Transport: TransportTCP,
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         "localhost",
+			NextProtos:         []string{protocol.Name},
+		},
+		Authenticator: BearerAuthenticator("token"),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			md, _ := MetadataFromContext(r.Context())
+			_, _ = w.Write([]byte(fmt.Sprintf("pong %s %d", md["region"], len(md))))
+		}),
+		Backoff: &wait.Backoff{Steps: 1, Duration: time.Millisecond},
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- tun.DialAndServe(ctx, ln.Addr().String())
+	}()
+
+	res := <-results
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	assert.Equal(t, "example", res.req.Service)
+	assert.Equal(t, "Bearer token", res.req.Metadata[authorizationMetadataKey])
+	// the Authorization key isn't exposed to the handler.
+	assert.Equal(t, "pong eu 1", res.body)
+
+	_, ok := tun.Stats()
+	assert.False(t, ok, "stats are only available over QUIC")
+
+	cancel()
+	if err := <-done; err != nil {
+		assert.ErrorIs(t, err, context.Canceled)
+	}
+}
+
+func TestRegisterHandshakeLimits(t *testing.T) {
+	// a server which reads the register listener request and then calls respond.
+	register := func(tun *Tunnel, respond func(net.Conn)) error {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+
+		go func() {
+			conn := newBufferedConn(server)
+			if _, err := protocol.NewDecoder[protocol.RegisterListenerRequest](conn).Decode(); err != nil {
+				return
+			}
+			respond(conn)
+		}()
+
+		_, err := tun.registerStream(context.Background(), newBufferedConn(client))
+		return err
+	}
+
+	tun := &Tunnel{Authenticator: BearerAuthenticator("token"), HandshakeTimeout: 50 * time.Millisecond}
+
+	start := time.Now()
+	err := register(tun, func(conn net.Conn) {
+		// never respond
+		_, _ = io.Copy(io.Discard, conn)
+	})
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.ErrorContains(t, err, "the server didn't complete registration within the handshake timeout of 50ms")
+	assert.Less(t, time.Since(start), time.Second)
+
+	tun.MaxHandshakeBytes = 1024
+	err = register(tun, func(conn net.Conn) {
+		_ = protocol.NewEncoder[protocol.RegisterListenerResponse](conn).Encode(&protocol.RegisterListenerResponse{
+			Code: protocol.CodeOK,
+			Body: bytes.Repeat([]byte("a"), 4096),
+		})
+	})
+	assert.ErrorContains(t, err, "the register listener response exceeds the limit of 1024 bytes")
+
+	err = register(tun, func(conn net.Conn) {
+		_ = protocol.NewEncoder[protocol.RegisterListenerResponse](conn).Encode(&protocol.RegisterListenerResponse{Code: protocol.CodeOK})
+	})
+	assert.NoError(t, err)
+}
+
+func TestOnRegister(t *testing.T) {
+	type attempt struct {
+		resp protocol.RegisterListenerResponse
+		err  error
+	}
+	var attempts []attempt
+	var ready int
+
+	tun := &Tunnel{
+		OnRegister: func(resp protocol.RegisterListenerResponse, err error) {
+			attempts = append(attempts, attempt{resp, err})
+		},
+		OnConnectionReady: func(protocol.RegisterListenerResponse) { ready++ },
+	}
+
+	register := func(resp protocol.RegisterListenerResponse) error {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+
+		go func() {
+			conn := newBufferedConn(server)
+			if _, err := protocol.NewDecoder[protocol.RegisterListenerRequest](conn).Decode(); err != nil {
+				return
+			}
+			_ = protocol.NewEncoder[protocol.RegisterListenerResponse](conn).Encode(&resp)
+		}()
+
+		_, err := tun.registerStream(context.Background(), newBufferedConn(client))
+		return err
+	}
+
+	err := register(protocol.RegisterListenerResponse{Code: protocol.CodeUnauthorized})
+	assert.Error(t, err)
+
+	err = register(protocol.RegisterListenerResponse{Code: protocol.CodeOK})
+	assert.NoError(t, err)
+
+	if assert.Len(t, attempts, 2) {
+		assert.Equal(t, protocol.CodeUnauthorized, attempts[0].resp.Code)
+		assert.Error(t, attempts[0].err)
+		assert.Equal(t, protocol.CodeOK, attempts[1].resp.Code)
+		assert.NoError(t, attempts[1].err)
+	}
+	assert.Equal(t, 1, ready, "OnConnectionReady is only called for successful registrations")
+}
+
+func TestRegisterWithoutAuthenticatorLogs(t *testing.T) {
+	var buf bytes.Buffer
+	tun := &Tunnel{Logger: slog.New(slog.NewTextHandler(&buf, nil))}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		conn := newBufferedConn(server)
+		if _, err := protocol.NewDecoder[protocol.RegisterListenerRequest](conn).Decode(); err != nil {
+			return
+		}
+		_ = protocol.NewEncoder[protocol.RegisterListenerResponse](conn).Encode(&protocol.RegisterListenerResponse{Code: protocol.CodeOK})
+	}()
+
+	_, err := tun.registerStream(context.Background(), newBufferedConn(client))
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), "No authenticator provided", "the warning should use the tunnel's logger")
+}
+
+func TestQuicConfigTimeouts(t *testing.T) {
+	conf := (&Tunnel{}).quicConfig()
+	assert.Equal(t, DefaultQuicConfig.MaxIdleTimeout, conf.MaxIdleTimeout)
+	assert.Equal(t, DefaultQuicConfig.KeepAlivePeriod, conf.KeepAlivePeriod)
+
+	conf = (&Tunnel{IdleTimeout: time.Minute}).quicConfig()
+	assert.Equal(t, time.Minute, conf.MaxIdleTimeout)
+	assert.Equal(t, DefaultQuicConfig.KeepAlivePeriod, conf.KeepAlivePeriod)
+	assert.Equal(t, 20*time.Second, DefaultQuicConfig.MaxIdleTimeout, "the default config shouldn't be modified")
+
+	custom := &quic.Config{MaxIdleTimeout: time.Second, KeepAlivePeriod: time.Second, EnableDatagrams: true}
+	conf = (&Tunnel{QuicConfig: custom, KeepAlivePeriod: 5 * time.Second}).quicConfig()
+	assert.Equal(t, time.Second, conf.MaxIdleTimeout)
+	assert.Equal(t, 5*time.Second, conf.KeepAlivePeriod)
+	assert.True(t, conf.EnableDatagrams)
+	assert.Equal(t, time.Second, custom.KeepAlivePeriod)
+}
+
+func TestDialAndServeNamespaces(t *testing.T) {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", selfSignedTLSConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	type result struct {
+		req    protocol.RegisterListenerRequest
+		bodies map[string]string
+		err    error
+	}
+	results := make(chan result, 1)
+
+	// the server registers the connection, then forwards a request to each namespace.
+	go func() {
+		raw, err := ln.Accept()
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		conn := newBufferedConn(raw)
+		defer conn.Close()
+
+		req, err := protocol.NewDecoder[protocol.RegisterListenerRequest](conn).Decode()
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		if err := protocol.NewEncoder[protocol.RegisterListenerResponse](conn).Encode(&protocol.RegisterListenerResponse{Code: protocol.CodeOK}); err != nil {
+			results <- result{err: err}
+			return
+		}
+
+		cc, err := (&http2.Transport{}).NewClientConn(conn)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+
+		bodies := map[string]string{}
+		for _, ns := range []string{"", "billing", "reports", "missing"} {
+			r, _ := http.NewRequest(http.MethodGet, "http://tunnel/ping", nil)
+			if ns != "" {
+				r.Header.Set(protocol.NamespaceHeader, ns)
+			}
+			res, err := cc.RoundTrip(r)
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			bodies[ns] = fmt.Sprintf("%d %s", res.StatusCode, body)
+		}
+		results <- result{req: req, bodies: bodies}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reply := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(name))
+		})
+	}
+
+	tun := &Tunnel{
+		Namespace: "example",
+		Handler:   reply("example"),
+		Namespaces: map[string]http.Handler{
+			"reports": reply("reports"),
+			"billing": reply("billing"),
+		},
+		Transport: TransportTCP,
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         "localhost",
+			NextProtos:         []string{protocol.Name},
+		},
+		Backoff: &wait.Backoff{Steps: 1, Duration: time.Millisecond},
+	}
+
+	go func() {
+		_ = tun.DialAndServe(ctx, ln.Addr().String())
+	}()
+
+	res := <-results
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	assert.Equal(t, []string{"billing", "reports"}, res.req.Namespaces)
+	assert.Equal(t, []string{"example", "billing", "reports"}, res.req.Services())
+	assert.Equal(t, map[string]string{
+		"":        "200 example",
+		"billing": "200 billing",
+		"reports": "200 reports",
+		"missing": `404 {"code":"CodeNotFound","message":"namespace missing isn't served by this connection"}` + "\n",
+	}, res.bodies)
+}
+
+func TestALPN(t *testing.T) {
+	conf, err := (&Tunnel{}).getTLSConfig("https://example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{protocol.Name}, conf.NextProtos)
+
+	conf, err = (&Tunnel{ALPN: "billing-tunnel"}).getTLSConfig("https://example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"billing-tunnel"}, conf.NextProtos)
+	assert.Equal(t, []string{protocol.Name}, DefaultTLSConfig.NextProtos, "the default config shouldn't be modified")
+
+	conf, err = (&Tunnel{ALPN: "billing-tunnel", TLSConfig: &tls.Config{NextProtos: []string{"custom"}}}).getTLSConfig("https://example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"custom"}, conf.NextProtos, "a full TLS config takes precedence")
+}
+
+func TestChallengeHandshake(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := KeyVerifier(func(keyID string) (ed25519.PublicKey, error) {
+		if keyID != "agent-1" {
+			return nil, errors.New("unknown key")
+		}
+		return pub, nil
+	})
+
+	// a server which challenges every registration, recording the signatures it receives.
+	var signatures [][]byte
+	register := func(tun *Tunnel) error {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+
+		go func() {
+			conn := newBufferedConn(server)
+			enc := protocol.NewEncoder[protocol.RegisterListenerResponse](conn)
+
+			req, err := protocol.NewDecoder[protocol.RegisterListenerRequest](conn).Decode()
+			if err != nil {
+				return
+			}
+			if err := verifier.Verify(context.Background(), &req); err != nil {
+				_ = enc.Encode(&protocol.RegisterListenerResponse{Code: protocol.CodeUnauthorized})
+				return
+			}
+
+			challenge, err := NewChallenge()
+			if err != nil {
+				return
+			}
+			_ = enc.Encode(&protocol.RegisterListenerResponse{Code: protocol.CodeChallenge, Challenge: challenge})
+
+			answer, err := protocol.NewDecoder[protocol.ChallengeResponse](conn).Decode()
+			if err != nil {
+				return
+			}
+			signatures = append(signatures, answer.Signature)
+
+			code := protocol.CodeOK
+			if err := verifier.VerifyChallenge(context.Background(), &req, challenge, answer.Signature); err != nil {
+				code = protocol.CodeUnauthorized
+			}
+			_ = enc.Encode(&protocol.RegisterListenerResponse{Code: code})
+		}()
+
+		_, err := tun.registerStream(context.Background(), newBufferedConn(client))
+		return err
+	}
+
+	err = register(&Tunnel{Namespace: "agents", Authenticator: KeyAuthenticator("agent-1", key)})
+	assert.NoError(t, err)
+
+	err = register(&Tunnel{Namespace: "agents", Authenticator: KeyAuthenticator("agent-1", otherKey)})
+	assert.ErrorContains(t, err, "unexpected response code: CodeUnauthorized", "the signature must be made with the registered key")
+
+	err = register(&Tunnel{Namespace: "agents", Authenticator: KeyAuthenticator("agent-2", key)})
+	assert.ErrorContains(t, err, "unexpected response code: CodeUnauthorized", "the key ID must be known")
+
+	keyIDOnly := AuthenticatorFunc(func(ctx context.Context, r *protocol.RegisterListenerRequest) error {
+		return KeyAuthenticator("agent-1", key).Authenticate(ctx, r)
+	})
+	err = register(&Tunnel{Namespace: "agents", Authenticator: keyIDOnly})
+	assert.ErrorContains(t, err, "the authenticator doesn't implement ChallengeAuthenticator")
+
+	// a signature can't be replayed, as each registration is sent a new challenge.
+	captured := signatures[0]
+	err = register(&Tunnel{Namespace: "agents", Authenticator: replayAuthenticator{signature: captured}})
+	assert.ErrorContains(t, err, "unexpected response code: CodeUnauthorized")
+}
+
+// replayAuthenticator answers every challenge with the same signature.
+type replayAuthenticator struct {
+	signature []byte
+}
+
+func (a replayAuthenticator) Authenticate(ctx context.Context, r *protocol.RegisterListenerRequest) error {
+	r.Metadata = map[string]string{"Key-Id": "agent-1"}
+	return nil
+}
+
+func (a replayAuthenticator) SignChallenge(context.Context, *protocol.RegisterListenerRequest, []byte) ([]byte, error) {
+	return a.signature, nil
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	tun := &Tunnel{
+		MaxConcurrentRequests: 1,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				entered <- struct{}{}
+				<-release
+			}
+		}),
+	}
+
+	// the handler is wrapped once for each connection.
+	conn := tun.limitRequests(tun.handler())
+	other := tun.limitRequests(tun.handler())
+
+	serve := func(h http.Handler, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+		return rec
+	}
+
+	slow := make(chan *httptest.ResponseRecorder)
+	go func() { slow <- serve(conn, "/slow") }()
+	<-entered
+
+	rec := serve(conn, "/fast")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var res protocol.ErrorResponse
+	if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res)) {
+		assert.Equal(t, protocol.ErrorResponse{
+			Code:    "CodeTooManyRequests",
+			Message: "the connection is already serving the maximum of 1 concurrent requests",
+		}, res)
+	}
+
+	assert.Equal(t, http.StatusOK, serve(other, "/fast").Code, "connections have their own limit")
+
+	close(release)
+	assert.Equal(t, http.StatusOK, (<-slow).Code)
+	assert.Equal(t, http.StatusOK, serve(conn, "/fast").Code, "requests are served once the limit is freed")
+}
+
+// testServer is a QUIC tunnel server for tests, which registers
+// each connection and then makes requests over it with HTTP/3.
+type testServer struct {
+	ln    *quic.Listener
+	conns chan quic.Connection
+}
+
+// newTestServer starts a tunnel server which registers connections with metadata.
+func newTestServer(t *testing.T, metadata map[string]string) *testServer {
+	t.Helper()
+
+	ln, err := quic.ListenAddr("127.0.0.1:0", selfSignedTLSConfig(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	srv := &testServer{ln: ln, conns: make(chan quic.Connection, 10)}
+
+	go func() {
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			stream, err := conn.AcceptStream(context.Background())
+			if err != nil {
+				continue
+			}
+			if _, err := protocol.NewDecoder[protocol.RegisterListenerRequest](stream).Decode(); err != nil {
+				continue
+			}
+			_ = protocol.NewEncoder[protocol.RegisterListenerResponse](stream).Encode(&protocol.RegisterListenerResponse{Code: protocol.CodeOK, Metadata: metadata})
+			_ = stream.Close()
+			srv.conns <- conn
+		}
+	}()
+
+	return srv
+}
+
+// dial starts serving the tunnel, returning the connection once it's registered
+// and a channel which receives the error DialAndServe returns.
+func (srv *testServer) dial(t *testing.T, ctx context.Context, tun *Tunnel) (quic.Connection, <-chan error) {
+	t.Helper()
+
+	tun.TLSConfig = &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         "localhost",
+		NextProtos:         []string{protocol.Name},
+	}
+	tun.Authenticator = BearerAuthenticator("token")
+	if tun.Backoff == nil {
+		tun.Backoff = &wait.Backoff{Steps: 1, Duration: time.Millisecond}
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- tun.DialAndServe(ctx, srv.ln.Addr().String()) }()
+
+	return srv.accept(t, errc), errc
+}
+
+// accept returns the next connection registered by the server.
+func (srv *testServer) accept(t *testing.T, errc <-chan error) quic.Connection {
+	t.Helper()
+
+	select {
+	case conn := <-srv.conns:
+		return conn
+	case err := <-errc:
+		t.Fatalf("DialAndServe returned before a connection was registered: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the connection to be registered")
+	}
+	return nil
+}
+
+// client returns an HTTP/3 client for the requests
+// the server makes over the tunnel connection.
+func client(conn quic.Connection) *http3.SingleDestinationRoundTripper {
+	rt := &http3.SingleDestinationRoundTripper{Connection: conn}
+	rt.Start()
+	return rt
+}
+
+// get makes a request to path over the tunnel connection,
+// returning the status and body of the response.
+func get(rt *http3.SingleDestinationRoundTripper, path string) (string, error) {
+	req, _ := http.NewRequest(http.MethodGet, "https://tunnel"+path, nil)
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d %s", res.StatusCode, body), nil
+}
+
+// closeError waits for the connection to be closed by the tunnel, returning the error it was closed with.
+func closeError(t *testing.T, conn quic.Connection) *quic.ApplicationError {
+	t.Helper()
+
+	select {
+	case <-conn.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the connection to be closed")
+	}
+
+	var appErr *quic.ApplicationError
+	if !errors.As(context.Cause(conn.Context()), &appErr) {
+		t.Fatalf("expected the connection to be closed with an application error, got %v", context.Cause(conn.Context()))
+	}
+	return appErr
+}
+
+func TestShutdownWaitsForInFlightRequests(t *testing.T) {
+	srv := newTestServer(t, nil)
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	tun := &Tunnel{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				close(entered)
+				<-release
+			}
+			_, _ = w.Write([]byte("done"))
+		}),
+	}
+
+	conn, errc := srv.dial(t, context.Background(), tun)
+	rt := client(conn)
+
+	type result struct {
+		res string
+		err error
+	}
+	slow := make(chan result, 1)
+	go func() {
+		res, err := get(rt, "/slow")
+		slow <- result{res, err}
+	}()
+	<-entered
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- tun.ShutdownWithReason(ctx, "deploy")
+	}()
+
+	// wait for the shutdown to begin, so that new requests are rejected.
+	assert.Eventually(t, tun.isShuttingDown, time.Second, time.Millisecond)
+
+	res, err := get(rt, "/fast")
+	assert.NoError(t, err)
+	assert.Equal(t, `503 {"code":"CodeServerError","message":"the tunnel is shutting down"}`+"\n", res, "new requests are rejected while shutting down")
+
+	select {
+	case <-conn.Context().Done():
+		t.Fatal("the connection was closed while a request was in flight")
+	case <-shutdown:
+		t.Fatal("Shutdown returned while a request was in flight")
+	default:
+	}
+
+	close(release)
+
+	got := <-slow
+	assert.NoError(t, got.err)
+	assert.Equal(t, "200 done", got.res, "the in-flight request finishes")
+	assert.NoError(t, <-shutdown)
+
+	appErr := closeError(t, conn)
+	assert.Equal(t, quic.ApplicationErrorCode(protocol.ApplicationShutdown), appErr.ErrorCode)
+	assert.Equal(t, "deploy", appErr.ErrorMessage)
+
+	select {
+	case err := <-errc:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("DialAndServe didn't return after Shutdown")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = srv.ln.Accept(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "the tunnel doesn't redial once it's shut down")
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	srv := newTestServer(t, nil)
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	tun := &Tunnel{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(entered)
+			<-release
+		}),
+	}
+
+	conn, errc := srv.dial(t, context.Background(), tun)
+
+	go func() { _, _ = get(client(conn), "/stuck") }()
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := tun.Shutdown(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	appErr := closeError(t, conn)
+	assert.Equal(t, quic.ApplicationErrorCode(protocol.ApplicationShutdown), appErr.ErrorCode)
+	assert.Equal(t, DefaultShutdownReason, appErr.ErrorMessage)
+
+	select {
+	case err := <-errc:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("DialAndServe didn't return after Shutdown")
+	}
+}
+
+func TestCancelClosesConnection(t *testing.T) {
+	srv := newTestServer(t, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, errc := srv.dial(t, ctx, &Tunnel{})
+	cancel()
+
+	appErr := closeError(t, conn)
+	assert.Equal(t, quic.ApplicationErrorCode(protocol.ApplicationCancelled), appErr.ErrorCode)
+
+	err := <-errc
+	if err != nil {
+		assert.ErrorIs(t, err, context.Canceled)
+	}
+}
+
+func TestOnDisconnectAndOnReconnecting(t *testing.T) {
+	srv := newTestServer(t, nil)
+
+	var mu sync.Mutex
+	var disconnects []error
+	var attempts []int
+
+	tun := &Tunnel{
+		Handler: http.NotFoundHandler(),
+		Backoff: &wait.Backoff{Steps: 3, Duration: time.Millisecond},
+		OnDisconnect: func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			disconnects = append(disconnects, err)
+		},
+		OnReconnecting: func(attempt int, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			attempts = append(attempts, attempt)
+			assert.Error(t, err)
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first, errc := srv.dial(t, ctx, tun)
+
+	// the server closes the first connection once it's being served.
+	_, err := get(client(first), "/")
+	assert.NoError(t, err)
+	_ = first.CloseWithError(protocol.ApplicationError, "rejected")
+
+	conn := srv.accept(t, errc)
+	_, err = get(client(conn), "/")
+	assert.NoError(t, err)
+
+	mu.Lock()
+	if assert.Len(t, disconnects, 1, "the rejected connection is reported") {
+		var appErr *quic.ApplicationError
+		if assert.ErrorAs(t, disconnects[0], &appErr) {
+			assert.Equal(t, "rejected", appErr.ErrorMessage)
+		}
+	}
+	assert.Equal(t, []int{1}, attempts)
+	mu.Unlock()
+
+	cancel()
+	closeError(t, conn)
+	<-errc
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, disconnects, 2, "the second connection is reported once it's closed")
+	assert.Equal(t, []int{1}, attempts, "the tunnel doesn't reconnect once the context is cancelled")
+}
+
+func TestLogMetadataKeys(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"region": "us-east-1", "version": "1.2.3", "secret": "hunter2"})
+
+	var buf bytes.Buffer
+	var mu sync.Mutex
+	tun := &Tunnel{
+		Logger:                slog.New(slog.NewTextHandler(&lockedWriter{w: &buf, mu: &mu}, nil)),
+		LogMetadataKeys:       []string{"region", "secret", "Authorization"},
+		SensitiveMetadataKeys: []string{"secret"},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			LoggerFromContext(r.Context()).Info("handled request")
+		}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn, _ := srv.dial(t, ctx, tun)
+
+	res, err := get(client(conn), "/log")
+	assert.NoError(t, err)
+	assert.Equal(t, "200 ", res)
+
+	mu.Lock()
+	defer mu.Unlock()
+	logs := buf.String()
+	assert.Regexp(t, `msg="handled request".*region=us-east-1`, logs)
+	assert.NotContains(t, logs, "version=", "keys which aren't allowlisted aren't logged")
+	assert.NotContains(t, logs, "hunter2", "sensitive keys aren't logged")
+	assert.NotContains(t, logs, "token", "the Authorization key is always sensitive")
+}
+
+// lockedWriter serialises writes from the tunnel's goroutines.
+type lockedWriter struct {
+	w  io.Writer
+	mu *sync.Mutex
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
@@ -0,0 +1,280 @@
+package ops
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/common-fate/ops/protocol"
+	"github.com/go-playground/validator/v10"
+)
+
+// FieldError describes a problem with a single field of an operation input.
+type FieldError struct {
+	// Field is the path to the field, using the JSON field names.
+	Field string `json:"field"`
+	// Rule is the validation rule which failed, e.g. 'required', or 'type',
+	// 'syntax' or 'unknown' if the input couldn't be decoded.
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned when an operation input fails validation,
+// or when it can't be decoded because a field has the wrong type or the
+// input isn't valid JSON.
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Message
+	}
+	return "input validation failed: " + strings.Join(msgs, "; ")
+}
+
+// InputValidator validates operation inputs, for rules which can't be expressed
+// with struct tags, such as those maintained in CUE.
+//
+// To reject an input, return a *ValidationError describing the invalid fields,
+// which is returned to HTTP callers as the Details of an ErrorResponse with a
+// 400 status. Returning an *Error sets the response code; other errors are
+// reported as protocol.CodeBadRequest.
+//
+// Inputs of operations which stream their input aren't passed to the validator.
+type InputValidator interface {
+	ValidateInput(ctx context.Context, req ValidationRequest) error
+}
+
+// InputValidatorFunc is a function which implements the InputValidator interface.
+type InputValidatorFunc func(ctx context.Context, req ValidationRequest) error
+
+// ValidateInput delegates to the underlying InputValidatorFunc.
+func (f InputValidatorFunc) ValidateInput(ctx context.Context, req ValidationRequest) error {
+	return f(ctx, req)
+}
+
+// ValidationRequest is passed to an InputValidator.
+type ValidationRequest struct {
+	Service   string
+	Operation string
+	// Raw is the input as it was received, before being decoded.
+	Raw json.RawMessage
+	// Input is the decoded input, of the operation's input type.
+	Input any
+}
+
+// newValidator returns a validator which reports
+// fields using their JSON names rather than their Go names.
+func newValidator(naming FieldNaming) *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		switch name {
+		case "-":
+			return ""
+		case "":
+			if naming != nil {
+				return naming(f.Name)
+			}
+			return f.Name
+		}
+		return name
+	})
+	return v
+}
+
+// Validate decodes and validates the input for an operation in the same way as Call,
+// without calling the operation, so that clients can check an input before submitting it.
+// An input which fails to decode or validate returns the same error as Call would.
+//
+// The context is passed to the registry's InputValidator. Inputs of operations
+// which stream their input aren't decoded, so only the operation is checked.
+func (h *Handler) Validate(ctx context.Context, service string, operation string, input json.RawMessage) error {
+	svcroutes, ok := h.routes[service]
+	if !ok {
+		return &Error{Code: protocol.CodeNotFound, Err: fmt.Errorf("service %s not found", service)}
+	}
+
+	function, ok := svcroutes[operation]
+	if !ok {
+		return &Error{Code: protocol.CodeNotFound, Err: fmt.Errorf("operation %s not found for service %s", operation, service)}
+	}
+
+	_, _, err := h.decodeInput(ctx, service, operation, function, input)
+	return err
+}
+
+// validateInput runs struct tag validation on a decoded operation input.
+func (h *Handler) validateInput(input reflect.Value) error {
+	if h.validate == nil {
+		return nil
+	}
+
+	t := input.Type()
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	err := h.validate.Struct(input.Interface())
+
+	var verrs validator.ValidationErrors
+	if !errors.As(err, &verrs) {
+		return err
+	}
+
+	res := &ValidationError{}
+
+	for _, fe := range verrs {
+		// strip the name of the input struct, which isn't part of the wire format.
+		_, field, _ := strings.Cut(fe.Namespace(), ".")
+
+		msg := fmt.Sprintf("%s failed on the '%s' rule", field, fe.Tag())
+		if fe.Param() != "" {
+			msg = fmt.Sprintf("%s failed on the '%s=%s' rule", field, fe.Tag(), fe.Param())
+		}
+
+		res.Fields = append(res.Fields, FieldError{
+			Field:   field,
+			Rule:    fe.Tag(),
+			Message: msg,
+		})
+	}
+
+	return &Error{Code: protocol.CodeBadRequest, Err: res}
+}
+
+// runInputValidator calls the registry's InputValidator, if one is set.
+func (h *Handler) runInputValidator(ctx context.Context, req ValidationRequest) error {
+	if h.inputValidator == nil {
+		return nil
+	}
+
+	err := h.inputValidator.ValidateInput(ctx, req)
+	if err == nil {
+		return nil
+	}
+
+	var opErr *Error
+	if errors.As(err, &opErr) {
+		return err
+	}
+
+	return &Error{Code: protocol.CodeBadRequest, Err: err}
+}
+
+// unmarshalError describes an input which couldn't be decoded. Type mismatches
+// and syntax errors are returned as a *ValidationError naming the field and the
+// expected type, using the field names of the wire format.
+func (h *Handler) unmarshalError(t reflect.Type, err error) error {
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+
+	switch {
+	case errors.As(err, &typeErr):
+		field := typeErr.Field
+		if h.fieldNaming != nil {
+			field = wirePath(t, field, h.fieldNaming)
+		}
+		expected := jsonTypeName(typeErr.Type)
+
+		msg := fmt.Sprintf("input must be %s, got %s", expected, typeErr.Value)
+		if field != "" {
+			msg = fmt.Sprintf("%s must be %s, got %s", field, expected, typeErr.Value)
+		}
+
+		return &Error{Code: protocol.CodeBadRequest, Err: &ValidationError{Fields: []FieldError{{
+			Field:   field,
+			Rule:    "type",
+			Message: msg,
+		}}}}
+
+	case errors.As(err, &syntaxErr):
+		return &Error{Code: protocol.CodeBadRequest, Err: &ValidationError{Fields: []FieldError{{
+			Rule:    "syntax",
+			Message: fmt.Sprintf("invalid JSON at offset %d: %s", syntaxErr.Offset, syntaxErr),
+		}}}}
+
+	case strings.HasPrefix(err.Error(), unknownFieldPrefix):
+		// encoding/json doesn't export a type for unknown field errors.
+		field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), unknownFieldPrefix))
+		return &Error{Code: protocol.CodeBadRequest, Err: &ValidationError{Fields: []FieldError{{
+			Field:   field,
+			Rule:    "unknown",
+			Message: fmt.Sprintf("unknown field %q", field),
+		}}}}
+	}
+
+	return &Error{Code: protocol.CodeBadRequest, Err: fmt.Errorf("error unmarshalling input: %w", err)}
+}
+
+// unknownFieldPrefix prefixes the errors returned by a json.Decoder for fields
+// which don't match the input type, when it disallows unknown fields.
+const unknownFieldPrefix = "json: unknown field "
+
+// jsonTypeName describes the JSON type which decodes into t.
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Struct, reflect.Map:
+		return "an object"
+	}
+
+	return "a " + t.String()
+}
+
+// wirePath converts a dotted path of decoded field names in the input type t,
+// in which untagged fields use their Go names, into the names used on the wire.
+func wirePath(t reflect.Type, path string, naming FieldNaming) string {
+	if path == "" {
+		return path
+	}
+
+	segments := strings.Split(path, ".")
+
+	for i, segment := range segments {
+		for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			break
+		}
+
+		var next reflect.Type
+		for _, f := range jsonFields(t, naming) {
+			if (f.tagged && f.wireName == segment) || (!f.tagged && f.goName == segment) {
+				segments[i] = f.wireName
+				next = f.typ
+				break
+			}
+		}
+		if next == nil {
+			break
+		}
+		t = next
+	}
+
+	return strings.Join(segments, ".")
+}